@@ -0,0 +1,280 @@
+// Copyright 2016 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+// The analytics example mixes OLTP and analytical reads against a
+// populated orders table. Clients run a configurable mix of point
+// lookups by primary key, bounded scans of a secondary index and full
+// table aggregations, while a trickle of writes updates and inserts
+// orders. Comparing the point lookup latencies with and without
+// aggregations shows how large scans interact with OLTP traffic.
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/cockroachdb/examples-go/dbdriver"
+	"github.com/cockroachdb/examples-go/opstats"
+	// Import postgres driver.
+	_ "github.com/cockroachdb/pq"
+)
+
+var numRows = flag.Int("rows", 1000000, "Number of orders to populate the table with.")
+var numCustomers = flag.Int("customers", 10000, "Number of customers placing orders.")
+var concurrency = flag.Int("concurrency", 16, "Number of concurrent readers.")
+var pointPercent = flag.Int("point-percent", 90, "Percentage of reads that are point lookups.")
+var scanPercent = flag.Int("scan-percent", 9, "Percentage of reads that are bounded index scans. "+
+	"The remaining reads are full table aggregations.")
+var scanLimit = flag.Int("scan-limit", 100, "Maximum number of rows returned by an index scan.")
+var writeRate = flag.Int("write-rate", 10, "Number of writes per second. 0 disables writes.")
+var outputInterval = flag.Duration("output-interval", 1*time.Second, "Interval of output.")
+var driver = flag.String("driver", "postgres", dbdriver.Usage)
+
+const schema = `
+CREATE TABLE IF NOT EXISTS orders (
+  id          INT PRIMARY KEY,
+  customer_id INT NOT NULL,
+  amount      DECIMAL NOT NULL,
+  status      STRING NOT NULL,
+  created     TIMESTAMP NOT NULL DEFAULT NOW(),
+  INDEX (customer_id, created)
+)`
+
+var statuses = []string{"pending", "shipped", "delivered", "returned"}
+
+const (
+	pointOp = iota
+	scanOp
+	aggregateOp
+	writeOp
+	numOps
+)
+
+var opNames = [numOps]string{"point", "scan", "aggregate", "write"}
+
+func pointLookup(db *sql.DB, r *rand.Rand) error {
+	var customerID int
+	var amount, status string
+	err := db.QueryRow(`SELECT customer_id, amount, status FROM orders WHERE id = $1`,
+		r.Intn(*numRows)).Scan(&customerID, &amount, &status)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	return err
+}
+
+func indexScan(db *sql.DB, r *rand.Rand) error {
+	rows, err := db.Query(`SELECT id, amount, created FROM orders WHERE customer_id = $1 `+
+		`ORDER BY created DESC LIMIT $2`, r.Intn(*numCustomers), *scanLimit)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = rows.Close() }()
+	for rows.Next() {
+		var id int
+		var amount string
+		var created time.Time
+		if err := rows.Scan(&id, &amount, &created); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func aggregate(db *sql.DB) error {
+	rows, err := db.Query(`SELECT status, COUNT(*), SUM(amount) FROM orders GROUP BY status`)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = rows.Close() }()
+	for rows.Next() {
+		var status, sum string
+		var count int
+		if err := rows.Scan(&status, &count, &sum); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// write updates the status of an existing order or, half of the time,
+// inserts a new one.
+func write(db *sql.DB, r *rand.Rand) error {
+	status := statuses[r.Intn(len(statuses))]
+	if r.Intn(2) == 0 {
+		_, err := db.Exec(`UPDATE orders SET status = $1 WHERE id = $2`, status, r.Intn(*numRows))
+		return err
+	}
+	_, err := db.Exec(`UPSERT INTO orders (id, customer_id, amount, status) VALUES ($1, $2, $3, $4)`,
+		*numRows+r.Intn(*numRows), r.Intn(*numCustomers), fmt.Sprintf("%d.%02d", r.Intn(1000), r.Intn(100)), status)
+	return err
+}
+
+var stats [numOps]*opstats.Stats
+
+func init() {
+	for i := range stats {
+		stats[i] = opstats.New(time.Minute)
+	}
+}
+
+func reader(db *sql.DB) {
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	for {
+		op := aggregateOp
+		switch p := r.Intn(100); {
+		case p < *pointPercent:
+			op = pointOp
+		case p < *pointPercent+*scanPercent:
+			op = scanOp
+		}
+
+		start := time.Now()
+		var err error
+		switch op {
+		case pointOp:
+			err = pointLookup(db, r)
+		case scanOp:
+			err = indexScan(db, r)
+		case aggregateOp:
+			err = aggregate(db)
+		}
+		if err != nil {
+			log.Printf("%s failed: %s", opNames[op], err)
+		}
+		stats[op].Record(start, err)
+	}
+}
+
+func writer(db *sql.DB) {
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	for range time.Tick(time.Second / time.Duration(*writeRate)) {
+		start := time.Now()
+		err := write(db, r)
+		if err != nil {
+			log.Printf("write failed: %s", err)
+		}
+		stats[writeOp].Record(start, err)
+	}
+}
+
+func setupDatabase(db *sql.DB) error {
+	if _, err := db.Exec("CREATE DATABASE IF NOT EXISTS analytics"); err != nil {
+		return err
+	}
+	if _, err := db.Exec(schema); err != nil {
+		return err
+	}
+	if _, err := db.Exec("TRUNCATE TABLE orders"); err != nil {
+		return err
+	}
+
+	const batchSize = 500
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	for i := 0; i < *numRows; i += batchSize {
+		var buf bytes.Buffer
+		buf.WriteString(`INSERT INTO orders (id, customer_id, amount, status) VALUES `)
+		for j := i; j < i+batchSize && j < *numRows; j++ {
+			if j > i {
+				buf.WriteString(", ")
+			}
+			fmt.Fprintf(&buf, "(%d, %d, %d.%02d, '%s')", j, r.Intn(*numCustomers),
+				r.Intn(1000), r.Intn(100), statuses[r.Intn(len(statuses))])
+		}
+		if _, err := db.Exec(buf.String()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var usage = func() {
+	fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s [<db URL>]\n\n", os.Args[0])
+	flag.PrintDefaults()
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() > 1 {
+		usage()
+		os.Exit(2)
+	}
+
+	if *pointPercent < 0 || *scanPercent < 0 || *pointPercent+*scanPercent > 100 {
+		log.Fatal("'point-percent' and 'scan-percent' must be non-negative and add up to at most 100")
+	}
+	if *numRows < 1 || *numCustomers < 1 {
+		log.Fatal("'rows' and 'customers' must be at least 1")
+	}
+
+	dbURL, err := dbdriver.URL(flag.Arg(0), "")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	parsedURL, err := url.Parse(dbURL)
+	if err != nil {
+		log.Fatal(err)
+	}
+	parsedURL.Path = "analytics"
+
+	db, err := dbdriver.Open(*driver, parsedURL.String())
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer func() { _ = db.Close() }()
+
+	db.SetMaxOpenConns(*concurrency + 1)
+
+	log.Printf("populating %d orders", *numRows)
+	if err := setupDatabase(db); err != nil {
+		log.Fatal(err)
+	}
+
+	for i := 0; i < *concurrency; i++ {
+		go reader(db)
+	}
+	if *writeRate > 0 {
+		go writer(db)
+	}
+
+	lastNow := time.Now()
+	for range time.Tick(*outputInterval) {
+		now := time.Now()
+		elapsed := now.Sub(lastNow)
+		lastNow = now
+
+		for op, s := range stats {
+			hist, errors := s.Snapshot()
+			log.Printf("%-9s: %7.1f/sec, p50=%s p95=%s p99=%s max=%s (%d errors)",
+				opNames[op], float64(hist.TotalCount())/elapsed.Seconds(),
+				time.Duration(hist.ValueAtQuantile(50)),
+				time.Duration(hist.ValueAtQuantile(95)),
+				time.Duration(hist.ValueAtQuantile(99)),
+				time.Duration(hist.Max()),
+				errors)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+// Copyright 2016 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+)
+
+// An entry is a row of the audit table.
+type entry struct {
+	streamID int64
+	seq      int64
+	prevHash []byte
+	hash     []byte
+	payload  string
+}
+
+// entryHash computes the hash of an entry, covering the hash of the
+// previous entry of the stream so that any modification, insertion or
+// removal breaks the chain.
+func entryHash(streamID, seq int64, prevHash []byte, payload string) []byte {
+	h := sha256.New()
+	var buf [16]byte
+	binary.BigEndian.PutUint64(buf[:8], uint64(streamID))
+	binary.BigEndian.PutUint64(buf[8:], uint64(seq))
+	_, _ = h.Write(buf[:])
+	_, _ = h.Write(prevHash)
+	_, _ = h.Write([]byte(payload))
+	return h.Sum(nil)
+}
+
+// chainChecker verifies the entries of one stream, which must be fed in
+// sequence order.
+type chainChecker struct {
+	streamID int64
+	lastSeq  int64
+	lastHash []byte
+	problems []string
+}
+
+func (c *chainChecker) add(e entry) {
+	switch {
+	case e.seq <= c.lastSeq:
+		c.problems = append(c.problems, fmt.Sprintf("stream %d: seq %d follows seq %d", c.streamID, e.seq, c.lastSeq))
+	case e.seq != c.lastSeq+1:
+		c.problems = append(c.problems, fmt.Sprintf("stream %d: gap between seq %d and %d", c.streamID, c.lastSeq, e.seq))
+	}
+	if !bytes.Equal(e.prevHash, c.lastHash) {
+		c.problems = append(c.problems, fmt.Sprintf("stream %d: seq %d does not chain to seq %d", c.streamID, e.seq, c.lastSeq))
+	}
+	if !bytes.Equal(e.hash, entryHash(e.streamID, e.seq, e.prevHash, e.payload)) {
+		c.problems = append(c.problems, fmt.Sprintf("stream %d: seq %d has been tampered with", c.streamID, e.seq))
+	}
+	c.lastSeq, c.lastHash = e.seq, e.hash
+}
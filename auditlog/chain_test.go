@@ -0,0 +1,73 @@
+// Copyright 2016 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func makeChain(streamID int64, n int) []entry {
+	var entries []entry
+	var prev []byte
+	for i := 1; i <= n; i++ {
+		payload := fmt.Sprintf("payload %d", i)
+		e := entry{
+			streamID: streamID,
+			seq:      int64(i),
+			prevHash: prev,
+			hash:     entryHash(streamID, int64(i), prev, payload),
+			payload:  payload,
+		}
+		entries = append(entries, e)
+		prev = e.hash
+	}
+	return entries
+}
+
+func TestChainChecker(t *testing.T) {
+	testCases := []struct {
+		name     string
+		mutate   func([]entry) []entry
+		problems []string
+	}{
+		{"intact", func(es []entry) []entry { return es }, nil},
+		{"gap", func(es []entry) []entry { return append(es[:1], es[2:]...) }, []string{
+			"stream 7: gap between seq 1 and 3",
+			"stream 7: seq 3 does not chain to seq 1",
+		}},
+		{"tampered", func(es []entry) []entry { es[1].payload = "forged"; return es }, []string{
+			"stream 7: seq 2 has been tampered with",
+		}},
+		{"reordered", func(es []entry) []entry { es[1], es[2] = es[2], es[1]; return es }, []string{
+			"stream 7: gap between seq 1 and 3",
+			"stream 7: seq 3 does not chain to seq 1",
+			"stream 7: seq 2 follows seq 3",
+			"stream 7: seq 2 does not chain to seq 3",
+		}},
+	}
+
+	for _, tc := range testCases {
+		c := chainChecker{streamID: 7}
+		for _, e := range tc.mutate(makeChain(7, 3)) {
+			c.add(e)
+		}
+		if !reflect.DeepEqual(c.problems, tc.problems) {
+			t.Errorf("%s: expected %q, got %q", tc.name, tc.problems, c.problems)
+		}
+	}
+}
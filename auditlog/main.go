@@ -0,0 +1,202 @@
+// Copyright 2016 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+// The auditlog example writes a tamper-evident, append-only audit log.
+// The log consists of streams; each entry carries a per-stream sequence
+// number and a hash covering the previous entry's hash, forming a hash
+// chain. Like the causality IDs in the ledger example, appending to a
+// stream requires reading its last entry, so concurrent writers to the
+// same stream contend with each other.
+//
+// With --verify, the example instead scans every stream and reports gaps,
+// reordering, broken links and tampered entries, exiting non-zero if any
+// is found.
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/url"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/cockroachdb/examples-go/dbdriver"
+	"github.com/cockroachdb/examples-go/dialect"
+)
+
+var numStreams = flag.Int("streams", 10, "Number of audit streams. Fewer streams cause more contention.")
+var concurrency = flag.Int("concurrency", 8, "Number of concurrent writers.")
+var verifyOnly = flag.Bool("verify", false, "Verify the hash chains of all streams and exit.")
+var outputInterval = flag.Duration("output-interval", 1*time.Second, "Interval of output.")
+var driver = flag.String("driver", "postgres", dbdriver.Usage)
+
+const schema = `
+CREATE TABLE IF NOT EXISTS audit (
+  stream_id INT NOT NULL,
+  seq       INT NOT NULL,
+  prev_hash BYTES,
+  hash      BYTES NOT NULL,
+  payload   STRING NOT NULL,
+  created   TIMESTAMP NOT NULL DEFAULT NOW(),
+  PRIMARY KEY (stream_id, seq)
+)`
+
+var numAppended, numConflicts uint64
+
+// appendEntry appends an entry to the given stream, chaining it to the
+// stream's current last entry.
+func appendEntry(tx *sql.Tx, streamID int64, payload string) error {
+	var lastSeq int64
+	var lastHash []byte
+	err := tx.QueryRow(`SELECT seq, hash FROM audit WHERE stream_id = $1 ORDER BY seq DESC LIMIT 1`,
+		streamID).Scan(&lastSeq, &lastHash)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	seq := lastSeq + 1
+	_, err = tx.Exec(`INSERT INTO audit (stream_id, seq, prev_hash, hash, payload) VALUES ($1, $2, $3, $4, $5)`,
+		streamID, seq, lastHash, entryHash(streamID, seq, lastHash, payload), payload)
+	return err
+}
+
+func write(db *sql.DB) {
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	for {
+		streamID := r.Int63n(int64(*numStreams))
+		payload := fmt.Sprintf("user%d performed action%d", r.Intn(1000), r.Intn(100))
+		err := dbdriver.ExecuteTx(db, func(tx *sql.Tx) error {
+			return appendEntry(tx, streamID, payload)
+		})
+		if err != nil {
+			if dialect.Cockroach.Classify(err) == dialect.IntegrityError {
+				// Another writer appended the same sequence number first.
+				// The primary key keeps the chain from forking.
+				atomic.AddUint64(&numConflicts, 1)
+				continue
+			}
+			log.Fatal(err)
+		}
+		atomic.AddUint64(&numAppended, 1)
+	}
+}
+
+// verify checks the hash chain of every stream and returns the problems
+// found.
+func verify(db *sql.DB) ([]string, int, error) {
+	rows, err := db.Query(`SELECT stream_id, seq, prev_hash, hash, payload FROM audit ORDER BY stream_id, seq`)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	var problems []string
+	var c *chainChecker
+	var count int
+	for rows.Next() {
+		var e entry
+		if err := rows.Scan(&e.streamID, &e.seq, &e.prevHash, &e.hash, &e.payload); err != nil {
+			return nil, 0, err
+		}
+		if c == nil || c.streamID != e.streamID {
+			if c != nil {
+				problems = append(problems, c.problems...)
+			}
+			c = &chainChecker{streamID: e.streamID}
+		}
+		c.add(e)
+		count++
+	}
+	if c != nil {
+		problems = append(problems, c.problems...)
+	}
+	return problems, count, rows.Err()
+}
+
+var usage = func() {
+	fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s [<db URL>]\n\n", os.Args[0])
+	flag.PrintDefaults()
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() > 1 {
+		usage()
+		os.Exit(2)
+	}
+
+	dbURL, err := dbdriver.URL(flag.Arg(0), "")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	parsedURL, err := url.Parse(dbURL)
+	if err != nil {
+		log.Fatal(err)
+	}
+	parsedURL.Path = "auditlog"
+
+	db, err := dbdriver.Open(*driver, parsedURL.String())
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer func() { _ = db.Close() }()
+
+	if *verifyOnly {
+		problems, count, err := verify(db)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, p := range problems {
+			log.Print(p)
+		}
+		if len(problems) > 0 {
+			log.Fatalf("found %d problems in %d audit entries", len(problems), count)
+		}
+		log.Printf("verified %d audit entries", count)
+		return
+	}
+
+	if _, err := db.Exec("CREATE DATABASE IF NOT EXISTS auditlog"); err != nil {
+		log.Fatal(err)
+	}
+	if _, err := db.Exec(schema); err != nil {
+		log.Fatal(err)
+	}
+
+	db.SetMaxOpenConns(*concurrency + 1)
+
+	for i := 0; i < *concurrency; i++ {
+		go write(db)
+	}
+
+	lastNow := time.Now()
+	var lastAppended, lastConflicts uint64
+	for range time.Tick(*outputInterval) {
+		now := time.Now()
+		elapsed := now.Sub(lastNow).Seconds()
+		lastNow = now
+		appended, conflicts := atomic.LoadUint64(&numAppended), atomic.LoadUint64(&numConflicts)
+		log.Printf("%.1f entries/sec, %.1f conflicts/sec (%d entries total)",
+			float64(appended-lastAppended)/elapsed, float64(conflicts-lastConflicts)/elapsed, appended)
+		lastAppended, lastConflicts = appended, conflicts
+	}
+}
@@ -0,0 +1,280 @@
+// Copyright 2016 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+// The backup example takes backups while a write workload is running and
+// verifies that they can be restored. Every --backup-interval, it picks
+// a timestamp, backs up the kv table as of that timestamp and records the
+// row count and a checksum of the table at the same timestamp in a
+// manifest. After --duration, the writers stop and every backup is
+// restored into a scratch database and compared against its manifest
+// entry.
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cockroachdb/examples-go/dbdriver"
+	// Import postgres driver.
+	_ "github.com/cockroachdb/pq"
+)
+
+var concurrency = flag.Int("concurrency", 4, "Number of concurrent writers.")
+var numKeys = flag.Int("keys", 100000, "Number of distinct keys written.")
+var duration = flag.Duration("duration", 5*time.Minute, "How long to run the workload before verifying the backups.")
+var backupInterval = flag.Duration("backup-interval", 1*time.Minute, "Interval between backups.")
+var backupURI = flag.String("backup-uri", "nodelocal:///backup-example",
+	"Base URI of the backups. Each backup is stored in a subdirectory.")
+var manifestPath = flag.String("manifest", "backup-manifest.json", "File the backup manifest is written to.")
+var outputInterval = flag.Duration("output-interval", 10*time.Second, "Interval of output.")
+var driver = flag.String("driver", "postgres", dbdriver.Usage)
+
+const (
+	sourceDB  = "backup_src"
+	restoreDB = "backup_restore"
+)
+
+const schema = `
+CREATE TABLE IF NOT EXISTS kv (
+  k INT PRIMARY KEY,
+  v BYTES NOT NULL
+)`
+
+// A manifestEntry describes a backup and the contents it is expected to
+// restore.
+type manifestEntry struct {
+	URI       string `json:"uri"`
+	Timestamp string `json:"timestamp"`
+	Rows      int64  `json:"rows"`
+	Checksum  string `json:"checksum"`
+}
+
+var numWrites uint64
+
+// quote returns s as a SQL string literal.
+func quote(s string) string {
+	return "'" + strings.Replace(s, "'", "''", -1) + "'"
+}
+
+func write(db *sql.DB, stop <-chan struct{}, wg *sync.WaitGroup) {
+	defer wg.Done()
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	v := make([]byte, 64)
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		_, _ = r.Read(v)
+		var err error
+		if r.Intn(10) == 0 {
+			_, err = db.Exec(`DELETE FROM kv WHERE k = $1`, r.Intn(*numKeys))
+		} else {
+			_, err = db.Exec(`UPSERT INTO kv (k, v) VALUES ($1, $2)`, r.Intn(*numKeys), v)
+		}
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+		atomic.AddUint64(&numWrites, 1)
+	}
+}
+
+// checksum returns the number of rows of a kv table and a checksum of its
+// contents. If ts is non-empty, the table is read as of that timestamp.
+func checksum(db *sql.DB, table, ts string) (int64, string, error) {
+	query := `SELECT k, v FROM ` + table
+	if ts != "" {
+		query += ` AS OF SYSTEM TIME ` + quote(ts)
+	}
+	rows, err := db.Query(query + ` ORDER BY k`)
+	if err != nil {
+		return 0, "", err
+	}
+	defer func() { _ = rows.Close() }()
+	h := sha256.New()
+	var n int64
+	for rows.Next() {
+		var k int64
+		var v []byte
+		if err := rows.Scan(&k, &v); err != nil {
+			return 0, "", err
+		}
+		fmt.Fprintf(h, "%d:%x\n", k, v)
+		n++
+	}
+	return n, hex.EncodeToString(h.Sum(nil)), rows.Err()
+}
+
+// takeBackup backs up the kv table as of the current time and returns the
+// manifest entry describing it.
+func takeBackup(db *sql.DB, n int) (manifestEntry, error) {
+	var e manifestEntry
+	if err := db.QueryRow(`SELECT cluster_logical_timestamp()::STRING`).Scan(&e.Timestamp); err != nil {
+		return e, err
+	}
+	e.URI = fmt.Sprintf("%s/%d-%s", strings.TrimSuffix(*backupURI, "/"), n, time.Now().UTC().Format("20060102-150405"))
+	if _, err := db.Exec(fmt.Sprintf(`BACKUP TABLE %s.kv TO %s AS OF SYSTEM TIME %s`,
+		sourceDB, quote(e.URI), quote(e.Timestamp))); err != nil {
+		return e, err
+	}
+	var err error
+	e.Rows, e.Checksum, err = checksum(db, sourceDB+".kv", e.Timestamp)
+	return e, err
+}
+
+// verifyBackup restores a backup into the scratch database and compares
+// its contents with the manifest.
+func verifyBackup(db *sql.DB, e manifestEntry) error {
+	if _, err := db.Exec(`DROP DATABASE IF EXISTS ` + restoreDB + ` CASCADE`); err != nil {
+		return err
+	}
+	if _, err := db.Exec(`CREATE DATABASE ` + restoreDB); err != nil {
+		return err
+	}
+	if _, err := db.Exec(fmt.Sprintf(`RESTORE TABLE %s.kv FROM %s WITH into_db = %s`,
+		sourceDB, quote(e.URI), quote(restoreDB))); err != nil {
+		return err
+	}
+	rows, sum, err := checksum(db, restoreDB+".kv", "")
+	if err != nil {
+		return err
+	}
+	if rows != e.Rows || sum != e.Checksum {
+		return fmt.Errorf("restored %d rows with checksum %s, expected %d rows with checksum %s",
+			rows, sum, e.Rows, e.Checksum)
+	}
+	return nil
+}
+
+func writeManifest(manifest []manifestEntry) error {
+	b, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(*manifestPath, b, 0644)
+}
+
+var usage = func() {
+	fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s [<db URL>]\n\n", os.Args[0])
+	flag.PrintDefaults()
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() > 1 {
+		usage()
+		os.Exit(2)
+	}
+
+	dbURL, err := dbdriver.URL(flag.Arg(0), "")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	parsedURL, err := url.Parse(dbURL)
+	if err != nil {
+		log.Fatal(err)
+	}
+	parsedURL.Path = sourceDB
+
+	db, err := dbdriver.Open(*driver, parsedURL.String())
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer func() { _ = db.Close() }()
+
+	db.SetMaxOpenConns(*concurrency + 2)
+
+	if _, err := db.Exec("CREATE DATABASE IF NOT EXISTS " + sourceDB); err != nil {
+		log.Fatal(err)
+	}
+	if _, err := db.Exec(schema); err != nil {
+		log.Fatal(err)
+	}
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < *concurrency; i++ {
+		wg.Add(1)
+		go write(db, stop, &wg)
+	}
+
+	var manifest []manifestEntry
+	done := time.After(*duration)
+	backupTicker := time.NewTicker(*backupInterval)
+	outputTicker := time.NewTicker(*outputInterval)
+	lastNow := time.Now()
+	var lastWrites uint64
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		case <-backupTicker.C:
+			start := time.Now()
+			e, err := takeBackup(db, len(manifest))
+			if err != nil {
+				log.Printf("backup failed: %s", err)
+				continue
+			}
+			manifest = append(manifest, e)
+			if err := writeManifest(manifest); err != nil {
+				log.Fatal(err)
+			}
+			log.Printf("backed up %d rows to %s in %s", e.Rows, e.URI, time.Since(start))
+		case <-outputTicker.C:
+			now := time.Now()
+			writes := atomic.LoadUint64(&numWrites)
+			log.Printf("%.1f writes/sec", float64(writes-lastWrites)/now.Sub(lastNow).Seconds())
+			lastNow, lastWrites = now, writes
+		}
+	}
+	backupTicker.Stop()
+	outputTicker.Stop()
+	close(stop)
+	wg.Wait()
+
+	var failed int
+	for _, e := range manifest {
+		start := time.Now()
+		if err := verifyBackup(db, e); err != nil {
+			log.Printf("%s: %s", e.URI, err)
+			failed++
+			continue
+		}
+		log.Printf("%s: restored and verified %d rows in %s", e.URI, e.Rows, time.Since(start))
+	}
+	if failed > 0 {
+		log.Fatalf("%d of %d backups failed verification", failed, len(manifest))
+	}
+	log.Printf("verified %d backups", len(manifest))
+}
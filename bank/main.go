@@ -19,14 +19,27 @@ package main
 
 import (
 	"database/sql"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
+	"math"
 	"math/rand"
 	"net/url"
 	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
+	"github.com/cockroachdb/examples-go/capture"
+	"github.com/cockroachdb/examples-go/chaos"
+	"github.com/cockroachdb/examples-go/control"
+	"github.com/cockroachdb/examples-go/dbdriver"
+	"github.com/cockroachdb/examples-go/dialect"
+	"github.com/codahale/hdrhistogram"
 	// Import postgres driver.
 	_ "github.com/cockroachdb/pq"
 )
@@ -36,125 +49,588 @@ var numAccounts = flag.Int("num-accounts", 999, "Number of accounts.")
 var concurrency = flag.Int("concurrency", 5, "Number of concurrent actors moving money.")
 var transferStyle = flag.String("transfer-style", "txn", "\"single-stmt\" or \"txn\"")
 var balanceCheckInterval = flag.Duration("balance-check-interval", 1*time.Second, "Interval of balance check.")
+var readPercent = flag.Int("read-percent", 0, "Percentage of operations that only read account balances.")
+var duration = flag.Duration("duration", 0, "The duration to run. If 0, run until interrupted.")
+var verifyOnly = flag.Bool("verify", false, "Verify the invariants of an existing bank and exit.")
+var verifyInterval = flag.Duration("verify-interval", 1*time.Second,
+	"Interval of the background invariant check. If 0, only check at startup.")
+var schemaName = flag.String("schema", "balances", "Schema to use: \"balances\" keeps one row per account, "+
+	"\"postings\" appends a posting per account for every transfer.")
+var history = flag.Bool("history", false, "Record every transfer in a transfers table and reconcile balances against it.")
+var initSplits = flag.Int("init-splits", 0, "Number of ranges to pre-split the accounts table into and scatter before starting.")
+var distribution = flag.String("distribution", "uniform", "Account selection. One of uniform, zipf or hotspot.")
+var zipfS = flag.Float64("zipf-s", 1.1, "Zipf exponent for the zipf distribution. Must be > 1; higher is more skewed.")
+var hotspotAccounts = flag.Int("hotspot-accounts", 10, "Number of hot accounts for the hotspot distribution.")
+var hotspotPercent = flag.Int("hotspot-percent", 90, "Percentage of accounts picked from the hot set for the hotspot distribution.")
+var hotPairPercent = flag.Int("hot-pair-percent", 0, "Percentage of transfers between two accounts of the hot set, "+
+	"regardless of the distribution. The hot set is the first 'hotspot-accounts' accounts.")
+var amountDistribution = flag.String("amount-distribution", "uniform",
+	"Distribution of transfer amounts. One of fixed (always max-transfer), uniform or pareto.")
+var multiHopPercent = flag.Int("multi-hop-percent", 0, "Percentage of transfers chained through a third "+
+	"account, A to B to C in one transaction, touching three rows instead of two.")
+var paretoAlpha = flag.Float64("pareto-alpha", 1.16, "Shape of the pareto amount distribution; lower values have heavier tails.")
+var driver = flag.String("driver", "postgres", dbdriver.Usage)
+
+const initialBalance = 1000
+
+// postingsSchema creates the postings table. %s is the definition of
+// generated ID columns.
+const postingsSchema = `
+CREATE TABLE IF NOT EXISTS postings (
+  account_id BIGINT NOT NULL,
+  id         %s,
+  amount     BIGINT NOT NULL,
+  created    TIMESTAMP NOT NULL DEFAULT NOW(),
+  PRIMARY KEY (account_id, id)
+)`
+
+// A pickFn returns a random account ID.
+type pickFn func() int
+
+var distributions = map[string]func(r *rand.Rand) pickFn{
+	// Uncontended unless there are few accounts.
+	"uniform": func(r *rand.Rand) pickFn {
+		return func() int { return r.Intn(*numAccounts) }
+	},
+	// Low account IDs are picked far more often than high ones.
+	"zipf": func(r *rand.Rand) pickFn {
+		z := rand.NewZipf(r, *zipfS, 1, uint64(*numAccounts-1))
+		return func() int { return int(z.Uint64()) }
+	},
+	// A fixed percentage of picks hit a small set of hot accounts.
+	"hotspot": func(r *rand.Rand) pickFn {
+		return func() int {
+			if r.Intn(100) < *hotspotPercent {
+				return r.Intn(*hotspotAccounts)
+			}
+			return r.Intn(*numAccounts)
+		}
+	},
+}
+
+// An amountFn returns a random transfer amount.
+type amountFn func() int
+
+var amountDistributions = map[string]func(r *rand.Rand) amountFn{
+	"fixed": func(r *rand.Rand) amountFn {
+		return func() int { return *maxTransfer }
+	},
+	"uniform": func(r *rand.Rand) amountFn {
+		return func() int { return r.Intn(*maxTransfer) }
+	},
+	// Most transfers are small, but a few are large, capped at
+	// max-transfer.
+	"pareto": func(r *rand.Rand) amountFn {
+		return func() int {
+			amount := 1 / math.Pow(1-r.Float64(), 1 / *paretoAlpha)
+			if amount > float64(*maxTransfer) {
+				return *maxTransfer
+			}
+			return int(amount)
+		}
+	},
+}
 
 type measurement struct {
 	read, write, total time.Duration
 }
 
-func moveMoney(db *sql.DB, readings chan measurement) {
+// balanceReads tracks the latencies of read-only balance checks.
+var balanceReads struct {
+	sync.Mutex
+	hist, cumulative *hdrhistogram.Histogram
+	errors           int
+}
+
+// numOps and numErrors count the operations run by the workers, and those
+// that failed.
+var numOps, numErrors uint64
+
+// faults are the faults injected with --chaos.
+var faults *chaos.Injector
+
+// readBalances reads the balances of one or two accounts, without
+// transferring any money.
+func readBalances(db *sql.DB, accounts []int) error {
+	ids := []interface{}{accounts[0]}
+	query := `SELECT balance FROM accounts WHERE id = $1`
+	if *schemaName == "postings" {
+		query = `SELECT SUM(amount) FROM postings WHERE account_id = $1`
+	}
+	if len(accounts) > 1 {
+		ids = append(ids, accounts[1])
+		query = `SELECT balance FROM accounts WHERE id IN ($1, $2)`
+		if *schemaName == "postings" {
+			query = `SELECT SUM(amount) FROM postings WHERE account_id IN ($1, $2) GROUP BY account_id`
+		}
+	}
+	start := time.Now()
+	err := func() error {
+		rows, err := db.Query(query, ids...)
+		if err != nil {
+			return err
+		}
+		defer func() { _ = rows.Close() }()
+		for rows.Next() {
+			var balance int
+			if err := rows.Scan(&balance); err != nil {
+				return err
+			}
+		}
+		return rows.Err()
+	}()
+	elapsed := time.Since(start)
+
+	balanceReads.Lock()
+	defer balanceReads.Unlock()
+	if err != nil {
+		balanceReads.errors++
+		return err
+	}
+	_ = balanceReads.hist.RecordValue(int64(elapsed))
+	_ = balanceReads.cumulative.RecordValue(int64(elapsed))
+	return nil
+}
+
+// An op is an operation of the workload, recorded with --record: a transfer
+// of Amount from Accounts[0] to Accounts[1], and on to Accounts[2] for a
+// multi-hop transfer, or, with Read, a read of the balances of Accounts.
+type op struct {
+	Read     bool  `json:"read,omitempty"`
+	Accounts []int `json:"accounts"`
+	Amount   int   `json:"amount,omitempty"`
+}
+
+// newGenerator returns a function generating the operations of a worker, of
+// which readPercent returns the percentage that only read.
+func newGenerator(newPick func(r *rand.Rand) pickFn, newAmount func(r *rand.Rand) amountFn,
+	readPercent func() int) func() op {
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	pick, nextAmount := newPick(r), newAmount(r)
+	return func() op {
+		for {
+			if r.Intn(100) < readPercent() {
+				accounts := []int{pick()}
+				if r.Intn(2) == 0 {
+					accounts = append(accounts, pick())
+				}
+				return op{Read: true, Accounts: accounts}
+			}
+			if r.Intn(100) < *multiHopPercent {
+				a, b, c := pick(), pick(), pick()
+				if a == b || b == c || a == c {
+					continue
+				}
+				return op{Accounts: []int{a, b, c}, Amount: nextAmount()}
+			}
+			from, to := pick(), pick()
+			if r.Intn(100) < *hotPairPercent {
+				from, to = r.Intn(*hotspotAccounts), r.Intn(*hotspotAccounts)
+			}
+			if from == to {
+				continue
+			}
+			return op{Accounts: []int{from, to}, Amount: nextAmount()}
+		}
+	}
+}
+
+// moveMoney runs the operations returned by next until it returns false,
+// against node unless --chaos cuts the example off from it. The latencies of
+// the operations are recorded with ctl.
+func moveMoney(ctl *control.Controller, db *sql.DB, node string, next func() (op, bool),
+	readings chan measurement, wg *sync.WaitGroup) {
+	defer wg.Done()
 	for {
-		from, to := rand.Intn(*numAccounts), rand.Intn(*numAccounts)
-		if from == to {
+		o, ok := next()
+		if !ok {
+			return
+		}
+		start := time.Now()
+		err := faults.Reach(node)
+		switch {
+		case err != nil:
+		case o.Read:
+			err = readBalances(db, o.Accounts)
+		case len(o.Accounts) == 3:
+			err = transferChain(db, o.Accounts, o.Amount, readings)
+		default:
+			err = transfer(db, o.Accounts[0], o.Accounts[1], o.Amount, readings)
+		}
+		atomic.AddUint64(&numOps, 1)
+		if err != nil {
+			atomic.AddUint64(&numErrors, 1)
+			log.Print(err)
 			continue
 		}
-		amount := rand.Intn(*maxTransfer)
-		switch *transferStyle {
-		case "single-stmt":
-			update := `
+		ctl.Record(time.Since(start))
+	}
+}
+
+// rollback rolls back tx after err, and returns err.
+func rollback(tx *sql.Tx, err error) error {
+	if rbErr := tx.Rollback(); rbErr != nil {
+		log.Fatal(rbErr)
+	}
+	return err
+}
+
+// transfer transfers amount from one account to another, sending the
+// latencies of the transfer to readings if it succeeds.
+func transfer(db *sql.DB, from, to, amount int, readings chan measurement) error {
+	if *schemaName == "postings" {
+		m, ok, err := transferPostings(db, from, to, amount)
+		if err == nil && ok {
+			readings <- m
+		}
+		return err
+	}
+	switch *transferStyle {
+	case "single-stmt":
+		update := `
 UPDATE accounts
   SET balance = CASE id WHEN $1 THEN balance-$3 WHEN $2 THEN balance+$3 END
   WHERE id IN ($1, $2) AND (SELECT balance >= $3 FROM accounts WHERE id = $1)
 `
-			start := time.Now()
-			result, err := db.Exec(update, from, to, amount)
-			if err != nil {
-				log.Print(err)
-				continue
-			}
-			affected, err := result.RowsAffected()
-			if err != nil {
+		start := time.Now()
+		faults.BeforeCommit()
+		result, err := db.Exec(update, from, to, amount)
+		if err != nil {
+			return err
+		}
+		affected, err := result.RowsAffected()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if affected > 0 {
+			d := time.Since(start)
+			readings <- measurement{read: d, write: d, total: d}
+		}
+
+	case "txn":
+		start := time.Now()
+		tx, err := db.Begin()
+		if err != nil {
+			log.Fatal(err)
+		}
+		startRead := time.Now()
+		rows, err := tx.Query(`SELECT id, balance FROM accounts WHERE id IN ($1, $2)`, from, to)
+		if err != nil {
+			return rollback(tx, err)
+		}
+		readDuration := time.Since(startRead)
+		var fromBalance, toBalance int
+		for rows.Next() {
+			var id, balance int
+			if err = rows.Scan(&id, &balance); err != nil {
 				log.Fatal(err)
 			}
-			if affected > 0 {
-				d := time.Since(start)
-				readings <- measurement{read: d, write: d, total: d}
+			switch id {
+			case from:
+				fromBalance = balance
+			case to:
+				toBalance = balance
+			default:
+				panic(fmt.Sprintf("got unexpected account %d", id))
 			}
+		}
+		startWrite := time.Now()
+		if fromBalance >= amount {
+			update := `UPDATE accounts
+  SET balance = CASE id WHEN $1 THEN $3::int WHEN $2 THEN $4::int END
+  WHERE id IN ($1, $2)`
+			if _, err = tx.Exec(update, to, from, toBalance+amount, fromBalance-amount); err != nil {
+				return rollback(tx, err)
+			}
+			if *history {
+				if _, err = tx.Exec(`INSERT INTO transfers (from_id, to_id, amount) VALUES ($1, $2, $3)`,
+					from, to, amount); err != nil {
+					return rollback(tx, err)
+				}
+			}
+		}
+		writeDuration := time.Since(startWrite)
+		faults.BeforeCommit()
+		if err = tx.Commit(); err != nil {
+			return err
+		}
+		if fromBalance >= amount {
+			readings <- measurement{read: readDuration, write: writeDuration, total: time.Since(start)}
+		}
+	}
+	return nil
+}
 
-		case "txn":
-			start := time.Now()
-			tx, err := db.Begin()
-			if err != nil {
-				log.Fatal(err)
+// transferChain transfers amount along a chain of three accounts in one
+// transaction: from the first to the second, and on to the third. The
+// balance of the middle account ends up unchanged, but its row is read and
+// written like the others, so that the transaction touches three rows.
+func transferChain(db *sql.DB, accounts []int, amount int, readings chan measurement) error {
+	start := time.Now()
+	tx, err := db.Begin()
+	if err != nil {
+		log.Fatal(err)
+	}
+	startRead := time.Now()
+	rows, err := tx.Query(`SELECT id, balance FROM accounts WHERE id IN ($1, $2, $3)`,
+		accounts[0], accounts[1], accounts[2])
+	if err != nil {
+		return rollback(tx, err)
+	}
+	readDuration := time.Since(startRead)
+	balances := make(map[int]int, len(accounts))
+	for rows.Next() {
+		var id, balance int
+		if err = rows.Scan(&id, &balance); err != nil {
+			log.Fatal(err)
+		}
+		if _, ok := balances[id]; ok || (id != accounts[0] && id != accounts[1] && id != accounts[2]) {
+			panic(fmt.Sprintf("got unexpected account %d", id))
+		}
+		balances[id] = balance
+	}
+	startWrite := time.Now()
+	ok := balances[accounts[0]] >= amount
+	if ok {
+		update := `UPDATE accounts
+  SET balance = CASE id WHEN $1 THEN $4::int WHEN $2 THEN $5::int WHEN $3 THEN $6::int END
+  WHERE id IN ($1, $2, $3)`
+		if _, err = tx.Exec(update, accounts[0], accounts[1], accounts[2],
+			balances[accounts[0]]-amount, balances[accounts[1]], balances[accounts[2]]+amount); err != nil {
+			return rollback(tx, err)
+		}
+		if *history {
+			if _, err = tx.Exec(`INSERT INTO transfers (from_id, to_id, amount) VALUES ($1, $2, $4), ($2, $3, $4)`,
+				accounts[0], accounts[1], accounts[2], amount); err != nil {
+				return rollback(tx, err)
+			}
+		}
+	}
+	writeDuration := time.Since(startWrite)
+	faults.BeforeCommit()
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	if ok {
+		readings <- measurement{read: readDuration, write: writeDuration, total: time.Since(start)}
+	}
+	return nil
+}
+
+// transferPostings transfers money by appending a pair of postings. The
+// balance of the source account is the sum of its postings. It returns
+// false if the source account has insufficient funds.
+func transferPostings(db *sql.DB, from, to, amount int) (measurement, bool, error) {
+	var m measurement
+	var ok bool
+	start := time.Now()
+	err := dbdriver.ExecuteTx(db, func(tx *sql.Tx) error {
+		startRead := time.Now()
+		var fromBalance int
+		if err := tx.QueryRow(`SELECT COALESCE(SUM(amount), 0) FROM postings WHERE account_id = $1`,
+			from).Scan(&fromBalance); err != nil {
+			return err
+		}
+		m.read = time.Since(startRead)
+		startWrite := time.Now()
+		if ok = fromBalance >= amount; ok {
+			if _, err := tx.Exec(`INSERT INTO postings (account_id, amount) VALUES ($1, $2), ($3, $4)`,
+				from, -amount, to, amount); err != nil {
+				return err
 			}
-			startRead := time.Now()
-			rows, err := tx.Query(`SELECT id, balance FROM accounts WHERE id IN ($1, $2)`, from, to)
+		}
+		m.write = time.Since(startWrite)
+		faults.BeforeCommit()
+		return nil
+	})
+	m.total = time.Since(start)
+	return m, ok, err
+}
+
+// checkInvariants verifies that money was neither created nor destroyed
+// and that no account was overdrawn.
+func checkInvariants(db *sql.DB) error {
+	totalsQuery := "SELECT COUNT(*), COALESCE(SUM(balance), 0) FROM accounts"
+	negativeQuery := "SELECT id, balance FROM accounts WHERE balance < 0"
+	if *schemaName == "postings" {
+		totalsQuery = "SELECT COUNT(DISTINCT account_id), COALESCE(SUM(amount), 0) FROM postings"
+		negativeQuery = "SELECT account_id, SUM(amount) FROM postings GROUP BY account_id HAVING SUM(amount) < 0"
+	}
+	var count, sum int
+	if err := db.QueryRow(totalsQuery).Scan(&count, &sum); err != nil {
+		return err
+	}
+	var problems []string
+	if count != *numAccounts {
+		problems = append(problems, fmt.Sprintf("found %d accounts, expected %d", count, *numAccounts))
+	}
+	if expected := *numAccounts * initialBalance; sum != expected {
+		problems = append(problems, fmt.Sprintf("total value is %d, expected %d", sum, expected))
+	}
+	rows, err := db.Query(negativeQuery)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = rows.Close() }()
+	for rows.Next() {
+		var id, balance int
+		if err := rows.Scan(&id, &balance); err != nil {
+			return err
+		}
+		problems = append(problems, fmt.Sprintf("account %d has negative balance %d", id, balance))
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if *history {
+		historyProblems, err := reconcileHistory(db)
+		if err != nil {
+			return err
+		}
+		problems = append(problems, historyProblems...)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// reconcileHistory checks that the balance of every account equals its
+// initial balance plus the net amount of the transfers recorded for it.
+func reconcileHistory(db *sql.DB) ([]string, error) {
+	var problems []string
+	// Read the balances and the transfers in the same transaction so that
+	// they are consistent with each other.
+	err := dbdriver.ExecuteTx(db, func(tx *sql.Tx) error {
+		problems = nil
+		expected := make(map[int]int)
+		for _, q := range []string{
+			"SELECT to_id, SUM(amount) FROM transfers GROUP BY to_id",
+			"SELECT from_id, -SUM(amount) FROM transfers GROUP BY from_id",
+		} {
+			rows, err := tx.Query(q)
 			if err != nil {
-				log.Print(err)
-				if err = tx.Rollback(); err != nil {
-					log.Fatal(err)
-				}
-				continue
+				return err
 			}
-			readDuration := time.Since(startRead)
-			var fromBalance, toBalance int
 			for rows.Next() {
-				var id, balance int
-				if err = rows.Scan(&id, &balance); err != nil {
-					log.Fatal(err)
-				}
-				switch id {
-				case from:
-					fromBalance = balance
-				case to:
-					toBalance = balance
-				default:
-					panic(fmt.Sprintf("got unexpected account %d", id))
+				var id, net int
+				if err := rows.Scan(&id, &net); err != nil {
+					_ = rows.Close()
+					return err
 				}
+				expected[id] += net
 			}
-			startWrite := time.Now()
-			if fromBalance >= amount {
-				update := `UPDATE accounts
-  SET balance = CASE id WHEN $1 THEN $3::int WHEN $2 THEN $4::int END
-  WHERE id IN ($1, $2)`
-				if _, err = tx.Exec(update, to, from, toBalance+amount, fromBalance-amount); err != nil {
-					log.Print(err)
-					if err = tx.Rollback(); err != nil {
-						log.Fatal(err)
-					}
-					continue
-				}
+			if err := rows.Err(); err != nil {
+				return err
 			}
-			writeDuration := time.Since(startWrite)
-			if err = tx.Commit(); err != nil {
-				log.Print(err)
-				continue
+		}
+
+		rows, err := tx.Query("SELECT id, balance FROM accounts")
+		if err != nil {
+			return err
+		}
+		defer func() { _ = rows.Close() }()
+		for rows.Next() {
+			var id, balance int
+			if err := rows.Scan(&id, &balance); err != nil {
+				return err
 			}
-			if fromBalance >= amount {
-				readings <- measurement{read: readDuration, write: writeDuration, total: time.Since(start)}
+			if want := initialBalance + expected[id]; balance != want {
+				problems = append(problems, fmt.Sprintf("account %d has balance %d, but its transfers add up to %d",
+					id, balance, want))
 			}
 		}
+		return rows.Err()
+	})
+	return problems, err
+}
+
+// splitAccounts splits a table keyed by account ID into n ranges of
+// equal numbers of accounts and scatters them across the cluster, so that
+// the load doesn't start out bottlenecked on a single range.
+func splitAccounts(db *sql.DB, table string, n int) error {
+	for i := 1; i < n; i++ {
+		split := i * *numAccounts / n
+		if _, err := db.Exec(`ALTER TABLE `+table+` SPLIT AT VALUES ($1)`, split); err != nil {
+			return err
+		}
 	}
+	_, err := db.Exec(`ALTER TABLE ` + table + ` SCATTER`)
+	return err
 }
 
 func verifyBank(db *sql.DB) {
-	var sum int
-	if err := db.QueryRow("SELECT SUM(balance) FROM accounts").Scan(&sum); err != nil {
-		log.Fatal(err)
-	}
-	if sum == *numAccounts*1000 {
-		log.Print("The bank is in good order.")
-	} else {
-		log.Printf("The bank is not in good order. Total value: %d", sum)
+	if err := checkInvariants(db); err != nil {
+		log.Printf("The bank is not in good order: %s", err)
 		os.Exit(1)
 	}
+	log.Print("The bank is in good order.")
 }
 
 var usage = func() {
 	fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
-	fmt.Fprintf(os.Stderr, "  %s <db URL>\n\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s [<db URL>]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s --coordinate=<addr>,... <command>\n\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "%s\n", control.Usage)
 	flag.PrintDefaults()
 }
 
 func main() {
 	flag.Usage = usage
 	flag.Parse()
+	control.Coordinate(flag.Args())
 
-	if flag.NArg() != 1 {
+	if flag.NArg() > 1 {
 		usage()
 		os.Exit(2)
 	}
 
-	dbURL := flag.Arg(0)
+	newPick, ok := distributions[*distribution]
+	if !ok {
+		log.Fatalf("unknown distribution %q", *distribution)
+	}
+	if *readPercent < 0 || *readPercent > 100 {
+		log.Fatalf("Value of 'read-percent' flag (%d) must be between 0 and 100", *readPercent)
+	}
+	if *schemaName != "balances" && *schemaName != "postings" {
+		log.Fatalf("unknown schema %q", *schemaName)
+	}
+	if *schemaName == "postings" && (*history || *transferStyle != "txn") {
+		log.Fatal("--schema=postings requires --transfer-style=txn and can't be combined with --history")
+	}
+	if *history && *transferStyle != "txn" {
+		log.Fatal("--history requires --transfer-style=txn")
+	}
+	if *distribution == "zipf" && *zipfS <= 1 {
+		log.Fatalf("Value of 'zipf-s' flag (%f) must be greater than 1", *zipfS)
+	}
+	if *distribution == "hotspot" && (*hotspotAccounts < 1 || *hotspotAccounts > *numAccounts) {
+		log.Fatalf("Value of 'hotspot-accounts' flag (%d) must be between 1 and %d", *hotspotAccounts, *numAccounts)
+	}
+	if *hotPairPercent > 0 && (*hotspotAccounts < 2 || *hotspotAccounts > *numAccounts) {
+		log.Fatalf("Value of 'hotspot-accounts' flag (%d) must be between 2 and %d", *hotspotAccounts, *numAccounts)
+	}
+	newAmount, ok := amountDistributions[*amountDistribution]
+	if !ok {
+		log.Fatalf("unknown amount distribution %q", *amountDistribution)
+	}
+	if *paretoAlpha <= 0 {
+		log.Fatalf("Value of 'pareto-alpha' flag (%f) must be positive", *paretoAlpha)
+	}
+	if *multiHopPercent < 0 || *multiHopPercent > 100 {
+		log.Fatalf("Value of 'multi-hop-percent' flag (%d) must be between 0 and 100", *multiHopPercent)
+	}
+	if *multiHopPercent > 0 && (*schemaName != "balances" || *transferStyle != "txn" || *numAccounts < 3) {
+		log.Fatal("--multi-hop-percent requires --schema=balances, --transfer-style=txn and at least 3 accounts")
+	}
+	if err := capture.Check(); err != nil {
+		log.Fatal(err)
+	}
+
+	dbURL, err := dbdriver.URL(flag.Arg(0), "")
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	parsedURL, err := url.Parse(dbURL)
 	if err != nil {
@@ -162,19 +638,29 @@ func main() {
 	}
 	parsedURL.Path = "bank"
 
-	db, err := sql.Open("postgres", parsedURL.String())
+	db, err := dbdriver.Open(*driver, parsedURL.String())
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer func() { _ = db.Close() }()
 
+	if *verifyOnly {
+		verifyBank(db)
+		return
+	}
+
 	if _, err := db.Exec("CREATE DATABASE IF NOT EXISTS bank"); err != nil {
 		log.Fatal(err)
 	}
 
-	// concurrency + 1, for this thread and the "concurrency" number of
-	// goroutines that move money
-	db.SetMaxOpenConns(*concurrency + 1)
+	d, err := dialect.Detect(db)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// Splitting and scattering ranges are CockroachDB statements.
+	if *initSplits > 1 && d != dialect.Cockroach {
+		log.Fatalf("--init-splits requires CockroachDB, not %s", d.Name())
+	}
 
 	if _, err = db.Exec("CREATE TABLE IF NOT EXISTS accounts (id BIGINT PRIMARY KEY, balance BIGINT NOT NULL)"); err != nil {
 		log.Fatal(err)
@@ -184,8 +670,41 @@ func main() {
 		log.Fatal(err)
 	}
 
+	if *history {
+		if _, err = db.Exec(`CREATE TABLE IF NOT EXISTS transfers (
+  id      ` + d.IDColumn() + ` PRIMARY KEY,
+  from_id BIGINT NOT NULL,
+  to_id   BIGINT NOT NULL,
+  amount  BIGINT NOT NULL,
+  created TIMESTAMP NOT NULL DEFAULT NOW()
+)`); err != nil {
+			log.Fatal(err)
+		}
+		if _, err = db.Exec("TRUNCATE TABLE transfers"); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	table, insert := "accounts", "INSERT INTO accounts (id, balance) VALUES ($1, $2)"
+	if *schemaName == "postings" {
+		if _, err = db.Exec(fmt.Sprintf(postingsSchema, d.IDColumn())); err != nil {
+			log.Fatal(err)
+		}
+		if _, err = db.Exec("TRUNCATE TABLE postings"); err != nil {
+			log.Fatal(err)
+		}
+		table, insert = "postings", "INSERT INTO postings (account_id, amount) VALUES ($1, $2)"
+	}
+
+	if *initSplits > 1 {
+		log.Printf("splitting %s into %d ranges", table, *initSplits)
+		if err := splitAccounts(db, table, *initSplits); err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	for i := 0; i < *numAccounts; i++ {
-		if _, err = db.Exec("INSERT INTO accounts (id, balance) VALUES ($1, $2)", i, 1000); err != nil {
+		if _, err = db.Exec(insert, i, initialBalance); err != nil {
 			log.Fatal(err)
 		}
 	}
@@ -195,11 +714,128 @@ func main() {
 	lastNow := time.Now()
 	readings := make(chan measurement, 10000)
 
+	balanceReads.hist = hdrhistogram.New(0, int64(time.Minute), 1)
+	balanceReads.cumulative = hdrhistogram.New(0, int64(time.Minute), 1)
+	rec, err := capture.NewRecorder()
+	if err != nil {
+		log.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	var ops chan op
+	if capture.Replaying() {
+		ops = make(chan op)
+	}
+	stop := make(chan struct{})
+	var ctl *control.Controller
+	spawn := func(i int) {
+		// One connection per worker moving money, plus one for this thread
+		// and one for the invariant checker.
+		db.SetMaxOpenConns(i + 3)
+		next := func() (op, bool) {
+			if !ctl.Wait(i, stop) {
+				return op{}, false
+			}
+			o, ok := <-ops
+			return o, ok
+		}
+		if ops == nil {
+			gen := newGenerator(newPick, newAmount, ctl.ReadPercent)
+			next = func() (op, bool) {
+				if !ctl.Wait(i, stop) {
+					return op{}, false
+				}
+				o := gen()
+				if err := rec.Record(o); err != nil {
+					log.Fatal(err)
+				}
+				return o, true
+			}
+		}
+		wg.Add(1)
+		go moveMoney(ctl, db, parsedURL.Host, next, readings, &wg)
+	}
+	if faults, err = chaos.New(func() (uint64, uint64) {
+		return atomic.LoadUint64(&numOps), atomic.LoadUint64(&numErrors)
+	}); err != nil {
+		log.Fatal(err)
+	}
+	ctl = control.New(*concurrency, spawn, func() (uint64, uint64) {
+		return atomic.LoadUint64(&numOps), atomic.LoadUint64(&numErrors)
+	})
+	if err := ctl.SetReadPercent(*readPercent); err != nil {
+		log.Fatal(err)
+	}
 	for i := 0; i < *concurrency; i++ {
-		go moveMoney(db, readings)
+		spawn(i)
+	}
+	if err := control.Serve(ctl); err != nil {
+		log.Fatal(err)
+	}
+	if err := control.ServeREST(ctl); err != nil {
+		log.Fatal(err)
+	}
+	control.Adapt(ctl)
+	control.HandleSignals(ctl)
+	replayed := make(chan struct{})
+	if ops != nil {
+		go func() {
+			n, err := capture.Replay(func(raw json.RawMessage) error {
+				var o op
+				if err := json.Unmarshal(raw, &o); err != nil {
+					return err
+				}
+				ops <- o
+				return nil
+			})
+			close(ops)
+			if err != nil {
+				log.Fatal(err)
+			}
+			// Every operation was taken: release the workers waiting for
+			// the controller too.
+			ctl.Close()
+			close(stop)
+			wg.Wait()
+			log.Printf("replayed %d operations", n)
+			close(replayed)
+		}()
+	}
+
+	if *verifyInterval > 0 {
+		go func() {
+			for range time.Tick(*verifyInterval) {
+				verifyBank(db)
+			}
+		}()
+	}
+
+	signalCh := make(chan os.Signal, 1)
+	signal.Notify(signalCh, os.Interrupt, syscall.SIGTERM)
+	var done <-chan time.Time
+	if *duration > 0 {
+		done = time.After(*duration)
 	}
 
-	for range time.NewTicker(*balanceCheckInterval).C {
+	startTime := time.Now()
+	cumulative := hdrhistogram.New(0, int64(time.Minute), 1)
+	ticker := time.NewTicker(*balanceCheckInterval)
+	for running := true; running; {
+		select {
+		case <-ticker.C:
+		case <-signalCh:
+			running = false
+			continue
+		case <-done:
+			running = false
+			continue
+		case <-replayed:
+			running = false
+		}
+		// Mark the changes of the concurrency, so that a run sweeping a
+		// range of concurrencies can be split at them.
+		for _, ch := range ctl.Changes() {
+			log.Printf("%s: ----- %s -----", time.Duration(ch.Elapsed.Seconds()+0.5)*time.Second, ch)
+		}
 		now := time.Now()
 		elapsed := time.Since(lastNow)
 		lastNow = now
@@ -207,15 +843,56 @@ func main() {
 		log.Printf("%d transfers were executed at %.1f/second.", transfers, float64(transfers)/elapsed.Seconds())
 		if transfers > 0 {
 			var aggr measurement
+			hist := hdrhistogram.New(0, int64(time.Minute), 1)
 			for i := 0; i < transfers; i++ {
 				reading := <-readings
 				aggr.read += reading.read
 				aggr.write += reading.write
 				aggr.total += reading.total
+				_ = hist.RecordValue(int64(reading.total))
 			}
+			cumulative.Merge(hist)
 			d := time.Duration(transfers)
 			log.Printf("read time: %v, write time: %v, txn time: %v", aggr.read/d, aggr.write/d, aggr.total/d)
+			log.Printf("txn latency: p50=%s p95=%s p99=%s max=%s",
+				time.Duration(hist.ValueAtQuantile(50)), time.Duration(hist.ValueAtQuantile(95)),
+				time.Duration(hist.ValueAtQuantile(99)), time.Duration(hist.Max()))
 		}
-		verifyBank(db)
+		if ctl.ReadPercent() > 0 {
+			balanceReads.Lock()
+			hist, errors := balanceReads.hist, balanceReads.errors
+			balanceReads.hist = hdrhistogram.New(0, int64(time.Minute), 1)
+			balanceReads.errors = 0
+			balanceReads.Unlock()
+			log.Printf("%d balance reads at %.1f/second: p50=%s p95=%s p99=%s max=%s (%d errors)",
+				hist.TotalCount(), float64(hist.TotalCount())/elapsed.Seconds(),
+				time.Duration(hist.ValueAtQuantile(50)), time.Duration(hist.ValueAtQuantile(95)),
+				time.Duration(hist.ValueAtQuantile(99)), time.Duration(hist.Max()), errors)
+		}
+	}
+	ticker.Stop()
+	if n := ctl.Stats().Sustainable; n > 0 {
+		log.Printf("sustainable concurrency under --target-p99: %d workers", n)
 	}
+	if rec != nil {
+		if err := rec.Close(); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("recorded the operations to %s", capture.Path())
+	}
+
+	elapsed := time.Since(startTime)
+	log.Printf("%d transfers in %s (%.1f/second)", cumulative.TotalCount(), elapsed,
+		float64(cumulative.TotalCount())/elapsed.Seconds())
+	log.Printf("cumulative txn latency: p50=%s p95=%s p99=%s max=%s",
+		time.Duration(cumulative.ValueAtQuantile(50)), time.Duration(cumulative.ValueAtQuantile(95)),
+		time.Duration(cumulative.ValueAtQuantile(99)), time.Duration(cumulative.Max()))
+	balanceReads.Lock()
+	if reads := balanceReads.cumulative; reads.TotalCount() > 0 {
+		log.Printf("%d balance reads, cumulative latency: p50=%s p95=%s p99=%s max=%s", reads.TotalCount(),
+			time.Duration(reads.ValueAtQuantile(50)), time.Duration(reads.ValueAtQuantile(95)),
+			time.Duration(reads.ValueAtQuantile(99)), time.Duration(reads.Max()))
+	}
+	balanceReads.Unlock()
+	verifyBank(db)
 }
@@ -0,0 +1,413 @@
+// Copyright 2016 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+// The blobs example stores large binary objects by splitting them into
+// fixed-size chunk rows. Clients upload, download and delete objects,
+// transferring the chunks of each object in parallel. An object only
+// becomes visible once all of its chunks have been written, and every
+// download verifies the object's SHA-256 checksum.
+//
+// Object contents are generated chunk by chunk from a seed, so objects of
+// up to a gigabyte can be uploaded without holding them in memory.
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/url"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cockroachdb/examples-go/dbdriver"
+	"github.com/cockroachdb/examples-go/opstats"
+	// Import postgres driver.
+	_ "github.com/cockroachdb/pq"
+)
+
+var minSize = flag.Int64("min-size", 1<<20, "Minimum object size in bytes.")
+var maxSize = flag.Int64("max-size", 16<<20, "Maximum object size in bytes (up to 1GB).")
+var chunkSize = flag.Int("chunk-size", 256<<10, "Size of each chunk row in bytes.")
+var parallelism = flag.Int("parallelism", 4, "Number of chunks of an object transferred in parallel.")
+var concurrency = flag.Int("concurrency", 2, "Number of concurrent clients.")
+var uploadPercent = flag.Int("upload-percent", 40, "Percentage of operations that upload an object.")
+var downloadPercent = flag.Int("download-percent", 50, "Percentage of operations that download an object. "+
+	"The remaining operations delete an object.")
+var outputInterval = flag.Duration("output-interval", 5*time.Second, "Interval of output.")
+var driver = flag.String("driver", "postgres", dbdriver.Usage)
+
+const schema = `
+CREATE TABLE IF NOT EXISTS objects (
+  id         INT NOT NULL DEFAULT unique_rowid() PRIMARY KEY,
+  size       INT NOT NULL,
+  chunk_size INT NOT NULL,
+  checksum   BYTES,
+  complete   BOOL NOT NULL DEFAULT false
+);
+
+CREATE TABLE IF NOT EXISTS chunks (
+  object_id INT NOT NULL,
+  idx       INT NOT NULL,
+  data      BYTES NOT NULL,
+  PRIMARY KEY (object_id, idx)
+);
+`
+
+const (
+	uploadOp = iota
+	downloadOp
+	deleteOp
+	numOps
+)
+
+var opNames = [numOps]string{"upload", "download", "delete"}
+
+var numBytes [numOps]uint64
+var numCorrupt uint64
+
+// An object describes a completely uploaded object.
+type object struct {
+	id        int64
+	size      int64
+	chunkSize int
+	checksum  []byte
+}
+
+func (o object) numChunks() int {
+	return int((o.size + int64(o.chunkSize) - 1) / int64(o.chunkSize))
+}
+
+// chunkLen returns the length of the given chunk; the last chunk may be
+// shorter than the others.
+func (o object) chunkLen(idx int) int {
+	if rem := o.size - int64(idx)*int64(o.chunkSize); rem < int64(o.chunkSize) {
+		return int(rem)
+	}
+	return o.chunkSize
+}
+
+// catalog tracks the objects that are available for download and
+// deletion.
+var catalog struct {
+	sync.Mutex
+	objects []object
+}
+
+func addObject(o object) {
+	catalog.Lock()
+	catalog.objects = append(catalog.objects, o)
+	catalog.Unlock()
+}
+
+// pickObject returns a random object, removing it from the catalog if
+// remove is true.
+func pickObject(r *rand.Rand, remove bool) (object, bool) {
+	catalog.Lock()
+	defer catalog.Unlock()
+	n := len(catalog.objects)
+	if n == 0 {
+		return object{}, false
+	}
+	i := r.Intn(n)
+	o := catalog.objects[i]
+	if remove {
+		catalog.objects[i] = catalog.objects[n-1]
+		catalog.objects = catalog.objects[:n-1]
+	}
+	return o, true
+}
+
+// transfer calls fn for each chunk of an object, running up to
+// --parallelism calls at a time. The chunks are processed in windows of
+// --parallelism chunks and done is called with each chunk, in order, once
+// its window has completed.
+func transfer(o object, fn func(idx int) ([]byte, error), done func(data []byte)) error {
+	n := o.numChunks()
+	for start := 0; start < n; start += *parallelism {
+		end := start + *parallelism
+		if end > n {
+			end = n
+		}
+		results := make([][]byte, end-start)
+		errs := make([]error, end-start)
+		var wg sync.WaitGroup
+		for i := start; i < end; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				results[i-start], errs[i-start] = fn(i)
+			}(i)
+		}
+		wg.Wait()
+		for i := range results {
+			if errs[i] != nil {
+				return errs[i]
+			}
+			done(results[i])
+		}
+	}
+	return nil
+}
+
+func upload(db *sql.DB, r *rand.Rand) (int64, error) {
+	o := object{
+		size:      *minSize + r.Int63n(*maxSize-*minSize+1),
+		chunkSize: *chunkSize,
+	}
+	if err := db.QueryRow(`INSERT INTO objects (size, chunk_size) VALUES ($1, $2) RETURNING id`,
+		o.size, o.chunkSize).Scan(&o.id); err != nil {
+		return 0, err
+	}
+	seed := r.Int63()
+	h := sha256.New()
+	err := transfer(o, func(idx int) ([]byte, error) {
+		data := make([]byte, o.chunkLen(idx))
+		_, _ = rand.New(rand.NewSource(seed + int64(idx))).Read(data)
+		_, err := db.Exec(`INSERT INTO chunks (object_id, idx, data) VALUES ($1, $2, $3)`, o.id, idx, data)
+		return data, err
+	}, func(data []byte) {
+		_, _ = h.Write(data)
+	})
+	if err != nil {
+		return 0, err
+	}
+	o.checksum = h.Sum(nil)
+	// Only mark the object complete once all chunks are durable, so that
+	// readers never see a partial object.
+	if _, err := db.Exec(`UPDATE objects SET checksum = $1, complete = true WHERE id = $2`,
+		o.checksum, o.id); err != nil {
+		return 0, err
+	}
+	addObject(o)
+	return o.size, nil
+}
+
+func download(db *sql.DB, r *rand.Rand) (int64, error) {
+	o, ok := pickObject(r, false)
+	if !ok {
+		return 0, nil
+	}
+	h := sha256.New()
+	err := transfer(o, func(idx int) ([]byte, error) {
+		var data []byte
+		err := db.QueryRow(`SELECT data FROM chunks WHERE object_id = $1 AND idx = $2`, o.id, idx).Scan(&data)
+		if err == nil && len(data) != o.chunkLen(idx) {
+			err = fmt.Errorf("object %d: chunk %d has %d bytes, expected %d", o.id, idx, len(data), o.chunkLen(idx))
+		}
+		return data, err
+	}, func(data []byte) {
+		_, _ = h.Write(data)
+	})
+	if err == sql.ErrNoRows {
+		// The object was deleted by another client while we were reading it.
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	if sum := h.Sum(nil); !bytes.Equal(sum, o.checksum) {
+		atomic.AddUint64(&numCorrupt, 1)
+		return 0, fmt.Errorf("object %d: checksum mismatch: got %x, expected %x", o.id, sum, o.checksum)
+	}
+	return o.size, nil
+}
+
+func deleteObject(db *sql.DB, r *rand.Rand) (int64, error) {
+	o, ok := pickObject(r, true)
+	if !ok {
+		return 0, nil
+	}
+	if err := removeObject(db, o); err != nil {
+		return 0, err
+	}
+	return o.size, nil
+}
+
+// removeObject deletes an object and its chunks. The object row is
+// deleted first so that an interrupted delete never leaves behind a
+// visible object with missing chunks. The chunks are deleted in batches
+// to keep the transactions small.
+func removeObject(db *sql.DB, o object) error {
+	if _, err := db.Exec(`DELETE FROM objects WHERE id = $1`, o.id); err != nil {
+		return err
+	}
+	for {
+		res, err := db.Exec(`DELETE FROM chunks WHERE object_id = $1 LIMIT 100`, o.id)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil || n == 0 {
+			return err
+		}
+	}
+}
+
+var stats [numOps]*opstats.Stats
+
+func init() {
+	for i := range stats {
+		stats[i] = opstats.New(10 * time.Minute)
+	}
+}
+
+func client(db *sql.DB) {
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	for {
+		op := deleteOp
+		switch p := r.Intn(100); {
+		case p < *uploadPercent:
+			op = uploadOp
+		case p < *uploadPercent+*downloadPercent:
+			op = downloadOp
+		}
+
+		start := time.Now()
+		var n int64
+		var err error
+		switch op {
+		case uploadOp:
+			n, err = upload(db, r)
+		case downloadOp:
+			n, err = download(db, r)
+		case deleteOp:
+			n, err = deleteObject(db, r)
+		}
+		if err != nil {
+			log.Printf("%s failed: %s", opNames[op], err)
+		}
+		if n > 0 || err != nil {
+			stats[op].Record(start, err)
+		}
+		atomic.AddUint64(&numBytes[op], uint64(n))
+	}
+}
+
+func setupDatabase(db *sql.DB) error {
+	if _, err := db.Exec("CREATE DATABASE IF NOT EXISTS blobs"); err != nil {
+		return err
+	}
+	if _, err := db.Exec(schema); err != nil {
+		return err
+	}
+	// Pick up the objects left by a previous run and remove the leftovers
+	// of interrupted uploads.
+	rows, err := db.Query(`SELECT id, size, chunk_size, checksum, complete FROM objects`)
+	if err != nil {
+		return err
+	}
+	var incomplete []object
+	for rows.Next() {
+		var o object
+		var complete bool
+		if err := rows.Scan(&o.id, &o.size, &o.chunkSize, &o.checksum, &complete); err != nil {
+			_ = rows.Close()
+			return err
+		}
+		if complete {
+			addObject(o)
+		} else {
+			incomplete = append(incomplete, o)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, o := range incomplete {
+		if err := removeObject(db, o); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var usage = func() {
+	fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s [<db URL>]\n\n", os.Args[0])
+	flag.PrintDefaults()
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() > 1 {
+		usage()
+		os.Exit(2)
+	}
+
+	if *minSize < 1 || *maxSize < *minSize || *maxSize > 1<<30 {
+		log.Fatal("object sizes must satisfy 1 <= min-size <= max-size <= 1GB")
+	}
+	if *chunkSize < 1 || *parallelism < 1 {
+		log.Fatal("'chunk-size' and 'parallelism' must be at least 1")
+	}
+	if *uploadPercent < 0 || *downloadPercent < 0 || *uploadPercent+*downloadPercent > 100 {
+		log.Fatal("'upload-percent' and 'download-percent' must be non-negative and add up to at most 100")
+	}
+
+	dbURL, err := dbdriver.URL(flag.Arg(0), "")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	parsedURL, err := url.Parse(dbURL)
+	if err != nil {
+		log.Fatal(err)
+	}
+	parsedURL.Path = "blobs"
+
+	db, err := dbdriver.Open(*driver, parsedURL.String())
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer func() { _ = db.Close() }()
+
+	db.SetMaxOpenConns(*concurrency * (*parallelism + 1))
+
+	if err := setupDatabase(db); err != nil {
+		log.Fatal(err)
+	}
+
+	for i := 0; i < *concurrency; i++ {
+		go client(db)
+	}
+
+	lastNow := time.Now()
+	var lastBytes [numOps]uint64
+	for range time.Tick(*outputInterval) {
+		now := time.Now()
+		elapsed := now.Sub(lastNow)
+		lastNow = now
+
+		for op, s := range stats {
+			hist, errors := s.Snapshot()
+			b := atomic.LoadUint64(&numBytes[op])
+			log.Printf("%-8s: %5d objects, %6.1f MB/sec, p50=%s p99=%s (%d errors)",
+				opNames[op], hist.TotalCount(), float64(b-lastBytes[op])/(1<<20)/elapsed.Seconds(),
+				time.Duration(hist.ValueAtQuantile(50)),
+				time.Duration(hist.ValueAtQuantile(99)),
+				errors)
+			lastBytes[op] = b
+		}
+		catalog.Lock()
+		log.Printf("%d objects stored, %d checksum mismatches", len(catalog.objects), atomic.LoadUint64(&numCorrupt))
+		catalog.Unlock()
+	}
+}
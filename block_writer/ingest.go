@@ -0,0 +1,153 @@
+// Copyright 2016 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"hash/crc32"
+	"log"
+
+	"github.com/cockroachdb/examples-go/chaos"
+	"github.com/cockroachdb/examples-go/dbdriver"
+	"github.com/cockroachdb/pq"
+)
+
+var ingestMode = flag.String("ingest", "",
+	"If set, write the blocks in large chunks to measure the maximum ingest rate: copy uses COPY FROM "+
+		"(Postgres, --driver=postgres only), insert uses multi-value INSERT statements. Overrides --batch.")
+var ingestBytes = flag.Int("ingest-bytes", 4<<20,
+	"Size of the block data of each chunk written by --ingest, which should stay below the size limits "+
+		"of a transaction. Chunks failing with a database error are split in halves and retried.")
+
+// maxInsertBlocks is the largest number of blocks inserted by a single
+// statement: Postgres binds at most 65535 parameters, 4 per block.
+const maxInsertBlocks = 65535 / 4
+
+// validateIngest checks the --ingest flags.
+func validateIngest() error {
+	switch *ingestMode {
+	case "", "insert":
+	case "copy":
+		if *driver != "postgres" {
+			return fmt.Errorf("--ingest=copy requires --driver=postgres, not %q", *driver)
+		}
+	default:
+		return fmt.Errorf("unknown --ingest mode %q, expected copy or insert", *ingestMode)
+	}
+	if *ingestBytes < 1 {
+		return fmt.Errorf("value of 'ingest-bytes' flag (%d) must be greater than or equal to 1", *ingestBytes)
+	}
+	return nil
+}
+
+// ingestChunk generates a chunk of about --ingest-bytes of block data and
+// writes it. It returns the blocks written and the number of transactions
+// that wrote them.
+func (bw *blockWriter) ingestChunk() ([]writtenBlock, uint64, error) {
+	var blocks []writtenBlock
+	var data [][]byte
+	for size := 0; size < *ingestBytes; {
+		if *ingestMode == "insert" && len(blocks) == maxInsertBlocks {
+			break
+		}
+		bw.blockCount++
+		d := bw.randomBlock()
+		blocks = append(blocks, writtenBlock{bw.rand.Int63(), bw.id, bw.blockCount, crc32.ChecksumIEEE(d)})
+		data = append(data, d)
+		size += len(d)
+	}
+	return bw.ingest(blocks, data)
+}
+
+// ingest writes blocks, whose data is in data, in a single transaction. If
+// the database rejects it, e.g. for exceeding the size limits of a
+// transaction, the blocks are split in halves written separately, down to
+// single blocks. The blocks of the chunks that still fail are marked as
+// failed.
+func (bw *blockWriter) ingest(blocks []writtenBlock, data [][]byte) ([]writtenBlock, uint64, error) {
+	var err error
+	if *ingestMode == "copy" {
+		err = bw.copyBlocks(blocks, data)
+	} else {
+		args := make([]interface{}, 0, 4*len(blocks))
+		for i, b := range blocks {
+			args = append(args, b.blockID, b.writerID, b.blockNum, data[i])
+		}
+		err = bw.insert(insertStmt(len(blocks)), args)
+	}
+	if err == nil {
+		return blocks, 1, nil
+	}
+	// Errors without a SQLSTATE code come from the connection, which
+	// smaller chunks wouldn't fix.
+	if len(blocks) == 1 || dbdriver.Code(err) == "" {
+		for _, b := range blocks {
+			bw.failed[b.blockNum] = true
+		}
+		return nil, 0, err
+	}
+	log.Printf("blockwriter %s: splitting a chunk of %d blocks: %s", bw.id, len(blocks), err)
+	half := len(blocks) / 2
+	done, txns, err := bw.ingest(blocks[:half], data[:half])
+	if err != nil {
+		for _, b := range blocks[half:] {
+			bw.failed[b.blockNum] = true
+		}
+		return done, txns, err
+	}
+	more, moreTxns, err := bw.ingest(blocks[half:], data[half:])
+	return append(done, more...), txns + moreTxns, err
+}
+
+// copyBlocks writes blocks with COPY FROM, in a transaction, unless --chaos
+// cuts the writer off from its node.
+func (bw *blockWriter) copyBlocks(blocks []writtenBlock, data [][]byte) error {
+	if faults.Partitioned(bw.node) {
+		if bw.db != nil {
+			_ = bw.db.Close()
+		}
+		return chaos.ErrPartitioned
+	}
+	tx, err := bw.db.Begin()
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.Prepare(pq.CopyIn("blocks", "block_id", "writer_id", "block_num", "raw_bytes"))
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	for i, b := range blocks {
+		if _, err := stmt.Exec(b.blockID, b.writerID, b.blockNum, data[i]); err != nil {
+			_ = stmt.Close()
+			_ = tx.Rollback()
+			return err
+		}
+	}
+	// The rows are only sent, and checked, once the COPY is flushed.
+	if _, err := stmt.Exec(); err != nil {
+		_ = stmt.Close()
+		_ = tx.Rollback()
+		return err
+	}
+	if err := stmt.Close(); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	faults.BeforeCommit()
+	return tx.Commit()
+}
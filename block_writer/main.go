@@ -21,23 +21,31 @@
 package main
 
 import (
+	"bytes"
 	"database/sql"
 	"flag"
 	"fmt"
+	"hash/crc32"
 	"log"
 	"math/rand"
 	"net/url"
 	"os"
+	"os/signal"
+	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 
+	"github.com/cockroachdb/examples-go/chaos"
+	"github.com/cockroachdb/examples-go/control"
+	"github.com/cockroachdb/examples-go/dbdriver"
 	"github.com/satori/go.uuid"
 	// Import postgres driver.
 	_ "github.com/cockroachdb/pq"
 )
 
 const (
-	insertBlockStmt = `INSERT INTO blocks (block_id, writer_id, block_num, raw_bytes) VALUES ($1, $2, $3, $4)`
+	insertBlockStmt = `INSERT INTO blocks (block_id, writer_id, block_num, raw_bytes) VALUES `
 )
 
 // concurrency = number of concurrent insertion processes.
@@ -52,65 +60,439 @@ var outputInterval = flag.Duration("output-interval", 1*time.Second, "Interval o
 var minBlockSizeBytes = flag.Int("min-block-bytes", 256, "Minimum amount of raw data written with each insertion")
 var maxBlockSizeBytes = flag.Int("max-block-bytes", 1024, "Maximum amount of raw data written with each insertion")
 
-// numBlocks keeps a global count of successfully written blocks.
+// compressibility is the fraction of each block made of repeated bytes.
+var compressibility = flag.Float64("compressibility", 0,
+	"Fraction of each block, between 0 and 1, made of repeated bytes rather than random bytes")
+
+// batch = number of blocks inserted by each INSERT statement.
+var batch = flag.Int("batch", 1, "Number of blocks inserted by each INSERT statement")
+
+// maxBackoff is the longest a writer waits between reconnection attempts.
+const maxBackoff = 5 * time.Second
+
+var duration = flag.Duration("duration", 0, "If non-zero, how long to run before stopping the writers")
+
+var verify = flag.Bool("verify", false,
+	"Once the writers stop, check that every block they wrote is present exactly once")
+
+var numReaders = flag.Int("readers", 0,
+	"Number of concurrent readers reading back and checking blocks written earlier")
+
+var readPercent = flag.Int("read-percent", 0,
+	"Percentage of the operations of the writers that read back and check a block written earlier instead of inserting")
+
+var metricsAddr = flag.String("metrics-addr", "",
+	"If set, address on which to serve Prometheus metrics on /metrics, the live status on /status "+
+		"and the control endpoints under /control")
+var driver = flag.String("driver", "postgres", dbdriver.Usage)
+
+// faults are the faults injected with --chaos.
+var faults *chaos.Injector
+
+// numBlocks keeps a global count of successfully written blocks, and
+// numTxns of the statements that wrote them.
 var numBlocks uint64
+var numTxns uint64
 
 // A blockWriter writes blocks of random data into cockroach in an infinite
-// loop.
+// loop. The blocks of a writer are numbered sequentially by block_num.
 type blockWriter struct {
+	// rows and errors count the blocks inserted and the failed insertions.
+	// They are accessed atomically, and come first to be 64-bit aligned.
+	rows   uint64
+	errors uint64
+
 	id         string
 	blockCount uint64
+	dbURL      string
+	node       string // address of the node the writer is connected to
 	db         *sql.DB
 	rand       *rand.Rand
+
+	// down is set while the writer's insertions are failing.
+	down bool
+
+	// failed holds the block numbers whose insertion returned an error.
+	// Such blocks may or may not have been written.
+	failed map[uint64]bool
 }
 
-func newBlockWriter(db *sql.DB) blockWriter {
+func newBlockWriter(dbURL, node string) (*blockWriter, error) {
 	source := rand.NewSource(int64(time.Now().UnixNano()))
-	return blockWriter{
-		db:   db,
-		id:   uuid.NewV4().String(),
-		rand: rand.New(source),
+	bw := &blockWriter{
+		dbURL:  dbURL,
+		node:   node,
+		id:     uuid.NewV4().String(),
+		rand:   rand.New(source),
+		failed: make(map[uint64]bool),
 	}
+	return bw, bw.connect()
 }
 
-// run is an infinite loop in which the blockWriter continuously attempts to
-// write blocks of random data into a table in cockroach DB.
-func (bw blockWriter) run(errCh chan<- error) {
-	for {
-		blockID := bw.rand.Int63()
-		blockData := bw.randomBlock()
+// connect opens the writer's own connection to the database, closing the
+// previous one if any.
+func (bw *blockWriter) connect() error {
+	if bw.db != nil {
+		_ = bw.db.Close()
+	}
+	if faults.Partitioned(bw.node) {
+		return chaos.ErrPartitioned
+	}
+	var err error
+	if bw.db, err = dbdriver.Open(*driver, bw.dbURL); err != nil {
+		return err
+	}
+	bw.db.SetMaxOpenConns(1)
+	return bw.db.Ping()
+}
+
+// reconnect reopens the writer's connection after an error, backing off
+// exponentially until it succeeds or stop is closed.
+func (bw *blockWriter) reconnect(stop <-chan struct{}) {
+	for backoff := 100 * time.Millisecond; ; backoff *= 2 {
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+		select {
+		case <-time.After(backoff):
+		case <-stop:
+			return
+		}
+		err := bw.connect()
+		if err == nil {
+			return
+		}
+		log.Printf("blockwriter %s: reconnecting: %s", bw.id, err)
+	}
+}
+
+// run is a loop in which the blockWriter continuously attempts to write
+// blocks of random data into a table in cockroach DB, until stop is closed.
+// Each insertion waits for ctl to let the writer through.
+func (bw *blockWriter) run(ctl *control.Controller, worker int, errCh chan<- error,
+	stop <-chan struct{}, wg *sync.WaitGroup) {
+	defer wg.Done()
+	n := *batch
+	stmt := insertStmt(n)
+	args := make([]interface{}, 0, 4*n)
+	blocks := make([]writtenBlock, n)
+	// With --tolerate-errors, a writer whose first connection failed is
+	// started without one, and only runs once connected.
+	if bw.db == nil {
+		if bw.reconnect(stop); bw.db == nil {
+			return
+		}
+	}
+	for ctl.Wait(worker, stop) {
+		if bw.rand.Intn(100) < ctl.ReadPercent() {
+			if ok, err := readBlock(bw.db); err != nil {
+				select {
+				case errCh <- err:
+				case <-stop:
+					return
+				}
+			} else if !ok {
+				time.Sleep(10 * time.Millisecond)
+			}
+			continue
+		}
+		start := time.Now()
+		var done []writtenBlock
+		var txns uint64
+		var err error
+		if *ingestMode != "" {
+			done, txns, err = bw.ingestChunk()
+		} else if done, err = bw.insertBatch(stmt, args, blocks); err == nil {
+			txns = 1
+		}
+		if len(done) > 0 {
+			latency := time.Since(start)
+			insertLatency.record(latency)
+			ctl.Record(latency)
+			atomic.AddUint64(&bw.rows, uint64(len(done)))
+			atomic.AddUint64(&numBlocks, uint64(len(done)))
+			atomic.AddUint64(&numTxns, txns)
+			// The read percentage may be raised at any time through the
+			// control API, so blocks are sampled even without readers.
+			written.add(done)
+		}
+		if err != nil {
+			atomic.AddUint64(&bw.errors, 1)
+			if !bw.down {
+				bw.down = true
+				downtime.markDown()
+			}
+			select {
+			case errCh <- fmt.Errorf("error running blockwriter %s: %s", bw.id, err):
+			case <-stop:
+				return
+			}
+			bw.reconnect(stop)
+		} else if bw.down {
+			bw.down = false
+			downtime.markUp()
+		}
+	}
+}
+
+// insertBatch generates --batch blocks and inserts them with stmt, using
+// args and blocks as buffers.
+func (bw *blockWriter) insertBatch(stmt string, args []interface{}, blocks []writtenBlock) ([]writtenBlock, error) {
+	args = args[:0]
+	for i := range blocks {
 		bw.blockCount++
-		if _, err := bw.db.Exec(insertBlockStmt, blockID, bw.id, bw.blockCount, blockData); err != nil {
-			errCh <- fmt.Errorf("error running blockwriter %s: %s", bw.id, err)
-		} else {
-			atomic.AddUint64(&numBlocks, 1)
+		data := bw.randomBlock()
+		blocks[i] = writtenBlock{bw.rand.Int63(), bw.id, bw.blockCount, crc32.ChecksumIEEE(data)}
+		args = append(args, blocks[i].blockID, bw.id, bw.blockCount, data)
+	}
+	if err := bw.insert(stmt, args); err != nil {
+		for _, b := range blocks {
+			bw.failed[b.blockNum] = true
+		}
+		return nil, err
+	}
+	return blocks, nil
+}
+
+// insert runs an insert statement, unless --chaos cuts the writer off from
+// its node.
+func (bw *blockWriter) insert(stmt string, args []interface{}) error {
+	if faults.Partitioned(bw.node) {
+		// Drop the pool, whose connections a partition would break.
+		if bw.db != nil {
+			_ = bw.db.Close()
+		}
+		return chaos.ErrPartitioned
+	}
+	faults.BeforeCommit()
+	_, err := bw.db.Exec(stmt, args...)
+	return err
+}
+
+// A writtenBlock identifies a block that was successfully inserted, along
+// with the checksum of its data.
+type writtenBlock struct {
+	blockID  int64
+	writerID string
+	blockNum uint64
+	checksum uint32
+}
+
+// A blockSample holds a bounded random sample of the blocks written so far,
+// for readers to read back.
+type blockSample struct {
+	sync.Mutex
+	blocks []writtenBlock
+	seen   int
+	rand   *rand.Rand
+}
+
+// add adds blocks to the sample, using reservoir sampling once the sample
+// is full.
+func (s *blockSample) add(blocks []writtenBlock) {
+	s.Lock()
+	defer s.Unlock()
+	for _, b := range blocks {
+		s.seen++
+		if len(s.blocks) < maxSampledBlocks {
+			s.blocks = append(s.blocks, b)
+		} else if i := s.rand.Intn(s.seen); i < maxSampledBlocks {
+			s.blocks[i] = b
+		}
+	}
+}
+
+// pick returns a random block of the sample, or false if it's empty.
+func (s *blockSample) pick() (writtenBlock, bool) {
+	s.Lock()
+	defer s.Unlock()
+	if len(s.blocks) == 0 {
+		return writtenBlock{}, false
+	}
+	return s.blocks[s.rand.Intn(len(s.blocks))], true
+}
+
+const maxSampledBlocks = 100000
+
+var written = blockSample{rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+
+// numReads keeps a global count of blocks read back, and numBadReads of
+// those that were missing or didn't match their checksum.
+var numReads uint64
+var numBadReads uint64
+
+// readBlocks reads back random blocks written earlier and verifies their
+// checksum, until stop is closed.
+func readBlocks(db *sql.DB, errCh chan<- error, stop <-chan struct{}, wg *sync.WaitGroup) {
+	defer wg.Done()
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		ok, err := readBlock(db)
+		if err != nil {
+			select {
+			case errCh <- err:
+			case <-stop:
+				return
+			}
+			continue
+		}
+		if !ok {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+// readBlock reads back a random block written earlier and verifies its
+// checksum. It returns false if no block was written yet.
+func readBlock(db *sql.DB) (bool, error) {
+	b, ok := written.pick()
+	if !ok {
+		return false, nil
+	}
+	var data []byte
+	err := db.QueryRow(`SELECT raw_bytes FROM blocks WHERE block_id = $1 AND writer_id = $2 AND block_num = $3`,
+		b.blockID, b.writerID, b.blockNum).Scan(&data)
+	switch {
+	case err == sql.ErrNoRows:
+		atomic.AddUint64(&numBadReads, 1)
+		log.Printf("block %d of writer %s is missing", b.blockNum, b.writerID)
+	case err != nil:
+		return true, fmt.Errorf("error reading block: %s", err)
+	case crc32.ChecksumIEEE(data) != b.checksum:
+		atomic.AddUint64(&numBadReads, 1)
+		log.Printf("block %d of writer %s doesn't match its checksum", b.blockNum, b.writerID)
+	}
+	atomic.AddUint64(&numReads, 1)
+	return true, nil
+}
+
+// verify checks that every block the writer successfully inserted is
+// present exactly once, that blocks whose insertion failed are present at
+// most once, and that no other blocks of the writer exist. It returns a
+// description of each problem found.
+func (bw *blockWriter) verify(db *sql.DB) ([]string, error) {
+	rows, err := db.Query(`SELECT block_num, COUNT(*) FROM blocks WHERE writer_id = $1 `+
+		`GROUP BY block_num ORDER BY block_num`, bw.id)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+	var problems []string
+	missing := func(from, to uint64) {
+		for num := from; num < to; num++ {
+			if !bw.failed[num] {
+				problems = append(problems, fmt.Sprintf("writer %s: block %d is missing", bw.id, num))
+			}
+		}
+	}
+	next := uint64(1)
+	for rows.Next() {
+		var num uint64
+		var count int
+		if err := rows.Scan(&num, &count); err != nil {
+			return nil, err
+		}
+		if num > bw.blockCount {
+			problems = append(problems, fmt.Sprintf("writer %s: block %d was never written", bw.id, num))
+			continue
+		}
+		missing(next, num)
+		if count > 1 {
+			problems = append(problems, fmt.Sprintf("writer %s: block %d is present %d times", bw.id, num, count))
+		}
+		next = num + 1
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	missing(next, bw.blockCount+1)
+	return problems, nil
+}
+
+// A downtimeTracker measures the time during which at least one writer is
+// failing to insert blocks.
+type downtimeTracker struct {
+	sync.Mutex
+	down  int
+	since time.Time
+	total time.Duration
+}
+
+func (d *downtimeTracker) markDown() {
+	d.Lock()
+	defer d.Unlock()
+	if d.down == 0 {
+		d.since = time.Now()
+	}
+	d.down++
+}
+
+func (d *downtimeTracker) markUp() {
+	d.Lock()
+	defer d.Unlock()
+	d.down--
+	if d.down == 0 {
+		d.total += time.Since(d.since)
+	}
+}
+
+// snapshot returns the number of writers currently down and the total
+// downtime so far.
+func (d *downtimeTracker) snapshot() (int, time.Duration) {
+	d.Lock()
+	defer d.Unlock()
+	total := d.total
+	if d.down > 0 {
+		total += time.Since(d.since)
+	}
+	return d.down, total
+}
+
+var downtime downtimeTracker
+
+// insertStmt returns a statement inserting n blocks.
+func insertStmt(n int) string {
+	var buf bytes.Buffer
+	buf.WriteString(insertBlockStmt)
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			buf.WriteString(", ")
 		}
+		j := 4 * i
+		fmt.Fprintf(&buf, "($%d, $%d, $%d, $%d)", j+1, j+2, j+3, j+4)
 	}
+	return buf.String()
 }
 
-// randomBlock generates a slice of randomized bytes. Random data is preferred
-// to prevent compression in storage.
+// randomBlock generates a slice of randomized bytes. Block sizes are
+// uniformly distributed between --min-block-bytes and --max-block-bytes,
+// inclusive. By default, the data is entirely random to prevent compression
+// in storage; with --compressibility, the tail of the block is made of a
+// repeated byte instead, so that the block compresses to roughly
+// 1-compressibility of its size.
 func (bw blockWriter) randomBlock() []byte {
-	blockSize := bw.rand.Intn(*maxBlockSizeBytes-*minBlockSizeBytes) + *minBlockSizeBytes
+	blockSize := bw.rand.Intn(*maxBlockSizeBytes-*minBlockSizeBytes+1) + *minBlockSizeBytes
 	blockData := make([]byte, blockSize)
+	randomBytes := int(float64(blockSize) * (1 - *compressibility))
 	for i := range blockData {
-		blockData[i] = byte(bw.rand.Int() & 0xff)
+		if i < randomBytes {
+			blockData[i] = byte(bw.rand.Int() & 0xff)
+		} else {
+			blockData[i] = 'x'
+		}
 	}
 	return blockData
 }
 
 // setupDatabase performs initial setup for the example, creating a database and
-// with a single table. If the desired table already exists on the cluster, the
-// existing table will be dropped.
+// with a single table.
 func setupDatabase(dbURL string) (*sql.DB, error) {
-	parsedURL, err := url.Parse(dbURL)
-	if err != nil {
-		return nil, err
-	}
-	parsedURL.Path = "datablocks"
-
 	// Open connection to server and create a database.
-	db, err := sql.Open("postgres", parsedURL.String())
+	db, err := dbdriver.Open(*driver, dbURL)
 	if err != nil {
 		return nil, err
 	}
@@ -118,8 +500,9 @@ func setupDatabase(dbURL string) (*sql.DB, error) {
 		return nil, err
 	}
 
-	// Allow a maximum of concurrency+1 connections to the database.
-	db.SetMaxOpenConns(*concurrency + 1)
+	// Writers use their own connections, this one is only used for setup
+	// and verification.
+	db.SetMaxOpenConns(1)
 
 	// Create the initial table for storing blocks.
 	if _, err := db.Exec(`
@@ -136,64 +519,214 @@ func setupDatabase(dbURL string) (*sql.DB, error) {
 	return db, nil
 }
 
+// A writerList holds the writers started so far, which grows when the
+// concurrency is raised through the control API.
+type writerList struct {
+	sync.Mutex
+	writers []*blockWriter
+}
+
+func (l *writerList) add(bw *blockWriter) {
+	l.Lock()
+	defer l.Unlock()
+	l.writers = append(l.writers, bw)
+}
+
+// snapshot returns the writers started so far.
+func (l *writerList) snapshot() []*blockWriter {
+	l.Lock()
+	defer l.Unlock()
+	return append([]*blockWriter(nil), l.writers...)
+}
+
+// numErrors returns the number of failed insertions of the writers.
+func (l *writerList) numErrors() uint64 {
+	var n uint64
+	for _, bw := range l.snapshot() {
+		n += atomic.LoadUint64(&bw.errors)
+	}
+	return n
+}
+
 var usage = func() {
 	fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
-	fmt.Fprintf(os.Stderr, "  %s <db URL>\n\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s [<db URL> ...]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s --coordinate=<addr>,... <command>\n\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "%s\n", control.Usage)
 	flag.PrintDefaults()
 }
 
 func main() {
 	flag.Usage = usage
 	flag.Parse()
+	control.Coordinate(flag.Args())
 
-	dbURL := "postgresql://root@localhost:26257/photos?sslmode=disable"
-	if flag.NArg() == 1 {
-		dbURL = flag.Arg(0)
+	// Writers are spread over the given nodes.
+	dbURLs := flag.Args()
+	if len(dbURLs) == 0 {
+		dbURL, err := dbdriver.URL("", "postgresql://root@localhost:26257/photos?sslmode=disable")
+		if err != nil {
+			log.Fatal(err)
+		}
+		dbURLs = []string{dbURL}
 	}
+	dbURLs, err := dbdriver.SplitHosts(dbURLs...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	nodes := make([]string, len(dbURLs))
+	for i, dbURL := range dbURLs {
+		parsedURL, err := url.Parse(dbURL)
+		if err != nil {
+			log.Fatal(err)
+		}
+		parsedURL.Path = "datablocks"
+		dbURLs[i] = parsedURL.String()
+		nodes[i] = parsedURL.Host
+	}
+	dbURL := dbURLs[0]
 
 	if *concurrency < 1 {
 		log.Fatalf("Value of 'concurrency' flag (%d) must be greater than or equal to 1", *concurrency)
 	}
 
+	if *minBlockSizeBytes < 0 {
+		log.Fatalf("Value of 'min-block-bytes' flag (%d) must be greater than or equal to 0", *minBlockSizeBytes)
+	}
+
 	if max, min := *maxBlockSizeBytes, *minBlockSizeBytes; max < min {
 		log.Fatalf("Value of 'max-block-bytes' (%d) must be greater than or equal to value of 'min-block-bytes' (%d)", max, min)
 	}
 
+	if *batch < 1 {
+		log.Fatalf("Value of 'batch' flag (%d) must be greater than or equal to 1", *batch)
+	}
+
+	if *compressibility < 0 || *compressibility > 1 {
+		log.Fatalf("Value of 'compressibility' flag (%f) must be between 0 and 1", *compressibility)
+	}
+
+	if err := validateIngest(); err != nil {
+		log.Fatal(err)
+	}
+
 	var db *sql.DB
-	{
-		var err error
-		for err == nil || *tolerateErrors {
-			db, err = setupDatabase(dbURL)
-			if err == nil {
-				break
-			}
-			if !*tolerateErrors {
-				log.Fatal(err)
-			}
+	for {
+		db, err = setupDatabase(dbURL)
+		if err == nil {
+			break
 		}
+		if !*tolerateErrors {
+			log.Fatal(err)
+		}
+		log.Print(err)
+		time.Sleep(time.Second)
 	}
 
 	lastNow := time.Now()
 	start := lastNow
-	var lastNumDumps uint64
-	writers := make([]blockWriter, *concurrency)
+	var lastNumDumps, lastNumTxns, lastNumReads uint64
+	var writers writerList
 
 	errCh := make(chan error)
-	for i := range writers {
-		writers[i] = newBlockWriter(db)
-		go writers[i].run(errCh)
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	var ctl *control.Controller
+	spawn := func(i int) {
+		j := i % len(dbURLs)
+		bw, err := newBlockWriter(dbURLs[j], nodes[j])
+		if err != nil {
+			if !*tolerateErrors {
+				log.Fatal(err)
+			}
+			log.Print(err)
+		}
+		writers.add(bw)
+		wg.Add(1)
+		go bw.run(ctl, i, errCh, stop, &wg)
+	}
+	if faults, err = chaos.New(func() (uint64, uint64) {
+		return atomic.LoadUint64(&numTxns), writers.numErrors()
+	}); err != nil {
+		log.Fatal(err)
+	}
+	ctl = control.New(*concurrency, spawn, func() (uint64, uint64) {
+		return atomic.LoadUint64(&numTxns) + atomic.LoadUint64(&numReads), writers.numErrors()
+	})
+	if err := ctl.SetReadPercent(*readPercent); err != nil {
+		log.Fatal(err)
+	}
+	for i := 0; i < *concurrency; i++ {
+		spawn(i)
+	}
+	if *numReaders > 0 {
+		readDB, err := dbdriver.Open(*driver, dbURL)
+		if err != nil {
+			log.Fatal(err)
+		}
+		readDB.SetMaxOpenConns(*numReaders)
+		for i := 0; i < *numReaders; i++ {
+			wg.Add(1)
+			go readBlocks(readDB, errCh, stop, &wg)
+		}
 	}
 
+	if *metricsAddr != "" {
+		serveMetrics(*metricsAddr, &writers, ctl, start)
+	}
+	if err := control.Serve(ctl); err != nil {
+		log.Fatal(err)
+	}
+	if err := control.ServeREST(ctl); err != nil {
+		log.Fatal(err)
+	}
+	control.Adapt(ctl)
+	control.HandleSignals(ctl)
+
+	var done <-chan time.Time
+	if *duration > 0 {
+		done = time.After(*duration)
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
 	var numErr int
-	for range time.Tick(*outputInterval) {
+	ticker := time.NewTicker(*outputInterval)
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+			continue
+		case <-signals:
+			running = false
+			continue
+		case <-ticker.C:
+		}
+		// Mark the changes of the concurrency, so that a run sweeping a
+		// range of concurrencies can be split at them.
+		for _, ch := range ctl.Changes() {
+			fmt.Printf("%6s: ----- %s -----\n", time.Duration(ch.Elapsed.Seconds()+0.5)*time.Second, ch)
+		}
 		now := time.Now()
 		elapsed := time.Since(lastNow)
 		dumps := atomic.LoadUint64(&numBlocks)
-		fmt.Printf("%6s: %6.1f/sec",
+		txns := atomic.LoadUint64(&numTxns)
+		fmt.Printf("%6s: %6.1f rows/sec, %6.1f txns/sec",
 			time.Duration(time.Since(start).Seconds()+0.5)*time.Second,
-			float64(dumps-lastNumDumps)/elapsed.Seconds())
+			float64(dumps-lastNumDumps)/elapsed.Seconds(),
+			float64(txns-lastNumTxns)/elapsed.Seconds())
+		reads := atomic.LoadUint64(&numReads)
+		if *numReaders > 0 || ctl.ReadPercent() > 0 {
+			fmt.Printf(", %6.1f reads/sec", float64(reads-lastNumReads)/elapsed.Seconds())
+			if bad := atomic.LoadUint64(&numBadReads); bad > 0 {
+				fmt.Printf(" (%d bad reads)", bad)
+			}
+		}
 		if numErr > 0 {
-			fmt.Printf(" (%d total errors)\n", numErr)
+			fmt.Printf(" (%d total errors)", numErr)
+		}
+		if down, total := downtime.snapshot(); total > 0 {
+			fmt.Printf(" (%d writers down, %s total downtime)", down, total)
 		}
 		fmt.Printf("\n")
 		for {
@@ -211,6 +744,42 @@ func main() {
 			break
 		}
 		lastNumDumps = dumps
+		lastNumTxns = txns
+		lastNumReads = reads
 		lastNow = now
 	}
+	ticker.Stop()
+	ctl.Close()
+	close(stop)
+	wg.Wait()
+
+	if _, total := downtime.snapshot(); total > 0 {
+		log.Printf("writers were down for %s in total", total)
+	}
+	if n := ctl.Stats().Sustainable; n > 0 {
+		log.Printf("sustainable concurrency under --target-p99: %d writers", n)
+	}
+
+	numProblems := int(atomic.LoadUint64(&numBadReads))
+	if numProblems > 0 {
+		log.Printf("readers found %d missing or corrupted blocks", numProblems)
+	}
+	if *verify {
+		for _, bw := range writers.snapshot() {
+			problems, err := bw.verify(db)
+			if err != nil {
+				log.Fatal(err)
+			}
+			for _, p := range problems {
+				log.Print(p)
+			}
+			numProblems += len(problems)
+		}
+	}
+	if numProblems > 0 {
+		log.Fatalf("found %d problems", numProblems)
+	}
+	if *verify {
+		log.Printf("verified the blocks of %d writers", len(writers.snapshot()))
+	}
 }
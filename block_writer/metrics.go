@@ -0,0 +1,183 @@
+// Copyright 2016 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/cockroachdb/examples-go/control"
+)
+
+// latencyBuckets are the upper bounds, in seconds, of the buckets of the
+// insert latency histogram.
+var latencyBuckets = []float64{
+	0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10,
+}
+
+// A latencyHistogram counts latencies in the buckets exported to
+// Prometheus. It is safe for concurrent use.
+type latencyHistogram struct {
+	// They are accessed atomically, and come first to be 64-bit aligned.
+	count    uint64
+	sumNanos uint64
+	// counts[i] is the number of latencies in bucket i, the last one being
+	// for latencies above the last bound.
+	counts []uint64
+}
+
+func newLatencyHistogram() *latencyHistogram {
+	return &latencyHistogram{counts: make([]uint64, len(latencyBuckets)+1)}
+}
+
+func (h *latencyHistogram) record(d time.Duration) {
+	i := sort.SearchFloat64s(latencyBuckets, d.Seconds())
+	atomic.AddUint64(&h.counts[i], 1)
+	atomic.AddUint64(&h.count, 1)
+	atomic.AddUint64(&h.sumNanos, uint64(d))
+}
+
+// write writes the histogram in the Prometheus text format.
+func (h *latencyHistogram) write(w io.Writer, name, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	var cumulative uint64
+	for i, bound := range latencyBuckets {
+		cumulative += atomic.LoadUint64(&h.counts[i])
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", name, strconv.FormatFloat(bound, 'g', -1, 64), cumulative)
+	}
+	cumulative += atomic.LoadUint64(&h.counts[len(latencyBuckets)])
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, cumulative)
+	fmt.Fprintf(w, "%s_sum %g\n", name, time.Duration(atomic.LoadUint64(&h.sumNanos)).Seconds())
+	fmt.Fprintf(w, "%s_count %d\n", name, atomic.LoadUint64(&h.count))
+}
+
+// insertLatency measures the latency of successful insertions.
+var insertLatency = newLatencyHistogram()
+
+// nodeCounts holds the counters of the writers connected to a node.
+type nodeCounts struct {
+	Writers int    `json:"writers"`
+	Rows    uint64 `json:"rows"`
+	Errors  uint64 `json:"errors"`
+}
+
+// countByNode aggregates the counters of the writers by the node they are
+// connected to.
+func countByNode(writers []*blockWriter) map[string]*nodeCounts {
+	nodes := make(map[string]*nodeCounts)
+	for _, bw := range writers {
+		c, ok := nodes[bw.node]
+		if !ok {
+			c = &nodeCounts{}
+			nodes[bw.node] = c
+		}
+		c.Writers++
+		c.Rows += atomic.LoadUint64(&bw.rows)
+		c.Errors += atomic.LoadUint64(&bw.errors)
+	}
+	return nodes
+}
+
+func writeCounter(w io.Writer, name, help string, value interface{}) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %v\n", name, help, name, name, value)
+}
+
+func writeGauge(w io.Writer, name, help string, value interface{}) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %v\n", name, help, name, name, value)
+}
+
+// writeMetrics writes the metrics of the run in the Prometheus text format.
+func writeMetrics(w io.Writer, writers []*blockWriter) {
+	nodes := countByNode(writers)
+	names := make([]string, 0, len(nodes))
+	for node := range nodes {
+		names = append(names, node)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintf(w, "# HELP block_writer_rows_total Number of blocks inserted.\n")
+	fmt.Fprintf(w, "# TYPE block_writer_rows_total counter\n")
+	for _, node := range names {
+		fmt.Fprintf(w, "block_writer_rows_total{node=%q} %d\n", node, nodes[node].Rows)
+	}
+	fmt.Fprintf(w, "# HELP block_writer_errors_total Number of failed insertions.\n")
+	fmt.Fprintf(w, "# TYPE block_writer_errors_total counter\n")
+	for _, node := range names {
+		fmt.Fprintf(w, "block_writer_errors_total{node=%q} %d\n", node, nodes[node].Errors)
+	}
+	writeCounter(w, "block_writer_txns_total", "Number of successful insert statements.",
+		atomic.LoadUint64(&numTxns))
+	writeCounter(w, "block_writer_reads_total", "Number of blocks read back.",
+		atomic.LoadUint64(&numReads))
+	writeCounter(w, "block_writer_bad_reads_total", "Number of blocks read back missing or corrupted.",
+		atomic.LoadUint64(&numBadReads))
+	down, total := downtime.snapshot()
+	writeGauge(w, "block_writer_writers_down", "Number of writers currently failing.", down)
+	writeCounter(w, "block_writer_downtime_seconds_total",
+		"Time during which at least one writer was failing.", total.Seconds())
+	insertLatency.write(w, "block_writer_insert_latency_seconds", "Latency of successful insert statements.")
+}
+
+// runStatus is the live status of the run served on /status.
+type runStatus struct {
+	Uptime      string                 `json:"uptime"`
+	Rows        uint64                 `json:"rows"`
+	Txns        uint64                 `json:"txns"`
+	Reads       uint64                 `json:"reads"`
+	BadReads    uint64                 `json:"badReads"`
+	WritersDown int                    `json:"writersDown"`
+	Downtime    string                 `json:"downtime"`
+	Nodes       map[string]*nodeCounts `json:"nodes"`
+}
+
+// serveMetrics serves Prometheus metrics on /metrics, the live status of
+// the run on /status, and the control endpoints of ctl under /control.
+func serveMetrics(addr string, writers *writerList, ctl *control.Controller, start time.Time) {
+	mux := http.NewServeMux()
+	control.Register(mux, ctl)
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writeMetrics(w, writers.snapshot())
+	})
+	mux.HandleFunc("/status", func(w http.ResponseWriter, _ *http.Request) {
+		down, total := downtime.snapshot()
+		status := runStatus{
+			Uptime:      time.Since(start).String(),
+			Rows:        atomic.LoadUint64(&numBlocks),
+			Txns:        atomic.LoadUint64(&numTxns),
+			Reads:       atomic.LoadUint64(&numReads),
+			BadReads:    atomic.LoadUint64(&numBadReads),
+			WritersDown: down,
+			Downtime:    total.String(),
+			Nodes:       countByNode(writers.snapshot()),
+		}
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		if err := enc.Encode(status); err != nil {
+			log.Print(err)
+		}
+	})
+	go func() {
+		log.Fatal(http.ListenAndServe(addr, mux))
+	}()
+}
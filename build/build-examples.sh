@@ -6,7 +6,7 @@
 set -eux
 
 time make deps
-for proj in bank ledger block_writer fakerealtime filesystem photos; do
+for proj in bank ledger block_writer fakerealtime filesystem photos leaderboard shortener feed geo pagination lease outbox auditlog inventory ratelimit analytics blobs counter ingest graph tenants backup; do
   time make STATIC=1 ${proj}
   strip -S ${proj}/${proj}
 done
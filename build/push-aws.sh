@@ -39,6 +39,6 @@ function push_one_binary {
   rm -f ${tmpfile}
 }
 
-for proj in bank ledger block_writer fakerealtime filesystem photos; do
+for proj in bank ledger block_writer fakerealtime filesystem photos leaderboard shortener feed geo pagination lease outbox auditlog inventory ratelimit analytics blobs counter ingest graph tenants backup; do
   push_one_binary ${proj}/${proj}
 done
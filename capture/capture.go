@@ -0,0 +1,172 @@
+// Copyright 2016 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+// Package capture records the operations generated by the examples, along
+// with the times they were generated at, and replays them later, scaled in
+// time, so that two clusters or versions can be compared under the exact
+// same workload. An example defines its operations as JSON-encodable values:
+// with --record, it passes each one to a Recorder, and with --replay, it
+// issues the ones decoded by Replay instead of generating new ones. The bank,
+// ledger and fakerealtime examples use it.
+package capture
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+var recordFile = flag.String("record", "", "If set, file to record the generated operations to, "+
+	"along with the times they were generated at, for --replay.")
+var replayFile = flag.String("replay", "", "If set, file of operations recorded with --record to "+
+	"issue again instead of generating new ones, exiting once done.")
+var replaySpeed = flag.Float64("replay-speed", 1, "Speed multiplier of --replay, relative to the recorded "+
+	"times of the operations, e.g. 0.5 for half speed or 10 for ten times faster. If 0, the operations "+
+	"are issued as fast as they are taken.")
+
+// Check checks the flags of the package.
+func Check() error {
+	if *recordFile != "" && *replayFile != "" {
+		return errors.New("--record and --replay can't be combined")
+	}
+	if *replaySpeed < 0 {
+		return errors.New("--replay-speed can't be negative")
+	}
+	return nil
+}
+
+// An entry is a line of a recording.
+type entry struct {
+	Offset time.Duration   `json:"offset"`
+	Op     json.RawMessage `json:"op"`
+}
+
+// A Recorder writes operations to a recording. It is safe for concurrent
+// use, and a nil Recorder records nothing.
+type Recorder struct {
+	mu     sync.Mutex
+	f      *os.File
+	w      *bufio.Writer
+	enc    *json.Encoder
+	start  time.Time
+	closed bool
+}
+
+// NewRecorder returns a recorder to --record, or nil if it isn't set.
+func NewRecorder() (*Recorder, error) {
+	if *recordFile == "" {
+		return nil, nil
+	}
+	return Create(*recordFile)
+}
+
+// Create returns a recorder to the file at path, whose times start now.
+func Create(path string) (*Recorder, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	w := bufio.NewWriter(f)
+	return &Recorder{f: f, w: w, enc: json.NewEncoder(w), start: time.Now()}, nil
+}
+
+// Record records op. Operations recorded once the recorder is closed, by
+// workers still running, are dropped.
+func (r *Recorder) Record(op interface{}) error {
+	if r == nil {
+		return nil
+	}
+	raw, err := json.Marshal(op)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return nil
+	}
+	return r.enc.Encode(entry{Offset: time.Since(r.start), Op: raw})
+}
+
+// Close flushes the recording and closes its file.
+func (r *Recorder) Close() error {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	if err := r.w.Flush(); err != nil {
+		_ = r.f.Close()
+		return err
+	}
+	return r.f.Close()
+}
+
+// Path returns the path of the file of --record.
+func Path() string {
+	return *recordFile
+}
+
+// Replaying returns whether --replay is set.
+func Replaying() bool {
+	return *replayFile != ""
+}
+
+// Replay issues the operations recorded in --replay at their recorded
+// times scaled by --replay-speed. It returns the number of operations
+// issued.
+func Replay(issue func(op json.RawMessage) error) (int, error) {
+	f, err := os.Open(*replayFile)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = f.Close() }()
+	return ReplayFrom(f, *replaySpeed, issue)
+}
+
+// ReplayFrom calls issue with each operation recorded in r, at its
+// recorded time sped up by speed, or right after the previous one returns
+// if speed is 0. It returns the number of operations issued, stopping at
+// the first error.
+func ReplayFrom(r io.Reader, speed float64, issue func(op json.RawMessage) error) (int, error) {
+	dec := json.NewDecoder(bufio.NewReader(r))
+	start := time.Now()
+	var n int
+	for {
+		var e entry
+		if err := dec.Decode(&e); err == io.EOF {
+			return n, nil
+		} else if err != nil {
+			return n, err
+		}
+		if speed > 0 {
+			at := start.Add(time.Duration(float64(e.Offset) / speed))
+			time.Sleep(at.Sub(time.Now()))
+		}
+		if err := issue(e.Op); err != nil {
+			return n, err
+		}
+		n++
+	}
+}
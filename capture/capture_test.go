@@ -0,0 +1,118 @@
+// Copyright 2016 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package capture
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type testOp struct {
+	Key   string `json:"key"`
+	Value int    `json:"value"`
+}
+
+func TestRecordReplay(t *testing.T) {
+	f, err := ioutil.TempFile("", "capture")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.Remove(f.Name()) }()
+	_ = f.Close()
+
+	rec, err := Create(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorded := []testOp{{"a", 1}, {"b", 2}, {"c", 3}}
+	for _, op := range recorded {
+		if err := rec.Record(op); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := rec.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Operations recorded once closed are dropped.
+	if err := rec.Record(testOp{"d", 4}); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := os.Open(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = r.Close() }()
+	var replayed []testOp
+	n, err := ReplayFrom(r, 0, func(raw json.RawMessage) error {
+		var op testOp
+		if err := json.Unmarshal(raw, &op); err != nil {
+			return err
+		}
+		replayed = append(replayed, op)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(recorded) || !reflect.DeepEqual(replayed, recorded) {
+		t.Errorf("expected %v, got %d ops %v", recorded, n, replayed)
+	}
+}
+
+func TestReplaySpeed(t *testing.T) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, offset := range []time.Duration{0, 100 * time.Millisecond} {
+		if err := enc.Encode(entry{Offset: offset, Op: json.RawMessage(`{}`)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	issue := func(json.RawMessage) error { return nil }
+
+	// At ten times the recorded speed, the second operation is issued
+	// after 10ms rather than 100ms.
+	start := time.Now()
+	if _, err := ReplayFrom(bytes.NewReader(buf.Bytes()), 10, issue); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 10*time.Millisecond || elapsed >= 100*time.Millisecond {
+		t.Errorf("expected the replay at 10x to take about 10ms, took %s", elapsed)
+	}
+
+	// An error of issue stops the replay.
+	errStop := errors.New("stop")
+	n, err := ReplayFrom(bytes.NewReader(buf.Bytes()), 0, func(json.RawMessage) error { return errStop })
+	if err != errStop || n != 0 {
+		t.Errorf("expected the replay to stop at the first op, got %d ops and error %v", n, err)
+	}
+}
+
+func TestNilRecorder(t *testing.T) {
+	var rec *Recorder
+	if err := rec.Record(testOp{"a", 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := rec.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,224 @@
+// Copyright 2016 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+// Package chaos injects faults from the client side on a schedule: it cuts
+// the examples off from selected nodes, as in a network partition, and
+// delays their commits. It records the timeline of the faults along with
+// the throughput of the example, so their impact on clients can be graphed.
+package chaos
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+var schedule = flag.String("chaos", "",
+	"Comma-separated faults to inject, each as <fault>@<start>+<duration>, the start being relative to the "+
+		"start of the run. The faults are partition=<host:port>, cutting the example off from a node, "+
+		"and latency=<duration>, delaying each commit. E.g. partition=node2:26257@30s+1m,latency=200ms@2m+30s")
+var timelineFile = flag.String("chaos-timeline", "",
+	"If set, CSV file to record the active faults and the throughput to, every second")
+
+// A fault is a fault of the schedule.
+type fault struct {
+	// node is the host:port of the node of a partition, and latency the
+	// delay of a latency fault.
+	node     string
+	latency  time.Duration
+	start    time.Duration
+	duration time.Duration
+}
+
+func (f fault) String() string {
+	if f.node != "" {
+		return "partition=" + f.node
+	}
+	return "latency=" + f.latency.String()
+}
+
+// parseSchedule parses the faults of --chaos.
+func parseSchedule(s string) ([]fault, error) {
+	var faults []fault
+	for _, spec := range strings.Split(s, ",") {
+		at := strings.LastIndex(spec, "@")
+		plus := strings.LastIndex(spec, "+")
+		if at < 0 || plus < at {
+			return nil, fmt.Errorf("fault %q isn't of the form <fault>@<start>+<duration>", spec)
+		}
+		var f fault
+		var err error
+		if f.start, err = time.ParseDuration(spec[at+1 : plus]); err != nil {
+			return nil, fmt.Errorf("fault %q: %s", spec, err)
+		}
+		if f.duration, err = time.ParseDuration(spec[plus+1:]); err != nil {
+			return nil, fmt.Errorf("fault %q: %s", spec, err)
+		}
+		kind := spec[:at]
+		switch {
+		case strings.HasPrefix(kind, "partition="):
+			f.node = strings.TrimPrefix(kind, "partition=")
+			if f.node == "" {
+				return nil, fmt.Errorf("fault %q: no node to partition", spec)
+			}
+		case strings.HasPrefix(kind, "latency="):
+			if f.latency, err = time.ParseDuration(strings.TrimPrefix(kind, "latency=")); err != nil {
+				return nil, fmt.Errorf("fault %q: %s", spec, err)
+			}
+		default:
+			return nil, fmt.Errorf("fault %q: unknown fault %q, expected partition or latency", spec, kind)
+		}
+		if f.start < 0 || f.duration <= 0 || f.latency < 0 {
+			return nil, fmt.Errorf("fault %q: durations must be positive", spec)
+		}
+		faults = append(faults, f)
+	}
+	return faults, nil
+}
+
+// An Injector injects the faults of --chaos. A nil Injector injects none.
+type Injector struct {
+	faults []fault
+	start  time.Time
+}
+
+// New returns the injector of the faults of --chaos, whose schedule starts
+// right away, or nil if --chaos isn't set. counters returns the number of
+// operations done and failed so far, recorded to --chaos-timeline along
+// with the active faults.
+func New(counters func() (ops, errors uint64)) (*Injector, error) {
+	if *schedule == "" {
+		if *timelineFile != "" {
+			return nil, errors.New("--chaos-timeline requires --chaos")
+		}
+		return nil, nil
+	}
+	faults, err := parseSchedule(*schedule)
+	if err != nil {
+		return nil, err
+	}
+	inj := &Injector{faults: faults, start: time.Now()}
+	var timeline *os.File
+	if *timelineFile != "" {
+		if timeline, err = os.Create(*timelineFile); err != nil {
+			return nil, err
+		}
+	}
+	go inj.record(timeline, counters)
+	return inj, nil
+}
+
+// active returns the faults active at elapsed since the start of the run.
+func (inj *Injector) active(elapsed time.Duration) []fault {
+	var active []fault
+	for _, f := range inj.faults {
+		if elapsed >= f.start && elapsed < f.start+f.duration {
+			active = append(active, f)
+		}
+	}
+	return active
+}
+
+// Partitioned returns whether the example is cut off from node, given as
+// host:port.
+func (inj *Injector) Partitioned(node string) bool {
+	if inj == nil {
+		return false
+	}
+	for _, f := range inj.active(time.Since(inj.start)) {
+		if f.node == node {
+			return true
+		}
+	}
+	return false
+}
+
+// ErrPartitioned is returned when connecting to a node the example is cut
+// off from.
+var ErrPartitioned = errors.New("partitioned from the node by --chaos")
+
+// partitionTimeout is how long Reach takes to fail, as connecting to an
+// unreachable node only fails after a timeout.
+const partitionTimeout = time.Second
+
+// Reach returns ErrPartitioned after partitionTimeout if the example is cut
+// off from node, and nil otherwise. The examples sharing one pool of
+// connections, which they can't drop, call it before each operation.
+func (inj *Injector) Reach(node string) error {
+	if !inj.Partitioned(node) {
+		return nil
+	}
+	time.Sleep(partitionTimeout)
+	return ErrPartitioned
+}
+
+// BeforeCommit sleeps for the latency injected before commits, if any.
+func (inj *Injector) BeforeCommit() {
+	if inj == nil {
+		return
+	}
+	var latency time.Duration
+	for _, f := range inj.active(time.Since(inj.start)) {
+		latency += f.latency
+	}
+	if latency > 0 {
+		time.Sleep(latency)
+	}
+}
+
+// record logs the faults as they start and end and, if timeline is set,
+// writes the active faults and the throughput to it every second.
+func (inj *Injector) record(timeline *os.File, counters func() (uint64, uint64)) {
+	var w *bufio.Writer
+	if timeline != nil {
+		w = bufio.NewWriter(timeline)
+		fmt.Fprintln(w, "elapsed,ops_per_sec,errors_per_sec,faults")
+	}
+	var last string
+	var lastOps, lastErrors uint64
+	lastNow := inj.start
+	for now := range time.Tick(time.Second) {
+		elapsed := now.Sub(inj.start)
+		var names []string
+		for _, f := range inj.active(elapsed) {
+			names = append(names, f.String())
+		}
+		if active := strings.Join(names, " "); active != last {
+			if active == "" {
+				log.Printf("chaos: no fault")
+			} else {
+				log.Printf("chaos: %s", active)
+			}
+			last = active
+		}
+		if w == nil {
+			continue
+		}
+		ops, errs := counters()
+		secs := now.Sub(lastNow).Seconds()
+		fmt.Fprintf(w, "%.0f,%.1f,%.1f,%s\n", elapsed.Seconds(),
+			float64(ops-lastOps)/secs, float64(errs-lastErrors)/secs, last)
+		// Flushing every second keeps the timeline readable while running.
+		if err := w.Flush(); err != nil {
+			log.Printf("chaos: %s", err)
+		}
+		lastOps, lastErrors, lastNow = ops, errs, now
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright 2016 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package chaos
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseSchedule(t *testing.T) {
+	faults, err := parseSchedule("partition=node2:26257@30s+1m,latency=200ms@1m+1m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []fault{
+		{node: "node2:26257", start: 30 * time.Second, duration: time.Minute},
+		{latency: 200 * time.Millisecond, start: time.Minute, duration: time.Minute},
+	}
+	if !reflect.DeepEqual(faults, expected) {
+		t.Fatalf("expected %v, got %v", expected, faults)
+	}
+
+	inj := &Injector{faults: faults}
+	testCases := []struct {
+		elapsed time.Duration
+		active  []fault
+	}{
+		{10 * time.Second, nil},
+		{45 * time.Second, faults[:1]},
+		{75 * time.Second, faults},
+		{100 * time.Second, faults[1:]},
+		{2 * time.Minute, nil},
+	}
+	for _, c := range testCases {
+		if active := inj.active(c.elapsed); !reflect.DeepEqual(active, c.active) {
+			t.Errorf("%s: expected %v, got %v", c.elapsed, c.active, active)
+		}
+	}
+
+	for _, s := range []string{
+		"partition=node2:26257", "partition=@1s+1s", "latency=fast@1s+1s", "drop=node2@1s+1s", "latency=1ms@1s+0s",
+	} {
+		if _, err := parseSchedule(s); err == nil {
+			t.Errorf("%q: expected an error", s)
+		}
+	}
+}
+
+func TestNilInjector(t *testing.T) {
+	var inj *Injector
+	if inj.Partitioned("node1:26257") {
+		t.Error("expected no partition")
+	}
+	if err := inj.Reach("node1:26257"); err != nil {
+		t.Error(err)
+	}
+	inj.BeforeCommit()
+}
@@ -0,0 +1,121 @@
+// Copyright 2016 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package control
+
+import (
+	"flag"
+	"log"
+	"sort"
+	"time"
+)
+
+var targetP99 = flag.Duration("target-p99", 0,
+	"If set, adjust the concurrency to keep the p99 latency of the operations under this target: "+
+		"raise it by one worker after every interval meeting the target, and halve it otherwise")
+var adaptInterval = flag.Duration("adapt-interval", 10*time.Second,
+	"Interval over which --target-p99 measures the p99 latency between adjustments")
+
+// minSamples is the number of latencies an interval needs for its p99 to
+// be trusted. Intervals with fewer leave the concurrency as it is.
+const minSamples = 100
+
+type durations []time.Duration
+
+func (d durations) Len() int           { return len(d) }
+func (d durations) Less(i, j int) bool { return d[i] < d[j] }
+func (d durations) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+
+// p99 returns the 99th percentile of latencies, which it sorts.
+func p99(latencies []time.Duration) time.Duration {
+	if len(latencies) == 0 {
+		return 0
+	}
+	sort.Sort(durations(latencies))
+	return latencies[(len(latencies)*99-1)/100]
+}
+
+// aimd returns the concurrency following an interval at concurrency whose
+// p99 latency was p: one more worker if it met target, half as many
+// otherwise.
+func aimd(concurrency int, p, target time.Duration) int {
+	if p <= target {
+		return concurrency + 1
+	}
+	if concurrency /= 2; concurrency < 1 {
+		return 1
+	}
+	return concurrency
+}
+
+// Record records the latency of an operation, for --target-p99. It does
+// nothing unless Adapt is adjusting the concurrency of c.
+func (c *Controller) Record(latency time.Duration) {
+	c.latencyMu.Lock()
+	if c.adapting {
+		c.latencies = append(c.latencies, latency)
+	}
+	c.latencyMu.Unlock()
+}
+
+// Adapt starts adjusting the concurrency of c to keep the p99 latency of
+// the operations recorded with Record under --target-p99, if set. The
+// highest concurrency found to meet the target is reported by Stats.
+func Adapt(c *Controller) {
+	if *targetP99 <= 0 {
+		return
+	}
+	c.latencyMu.Lock()
+	c.adapting = true
+	c.latencyMu.Unlock()
+	go c.adapt(*targetP99, *adaptInterval)
+}
+
+func (c *Controller) adapt(target, interval time.Duration) {
+	for range time.Tick(interval) {
+		c.latencyMu.Lock()
+		latencies := c.latencies
+		c.latencies = nil
+		c.latencyMu.Unlock()
+
+		c.mu.Lock()
+		concurrency, paused, closed := c.concurrency, c.paused, c.closed
+		c.mu.Unlock()
+		if closed {
+			return
+		}
+		if paused || len(latencies) < minSamples {
+			continue
+		}
+
+		p := p99(latencies)
+		next := aimd(concurrency, p, target)
+		c.mu.Lock()
+		// The sustainable concurrency is the highest one that met the
+		// target, lowered whenever a concurrency at or below it misses.
+		if p <= target && concurrency > c.sustainable {
+			c.sustainable = concurrency
+		} else if p > target && concurrency <= c.sustainable {
+			c.sustainable = concurrency - 1
+		}
+		sustainable := c.sustainable
+		c.mu.Unlock()
+		log.Printf("adapt: p99 %s over %d ops at concurrency %d, setting it to %d (sustainable: %d)",
+			p, len(latencies), concurrency, next, sustainable)
+		if err := c.SetConcurrency(next); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,280 @@
+// Copyright 2016 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+// Package control lets the load generated by the examples (block_writer,
+// bank, ledger and fakerealtime) be changed while they run: their rate,
+// concurrency and read percentage can be set, and they can be paused and
+// resumed. The settings are changed through REST endpoints, on the metrics
+// port of an example or on --control-http-addr, or over gRPC. Running the
+// same example on many machines, a coordinator sends commands to all of them
+// over gRPC and aggregates their stats.
+package control
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Stats is a snapshot of the progress and settings of a workload.
+type Stats struct {
+	Elapsed     time.Duration `json:"elapsed"`
+	Ops         uint64        `json:"ops"`
+	Errors      uint64        `json:"errors"`
+	Concurrency int           `json:"concurrency"`
+	// Rate is the maximum number of operations per second, or 0 if
+	// unlimited.
+	Rate float64 `json:"rate"`
+	// ReadPercent is the percentage of operations that only read, for
+	// workloads mixing reads and writes.
+	ReadPercent int  `json:"readPercent"`
+	Paused      bool `json:"paused"`
+	// Sustainable is the highest concurrency found to keep the p99 latency
+	// under --target-p99, or 0 if none was found yet.
+	Sustainable int `json:"sustainable,omitempty"`
+}
+
+// OpsPerSec returns the average number of operations per second.
+func (s Stats) OpsPerSec() float64 {
+	if s.Elapsed <= 0 {
+		return 0
+	}
+	return float64(s.Ops) / s.Elapsed.Seconds()
+}
+
+// A Change is a change of the concurrency of a workload while it runs, for
+// the examples to annotate their stats output with.
+type Change struct {
+	Elapsed  time.Duration
+	From, To int
+}
+
+func (ch Change) String() string {
+	return fmt.Sprintf("concurrency %d -> %d", ch.From, ch.To)
+}
+
+// A Controller gates the workers of a workload, numbered from 0. It is safe
+// for concurrent use.
+type Controller struct {
+	mu          sync.Mutex
+	concurrency int
+	rate        float64
+	readPercent int
+	paused      bool
+	// next is the earliest time at which the next operation may start,
+	// when the rate is limited.
+	next time.Time
+	// changed is closed and replaced whenever the settings change, waking
+	// up the workers waiting for them.
+	changed chan struct{}
+	// started is the number of workers started so far.
+	started int
+	// closed is set once the workload is stopping.
+	closed bool
+	// sustainable is the concurrency reported by Stats.Sustainable.
+	sustainable int
+	// changes are the changes of the concurrency not yet returned by
+	// Changes.
+	changes []Change
+
+	// latencies are recorded for Adapt, while adapting, under latencyMu
+	// rather than mu so that the workers don't contend with Wait.
+	latencyMu sync.Mutex
+	adapting  bool
+	latencies []time.Duration
+
+	start    time.Time
+	spawn    func(worker int)
+	counters func() (ops, errors uint64)
+}
+
+// New returns a controller for a workload of the given concurrency. spawn
+// is called to start the workers beyond the ones started so far when the
+// concurrency is raised, and counters returns the number of operations
+// done and failed so far.
+func New(concurrency int, spawn func(worker int), counters func() (ops, errors uint64)) *Controller {
+	return &Controller{
+		concurrency: concurrency,
+		changed:     make(chan struct{}),
+		started:     concurrency,
+		start:       time.Now(),
+		spawn:       spawn,
+		counters:    counters,
+	}
+}
+
+// Wait blocks worker until it may run its next operation: while the
+// workload is paused, while the worker is beyond the concurrency, and
+// until the rate allows it. It returns false if stop is closed first.
+func (c *Controller) Wait(worker int, stop <-chan struct{}) bool {
+	for {
+		c.mu.Lock()
+		if !c.paused && worker < c.concurrency {
+			var delay time.Duration
+			if c.rate > 0 {
+				now := time.Now()
+				if c.next.Before(now) {
+					c.next = now
+				}
+				delay = c.next.Sub(now)
+				c.next = c.next.Add(time.Duration(float64(time.Second) / c.rate))
+			}
+			c.mu.Unlock()
+			if delay > 0 {
+				select {
+				case <-time.After(delay):
+				case <-stop:
+					return false
+				}
+			}
+			return true
+		}
+		changed := c.changed
+		c.mu.Unlock()
+		select {
+		case <-changed:
+		case <-stop:
+			return false
+		}
+	}
+}
+
+// notify wakes up the waiting workers. c.mu must be held.
+func (c *Controller) notify() {
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// SetRate limits the workload to rate operations per second, or lifts the
+// limit if rate is 0.
+func (c *Controller) SetRate(rate float64) error {
+	if rate < 0 {
+		return errors.New("the rate can't be negative")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rate = rate
+	c.next = time.Time{}
+	c.notify()
+	return nil
+}
+
+// SetConcurrency sets the number of workers running, starting new ones if
+// needed. Workers beyond the concurrency wait until it's raised again.
+func (c *Controller) SetConcurrency(concurrency int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.setConcurrencyLocked(concurrency)
+}
+
+// Step adds delta workers, or removes them if delta is negative, and
+// returns the new concurrency.
+func (c *Controller) Step(delta int) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.setConcurrencyLocked(c.concurrency + delta); err != nil {
+		return c.concurrency, err
+	}
+	return c.concurrency, nil
+}
+
+// setConcurrencyLocked sets the concurrency. c.mu must be held.
+func (c *Controller) setConcurrencyLocked(concurrency int) error {
+	if concurrency < 1 {
+		return errors.New("the concurrency must be at least 1")
+	}
+	if c.closed {
+		return errors.New("the workload is stopping")
+	}
+	if concurrency != c.concurrency {
+		c.changes = append(c.changes, Change{Elapsed: time.Since(c.start), From: c.concurrency, To: concurrency})
+	}
+	c.concurrency = concurrency
+	for ; c.started < concurrency; c.started++ {
+		c.spawn(c.started)
+	}
+	c.notify()
+	return nil
+}
+
+// Changes returns the changes of the concurrency made since the last call.
+func (c *Controller) Changes() []Change {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	changes := c.changes
+	c.changes = nil
+	return changes
+}
+
+// SetReadPercent sets the percentage of operations that only read, for
+// workloads mixing reads and writes.
+func (c *Controller) SetReadPercent(percent int) error {
+	if percent < 0 || percent > 100 {
+		return errors.New("the read percentage must be between 0 and 100")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readPercent = percent
+	return nil
+}
+
+// ReadPercent returns the percentage of operations that only read.
+func (c *Controller) ReadPercent() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.readPercent
+}
+
+// Pause stops the workers before their next operation, until Resume is
+// called.
+func (c *Controller) Pause() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.paused = true
+	c.notify()
+}
+
+// Resume restarts the workers stopped by Pause.
+func (c *Controller) Resume() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.paused = false
+	c.notify()
+}
+
+// Close keeps new workers from being started: SetConcurrency fails once it
+// returns. It's called before waiting for the workers to stop.
+func (c *Controller) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+}
+
+// Stats returns a snapshot of the progress and settings of the workload.
+func (c *Controller) Stats() Stats {
+	c.mu.Lock()
+	s := Stats{
+		Elapsed:     time.Since(c.start),
+		Concurrency: c.concurrency,
+		Rate:        c.rate,
+		ReadPercent: c.readPercent,
+		Paused:      c.paused,
+		Sustainable: c.sustainable,
+	}
+	c.mu.Unlock()
+	s.Ops, s.Errors = c.counters()
+	return s
+}
@@ -0,0 +1,286 @@
+// Copyright 2016 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package control
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// waits returns whether worker is let through by c within d.
+func waits(c *Controller, worker int, d time.Duration) bool {
+	stop := make(chan struct{})
+	done := make(chan bool, 1)
+	go func() { done <- c.Wait(worker, stop) }()
+	select {
+	case ok := <-done:
+		return ok
+	case <-time.After(d):
+		close(stop)
+		<-done
+		return false
+	}
+}
+
+func TestController(t *testing.T) {
+	var spawned []int
+	c := New(2, func(worker int) { spawned = append(spawned, worker) },
+		func() (uint64, uint64) { return 10, 1 })
+
+	if !waits(c, 1, time.Second) {
+		t.Fatal("expected worker 1 to run")
+	}
+	if waits(c, 2, 10*time.Millisecond) {
+		t.Fatal("expected worker 2 to wait")
+	}
+
+	if err := c.SetConcurrency(4); err != nil {
+		t.Fatal(err)
+	}
+	if len(spawned) != 2 || spawned[0] != 2 || spawned[1] != 3 {
+		t.Fatalf("expected workers 2 and 3 to be spawned, got %v", spawned)
+	}
+	if !waits(c, 3, time.Second) {
+		t.Fatal("expected worker 3 to run")
+	}
+	if err := c.SetConcurrency(0); err == nil {
+		t.Fatal("expected an error")
+	}
+
+	c.Pause()
+	if waits(c, 0, 10*time.Millisecond) {
+		t.Fatal("expected worker 0 to wait while paused")
+	}
+	resumed := make(chan bool)
+	go func() { resumed <- c.Wait(0, nil) }()
+	c.Resume()
+	if !<-resumed {
+		t.Fatal("expected worker 0 to run once resumed")
+	}
+
+	s := c.Stats()
+	if s.Ops != 10 || s.Errors != 1 || s.Concurrency != 4 || s.Paused {
+		t.Errorf("unexpected stats %+v", s)
+	}
+}
+
+func TestStep(t *testing.T) {
+	c := New(2, func(int) {}, func() (uint64, uint64) { return 0, 0 })
+	if n, err := c.Step(3); err != nil || n != 5 {
+		t.Fatalf("expected concurrency 5, got %d (%v)", n, err)
+	}
+	if n, err := c.Step(-5); err == nil || n != 5 {
+		t.Fatalf("expected an error leaving concurrency 5, got %d (%v)", n, err)
+	}
+	if err := c.SetConcurrency(5); err != nil {
+		t.Fatal(err)
+	}
+
+	signals := make(chan os.Signal, 2)
+	signals <- os.Kill
+	signals <- os.Interrupt
+	close(signals)
+	handleSteps(c, signals, os.Interrupt, 2)
+
+	changes := c.Changes()
+	var got []string
+	for _, ch := range changes {
+		got = append(got, ch.String())
+	}
+	expected := []string{"concurrency 2 -> 5", "concurrency 5 -> 3", "concurrency 3 -> 5"}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected changes %v, got %v", expected, got)
+	}
+	if changes := c.Changes(); len(changes) != 0 {
+		t.Errorf("expected the changes to be drained, got %v", changes)
+	}
+}
+
+func TestRate(t *testing.T) {
+	c := New(1, nil, func() (uint64, uint64) { return 0, 0 })
+	if err := c.SetRate(100); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	for i := 0; i < 11; i++ {
+		c.Wait(0, nil)
+	}
+	// The first operation runs right away, the next ones 10ms apart.
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Errorf("expected 11 operations to take at least 100ms at 100 ops/sec, took %s", elapsed)
+	}
+	if err := c.SetRate(-1); err == nil {
+		t.Error("expected an error")
+	}
+}
+
+func TestParseCommand(t *testing.T) {
+	testCases := []struct {
+		args   string
+		method string
+		req    request
+	}{
+		{"stats", "Stats", request{}},
+		{"pause", "Pause", request{}},
+		{"resume", "Resume", request{}},
+		{"set-rate 1000", "SetRate", request{Rate: 250}},
+		{"set-concurrency 8", "SetConcurrency", request{Concurrency: 8}},
+		{"set-read-percent 90", "SetReadPercent", request{ReadPercent: 90}},
+	}
+	for _, c := range testCases {
+		method, req, err := parseCommand(strings.Fields(c.args), 4)
+		if err != nil {
+			t.Errorf("%s: %s", c.args, err)
+			continue
+		}
+		if method != c.method || *req != c.req {
+			t.Errorf("%s: expected %s %+v, got %s %+v", c.args, c.method, c.req, method, *req)
+		}
+	}
+	for _, args := range []string{
+		"", "stop", "stats now", "set-rate", "set-rate -1", "set-concurrency 0", "set-read-percent 101",
+	} {
+		if _, _, err := parseCommand(strings.Fields(args), 4); err == nil {
+			t.Errorf("%q: expected an error", args)
+		}
+	}
+}
+
+func TestRunCommand(t *testing.T) {
+	call := func(addr, method string, req *request) (*Stats, error) {
+		if addr == "down:7000" {
+			return nil, errors.New("connection refused")
+		}
+		return &Stats{Elapsed: 10 * time.Second, Ops: 1000, Concurrency: 3, Rate: req.Rate}, nil
+	}
+
+	var buf bytes.Buffer
+	if err := runCommand([]string{"a:7000", "b:7000"}, []string{"set-rate", "400"}, call, &buf); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("expected a header, 2 workers and the total, got:\n%s", buf.String())
+	}
+	if fields := strings.Fields(lines[3]); strings.Join(fields, " ") != "total 6 400.0 0% false 2000 0 200.0" {
+		t.Errorf("unexpected total %q", lines[3])
+	}
+
+	buf.Reset()
+	err := runCommand([]string{"a:7000", "down:7000"}, []string{"stats"}, call, &buf)
+	if err == nil || !strings.Contains(buf.String(), "connection refused") {
+		t.Errorf("expected the failed worker to be reported, got %v:\n%s", err, buf.String())
+	}
+}
+
+func TestRegister(t *testing.T) {
+	c := New(1, func(int) {}, func() (uint64, uint64) { return 0, 0 })
+	mux := http.NewServeMux()
+	Register(mux, c)
+
+	testCases := []struct {
+		method, path string
+		code         int
+	}{
+		{"POST", "/control/concurrency?value=3", http.StatusOK},
+		{"POST", "/control/concurrency/step?value=2", http.StatusOK},
+		{"POST", "/control/concurrency/step?value=-10", http.StatusBadRequest},
+		{"POST", "/control/rate?value=500", http.StatusOK},
+		{"POST", "/control/read-percent?value=20", http.StatusOK},
+		{"POST", "/control/pause", http.StatusOK},
+		{"POST", "/control/read-percent?value=200", http.StatusBadRequest},
+		{"POST", "/control/rate?value=fast", http.StatusBadRequest},
+		{"GET", "/control/pause", http.StatusMethodNotAllowed},
+		{"GET", "/control", http.StatusOK},
+	}
+	var s Stats
+	for _, tc := range testCases {
+		req, err := http.NewRequest(tc.method, tc.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		if w.Code != tc.code {
+			t.Errorf("%s %s: expected %d, got %d: %s", tc.method, tc.path, tc.code, w.Code, w.Body)
+			continue
+		}
+		if w.Code == http.StatusOK {
+			if err := json.NewDecoder(w.Body).Decode(&s); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if s.Concurrency != 5 || s.Rate != 500 || s.ReadPercent != 20 || !s.Paused {
+		t.Errorf("unexpected stats %+v", s)
+	}
+}
+
+func TestP99(t *testing.T) {
+	var latencies []time.Duration
+	for i := 200; i > 0; i-- {
+		latencies = append(latencies, time.Duration(i)*time.Millisecond)
+	}
+	if p := p99(latencies); p != 198*time.Millisecond {
+		t.Errorf("expected a p99 of 198ms, got %s", p)
+	}
+	if p := p99([]time.Duration{time.Second}); p != time.Second {
+		t.Errorf("expected a p99 of 1s, got %s", p)
+	}
+	if p := p99(nil); p != 0 {
+		t.Errorf("expected a p99 of 0, got %s", p)
+	}
+}
+
+func TestAIMD(t *testing.T) {
+	testCases := []struct {
+		concurrency int
+		p99         time.Duration
+		expected    int
+	}{
+		{1, 10 * time.Millisecond, 2},
+		{8, 50 * time.Millisecond, 9},
+		{8, 51 * time.Millisecond, 4},
+		{9, time.Second, 4},
+		{1, time.Second, 1},
+	}
+	for _, tc := range testCases {
+		if c := aimd(tc.concurrency, tc.p99, 50*time.Millisecond); c != tc.expected {
+			t.Errorf("aimd(%d, %s): expected %d, got %d", tc.concurrency, tc.p99, tc.expected, c)
+		}
+	}
+}
+
+func TestRecord(t *testing.T) {
+	c := New(1, func(int) {}, func() (uint64, uint64) { return 0, 0 })
+	c.Record(time.Millisecond)
+	if len(c.latencies) != 0 {
+		t.Fatal("expected latencies to be dropped while not adapting")
+	}
+	c.adapting = true
+	c.Record(time.Millisecond)
+	if len(c.latencies) != 1 {
+		t.Fatal("expected the latency to be recorded while adapting")
+	}
+}
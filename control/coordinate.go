@@ -0,0 +1,218 @@
+// Copyright 2016 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package control
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+)
+
+var coordinate = flag.String("coordinate", "",
+	"If set, comma-separated --control-addr of the workers to send the command given on the command line to, "+
+		"instead of running the workload")
+var callTimeout = flag.Duration("control-timeout", 10*time.Second, "Timeout of the calls to the workers with --coordinate")
+
+// Usage describes the commands of --coordinate, for the usage of the
+// examples.
+const Usage = `With --coordinate, the command is one of:
+  stats                   print the stats of each worker and their total
+  pause                   pause the workers
+  resume                  resume the workers
+  set-rate <ops/sec>      limit the total rate, split evenly across the workers, or lift the limit with 0
+  set-concurrency <n>     set the concurrency of each worker
+  set-read-percent <p>    set the percentage of operations that only read
+`
+
+// Coordinate runs the command in args against the workers of --coordinate
+// and exits, if set. It returns otherwise.
+func Coordinate(args []string) {
+	if *coordinate == "" {
+		return
+	}
+	if err := runCommand(strings.Split(*coordinate, ","), args, call, os.Stdout); err != nil {
+		log.Fatal(err)
+	}
+	os.Exit(0)
+}
+
+// A caller calls a method of the service of a worker.
+type caller func(addr, method string, req *request) (*Stats, error)
+
+// call calls a method of the service of the worker at addr over gRPC.
+func call(addr, method string, req *request) (*Stats, error) {
+	conn, err := grpc.Dial(addr, grpc.WithInsecure(), grpc.WithCodec(jsonCodec{}))
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = conn.Close() }()
+	ctx, cancel := context.WithTimeout(context.Background(), *callTimeout)
+	defer cancel()
+	stats := new(Stats)
+	if err := grpc.Invoke(ctx, "/"+serviceName+"/"+method, req, stats, conn); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// parseCommand returns the method to call for the command in args, and the
+// request to send to each of n workers.
+func parseCommand(args []string, n int) (string, *request, error) {
+	if len(args) == 0 {
+		return "", nil, fmt.Errorf("no command given\n%s", Usage)
+	}
+	cmd, args := args[0], args[1:]
+	var method string
+	req := new(request)
+	switch cmd {
+	case "stats", "pause", "resume":
+		if len(args) != 0 {
+			return "", nil, fmt.Errorf("%s takes no argument", cmd)
+		}
+		method = strings.ToUpper(cmd[:1]) + cmd[1:]
+	case "set-rate":
+		if len(args) != 1 {
+			return "", nil, fmt.Errorf("usage: set-rate <ops/sec>")
+		}
+		rate, err := strconv.ParseFloat(args[0], 64)
+		if err != nil || rate < 0 {
+			return "", nil, fmt.Errorf("invalid rate %q", args[0])
+		}
+		method, req.Rate = "SetRate", rate/float64(n)
+	case "set-concurrency":
+		if len(args) != 1 {
+			return "", nil, fmt.Errorf("usage: set-concurrency <n>")
+		}
+		concurrency, err := strconv.Atoi(args[0])
+		if err != nil || concurrency < 1 {
+			return "", nil, fmt.Errorf("invalid concurrency %q", args[0])
+		}
+		method, req.Concurrency = "SetConcurrency", concurrency
+	case "set-read-percent":
+		if len(args) != 1 {
+			return "", nil, fmt.Errorf("usage: set-read-percent <p>")
+		}
+		percent, err := strconv.Atoi(args[0])
+		if err != nil || percent < 0 || percent > 100 {
+			return "", nil, fmt.Errorf("invalid read percentage %q", args[0])
+		}
+		method, req.ReadPercent = "SetReadPercent", percent
+	default:
+		return "", nil, fmt.Errorf("unknown command %q\n%s", cmd, Usage)
+	}
+	return method, req, nil
+}
+
+// runCommand sends the command in args to the workers at addrs in parallel,
+// and writes their resulting stats and total to w.
+func runCommand(addrs, args []string, call caller, w io.Writer) error {
+	method, req, err := parseCommand(args, len(addrs))
+	if err != nil {
+		return err
+	}
+	stats := make([]*Stats, len(addrs))
+	errs := make([]error, len(addrs))
+	var wg sync.WaitGroup
+	for i, addr := range addrs {
+		wg.Add(1)
+		go func(i int, addr string) {
+			defer wg.Done()
+			stats[i], errs[i] = call(addr, method, req)
+		}(i, addr)
+	}
+	wg.Wait()
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "worker\tconcurrency\trate\treads\tpaused\tops\terrors\tops/sec\n")
+	var failed int
+	for i, addr := range addrs {
+		if errs[i] != nil {
+			failed++
+			fmt.Fprintf(tw, "%s\terror: %s\n", addr, errs[i])
+			continue
+		}
+		writeStats(tw, addr, *stats[i])
+	}
+	writeStats(tw, "total", total(stats))
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d workers failed", failed, len(addrs))
+	}
+	return nil
+}
+
+func writeStats(w io.Writer, name string, s Stats) {
+	rate := "-"
+	if s.Rate > 0 {
+		rate = strconv.FormatFloat(s.Rate, 'f', 1, 64)
+	}
+	fmt.Fprintf(w, "%s\t%d\t%s\t%d%%\t%t\t%d\t%d\t%.1f\n",
+		name, s.Concurrency, rate, s.ReadPercent, s.Paused, s.Ops, s.Errors, s.OpsPerSec())
+}
+
+// total aggregates the stats of the workers that answered, skipping nil
+// ones. Its rate is unlimited if any worker's is, its read percentage is
+// weighted by the operations of the workers, and it's paused only if all
+// the workers are.
+func total(stats []*Stats) Stats {
+	var t Stats
+	t.Paused = true
+	unlimited := false
+	var answered int
+	var opsPerSec, reads float64
+	for _, s := range stats {
+		if s == nil {
+			continue
+		}
+		answered++
+		t.Ops += s.Ops
+		t.Errors += s.Errors
+		t.Concurrency += s.Concurrency
+		t.Rate += s.Rate
+		unlimited = unlimited || s.Rate == 0
+		t.Paused = t.Paused && s.Paused
+		if s.Elapsed > t.Elapsed {
+			t.Elapsed = s.Elapsed
+		}
+		opsPerSec += s.OpsPerSec()
+		reads += float64(s.Ops) * float64(s.ReadPercent)
+	}
+	if t.Ops > 0 {
+		t.ReadPercent = int(reads/float64(t.Ops) + 0.5)
+	}
+	if unlimited {
+		t.Rate = 0
+	}
+	t.Paused = t.Paused && answered > 0
+	// The workers may have started at different times: the elapsed time is
+	// the one giving the sum of their rates of operations.
+	if opsPerSec > 0 {
+		t.Elapsed = time.Duration(float64(t.Ops) / opsPerSec * float64(time.Second))
+	}
+	return t
+}
@@ -0,0 +1,116 @@
+// Copyright 2016 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package control
+
+import (
+	"encoding/json"
+	"flag"
+	"log"
+	"net"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+)
+
+var controlAddr = flag.String("control-addr", "",
+	"If set, address on which to serve the gRPC control API, used by --coordinate")
+
+// serviceName is the name of the gRPC service. The service is declared by
+// hand rather than generated from a .proto file, and its messages are
+// encoded in JSON.
+const serviceName = "control.Control"
+
+// A request holds the arguments of a call to the service. Every call
+// returns the Stats of the workload once the request is applied.
+type request struct {
+	Rate        float64 `json:"rate,omitempty"`
+	Concurrency int     `json:"concurrency,omitempty"`
+	ReadPercent int     `json:"readPercent,omitempty"`
+}
+
+// jsonCodec encodes the messages of the service in JSON.
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) { return json.Marshal(v) }
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+
+func (jsonCodec) String() string { return "json" }
+
+// controlServer is implemented by *Controller, which serves the calls.
+type controlServer interface {
+	Stats() Stats
+}
+
+var serviceDesc = grpc.ServiceDesc{
+	ServiceName: serviceName,
+	HandlerType: (*controlServer)(nil),
+	Methods: []grpc.MethodDesc{
+		method("SetRate", func(c *Controller, req *request) error { return c.SetRate(req.Rate) }),
+		method("SetConcurrency", func(c *Controller, req *request) error { return c.SetConcurrency(req.Concurrency) }),
+		method("SetReadPercent", func(c *Controller, req *request) error { return c.SetReadPercent(req.ReadPercent) }),
+		method("Pause", func(c *Controller, _ *request) error { c.Pause(); return nil }),
+		method("Resume", func(c *Controller, _ *request) error { c.Resume(); return nil }),
+		method("Stats", func(*Controller, *request) error { return nil }),
+	},
+}
+
+// method returns the description of a method of the service applying a
+// request to the controller.
+func method(name string, apply func(*Controller, *request) error) grpc.MethodDesc {
+	handle := func(ctx context.Context, srv, req interface{}) (interface{}, error) {
+		c := srv.(*Controller)
+		if err := apply(c, req.(*request)); err != nil {
+			return nil, err
+		}
+		stats := c.Stats()
+		return &stats, nil
+	}
+	return grpc.MethodDesc{
+		MethodName: name,
+		Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error,
+			interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+			req := new(request)
+			if err := dec(req); err != nil {
+				return nil, err
+			}
+			if interceptor == nil {
+				return handle(ctx, srv, req)
+			}
+			info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/" + serviceName + "/" + name}
+			return interceptor(ctx, req, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+				return handle(ctx, srv, req)
+			})
+		},
+	}
+}
+
+// Serve serves the gRPC control API for c on --control-addr, if set.
+func Serve(c *Controller) error {
+	if *controlAddr == "" {
+		return nil
+	}
+	lis, err := net.Listen("tcp", *controlAddr)
+	if err != nil {
+		return err
+	}
+	s := grpc.NewServer(grpc.CustomCodec(jsonCodec{}))
+	s.RegisterService(&serviceDesc, c)
+	go func() {
+		log.Fatal(s.Serve(lis))
+	}()
+	return nil
+}
@@ -0,0 +1,116 @@
+// Copyright 2016 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package control
+
+import (
+	"encoding/json"
+	"flag"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+)
+
+var httpAddr = flag.String("control-http-addr", "",
+	"If set, address on which to serve the REST control endpoints, for the examples without a metrics port")
+
+// ServeREST serves the REST control endpoints of c on --control-http-addr,
+// if set.
+func ServeREST(c *Controller) error {
+	if *httpAddr == "" {
+		return nil
+	}
+	lis, err := net.Listen("tcp", *httpAddr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	Register(mux, c)
+	go func() {
+		log.Fatal(http.Serve(lis, mux))
+	}()
+	return nil
+}
+
+// Register registers the REST control endpoints of c on mux, usually that
+// of the metrics port of the example or that of ServeREST:
+//
+//	GET  /control                        the stats of the workload, right now
+//	POST /control/concurrency?value=<n>  set the concurrency
+//	POST /control/concurrency/step?value=<n>
+//	                                     add n workers, or remove them if n is negative
+//	POST /control/rate?value=<ops/sec>   limit the rate, or lift the limit with 0
+//	POST /control/read-percent?value=<p> set the percentage of operations that only read
+//	POST /control/pause                  pause the workers
+//	POST /control/resume                 resume the workers
+//
+// The POST endpoints respond with the stats once the change is applied.
+func Register(mux *http.ServeMux, c *Controller) {
+	mux.HandleFunc("/control", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "GET only", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, c.Stats())
+	})
+	setInt := func(set func(int) error) func(string) error {
+		return func(value string) error {
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return err
+			}
+			return set(n)
+		}
+	}
+	mux.HandleFunc("/control/concurrency", post(c, setInt(c.SetConcurrency)))
+	mux.HandleFunc("/control/concurrency/step", post(c, setInt(func(delta int) error {
+		_, err := c.Step(delta)
+		return err
+	})))
+	mux.HandleFunc("/control/read-percent", post(c, setInt(c.SetReadPercent)))
+	mux.HandleFunc("/control/rate", post(c, func(value string) error {
+		rate, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return err
+		}
+		return c.SetRate(rate)
+	}))
+	mux.HandleFunc("/control/pause", post(c, func(string) error { c.Pause(); return nil }))
+	mux.HandleFunc("/control/resume", post(c, func(string) error { c.Resume(); return nil }))
+}
+
+// post returns a handler of POST requests applying their value parameter,
+// and responding with the stats of c.
+func post(c *Controller, apply func(value string) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "POST only", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := apply(r.FormValue("value")); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, c.Stats())
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Print(err)
+	}
+}
@@ -0,0 +1,39 @@
+// Copyright 2016 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package control
+
+import (
+	"flag"
+	"log"
+	"os"
+)
+
+var concurrencyStep = flag.Int("concurrency-step", 1,
+	"Number of workers added on SIGUSR1 and removed on SIGUSR2, to sweep a range of concurrencies in a single run")
+
+// handleSteps adds step workers to c for each up signal received on
+// signals, and removes them for any other, until signals is closed.
+func handleSteps(c *Controller, signals <-chan os.Signal, up os.Signal, step int) {
+	for sig := range signals {
+		delta := step
+		if sig != up {
+			delta = -step
+		}
+		if _, err := c.Step(delta); err != nil {
+			log.Printf("%s: %s", sig, err)
+		}
+	}
+}
@@ -0,0 +1,33 @@
+// Copyright 2016 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+//go:build !windows
+// +build !windows
+
+package control
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// HandleSignals raises the concurrency of c by --concurrency-step on
+// SIGUSR1, and lowers it by as much on SIGUSR2.
+func HandleSignals(c *Controller) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1, syscall.SIGUSR2)
+	go handleSteps(c, signals, syscall.SIGUSR1, *concurrencyStep)
+}
@@ -0,0 +1,340 @@
+// Copyright 2016 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+// The counter example demonstrates the sharded counter pattern. Many
+// clients increment a few global counters, first with every counter
+// stored in a single row and then with every counter split across N
+// shard rows. In the sharded design, an aggregator periodically sums the
+// shards of each counter into a totals table, which is what readers would
+// query.
+//
+// Each design runs for --duration. At the end, the example prints the
+// throughput, latency and transaction retry rate of each design and
+// checks that no increments were lost.
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/examples-go/dbdriver"
+	"github.com/cockroachdb/examples-go/opstats"
+	"github.com/codahale/hdrhistogram"
+	// Import postgres driver.
+	_ "github.com/cockroachdb/pq"
+)
+
+var designs = flag.String("designs", "single,sharded", "Comma-separated list of counter designs to run: single, sharded.")
+var numCounters = flag.Int("counters", 1, "Number of global counters.")
+var numShards = flag.Int("shards", 16, "Number of shards per counter in the sharded design.")
+var concurrency = flag.Int("concurrency", 32, "Number of concurrent clients.")
+var duration = flag.Duration("duration", 30*time.Second, "How long to run each design.")
+var aggregateInterval = flag.Duration("aggregate-interval", 1*time.Second, "Interval at which shards are aggregated.")
+var outputInterval = flag.Duration("output-interval", 1*time.Second, "Interval of output.")
+var driver = flag.String("driver", "postgres", dbdriver.Usage)
+
+const schema = `
+CREATE TABLE IF NOT EXISTS counters (
+  id    INT PRIMARY KEY,
+  value INT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS counter_shards (
+  id    INT NOT NULL,
+  shard INT NOT NULL,
+  value INT NOT NULL,
+  PRIMARY KEY (id, shard)
+);
+
+CREATE TABLE IF NOT EXISTS counter_totals (
+  id      INT PRIMARY KEY,
+  value   INT NOT NULL,
+  updated TIMESTAMP NOT NULL
+);
+`
+
+// A design is a way of storing counters.
+type design interface {
+	// setup resets all counters to zero.
+	setup(db *sql.DB) error
+	// increment adds one to a counter.
+	increment(tx *sql.Tx, r *rand.Rand, id int) error
+	// total returns the sum of all counters.
+	total(db *sql.DB) (int64, error)
+}
+
+type singleRow struct{}
+
+func (singleRow) setup(db *sql.DB) error {
+	if _, err := db.Exec(`TRUNCATE TABLE counters`); err != nil {
+		return err
+	}
+	_, err := db.Exec(`INSERT INTO counters (id, value) SELECT i, 0 FROM GENERATE_SERIES(0, $1) AS g(i)`,
+		*numCounters-1)
+	return err
+}
+
+func (singleRow) increment(tx *sql.Tx, _ *rand.Rand, id int) error {
+	_, err := tx.Exec(`UPDATE counters SET value = value + 1 WHERE id = $1`, id)
+	return err
+}
+
+func (singleRow) total(db *sql.DB) (int64, error) {
+	var total int64
+	err := db.QueryRow(`SELECT COALESCE(SUM(value), 0) FROM counters`).Scan(&total)
+	return total, err
+}
+
+type sharded struct{}
+
+func (sharded) setup(db *sql.DB) error {
+	for _, table := range []string{"counter_shards", "counter_totals"} {
+		if _, err := db.Exec("TRUNCATE TABLE " + table); err != nil {
+			return err
+		}
+	}
+	rows := *numCounters * *numShards
+	_, err := db.Exec(`INSERT INTO counter_shards (id, shard, value) `+
+		`SELECT i / $1, i % $1, 0 FROM GENERATE_SERIES(0, $2) AS g(i)`, *numShards, rows-1)
+	return err
+}
+
+func (sharded) increment(tx *sql.Tx, r *rand.Rand, id int) error {
+	_, err := tx.Exec(`UPDATE counter_shards SET value = value + 1 WHERE id = $1 AND shard = $2`,
+		id, r.Intn(*numShards))
+	return err
+}
+
+// aggregate sums the shards of every counter into counter_totals.
+func (sharded) aggregate(db *sql.DB) error {
+	_, err := db.Exec(`UPSERT INTO counter_totals (id, value, updated) ` +
+		`SELECT id, SUM(value), NOW() FROM counter_shards GROUP BY id`)
+	return err
+}
+
+func (sharded) total(db *sql.DB) (int64, error) {
+	var total int64
+	err := db.QueryRow(`SELECT COALESCE(SUM(value), 0) FROM counter_shards`).Scan(&total)
+	return total, err
+}
+
+// results accumulates the statistics of one design.
+type results struct {
+	// ops tracks the increments since the last report, summing their
+	// retries.
+	ops        *opstats.Stats
+	hist       *hdrhistogram.Histogram
+	increments int64
+	retries    int64
+	errors     int64
+	// lost is set if the counters don't sum to the increments made.
+	lost bool
+}
+
+// collect adds the increments tracked since the last call to the results,
+// and returns how many succeeded.
+func (res *results) collect() int64 {
+	hist, retries, errors := res.ops.SnapshotSum()
+	res.hist.Merge(hist)
+	res.increments += hist.TotalCount()
+	res.retries += retries
+	res.errors += int64(errors)
+	return hist.TotalCount()
+}
+
+func client(db *sql.DB, d design, res *results, stop <-chan struct{}, wg *sync.WaitGroup) {
+	defer wg.Done()
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		id := r.Intn(*numCounters)
+		attempts := 0
+		start := time.Now()
+		err := dbdriver.ExecuteTx(db, func(tx *sql.Tx) error {
+			attempts++
+			return d.increment(tx, r, id)
+		})
+		if err != nil {
+			log.Print(err)
+		}
+		res.ops.RecordResult(start, attempts-1, err)
+	}
+}
+
+func aggregator(db *sql.DB, s sharded, stop <-chan struct{}, wg *sync.WaitGroup) {
+	defer wg.Done()
+	hist := hdrhistogram.New(0, int64(time.Minute), 1)
+	ticker := time.NewTicker(*aggregateInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			log.Printf("aggregated %d times, p50=%s p99=%s", hist.TotalCount(),
+				time.Duration(hist.ValueAtQuantile(50)), time.Duration(hist.ValueAtQuantile(99)))
+			return
+		case <-ticker.C:
+		}
+		start := time.Now()
+		if err := s.aggregate(db); err != nil {
+			log.Print(err)
+			continue
+		}
+		_ = hist.RecordValue(int64(time.Since(start)))
+	}
+}
+
+// run runs a design for --duration and returns its results.
+func run(db *sql.DB, name string, d design) *results {
+	if err := d.setup(db); err != nil {
+		log.Fatal(err)
+	}
+	res := &results{ops: opstats.New(time.Minute), hist: hdrhistogram.New(0, int64(time.Minute), 1)}
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < *concurrency; i++ {
+		wg.Add(1)
+		go client(db, d, res, stop, &wg)
+	}
+	if s, ok := d.(sharded); ok {
+		wg.Add(1)
+		go aggregator(db, s, stop, &wg)
+	}
+
+	done := time.After(*duration)
+	ticker := time.NewTicker(*outputInterval)
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		case <-ticker.C:
+			n := res.collect()
+			log.Printf("%s: %.1f increments/sec, %d retries, %d errors",
+				name, float64(n)/outputInterval.Seconds(), res.retries, res.errors)
+		}
+	}
+	ticker.Stop()
+	close(stop)
+	wg.Wait()
+	res.collect()
+
+	total, err := d.total(db)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// An increment that returned an error may still have committed, so
+	// the total can exceed the number of successful increments by at most
+	// the number of errors.
+	if total < res.increments || total > res.increments+res.errors {
+		log.Printf("%s: counters sum to %d, but %d increments succeeded and %d failed",
+			name, total, res.increments, res.errors)
+		res.lost = true
+	}
+	return res
+}
+
+var usage = func() {
+	fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s [<db URL>]\n\n", os.Args[0])
+	flag.PrintDefaults()
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() > 1 {
+		usage()
+		os.Exit(2)
+	}
+
+	if *numCounters < 1 || *numShards < 1 {
+		log.Fatal("'counters' and 'shards' must be at least 1")
+	}
+	var names []string
+	for _, name := range strings.Split(*designs, ",") {
+		switch name {
+		case "single", "sharded":
+			names = append(names, name)
+		default:
+			log.Fatalf("unknown design %q", name)
+		}
+	}
+
+	dbURL, err := dbdriver.URL(flag.Arg(0), "")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	parsedURL, err := url.Parse(dbURL)
+	if err != nil {
+		log.Fatal(err)
+	}
+	parsedURL.Path = "counter"
+
+	db, err := dbdriver.Open(*driver, parsedURL.String())
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer func() { _ = db.Close() }()
+
+	db.SetMaxOpenConns(*concurrency + 1)
+
+	if _, err := db.Exec("CREATE DATABASE IF NOT EXISTS counter"); err != nil {
+		log.Fatal(err)
+	}
+	if _, err := db.Exec(schema); err != nil {
+		log.Fatal(err)
+	}
+
+	all := make([]*results, len(names))
+	for i, name := range names {
+		var d design = singleRow{}
+		if name == "sharded" {
+			d = sharded{}
+		}
+		log.Printf("running %s design for %s", name, *duration)
+		all[i] = run(db, name, d)
+	}
+
+	fmt.Println("design   increments/sec  retries/increment  errors  p50(ms)  p99(ms)")
+	for i, name := range names {
+		res := all[i]
+		var retryRate float64
+		if res.increments > 0 {
+			retryRate = float64(res.retries) / float64(res.increments)
+		}
+		fmt.Printf("%-8s %14.1f %18.3f %7d %8.1f %8.1f\n",
+			name, float64(res.increments)/duration.Seconds(), retryRate, res.errors,
+			time.Duration(res.hist.ValueAtQuantile(50)).Seconds()*1000,
+			time.Duration(res.hist.ValueAtQuantile(99)).Seconds()*1000)
+	}
+	for i, name := range names {
+		if all[i].lost {
+			log.Fatalf("%s: the counters don't match the increments", name)
+		}
+	}
+}
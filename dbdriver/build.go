@@ -0,0 +1,142 @@
+// Copyright 2016 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package dbdriver
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+)
+
+// Instead of a fully formed db URL, the examples accept its parts as
+// flags, checking early that they go together.
+var host = flag.String("host", "", "Host to connect to, if no db URL is given. Defaults to localhost.")
+var port = flag.Int("port", 0, "Port to connect to, if no db URL is given. Defaults to 26257.")
+var user = flag.String("user", "", "User to connect as, if no db URL is given. Defaults to root.")
+var database = flag.String("database", "", "Database to connect to, if no db URL is given.")
+var sslMode = flag.String("sslmode", "",
+	"SSL mode, if no db URL is given: disable, require, verify-ca or verify-full. "+
+		"Defaults to verify-full with --sslrootcert or --cluster, and disable otherwise.")
+var sslRootCert = flag.String("sslrootcert", "", "CA certificate, if no db URL is given.")
+var sslCert = flag.String("sslcert", "", "Client certificate, if no db URL is given.")
+var sslKey = flag.String("sslkey", "", "Client key, if no db URL is given.")
+
+const (
+	defaultHost = "localhost"
+	defaultPort = 26257
+	defaultUser = "root"
+)
+
+var sslModes = map[string]bool{
+	"disable":     true,
+	"require":     true,
+	"verify-ca":   true,
+	"verify-full": true,
+}
+
+// urlParts holds the parts of a db URL given as flags.
+type urlParts struct {
+	host, user, database         string
+	port                         int
+	sslMode                      string
+	sslRootCert, sslCert, sslKey string
+}
+
+func partsFromFlags() urlParts {
+	return urlParts{
+		host:        *host,
+		port:        *port,
+		user:        *user,
+		database:    *database,
+		sslMode:     *sslMode,
+		sslRootCert: *sslRootCert,
+		sslCert:     *sslCert,
+		sslKey:      *sslKey,
+	}
+}
+
+// set returns whether any part is set.
+func (p urlParts) set() bool {
+	return p != urlParts{}
+}
+
+// build validates the parts and returns the db URL made of them.
+func (p urlParts) build() (string, error) {
+	if p.host == "" {
+		p.host = defaultHost
+	}
+	if p.port == 0 {
+		p.port = defaultPort
+	}
+	if p.port < 0 || p.port > 65535 {
+		return "", fmt.Errorf("--port %d is out of range", p.port)
+	}
+	if p.user == "" {
+		p.user = defaultUser
+	}
+	if p.sslMode == "" {
+		p.sslMode = "disable"
+		if p.sslRootCert != "" || *cluster != "" {
+			p.sslMode = "verify-full"
+		}
+	}
+	if !sslModes[p.sslMode] {
+		return "", fmt.Errorf("unknown --sslmode %q", p.sslMode)
+	}
+
+	certs := p.sslRootCert != "" || p.sslCert != "" || p.sslKey != ""
+	switch {
+	case p.sslMode == "disable" && certs:
+		return "", fmt.Errorf("certificates are given, but --sslmode is disable")
+	// Serverless clusters may be verified with the default CA certificate
+	// or the system roots, see withCluster.
+	case (p.sslMode == "verify-ca" || p.sslMode == "verify-full") && p.sslRootCert == "" && *cluster == "":
+		return "", fmt.Errorf("--sslmode %s requires --sslrootcert", p.sslMode)
+	case (p.sslCert == "") != (p.sslKey == ""):
+		return "", fmt.Errorf("--sslcert and --sslkey must be given together")
+	}
+	for _, file := range []string{p.sslRootCert, p.sslCert, p.sslKey} {
+		if file == "" {
+			continue
+		}
+		if _, err := os.Stat(file); err != nil {
+			return "", err
+		}
+	}
+
+	q := url.Values{}
+	q.Set("sslmode", p.sslMode)
+	if p.sslRootCert != "" {
+		q.Set("sslrootcert", p.sslRootCert)
+	}
+	if p.sslCert != "" {
+		q.Set("sslcert", p.sslCert)
+		q.Set("sslkey", p.sslKey)
+	}
+	u := url.URL{
+		Scheme:   "postgresql",
+		User:     url.User(p.user),
+		Host:     net.JoinHostPort(p.host, strconv.Itoa(p.port)),
+		RawQuery: q.Encode(),
+	}
+	if p.database != "" {
+		u.Path = "/" + p.database
+	}
+	return u.String(), nil
+}
@@ -0,0 +1,97 @@
+// Copyright 2016 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package dbdriver
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Serverless clusters share their hosts: connections are routed to a
+// cluster by an option, must use TLS, and usually authenticate with long
+// generated passwords that are awkward to URL-encode by hand.
+var cluster = flag.String("cluster", "",
+	"Routing ID of a serverless cluster, e.g. my-cluster-123. Implies --sslmode=verify-full.")
+var passwordFile = flag.String("password-file", "",
+	"File holding the password of the db user, e.g. an SQL token, instead of taking it from the db URL.")
+
+// defaultRootCert returns where libpq, and the instructions of the cloud
+// console, put the CA certificate of the cluster.
+func defaultRootCert() string {
+	return filepath.Join(os.Getenv("HOME"), ".postgresql", "root.crt")
+}
+
+// withCluster returns dbURL routed to the given serverless cluster, over
+// TLS. If the URL names no CA certificate, the default one is used if it
+// exists, and otherwise the system roots.
+func withCluster(dbURL, cluster string) (string, error) {
+	u, err := url.Parse(dbURL)
+	if err != nil {
+		return "", err
+	}
+	q := u.Query()
+	opt := "--cluster=" + cluster
+	if options := q.Get("options"); options != "" && !strings.Contains(options, opt) {
+		opt = options + " " + opt
+	}
+	q.Set("options", opt)
+
+	switch q.Get("sslmode") {
+	case "":
+		q.Set("sslmode", "verify-full")
+	case "disable":
+		return "", errors.New("serverless clusters require TLS, but sslmode is disable")
+	}
+	if q.Get("sslrootcert") == "" {
+		if rootCert := defaultRootCert(); fileExists(rootCert) {
+			q.Set("sslrootcert", rootCert)
+		}
+	}
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// withPasswordFile returns dbURL with the password read from file.
+func withPasswordFile(dbURL, file string) (string, error) {
+	u, err := url.Parse(dbURL)
+	if err != nil {
+		return "", err
+	}
+	if u.User == nil {
+		return "", fmt.Errorf("no user to set the password of in %s", dbURL)
+	}
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	password := strings.TrimSpace(string(b))
+	if password == "" {
+		return "", fmt.Errorf("%s is empty", file)
+	}
+	u.User = url.UserPassword(u.User.Username(), password)
+	return u.String(), nil
+}
+
+func fileExists(file string) bool {
+	_, err := os.Stat(file)
+	return err == nil
+}
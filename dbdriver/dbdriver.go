@@ -0,0 +1,148 @@
+// Copyright 2016 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+// Package dbdriver lets the examples talk to cockroach through either the
+// lib/pq driver or pgx, hiding the differences between the errors they
+// return.
+package dbdriver
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/cockroachdb/cockroach-go/crdb"
+	"github.com/cockroachdb/pq"
+	"github.com/jackc/pgx"
+	"github.com/jackc/pgx/stdlib"
+)
+
+// Usage is the usage of the --driver flag of the examples.
+const Usage = "Database driver: postgres (lib/pq) or pgx."
+
+// Open opens a database handle for the db URL with the given driver, either
+// "postgres" or "pgx", and waits for the database to be reachable. If the
+// URL lists several hosts, only the first one is used; see SplitHosts to
+// spread connections over all of them.
+func Open(driver, dbURL string) (*sql.DB, error) {
+	dataSource, err := firstHost(dbURL)
+	if err != nil {
+		return nil, err
+	}
+	switch driver {
+	case "postgres":
+		if *pooler {
+			if dataSource, err = forPooler(dataSource); err != nil {
+				return nil, err
+			}
+		}
+	case "pgx":
+		if *pooler {
+			return nil, errPoolerPgx
+		}
+		if isSocketURL(dataSource) {
+			// pgx only takes a socket directory as the host of a key/value
+			// data source name.
+			if dataSource, err = pq.ParseURL(dataSource); err != nil {
+				return nil, err
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unknown driver %q: %s", driver, Usage)
+	}
+	db, err := sql.Open(driver, dataSource)
+	if err != nil {
+		return nil, err
+	}
+	if err := Wait(db); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// Code returns the SQLSTATE code of an error returned by either driver, or
+// "" if the error doesn't come from the server.
+func Code(err error) string {
+	switch e := err.(type) {
+	case *pq.Error:
+		return string(e.Code)
+	case pgx.PgError:
+		return e.Code
+	case *pgx.PgError:
+		return e.Code
+	}
+	return ""
+}
+
+// Class returns the class of the SQLSTATE code of an error, that is its
+// first two characters, or "" if the error doesn't come from the server.
+func Class(err error) string {
+	if code := Code(err); len(code) >= 2 {
+		return code[:2]
+	}
+	return ""
+}
+
+// Retryable returns whether an error asks the client to retry the
+// transaction.
+func Retryable(err error) bool {
+	// CR000 is returned by older versions of cockroach.
+	code := Code(err)
+	return code == "40001" || code == "CR000"
+}
+
+// ExecuteTx runs fn in a transaction, retrying it as long as cockroach asks
+// for it. With lib/pq, it is crdb.ExecuteTx, which only recognizes the
+// errors of lib/pq; with pgx, it follows the same protocol.
+func ExecuteTx(db *sql.DB, fn func(*sql.Tx) error) error {
+	if _, ok := db.Driver().(*stdlib.Driver); !ok {
+		err := crdb.ExecuteTx(db, fn)
+		hintPooler(err)
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := executeInTx(tx, fn); err != nil {
+		_ = tx.Rollback()
+		hintPooler(err)
+		return err
+	}
+	return tx.Commit()
+}
+
+// executeInTx runs fn in tx, using the cockroach_restart savepoint to
+// retry it on retryable errors.
+func executeInTx(tx *sql.Tx, fn func(*sql.Tx) error) error {
+	if _, err := tx.Exec("SAVEPOINT cockroach_restart"); err != nil {
+		return err
+	}
+	for {
+		err := fn(tx)
+		if err == nil {
+			if _, err = tx.Exec("RELEASE SAVEPOINT cockroach_restart"); err == nil {
+				return nil
+			}
+		}
+		if !Retryable(err) {
+			return err
+		}
+		if _, err := tx.Exec("ROLLBACK TO SAVEPOINT cockroach_restart"); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,58 @@
+// Copyright 2016 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package dbdriver
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/cockroachdb/pq"
+	"github.com/jackc/pgx"
+)
+
+func TestCode(t *testing.T) {
+	testCases := []struct {
+		err       error
+		code      string
+		class     string
+		retryable bool
+	}{
+		{&pq.Error{Code: "40001"}, "40001", "40", true},
+		{&pq.Error{Code: "23505"}, "23505", "23", false},
+		{pgx.PgError{Code: "40001"}, "40001", "40", true},
+		{&pgx.PgError{Code: "CR000"}, "CR000", "CR", true},
+		{&pgx.PgError{Code: "23505"}, "23505", "23", false},
+		{errors.New("connection refused"), "", "", false},
+		{nil, "", "", false},
+	}
+	for i, c := range testCases {
+		if code := Code(c.err); code != c.code {
+			t.Errorf("%d: expected code %q, got %q", i, c.code, code)
+		}
+		if class := Class(c.err); class != c.class {
+			t.Errorf("%d: expected class %q, got %q", i, c.class, class)
+		}
+		if retryable := Retryable(c.err); retryable != c.retryable {
+			t.Errorf("%d: expected retryable %t, got %t", i, c.retryable, retryable)
+		}
+	}
+}
+
+func TestOpenUnknownDriver(t *testing.T) {
+	if _, err := Open("mysql", "mysql://localhost"); err == nil {
+		t.Fatal("expected an error")
+	}
+}
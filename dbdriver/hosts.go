@@ -0,0 +1,145 @@
+// Copyright 2016 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package dbdriver
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// SplitHosts returns one URL per host of the given db URLs, each of which
+// may list several hosts as libpq does: either in its authority, e.g.
+// postgresql://root@a:26257,b:26257,[::1]:26257/bank, or in its host and
+// port parameters, e.g. postgresql://root@/bank?host=a,b,::1&port=26257.
+// IPv6 addresses must be bracketed in the authority, and may be bare in the
+// host parameter.
+func SplitHosts(dbURLs ...string) ([]string, error) {
+	var split []string
+	for _, dbURL := range dbURLs {
+		for _, u := range splitAuthority(dbURL) {
+			hostURLs, err := splitHostParam(u)
+			if err != nil {
+				return nil, err
+			}
+			split = append(split, hostURLs...)
+		}
+	}
+	return split, nil
+}
+
+// splitAuthority splits a URL listing several hosts in its authority. It
+// works on the string, as url.Parse doesn't accept such URLs.
+func splitAuthority(dbURL string) []string {
+	i := strings.Index(dbURL, "://")
+	if i < 0 {
+		return []string{dbURL}
+	}
+	prefix, rest := dbURL[:i+3], dbURL[i+3:]
+	end := strings.IndexAny(rest, "/?#")
+	if end < 0 {
+		end = len(rest)
+	}
+	authority, suffix := rest[:end], rest[end:]
+	if at := strings.LastIndex(authority, "@"); at >= 0 {
+		prefix += authority[:at+1]
+		authority = authority[at+1:]
+	}
+	if !strings.Contains(authority, ",") {
+		return []string{dbURL}
+	}
+	var urls []string
+	for _, host := range strings.Split(authority, ",") {
+		urls = append(urls, prefix+host+suffix)
+	}
+	return urls
+}
+
+// splitHostParam splits a URL listing several hosts in its host parameter,
+// with either one port for all of them or one each.
+func splitHostParam(dbURL string) ([]string, error) {
+	u, err := url.Parse(dbURL)
+	if err != nil {
+		return nil, err
+	}
+	q := u.Query()
+	if !strings.Contains(q.Get("host"), ",") {
+		return []string{dbURL}, nil
+	}
+	hosts := strings.Split(q.Get("host"), ",")
+	var ports []string
+	if port := q.Get("port"); port != "" {
+		ports = strings.Split(port, ",")
+	} else if _, port, err := net.SplitHostPort(u.Host); err == nil {
+		ports = []string{port}
+	}
+	if len(ports) > 1 && len(ports) != len(hosts) {
+		return nil, fmt.Errorf("%d ports for %d hosts in %s", len(ports), len(hosts), dbURL)
+	}
+	q.Del("host")
+	q.Del("port")
+
+	urls := make([]string, len(hosts))
+	for i, host := range hosts {
+		port := ""
+		switch len(ports) {
+		case 1:
+			port = ports[0]
+		case len(hosts):
+			port = ports[i]
+		}
+		hostURL := *u
+		hostQuery := url.Values{}
+		for k, v := range q {
+			hostQuery[k] = v
+		}
+		switch {
+		case host == "":
+			return nil, fmt.Errorf("empty host in %s", dbURL)
+		case strings.HasPrefix(host, "/"):
+			// A Unix socket directory, see withSocket.
+			hostURL.Host = ""
+			if port != "" {
+				hostURL.Host = ":" + port
+			}
+			hostQuery.Set("host", host)
+		case port != "":
+			hostURL.Host = net.JoinHostPort(host, port)
+		case strings.Contains(host, ":"):
+			hostURL.Host = "[" + host + "]"
+		default:
+			hostURL.Host = host
+		}
+		hostURL.RawQuery = hostQuery.Encode()
+		urls[i] = hostURL.String()
+	}
+	return urls, nil
+}
+
+// firstHost returns the URL of the first host of dbURL, for examples that
+// connect to a single node.
+func firstHost(dbURL string) (string, error) {
+	urls, err := SplitHosts(dbURL)
+	if err != nil {
+		return "", err
+	}
+	if len(urls) > 1 {
+		log.Printf("connecting to the first of the %d hosts of the db URL only", len(urls))
+	}
+	return urls[0], nil
+}
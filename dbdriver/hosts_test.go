@@ -0,0 +1,68 @@
+// Copyright 2016 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package dbdriver
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitHosts(t *testing.T) {
+	testCases := []struct {
+		urls     []string
+		expected []string
+	}{
+		{[]string{"postgresql://root@a:26257/bank?sslmode=disable"},
+			[]string{"postgresql://root@a:26257/bank?sslmode=disable"}},
+		{[]string{"postgresql://root@a:26257,b:26258,[::1]:26259/bank?sslmode=disable"},
+			[]string{
+				"postgresql://root@a:26257/bank?sslmode=disable",
+				"postgresql://root@b:26258/bank?sslmode=disable",
+				"postgresql://root@[::1]:26259/bank?sslmode=disable",
+			}},
+		{[]string{"postgresql://root@/bank?host=a,b,::1&port=26257&sslmode=disable"},
+			[]string{
+				"postgresql://root@a:26257/bank?sslmode=disable",
+				"postgresql://root@b:26257/bank?sslmode=disable",
+				"postgresql://root@[::1]:26257/bank?sslmode=disable",
+			}},
+		{[]string{"postgresql://root@/bank?host=a,b&port=26257,26258", "postgresql://root@c"},
+			[]string{
+				"postgresql://root@a:26257/bank",
+				"postgresql://root@b:26258/bank",
+				"postgresql://root@c",
+			}},
+		{[]string{"postgresql://root@:26257/bank?host=/tmp,a"},
+			[]string{
+				"postgresql://root@:26257/bank?host=%2Ftmp",
+				"postgresql://root@a:26257/bank",
+			}},
+	}
+	for _, c := range testCases {
+		urls, err := SplitHosts(c.urls...)
+		if err != nil {
+			t.Errorf("%s: %s", c.urls, err)
+			continue
+		}
+		if !reflect.DeepEqual(urls, c.expected) {
+			t.Errorf("%s: expected %s, got %s", c.urls, c.expected, urls)
+		}
+	}
+
+	if _, err := SplitHosts("postgresql://root@/bank?host=a,b,c&port=1,2"); err == nil {
+		t.Error("expected an error for mismatched ports")
+	}
+}
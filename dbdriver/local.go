@@ -0,0 +1,151 @@
+// Copyright 2016 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package dbdriver
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// With --start-local, an example needs no setup: it starts a throwaway
+// single-node cluster, runs against it, and tears it down on exit.
+//
+// To tear the cluster down however the example exits, including through
+// log.Fatal, the process starting the cluster runs the example again as a
+// child process, passing it the URL of the cluster in localURLEnv, and
+// waits for it.
+var startLocal = flag.Bool("start-local", false,
+	"Start a throwaway single-node cluster to run against, and stop it on exit.")
+var cockroachBinary = flag.String("cockroach-binary", "cockroach",
+	"The cockroach binary started by --start-local.")
+
+// localURLEnv passes the URL of the local cluster to the child process.
+const localURLEnv = "EXAMPLES_GO_LOCAL_URL"
+
+// localStartTimeout bounds the time the local cluster takes to start, if
+// --connect-timeout is 0.
+const localStartTimeout = 30 * time.Second
+
+// runLocal starts a single-node cluster in a temporary directory, runs the
+// example again against it, then stops the cluster and exits with the
+// status of the example.
+func runLocal() {
+	dir, err := ioutil.TempDir("", "examples-go-local")
+	if err != nil {
+		log.Fatal(err)
+	}
+	urlFile := filepath.Join(dir, "url")
+	node := exec.Command(*cockroachBinary, "start-single-node", "--insecure",
+		"--store="+filepath.Join(dir, "data"),
+		"--listen-addr=localhost:0", "--http-addr=localhost:0",
+		"--listening-url-file="+urlFile,
+		"--log-dir="+filepath.Join(dir, "logs"))
+	detach(node)
+	if err := node.Start(); err != nil {
+		_ = os.RemoveAll(dir)
+		log.Fatalf("starting %s: %s", *cockroachBinary, err)
+	}
+	exited := make(chan error, 1)
+	go func() { exited <- node.Wait() }()
+	stop := func() {
+		_ = node.Process.Kill()
+		<-exited
+		_ = os.RemoveAll(dir)
+	}
+
+	timeout := *connectTimeout
+	if timeout == 0 {
+		timeout = localStartTimeout
+	}
+	dbURL, err := waitForURLFile(urlFile, exited, timeout)
+	if err != nil {
+		stop()
+		log.Fatalf("starting a local cluster: %s (logs in %s)", err, filepath.Join(dir, "logs"))
+	}
+	log.Printf("started a local cluster at %s", dbURL)
+
+	example := exec.Command(os.Args[0], os.Args[1:]...)
+	example.Stdin, example.Stdout, example.Stderr = os.Stdin, os.Stdout, os.Stderr
+	example.Env = append(os.Environ(), localURLEnv+"="+dbURL)
+
+	// Interrupts from the terminal reach the example directly, and the node
+	// runs in a process group of its own; SIGTERM is passed on.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	if err := example.Start(); err != nil {
+		stop()
+		log.Fatal(err)
+	}
+	go func() {
+		for sig := range signals {
+			if sig != os.Interrupt {
+				_ = example.Process.Signal(sig)
+			}
+		}
+	}()
+	err = example.Wait()
+	log.Printf("stopping the local cluster")
+	stop()
+
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+			os.Exit(status.ExitStatus())
+		}
+		os.Exit(1)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	os.Exit(0)
+}
+
+// waitForURLFile waits for the node to write its URL to file.
+func waitForURLFile(file string, exited <-chan error, timeout time.Duration) (string, error) {
+	deadline := time.After(timeout)
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case err := <-exited:
+			if err == nil {
+				err = errors.New("exited")
+			}
+			return "", fmt.Errorf("node stopped: %s", err)
+		case <-deadline:
+			return "", fmt.Errorf("node not started after %s", timeout)
+		case <-ticker.C:
+			b, err := ioutil.ReadFile(file)
+			if err != nil && !os.IsNotExist(err) {
+				return "", err
+			}
+			// The file may be read while being written: wait for the end of
+			// the line.
+			if s := string(b); strings.HasSuffix(s, "\n") {
+				return strings.TrimSpace(s), nil
+			}
+		}
+	}
+}
@@ -0,0 +1,114 @@
+// Copyright 2016 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package dbdriver
+
+import (
+	"errors"
+	"flag"
+	"log"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Behind a pooler in transaction pooling mode, such as PgBouncer, each
+// transaction may run on a different server connection, so no session state
+// may outlive a transaction.
+var pooler = flag.Bool("pooler", false,
+	"Run behind a connection pooler in transaction pooling mode, such as PgBouncer, "+
+		"keeping no session state across transactions.")
+
+// errPoolerPgx is returned when pgx is used with --pooler: it prepares named
+// statements on each connection, which the pooler doesn't follow.
+var errPoolerPgx = errors.New("--pooler can't be used with --driver=pgx, which keeps named prepared " +
+	"statements on its connections; use --driver=postgres")
+
+// clientParams are the parameters of a db URL used by lib/pq itself, rather
+// than sent to the server on connect.
+var clientParams = map[string]bool{
+	"binary_parameters":         true,
+	"connect_timeout":           true,
+	"dbname":                    true,
+	"fallback_application_name": true,
+	"host":                      true,
+	"password":                  true,
+	"port":                      true,
+	"sslcert":                   true,
+	"sslkey":                    true,
+	"sslmode":                   true,
+	"sslrootcert":               true,
+	"user":                      true,
+}
+
+// poolerParams are the parameters PgBouncer accepts on connect. It rejects
+// the others unless configured to ignore them.
+var poolerParams = map[string]bool{
+	"application_name":            true,
+	"client_encoding":             true,
+	"datestyle":                   true,
+	"standard_conforming_strings": true,
+	"timezone":                    true,
+}
+
+// forPooler returns dbURL changed to keep no session state, and logs the
+// parameters a pooler may reject.
+func forPooler(dbURL string) (string, error) {
+	u, err := url.Parse(dbURL)
+	if err != nil {
+		return "", err
+	}
+	q := u.Query()
+	var rejected []string
+	for param := range q {
+		if !clientParams[param] && !poolerParams[strings.ToLower(param)] {
+			rejected = append(rejected, param)
+		}
+	}
+	if len(rejected) > 0 {
+		sort.Strings(rejected)
+		log.Printf("--pooler: the pooler may reject the %s parameters of the db URL, "+
+			"unless they are listed in its ignore_startup_parameters", strings.Join(rejected, ", "))
+	}
+	// By default, lib/pq parses a query and binds its parameters in two
+	// round trips, between which a pooler may switch server connections.
+	// With binary_parameters, it sends both at once.
+	q.Set("binary_parameters", "yes")
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// Pooler returns whether --pooler is set, in which case the examples must
+// not prepare statements: their server connection may be gone by the time
+// they're used.
+func Pooler() bool {
+	return *pooler
+}
+
+var poolerHintOnce sync.Once
+
+// hintPooler logs a hint to use --pooler the first time a statement fails
+// the way it does behind a pooler, when it isn't set.
+func hintPooler(err error) {
+	// 26000 is invalid_sql_statement_name: a prepared statement vanished
+	// with the server connection it was on.
+	if *pooler || Code(err) != "26000" {
+		return
+	}
+	poolerHintOnce.Do(func() {
+		log.Printf("%s: if running behind a connection pooler in transaction pooling mode, use --pooler", err)
+	})
+}
@@ -0,0 +1,35 @@
+// Copyright 2016 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package dbdriver
+
+import "testing"
+
+func TestForPooler(t *testing.T) {
+	dbURL, err := forPooler("postgresql://root@pgbouncer:6432/bank?sslmode=disable&application_name=bank")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "postgresql://root@pgbouncer:6432/bank?application_name=bank&binary_parameters=yes&sslmode=disable"
+	if dbURL != expected {
+		t.Errorf("expected %s, got %s", expected, dbURL)
+	}
+
+	defer func(p bool) { *pooler = p }(*pooler)
+	*pooler = true
+	if _, err := Open("pgx", "postgresql://root@pgbouncer:6432/bank"); err != errPoolerPgx {
+		t.Errorf("expected %v, got %v", errPoolerPgx, err)
+	}
+}
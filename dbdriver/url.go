@@ -0,0 +1,181 @@
+// Copyright 2016 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package dbdriver
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// URLEnv is the environment variable holding the db URL when none is given
+// otherwise.
+const URLEnv = "DATABASE_URL"
+
+// Passing the db URL on the command line leaks its password into process
+// listings and shell history, so the examples can also read it from a file
+// or the environment, and prompt for the password.
+var urlFile = flag.String("url-file", "",
+	"File holding the db URL, used when none is given on the command line.")
+var passwordPrompt = flag.Bool("password-prompt", false,
+	"Prompt for the password of the db user instead of taking it from the db URL.")
+
+// Colocated benchmarks may connect through a Unix socket to avoid the
+// overhead of TCP loopback.
+var socket = flag.String("socket", "",
+	"Unix socket to connect through instead of TCP: either the socket file, e.g. /tmp/.s.PGSQL.26257, or its directory.")
+
+// socketPrefix is the prefix of the names of Postgres sockets, followed by
+// the port.
+const socketPrefix = ".s.PGSQL."
+
+// URL returns the db URL, taken from the first of arg (usually from the
+// command line), the --url-file flag, the URL builder flags (--host, --port,
+// etc.), the DATABASE_URL environment variable and defaultURL that is set.
+// The URL is then changed to connect through --socket, route to --cluster,
+// and use the password of --password-file or --password-prompt.
+//
+// With --start-local, URL starts a local cluster and runs the example again
+// against it, and doesn't return.
+func URL(arg, defaultURL string) (string, error) {
+	if localURL := os.Getenv(localURLEnv); localURL != "" {
+		// Running against the cluster started by --start-local.
+		return localURL, nil
+	}
+	if *startLocal {
+		if arg != "" || *urlFile != "" || partsFromFlags().set() {
+			return "", errors.New("--start-local can't be combined with a db URL")
+		}
+		runLocal()
+	}
+
+	dbURL := arg
+	if dbURL == "" && *urlFile != "" {
+		b, err := ioutil.ReadFile(*urlFile)
+		if err != nil {
+			return "", err
+		}
+		if dbURL = strings.TrimSpace(string(b)); dbURL == "" {
+			return "", fmt.Errorf("%s is empty", *urlFile)
+		}
+	}
+	if parts := partsFromFlags(); parts.set() {
+		if dbURL != "" {
+			return "", errors.New("--host, --port, --user, --database and the --ssl flags " +
+				"can't be combined with a db URL")
+		}
+		var err error
+		if dbURL, err = parts.build(); err != nil {
+			return "", err
+		}
+	}
+	if dbURL == "" {
+		dbURL = os.Getenv(URLEnv)
+	}
+	if dbURL == "" {
+		dbURL = defaultURL
+	}
+	if dbURL == "" {
+		return "", errors.New("no db URL: pass one on the command line, with --url-file or in $" + URLEnv)
+	}
+	if *socket != "" {
+		var err error
+		if dbURL, err = withSocket(dbURL, *socket); err != nil {
+			return "", err
+		}
+	}
+	if *cluster != "" {
+		var err error
+		if dbURL, err = withCluster(dbURL, *cluster); err != nil {
+			return "", err
+		}
+	}
+	if *passwordFile != "" {
+		if *passwordPrompt {
+			return "", errors.New("--password-file and --password-prompt can't be combined")
+		}
+		return withPasswordFile(dbURL, *passwordFile)
+	}
+	if *passwordPrompt {
+		return promptPassword(dbURL)
+	}
+	return dbURL, nil
+}
+
+// withSocket returns dbURL changed to connect through a Unix socket, using
+// the host=/dir syntax of lib/pq. The port is taken from the name of the
+// socket file, if given.
+func withSocket(dbURL, socket string) (string, error) {
+	u, err := url.Parse(dbURL)
+	if err != nil {
+		return "", err
+	}
+	dir, port := socket, ""
+	if base := filepath.Base(socket); strings.HasPrefix(base, socketPrefix) {
+		dir, port = filepath.Dir(socket), strings.TrimPrefix(base, socketPrefix)
+	}
+	if port == "" {
+		if _, p, err := net.SplitHostPort(u.Host); err == nil {
+			port = p
+		}
+	}
+	// The host of the URL would take precedence over the socket directory.
+	u.Host = ""
+	if port != "" {
+		u.Host = ":" + port
+	}
+	q := u.Query()
+	q.Set("host", dir)
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// isSocketURL returns whether dbURL connects through a Unix socket.
+func isSocketURL(dbURL string) bool {
+	u, err := url.Parse(dbURL)
+	return err == nil && strings.HasPrefix(u.Query().Get("host"), "/")
+}
+
+// promptPassword returns dbURL with the password read from the terminal.
+func promptPassword(dbURL string) (string, error) {
+	u, err := url.Parse(dbURL)
+	if err != nil {
+		return "", err
+	}
+	if u.User == nil {
+		return "", fmt.Errorf("no user to prompt a password for in %s", dbURL)
+	}
+	fd := int(os.Stdin.Fd())
+	if !terminal.IsTerminal(fd) {
+		return "", errors.New("--password-prompt requires a terminal")
+	}
+	fmt.Fprintf(os.Stderr, "Password for %s: ", u.User.Username())
+	password, err := terminal.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	u.User = url.UserPassword(u.User.Username(), string(password))
+	return u.String(), nil
+}
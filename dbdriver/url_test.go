@@ -0,0 +1,199 @@
+// Copyright 2016 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package dbdriver
+
+import (
+	"io/ioutil"
+	"net/url"
+	"os"
+	"testing"
+)
+
+func TestURL(t *testing.T) {
+	f, err := ioutil.TempFile("", "url")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.Remove(f.Name()) }()
+	if _, err := f.WriteString("postgresql://file@localhost:26257\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(env string) { _ = os.Setenv(URLEnv, env) }(os.Getenv(URLEnv))
+	defer func(file string) { *urlFile = file }(*urlFile)
+
+	testCases := []struct {
+		arg, file, env, def string
+		expected            string
+	}{
+		{"postgresql://arg@localhost", f.Name(), "postgresql://env@localhost", "", "postgresql://arg@localhost"},
+		{"", f.Name(), "postgresql://env@localhost", "", "postgresql://file@localhost:26257"},
+		{"", "", "postgresql://env@localhost", "postgresql://def@localhost", "postgresql://env@localhost"},
+		{"", "", "", "postgresql://def@localhost", "postgresql://def@localhost"},
+		{"", "", "", "", ""},
+	}
+	for i, c := range testCases {
+		*urlFile = c.file
+		if err := os.Setenv(URLEnv, c.env); err != nil {
+			t.Fatal(err)
+		}
+		dbURL, err := URL(c.arg, c.def)
+		if c.expected == "" {
+			if err == nil {
+				t.Errorf("%d: expected an error, got %s", i, dbURL)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%d: %s", i, err)
+		} else if dbURL != c.expected {
+			t.Errorf("%d: expected %s, got %s", i, c.expected, dbURL)
+		}
+	}
+}
+
+func TestWithSocket(t *testing.T) {
+	testCases := []struct {
+		url, socket string
+		expected    string
+	}{
+		{"postgresql://root@localhost:26257/bank?sslmode=disable", "/tmp",
+			"postgresql://root@:26257/bank?host=%2Ftmp&sslmode=disable"},
+		{"postgresql://root@localhost/bank", "/tmp/.s.PGSQL.26258",
+			"postgresql://root@:26258/bank?host=%2Ftmp"},
+		{"postgresql://root@localhost/bank", "/var/run",
+			"postgresql://root@/bank?host=%2Fvar%2Frun"},
+	}
+	for _, c := range testCases {
+		dbURL, err := withSocket(c.url, c.socket)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dbURL != c.expected {
+			t.Errorf("%s with %s: expected %s, got %s", c.url, c.socket, c.expected, dbURL)
+		}
+		if !isSocketURL(dbURL) {
+			t.Errorf("%s: expected a socket URL", dbURL)
+		}
+	}
+}
+
+func TestBuildURL(t *testing.T) {
+	f, err := ioutil.TempFile("", "ca.crt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.Remove(f.Name()) }()
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	cert := f.Name()
+
+	testCases := []struct {
+		parts    urlParts
+		expected string
+		err      string
+	}{
+		{urlParts{database: "bank"}, "postgresql://root@localhost:26257/bank?sslmode=disable", ""},
+		{urlParts{host: "db", port: 26258, user: "app"}, "postgresql://app@db:26258?sslmode=disable", ""},
+		{urlParts{sslRootCert: cert},
+			"postgresql://root@localhost:26257?sslmode=verify-full&sslrootcert=" + url.QueryEscape(cert), ""},
+		{urlParts{sslMode: "require"}, "postgresql://root@localhost:26257?sslmode=require", ""},
+		{urlParts{sslMode: "verify"}, "", `unknown --sslmode "verify"`},
+		{urlParts{sslMode: "verify-ca"}, "", "--sslmode verify-ca requires --sslrootcert"},
+		{urlParts{sslMode: "disable", sslRootCert: cert}, "", "certificates are given, but --sslmode is disable"},
+		{urlParts{sslMode: "require", sslCert: cert}, "", "--sslcert and --sslkey must be given together"},
+		{urlParts{port: 100000}, "", "--port 100000 is out of range"},
+	}
+	for i, c := range testCases {
+		dbURL, err := c.parts.build()
+		if c.err != "" {
+			if err == nil || err.Error() != c.err {
+				t.Errorf("%d: expected error %q, got %v", i, c.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%d: %s", i, err)
+		} else if dbURL != c.expected {
+			t.Errorf("%d: expected %s, got %s", i, c.expected, dbURL)
+		}
+	}
+
+	if _, err := (urlParts{sslMode: "require", sslCert: "missing.crt", sslKey: "missing.key"}).build(); err == nil {
+		t.Error("expected an error for missing certificates")
+	}
+}
+
+func TestWithCluster(t *testing.T) {
+	defer func(home string) { _ = os.Setenv("HOME", home) }(os.Getenv("HOME"))
+	if err := os.Setenv("HOME", "/nonexistent"); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		url, expected string
+	}{
+		{"postgresql://app@free-tier.gcp-us-central1.cockroachlabs.cloud:26257/bank",
+			"postgresql://app@free-tier.gcp-us-central1.cockroachlabs.cloud:26257/bank?" +
+				"options=--cluster%3Dmy-cluster-123&sslmode=verify-full"},
+		{"postgresql://app@host:26257?sslmode=verify-ca&sslrootcert=ca.crt&options=-c%20a%3Db",
+			"postgresql://app@host:26257?options=-c+a%3Db+--cluster%3Dmy-cluster-123&" +
+				"sslmode=verify-ca&sslrootcert=ca.crt"},
+	}
+	for _, c := range testCases {
+		dbURL, err := withCluster(c.url, "my-cluster-123")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dbURL != c.expected {
+			t.Errorf("%s: expected %s, got %s", c.url, c.expected, dbURL)
+		}
+	}
+
+	if _, err := withCluster("postgresql://app@host:26257?sslmode=disable", "my-cluster-123"); err == nil {
+		t.Error("expected an error with sslmode=disable")
+	}
+}
+
+func TestWithPasswordFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.Remove(f.Name()) }()
+	if _, err := f.WriteString("tok/en+with@special:chars\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	dbURL, err := withPasswordFile("postgresql://app@host:26257/bank", f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(dbURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if password, _ := u.User.Password(); password != "tok/en+with@special:chars" {
+		t.Errorf("unexpected password %q in %s", password, dbURL)
+	}
+}
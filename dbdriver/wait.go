@@ -0,0 +1,84 @@
+// Copyright 2016 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package dbdriver
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"time"
+)
+
+// The examples are often started along with the cluster, e.g. by
+// docker-compose or kubernetes, and must then wait for it to come up.
+var connectTimeout = flag.Duration("connect-timeout", 30*time.Second,
+	"How long to retry connecting to the database on startup. 0 disables retries.")
+
+const (
+	minConnectBackoff = 100 * time.Millisecond
+	maxConnectBackoff = 5 * time.Second
+)
+
+// Wait waits for db to be reachable, retrying with exponential backoff for
+// up to --connect-timeout.
+func Wait(db *sql.DB) error {
+	return wait(db.Ping, *connectTimeout, time.Sleep)
+}
+
+// wait calls ping until it succeeds or returns an error that retrying
+// won't fix, for up to timeout.
+func wait(ping func() error, timeout time.Duration, sleep func(time.Duration)) error {
+	var waited time.Duration
+	backoff := minConnectBackoff
+	for {
+		err := ping()
+		if err == nil || !retryableConnectError(err) {
+			return err
+		}
+		if waited+backoff > timeout {
+			if timeout == 0 {
+				return err
+			}
+			return fmt.Errorf("database unreachable after %s: %s", waited, err)
+		}
+		log.Printf("database unreachable, retrying in %s: %s", backoff, err)
+		sleep(backoff)
+		waited += backoff
+		if backoff *= 2; backoff > maxConnectBackoff {
+			backoff = maxConnectBackoff
+		}
+	}
+}
+
+// retryableConnectError returns whether err may go away as the database
+// starts: a network error, such as a refused connection, a connection
+// closed by the server, or an error of class 57, which covers servers not
+// accepting connections yet. Other errors, such as authentication failures
+// or the errors of MySQL, which have no SQLSTATE code, are permanent.
+func retryableConnectError(err error) bool {
+	switch err {
+	case io.EOF, io.ErrUnexpectedEOF, driver.ErrBadConn:
+		return true
+	}
+	if _, ok := err.(net.Error); ok {
+		return true
+	}
+	return Class(err) == "57"
+}
@@ -0,0 +1,74 @@
+// Copyright 2016 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package dbdriver
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/pq"
+	"github.com/go-sql-driver/mysql"
+)
+
+func TestWait(t *testing.T) {
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	testCases := []struct {
+		errs     []error
+		timeout  time.Duration
+		sleeps   []time.Duration
+		expected bool
+	}{
+		// Reachable right away.
+		{nil, time.Minute, nil, true},
+		// Reachable after the cluster starts.
+		{[]error{refused, &pq.Error{Code: "57P03"}, refused}, time.Minute,
+			[]time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond}, true},
+		// Authentication failures aren't retried.
+		{[]error{&pq.Error{Code: "28P01"}}, time.Minute, nil, false},
+		// Neither are the errors of MySQL, which have no SQLSTATE code.
+		{[]error{&mysql.MySQLError{Number: 1045, Message: "Access denied"}}, time.Minute, nil, false},
+		{[]error{&mysql.MySQLError{Number: 1049, Message: "Unknown database"}}, time.Minute, nil, false},
+		// Retries are disabled.
+		{[]error{refused}, 0, nil, false},
+		// Gives up once the next backoff would exceed the timeout: the
+		// 1.5s of sleeps fit, the next 1.6s don't.
+		{[]error{refused, refused, refused, refused, refused}, 1500 * time.Millisecond,
+			[]time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond,
+				800 * time.Millisecond}, false},
+	}
+	for i, c := range testCases {
+		errs := c.errs
+		ping := func() error {
+			if len(errs) == 0 {
+				return nil
+			}
+			err := errs[0]
+			errs = errs[1:]
+			return err
+		}
+		var sleeps []time.Duration
+		err := wait(ping, c.timeout, func(d time.Duration) { sleeps = append(sleeps, d) })
+		if (err == nil) != c.expected {
+			t.Errorf("%d: unexpected result %v", i, err)
+		}
+		if !reflect.DeepEqual(sleeps, c.sleeps) {
+			t.Errorf("%d: expected sleeps %v, got %v", i, c.sleeps, sleeps)
+		}
+	}
+}
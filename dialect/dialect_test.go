@@ -0,0 +1,88 @@
+// Copyright 2016 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package dialect
+
+import (
+	"errors"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/cockroachdb/pq"
+	"github.com/go-sql-driver/mysql"
+)
+
+func TestBind(t *testing.T) {
+	query, args := MySQL.Bind(`SELECT $2, $1 + $2`, "a", "b")
+	if expected := `SELECT ?, ? + ?`; query != expected {
+		t.Errorf("expected %q, got %q", expected, query)
+	}
+	if expected := []interface{}{"b", "a", "b"}; !reflect.DeepEqual(args, expected) {
+		t.Errorf("expected %v, got %v", expected, args)
+	}
+
+	query, args = Cockroach.Bind(`SELECT $1`, "a")
+	if query != `SELECT $1` || !reflect.DeepEqual(args, []interface{}{"a"}) {
+		t.Errorf("unexpected rewrite: %q %v", query, args)
+	}
+}
+
+func TestClassify(t *testing.T) {
+	testCases := []struct {
+		d        Dialect
+		err      error
+		expected ErrorClass
+	}{
+		{Cockroach, &pq.Error{Code: "40001"}, RetryError},
+		{Cockroach, &pq.Error{Code: "23505"}, IntegrityError},
+		{Postgres, &pq.Error{Code: "40P01"}, RetryError},
+		{Postgres, &pq.Error{Code: "42P01"}, OtherError},
+		{MySQL, &mysql.MySQLError{Number: 1062}, IntegrityError},
+		{MySQL, &mysql.MySQLError{Number: 1213}, RetryError},
+		{MySQL, &pq.Error{Code: "40001"}, OtherError},
+		{Cockroach, errors.New("connection refused"), OtherError},
+	}
+	for i, c := range testCases {
+		if class := c.d.Classify(c.err); class != c.expected {
+			t.Errorf("%d: %s: expected %d, got %d", i, c.d.Name(), c.expected, class)
+		}
+	}
+}
+
+func TestMySQLDataSource(t *testing.T) {
+	testCases := []struct {
+		url      string
+		expected string
+	}{
+		{"mysql://root@localhost:3306/ledger", "root@tcp(localhost:3306)/ledger"},
+		{"mysql://u:p%40ss@db:3306/ledger?tls=true", "u:p@ss@tcp(db:3306)/ledger?tls=true"},
+		{"mysql://db:3306", "tcp(db:3306)/"},
+		{"mysql://root@/ledger?host=/var/run/mysqld/mysqld.sock", "root@unix(/var/run/mysqld/mysqld.sock)/ledger"},
+	}
+	for _, c := range testCases {
+		u, err := url.Parse(c.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dsn, err := MySQLDataSource(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dsn != c.expected {
+			t.Errorf("%s: expected %q, got %q", c.url, c.expected, dsn)
+		}
+	}
+}
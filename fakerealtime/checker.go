@@ -0,0 +1,141 @@
+// Copyright 2016 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+// A monotonicityChecker verifies the message IDs a reader observes on its
+// channels. Writers assign message IDs sequentially per channel, so a
+// reader must never see a channel's IDs go backwards, and must never see
+// a gap that is filled in later: that would mean a message became visible
+// after a newer message of the same channel had already been read.
+type monotonicityChecker struct {
+	mu        sync.Mutex
+	highWater map[string]int64
+	// missing holds, per channel, the IDs below the high-water mark that
+	// haven't been observed yet, with the number of polls that missed them.
+	missing map[string]map[int64]int
+	// abandoned counts the missing IDs given up on after maxMissingPolls.
+	abandoned int
+	anomalies []string
+}
+
+// maxMissingPolls is the number of polls after which a missing ID is
+// counted as a gap and no longer polled for. Polls start from the lowest
+// missing ID, so a permanent gap followed by more than a poll depth of
+// messages would otherwise keep them from ever reaching new ones.
+const maxMissingPolls = 20
+
+func newMonotonicityChecker() *monotonicityChecker {
+	return &monotonicityChecker{
+		highWater: make(map[string]int64),
+		missing:   make(map[string]map[int64]int),
+	}
+}
+
+// from returns the message ID after which the next poll of a channel
+// should start reading, so that it covers the IDs still missing as well as
+// any new ones.
+func (c *monotonicityChecker) from(channel string) int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	from := c.highWater[channel]
+	for id := range c.missing[channel] {
+		if id-1 < from {
+			from = id - 1
+		}
+	}
+	return from
+}
+
+// highWaterMark returns the highest message ID observed on a channel.
+// Polls read the IDs above it for the first time.
+func (c *monotonicityChecker) highWaterMark(channel string) int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.highWater[channel]
+}
+
+// observe records the message IDs returned by a poll of a channel that
+// read, in ascending order, the IDs after from. If complete is false, the
+// poll stopped at a limit and may not have reached the high-water mark.
+func (c *monotonicityChecker) observe(channel string, from int64, ids []int64, complete bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	hw := c.highWater[channel]
+	prev := from
+	for _, id := range ids {
+		if id <= prev {
+			c.anomaly("channel %s: read message %d after message %d", channel, id, prev)
+			delete(c.missing[channel], id)
+			continue
+		}
+		prev = id
+		switch {
+		case id <= hw:
+			if _, ok := c.missing[channel][id]; ok {
+				c.anomaly("channel %s: message %d appeared after message %d had been read", channel, id, hw)
+				delete(c.missing[channel], id)
+			}
+		default:
+			if id > hw+1 {
+				if c.missing[channel] == nil {
+					c.missing[channel] = make(map[int64]int)
+				}
+				for m := hw + 1; m < id; m++ {
+					c.missing[channel][m] = 0
+				}
+			}
+			hw = id
+		}
+	}
+	if complete && from < c.highWater[channel] && prev < c.highWater[channel] {
+		c.anomaly("channel %s: high-water mark went backwards from %d to %d", channel, c.highWater[channel], prev)
+	}
+	c.highWater[channel] = hw
+	// Only the missing IDs within the range read count this poll against
+	// them. The lowest one always is, so polls keep moving forward.
+	for id, polls := range c.missing[channel] {
+		if !complete && id > prev {
+			continue
+		}
+		if polls+1 < maxMissingPolls {
+			c.missing[channel][id] = polls + 1
+			continue
+		}
+		delete(c.missing[channel], id)
+		c.abandoned++
+	}
+}
+
+func (c *monotonicityChecker) anomaly(format string, args ...interface{}) {
+	c.anomalies = append(c.anomalies, fmt.Sprintf(format, args...))
+}
+
+// results returns the anomalies found so far, along with the number of
+// messages that were skipped over and never showed up.
+func (c *monotonicityChecker) results() ([]string, int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	gaps := c.abandoned
+	for _, m := range c.missing {
+		gaps += len(m)
+	}
+	return append([]string(nil), c.anomalies...), gaps
+}
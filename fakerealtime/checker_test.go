@@ -0,0 +1,89 @@
+// Copyright 2016 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMonotonicityChecker(t *testing.T) {
+	type poll struct {
+		ids      []int64
+		complete bool
+	}
+	testCases := []struct {
+		polls     []poll
+		anomalies []string
+		gaps      int
+	}{
+		{
+			polls: []poll{{[]int64{1, 2}, true}, {nil, true}, {[]int64{3}, true}},
+		},
+		{
+			// A poll stopping at the poll depth doesn't skip anything.
+			polls: []poll{{[]int64{1, 2}, false}, {[]int64{3, 4}, true}},
+		},
+		{
+			polls: []poll{{[]int64{1, 3}, true}},
+			gaps:  1,
+		},
+		{
+			polls:     []poll{{[]int64{1, 3}, true}, {[]int64{2, 3, 4}, true}},
+			anomalies: []string{"channel c: message 2 appeared after message 3 had been read"},
+		},
+		{
+			polls:     []poll{{[]int64{2, 1}, true}},
+			anomalies: []string{"channel c: read message 1 after message 2"},
+		},
+		{
+			polls:     []poll{{[]int64{1, 4}, true}, {nil, true}},
+			anomalies: []string{"channel c: high-water mark went backwards from 4 to 1"},
+			gaps:      2,
+		},
+	}
+
+	for i, tc := range testCases {
+		c := newMonotonicityChecker()
+		for _, p := range tc.polls {
+			c.observe("c", c.from("c"), p.ids, p.complete)
+		}
+		anomalies, gaps := c.results()
+		if !reflect.DeepEqual(anomalies, tc.anomalies) {
+			t.Errorf("%d: expected anomalies %q, got %q", i, tc.anomalies, anomalies)
+		}
+		if gaps != tc.gaps {
+			t.Errorf("%d: expected %d gaps, got %d", i, tc.gaps, gaps)
+		}
+	}
+}
+
+func TestMonotonicityCheckerGivesUp(t *testing.T) {
+	c := newMonotonicityChecker()
+	c.observe("c", c.from("c"), []int64{1, 3}, true)
+	for i := 1; i < maxMissingPolls; i++ {
+		if from := c.from("c"); from != 1 {
+			t.Fatalf("poll %d: expected to poll from 1, got %d", i, from)
+		}
+		c.observe("c", c.from("c"), []int64{3}, true)
+	}
+	if from := c.from("c"); from != 3 {
+		t.Errorf("expected to give up on message 2 and poll from 3, got %d", from)
+	}
+	if anomalies, gaps := c.results(); len(anomalies) != 0 || gaps != 1 {
+		t.Errorf("expected 1 gap and no anomalies, got %d and %q", gaps, anomalies)
+	}
+}
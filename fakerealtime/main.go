@@ -21,10 +21,11 @@
 // organized by channel, and a global `updates` table stores metadata
 // about recently-updated channels.
 //
-// The example currently runs a number of writers, which update both
-// tables transactionally. Future work includes implementing a reader
-// which will effectively tail the `updates` table to learn when it
-// needs to query a channel's messages from the `messages` table.
+// The example runs a number of writers, which update both tables
+// transactionally, and a number of readers, each of which follows a set
+// of channels. A reader either polls each of its channels directly or
+// tails the `updates` table to learn which of its channels need to be
+// queried from the `messages` table.
 //
 // The implementation currently guarantees that `update_ids` are
 // strictly monotonic, which is extremely expensive under contention
@@ -48,14 +49,26 @@ package main
 
 import (
 	"database/sql"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
 	"math/rand"
+	"net/url"
 	"os"
+	"os/signal"
+	"sort"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
+	"github.com/cockroachdb/examples-go/capture"
+	"github.com/cockroachdb/examples-go/chaos"
+	"github.com/cockroachdb/examples-go/control"
+	"github.com/cockroachdb/examples-go/dbdriver"
+	"github.com/codahale/hdrhistogram"
 	"github.com/montanaflynn/stats"
 	// Import postgres driver.
 	_ "github.com/cockroachdb/pq"
@@ -89,106 +102,494 @@ func createTables(db *sql.DB) error {
 	return nil
 }
 
+// newMessage returns the body of a message written at t. It carries the
+// time for readers to measure the delivery latency of the message.
+func newMessage(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+// messageTime returns the time the message was written at.
+func messageTime(message string) (time.Time, error) {
+	nanos, err := strconv.ParseInt(message, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("message %q carries no time: %s", message, err)
+	}
+	return time.Unix(0, nanos), nil
+}
+
 type statistics struct {
 	sync.Mutex
-	writeTimes stats.Float64Data
+	writeTimes      stats.Float64Data
+	messagesWritten int
+	readTimes       stats.Float64Data
+	staleness       stats.Float64Data
+	messagesRead    int
+	// delivery holds the delivery latencies of the messages read since
+	// the last report, and channelDelivery those of each channel over the
+	// whole run.
+	delivery        stats.Float64Data
+	channelDelivery map[string]*hdrhistogram.Histogram
 }
 
-func (s *statistics) recordWrite(start time.Time) {
+// recordWrite records a transaction that wrote the given number of
+// messages.
+func (s *statistics) recordWrite(start time.Time, messages int) {
 	duration := time.Now().Sub(start)
 	s.Lock()
 	defer s.Unlock()
 	s.writeTimes = append(s.writeTimes, float64(duration.Nanoseconds()))
+	s.messagesWritten += messages
+}
+
+func (s *statistics) recordRead(start time.Time, messages int, staleness time.Duration) {
+	duration := time.Now().Sub(start)
+	s.Lock()
+	defer s.Unlock()
+	s.readTimes = append(s.readTimes, float64(duration.Nanoseconds()))
+	s.staleness = append(s.staleness, float64(staleness.Nanoseconds()))
+	s.messagesRead += messages
+}
+
+// recordDelivery records the delivery latencies of messages of a channel
+// read for the first time by a reader: the time from their write to the
+// end of their read.
+func (s *statistics) recordDelivery(channel string, latencies []time.Duration) {
+	if len(latencies) == 0 {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	h, ok := s.channelDelivery[channel]
+	if !ok {
+		if s.channelDelivery == nil {
+			s.channelDelivery = make(map[string]*hdrhistogram.Histogram)
+		}
+		h = hdrhistogram.New(0, int64(time.Minute), 1)
+		s.channelDelivery[channel] = h
+	}
+	for _, l := range latencies {
+		s.delivery = append(s.delivery, float64(l.Nanoseconds()))
+		_ = h.RecordValue(int64(l))
+	}
+}
+
+// maxReportedChannels is the number of channels whose delivery latencies
+// are reported on exit.
+const maxReportedChannels = 10
+
+// reportChannels logs the distribution of the delivery latencies of the
+// channels with the highest p99.
+func (s *statistics) reportChannels() {
+	s.Lock()
+	defer s.Unlock()
+	channels := make([]string, 0, len(s.channelDelivery))
+	for channel := range s.channelDelivery {
+		channels = append(channels, channel)
+	}
+	p99 := func(i int) int64 { return s.channelDelivery[channels[i]].ValueAtQuantile(99) }
+	sort.Sort(byP99{channels, p99})
+	if len(channels) > maxReportedChannels {
+		log.Printf("delivery latencies of the %d channels with the highest p99, out of %d:",
+			maxReportedChannels, len(channels))
+		channels = channels[:maxReportedChannels]
+	}
+	for _, channel := range channels {
+		h := s.channelDelivery[channel]
+		log.Printf("%s: %d messages delivered, p50=%s, p99=%s, max=%s", channel, h.TotalCount(),
+			time.Duration(h.ValueAtQuantile(50)), time.Duration(h.ValueAtQuantile(99)), time.Duration(h.Max()))
+	}
 }
 
-func (s *statistics) report() {
+// byP99 sorts channels by decreasing p99.
+type byP99 struct {
+	channels []string
+	p99      func(i int) int64
+}
+
+func (b byP99) Len() int           { return len(b.channels) }
+func (b byP99) Less(i, j int) bool { return b.p99(i) > b.p99(j) }
+func (b byP99) Swap(i, j int)      { b.channels[i], b.channels[j] = b.channels[j], b.channels[i] }
+
+// report logs the statistics every second, marking the changes of the
+// number of writers of ctl as they happen.
+func (s *statistics) report(ctl *control.Controller) {
 	for range time.Tick(time.Second) {
+		for _, ch := range ctl.Changes() {
+			log.Printf("%s: ----- %s -----", time.Duration(ch.Elapsed.Seconds()+0.5)*time.Second, ch)
+		}
 		s.Lock()
-		writeTimes := s.writeTimes
-		s.writeTimes = nil
+		writeTimes, messagesWritten := s.writeTimes, s.messagesWritten
+		readTimes, staleness, messagesRead := s.readTimes, s.staleness, s.messagesRead
+		delivery := s.delivery
+		s.writeTimes, s.messagesWritten = nil, 0
+		s.readTimes, s.staleness, s.messagesRead = nil, nil, 0
+		s.delivery = nil
 		s.Unlock()
 
 		// The stats functions return an error only when the input is empty.
+		// A message becomes visible to readers when its transaction
+		// commits, so the transaction latency is also the delay before
+		// readers can see it; its cost is shared by all the messages of
+		// the transaction.
 		mean, _ := stats.Mean(writeTimes)
 		stddev, _ := stats.StandardDeviation(writeTimes)
-		log.Printf("wrote %d messages, latency mean=%s, stddev=%s",
-			len(writeTimes), time.Duration(mean), time.Duration(stddev))
+		sum, _ := stats.Sum(writeTimes)
+		var perMessage float64
+		if messagesWritten > 0 {
+			perMessage = sum / float64(messagesWritten)
+		}
+		log.Printf("wrote %d messages in %d txns, latency mean=%s, stddev=%s, cost per message=%s",
+			messagesWritten, len(writeTimes), time.Duration(mean), time.Duration(stddev), time.Duration(perMessage))
+		if len(readTimes) > 0 {
+			mean, _ = stats.Mean(readTimes)
+			stddev, _ = stats.StandardDeviation(readTimes)
+			log.Printf("polled %d times, read %d messages, latency mean=%s, stddev=%s",
+				len(readTimes), messagesRead, time.Duration(mean), time.Duration(stddev))
+			p50, _ := stats.Percentile(staleness, 50)
+			p99, _ := stats.Percentile(staleness, 99)
+			max, _ := stats.Max(staleness)
+			log.Printf("staleness p50=%s, p99=%s, max=%s", time.Duration(p50), time.Duration(p99), time.Duration(max))
+		}
+		if len(delivery) > 0 {
+			p50, _ := stats.Percentile(delivery, 50)
+			p99, _ := stats.Percentile(delivery, 99)
+			max, _ := stats.Max(delivery)
+			log.Printf("delivered %d messages, write-to-read latency p50=%s, p99=%s, max=%s",
+				len(delivery), time.Duration(p50), time.Duration(p99), time.Duration(max))
+		}
+	}
+}
+
+// newChannelPicker returns a function picking channel numbers in [0,
+// numChannels). If zipfS is non-zero, channels are picked with a zipfian
+// distribution with that exponent, so that a handful of channels are
+// picked most of the time.
+func newChannelPicker(numChannels int, zipfS float64) func() int {
+	r := rand.New(rand.NewSource(rand.Int63()))
+	if zipfS == 0 {
+		return func() int { return r.Intn(numChannels) }
+	}
+	z := rand.NewZipf(r, zipfS, 1, uint64(numChannels-1))
+	return func() int { return int(z.Uint64()) }
+}
+
+// numWrites and numWriteErrors count the write transactions of the writers,
+// and their failed attempts.
+var numWrites, numWriteErrors uint64
+
+// faults are the faults injected with --chaos, and node the host:port of
+// the node they may cut the example off from.
+var faults *chaos.Injector
+var node string
+
+// A write is a transaction of a writer, recorded with --record: it writes a
+// message to each of Channels.
+type write struct {
+	Channels []string `json:"channels"`
+}
+
+// newWriteGenerator returns a function generating the writes of a writer,
+// each to messagesPerTx channels picked with pickChannel.
+func newWriteGenerator(pickChannel func() int, messagesPerTx int) func() write {
+	return func() write {
+		channels := make([]string, messagesPerTx)
+		for i := range channels {
+			channels[i] = fmt.Sprintf("room-%d", pickChannel())
+		}
+		return write{Channels: channels}
 	}
 }
 
 type writer struct {
-	db          *sql.DB
-	numChannels int
-	wg          *sync.WaitGroup
-	stats       *statistics
+	num int
+	db  *sql.DB
+	// next returns the next write, or false once there are no more.
+	next  func() (write, bool)
+	wg    *sync.WaitGroup
+	stats *statistics
 }
 
-func (w writer) run() {
+// run writes messages, each transaction once ctl lets the writer through,
+// until stop is closed. The latencies of the transactions are recorded with
+// ctl.
+func (w writer) run(ctl *control.Controller, stop <-chan struct{}) {
 	defer w.wg.Done()
-	for {
-		if err := w.writeMessage(); err != nil {
-			log.Printf("error writing message: %s", err)
+	for ctl.Wait(w.num, stop) {
+		wr, ok := w.next()
+		if !ok {
+			return
+		}
+		start := time.Now()
+		err := w.writeMessages(wr.Channels)
+		atomic.AddUint64(&numWrites, 1)
+		if err != nil {
+			log.Printf("error writing messages: %s", err)
+			continue
 		}
+		ctl.Record(time.Since(start))
 	}
 }
 
-func (w writer) writeMessage() error {
+// writeMessages writes a message to each of channels in a single
+// transaction.
+func (w writer) writeMessages(channels []string) error {
 	start := time.Now()
-	defer w.stats.recordWrite(start)
-	channel := fmt.Sprintf("room-%d", rand.Int31n(int32(w.numChannels)))
-	message := start.String()
+	defer w.stats.recordWrite(start, len(channels))
+	message := newMessage(start)
 
 	// TODO(bdarnell): retry only on certain errors.
 	for {
+		if err := faults.Reach(node); err != nil {
+			atomic.AddUint64(&numWriteErrors, 1)
+			continue
+		}
 		txn, err := w.db.Begin()
 		if err != nil {
+			atomic.AddUint64(&numWriteErrors, 1)
 			continue
 		}
+		if err := writeMessagesTxn(txn, channels, message); err != nil {
+			_ = txn.Rollback()
+			atomic.AddUint64(&numWriteErrors, 1)
+			continue
+		}
+		faults.BeforeCommit()
+		if err := txn.Commit(); err == nil {
+			return nil
+		}
+		atomic.AddUint64(&numWriteErrors, 1)
+	}
+}
+
+func writeMessagesTxn(txn *sql.Tx, channels []string, message string) error {
+	row := txn.QueryRow(`select max(update_id) from fakerealtime.updates`)
+	var maxUpdateID sql.NullInt64
+	if err := row.Scan(&maxUpdateID); err != nil {
+		return err
+	}
+	newUpdateID := maxUpdateID.Int64
 
+	for _, channel := range channels {
 		// TODO(bdarnell): make this a subquery when subqueries are supported on insert.
 		row := txn.QueryRow(`select max(msg_id) from fakerealtime.messages where channel=$1`, channel)
 		var maxMsgID sql.NullInt64
 		if err := row.Scan(&maxMsgID); err != nil {
-			_ = txn.Rollback()
-			continue
-		}
-		if !maxMsgID.Valid {
-			maxMsgID.Int64 = 0
+			return err
 		}
 		newMsgID := maxMsgID.Int64 + 1
-
-		row = txn.QueryRow(`select max(update_id) from fakerealtime.updates`)
-		var maxUpdateID sql.NullInt64
-		if err := row.Scan(&maxUpdateID); err != nil {
-			_ = txn.Rollback()
-			continue
-		}
-		if !maxUpdateID.Valid {
-			maxUpdateID.Int64 = 0
-		}
-		newUpdateID := maxUpdateID.Int64 + 1
+		newUpdateID++
 
 		if _, err := txn.Exec(`insert into fakerealtime.messages (channel, msg_id, message) values ($1, $2, $3)`,
 			channel, newMsgID, message); err != nil {
-			_ = txn.Rollback()
-			continue
+			return err
 		}
 
 		if _, err := txn.Exec(`insert into fakerealtime.updates (update_id, channel, msg_id) values ($1, $2, $3)`,
 			newUpdateID, channel, newMsgID); err != nil {
-			_ = txn.Rollback()
+			return err
+		}
+	}
+	return nil
+}
+
+type reader struct {
+	db        *sql.DB
+	channels  []string
+	readMode  string
+	pollEvery time.Duration
+	pollDepth int
+	wg        *sync.WaitGroup
+	stats     *statistics
+
+	// If staleness is non-zero, polls read as of that long ago, as of asOf.
+	staleness time.Duration
+	asOf      time.Time
+
+	// lastMsgIDs holds the highest message ID seen on each channel.
+	lastMsgIDs   map[string]int64
+	lastUpdateID int64
+
+	// If checker is non-nil, channels are read oldest first and every
+	// message ID read is verified by the checker.
+	checker *monotonicityChecker
+}
+
+// newReader returns a reader following channelsPerReader distinct
+// channels chosen with pickChannel. If pickChannel is too skewed to come
+// up with enough distinct channels, the rest are chosen uniformly.
+func newReader(db *sql.DB, pickChannel func() int, numChannels, channelsPerReader int) reader {
+	r := reader{db: db, lastMsgIDs: make(map[string]int64)}
+	followed := make(map[int]bool)
+	for attempts := 0; len(followed) < channelsPerReader; attempts++ {
+		i := rand.Intn(numChannels)
+		if attempts < 100*channelsPerReader {
+			i = pickChannel()
+		}
+		if !followed[i] {
+			followed[i] = true
+			r.channels = append(r.channels, fmt.Sprintf("room-%d", i))
+		}
+	}
+	return r
+}
+
+func (r *reader) run() {
+	defer r.wg.Done()
+	for range time.Tick(r.pollEvery) {
+		start := time.Now()
+		r.asOf = start.Add(-r.staleness)
+		n, err := r.poll()
+		if err != nil {
+			log.Printf("error reading messages: %s", err)
 			continue
 		}
+		// The staleness of a poll is the age of the data it returned by
+		// the time the poll completed. For consistent reads, that is at
+		// least the time the poll took.
+		staleness := time.Since(start)
+		if r.staleness > 0 {
+			staleness = time.Since(r.asOf)
+		}
+		r.stats.recordRead(start, n, staleness)
+	}
+}
 
-		if err := txn.Commit(); err == nil {
-			return nil
+// poll reads the new messages of the reader's channels and returns the
+// number of messages read.
+func (r *reader) poll() (int, error) {
+	if err := faults.Reach(node); err != nil {
+		return 0, err
+	}
+	channels := r.channels
+	if r.readMode == "updates" {
+		var err error
+		if channels, err = r.updatedChannels(); err != nil {
+			return 0, err
+		}
+	}
+	var total int
+	for _, channel := range channels {
+		n, err := r.readChannel(channel)
+		if err != nil {
+			return total, err
+		}
+		total += n
+	}
+	return total, nil
+}
+
+// table returns the name of the given table to select from, including an
+// AS OF SYSTEM TIME clause for stale reads.
+func (r *reader) table(name string) string {
+	if r.staleness == 0 {
+		return "fakerealtime." + name
+	}
+	return fmt.Sprintf("fakerealtime.%s AS OF SYSTEM TIME '%s'", name, r.asOf.UTC().Format("2006-01-02 15:04:05.999999"))
+}
+
+// updatedChannels tails the updates table and returns the followed
+// channels that received messages since the last poll.
+func (r *reader) updatedChannels() ([]string, error) {
+	rows, err := r.db.Query(`select update_id, channel from `+r.table("updates")+
+		` where update_id > $1 order by update_id`, r.lastUpdateID)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+	updated := make(map[string]bool)
+	for rows.Next() {
+		var channel string
+		if err := rows.Scan(&r.lastUpdateID, &channel); err != nil {
+			return nil, err
+		}
+		updated[channel] = true
+	}
+	var channels []string
+	for _, channel := range r.channels {
+		if updated[channel] {
+			channels = append(channels, channel)
+		}
+	}
+	return channels, rows.Err()
+}
+
+// readChannel reads up to pollDepth of the newest messages of a channel
+// that the reader hasn't seen yet.
+func (r *reader) readChannel(channel string) (int, error) {
+	if r.checker != nil {
+		return r.checkChannel(channel)
+	}
+	rows, err := r.db.Query(`select msg_id, message from `+r.table("messages")+
+		` where channel=$1 and msg_id > $2 order by msg_id desc limit $3`,
+		channel, r.lastMsgIDs[channel], r.pollDepth)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = rows.Close() }()
+	var latencies []time.Duration
+	for rows.Next() {
+		var msgID int64
+		var message string
+		if err := rows.Scan(&msgID, &message); err != nil {
+			return len(latencies), err
+		}
+		if msgID > r.lastMsgIDs[channel] {
+			r.lastMsgIDs[channel] = msgID
+		}
+		written, err := messageTime(message)
+		if err != nil {
+			return len(latencies), err
 		}
+		latencies = append(latencies, time.Since(written))
 	}
+	r.stats.recordDelivery(channel, latencies)
+	return len(latencies), rows.Err()
+}
+
+// checkChannel reads up to pollDepth of the oldest messages of a channel
+// that the reader hasn't seen yet, including any message skipped by
+// earlier polls, and passes their IDs to the checker.
+func (r *reader) checkChannel(channel string) (int, error) {
+	from, seen := r.checker.from(channel), r.checker.highWaterMark(channel)
+	rows, err := r.db.Query(`select msg_id, message from `+r.table("messages")+
+		` where channel=$1 and msg_id > $2 order by msg_id limit $3`,
+		channel, from, r.pollDepth)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = rows.Close() }()
+	var ids []int64
+	var latencies []time.Duration
+	for rows.Next() {
+		var msgID int64
+		var message string
+		if err := rows.Scan(&msgID, &message); err != nil {
+			return 0, err
+		}
+		written, err := messageTime(message)
+		if err != nil {
+			return 0, err
+		}
+		ids = append(ids, msgID)
+		// Messages still missing are read again until the gaps fill in,
+		// but only their first read counts toward the delivery latency.
+		if msgID > seen {
+			latencies = append(latencies, time.Since(written))
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	r.checker.observe(channel, from, ids, len(ids) < r.pollDepth)
+	r.stats.recordDelivery(channel, latencies)
+	return len(ids), nil
 }
 
 var usage = func() {
 	fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
-	fmt.Fprintf(os.Stderr, "  %s <db URL>\n\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s [<db URL>]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s --coordinate=<addr>,... <command>\n\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "%s\n", control.Usage)
 	flag.PrintDefaults()
 }
 
@@ -196,32 +597,202 @@ func main() {
 	flag.Usage = usage
 
 	numChannels := flag.Int("num-channels", 100, "number of channels")
+	channelZipfS := flag.Float64("channel-zipf-s", 0,
+		"if non-zero, pick channels with a zipfian distribution with this exponent (must be > 1) instead of uniformly")
 	numWriters := flag.Int("num-writers", 2, "number of writers")
+	messagesPerTx := flag.Int("messages-per-tx", 1, "number of messages each writer transaction inserts")
+	numReaders := flag.Int("num-readers", 0, "number of readers")
+	channelsPerReader := flag.Int("channels-per-reader", 10, "number of channels each reader follows")
+	readMode := flag.String("read-mode", "channels",
+		"how readers find new messages: \"channels\" queries every followed channel, "+
+			"\"updates\" tails the updates table first")
+	pollInterval := flag.Duration("poll-interval", time.Second, "interval between polls of each reader")
+	staleReads := flag.Bool("stale-reads", false, "whether readers read slightly stale data with AS OF SYSTEM TIME")
+	staleness := flag.Duration("staleness", 5*time.Second, "how far in the past stale reads read")
+	pollDepth := flag.Int("poll-depth", 100, "maximum number of new messages read per channel per poll")
+	verify := flag.Bool("verify", false,
+		"whether readers verify that the message IDs of each channel never go backwards or fill in gaps later")
+	duration := flag.Duration("duration", 0, "if non-zero, how long to run before exiting")
+	driver := flag.String("driver", "postgres", dbdriver.Usage)
 	flag.Parse()
+	control.Coordinate(flag.Args())
 
-	if flag.NArg() != 1 {
+	if flag.NArg() > 1 {
 		usage()
 		os.Exit(2)
 	}
 
-	dbURL := flag.Arg(0)
+	if *channelsPerReader < 1 || *channelsPerReader > *numChannels {
+		log.Fatalf("channels-per-reader must be between 1 and num-channels (%d)", *numChannels)
+	}
+	if *channelZipfS != 0 && *channelZipfS <= 1 {
+		log.Fatalf("channel-zipf-s (%f) must be greater than 1", *channelZipfS)
+	}
+	if *messagesPerTx < 1 {
+		log.Fatalf("messages-per-tx (%d) must be at least 1", *messagesPerTx)
+	}
+	if *readMode != "channels" && *readMode != "updates" {
+		log.Fatalf("unknown read mode %q", *readMode)
+	}
+	if err := capture.Check(); err != nil {
+		log.Fatal(err)
+	}
+
+	dbURL, err := dbdriver.URL(flag.Arg(0), "")
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	db, err := sql.Open("postgres", dbURL)
+	db, err := dbdriver.Open(*driver, dbURL)
+	if err != nil {
+		log.Fatal(err)
+	}
+	parsedURL, err := url.Parse(dbURL)
 	if err != nil {
 		log.Fatal(err)
 	}
+	node = parsedURL.Host
 
 	if err := createTables(db); err != nil {
 		log.Fatal(err)
 	}
 
 	var stats statistics
+	var checkers []*monotonicityChecker
 	var wg sync.WaitGroup
+	rec, err := capture.NewRecorder()
+	if err != nil {
+		log.Fatal(err)
+	}
+	var writes chan write
+	if capture.Replaying() {
+		writes = make(chan write)
+	}
+	stop := make(chan struct{})
+	var ctl *control.Controller
+	spawn := func(i int) {
+		next := func() (write, bool) {
+			wr, ok := <-writes
+			return wr, ok
+		}
+		if writes == nil {
+			gen := newWriteGenerator(newChannelPicker(*numChannels, *channelZipfS), *messagesPerTx)
+			next = func() (write, bool) {
+				wr := gen()
+				if err := rec.Record(wr); err != nil {
+					log.Fatal(err)
+				}
+				return wr, true
+			}
+		}
+		wg.Add(1)
+		w := writer{i, db, next, &wg, &stats}
+		go w.run(ctl, stop)
+	}
+	if faults, err = chaos.New(func() (uint64, uint64) {
+		return atomic.LoadUint64(&numWrites), atomic.LoadUint64(&numWriteErrors)
+	}); err != nil {
+		log.Fatal(err)
+	}
+	ctl = control.New(*numWriters, spawn, func() (uint64, uint64) {
+		return atomic.LoadUint64(&numWrites), atomic.LoadUint64(&numWriteErrors)
+	})
 	for i := 0; i < *numWriters; i++ {
+		spawn(i)
+	}
+	if err := control.Serve(ctl); err != nil {
+		log.Fatal(err)
+	}
+	if err := control.ServeREST(ctl); err != nil {
+		log.Fatal(err)
+	}
+	control.Adapt(ctl)
+	control.HandleSignals(ctl)
+	for i := 0; i < *numReaders; i++ {
 		wg.Add(1)
-		w := writer{db, *numChannels, &wg, &stats}
-		go w.run()
+		r := newReader(db, newChannelPicker(*numChannels, *channelZipfS), *numChannels, *channelsPerReader)
+		r.readMode, r.pollEvery, r.pollDepth = *readMode, *pollInterval, *pollDepth
+		r.wg, r.stats = &wg, &stats
+		if *staleReads {
+			r.staleness = *staleness
+		}
+		if *verify {
+			r.checker = newMonotonicityChecker()
+			checkers = append(checkers, r.checker)
+		}
+		go r.run()
+	}
+	go stats.report(ctl)
+
+	replayed := make(chan struct{})
+	if writes != nil {
+		go func() {
+			n, err := capture.Replay(func(raw json.RawMessage) error {
+				var wr write
+				if err := json.Unmarshal(raw, &wr); err != nil {
+					return err
+				}
+				writes <- wr
+				return nil
+			})
+			close(writes)
+			if err != nil {
+				log.Fatal(err)
+			}
+			log.Printf("replayed %d writes", n)
+			close(replayed)
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	var timeout <-chan time.Time
+	if *duration > 0 {
+		timeout = time.After(*duration)
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case <-done:
+	case <-timeout:
+	case <-signals:
+	case <-replayed:
+	}
+	ctl.Close()
+	close(stop)
+	if rec != nil {
+		if err := rec.Close(); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("recorded the writes to %s", capture.Path())
+	}
+	if n := ctl.Stats().Sustainable; n > 0 {
+		log.Printf("sustainable concurrency under --target-p99: %d writers", n)
+	}
+	if *numReaders > 0 {
+		stats.reportChannels()
+	}
+
+	if !*verify {
+		return
+	}
+	var anomalies, gaps int
+	for i, c := range checkers {
+		found, missing := c.results()
+		for _, a := range found {
+			log.Printf("reader %d: %s", i, a)
+		}
+		anomalies += len(found)
+		gaps += missing
+	}
+	if gaps > 0 {
+		log.Printf("%d messages skipped by readers never showed up", gaps)
+	}
+	if anomalies > 0 {
+		log.Fatalf("found %d ordering anomalies", anomalies)
 	}
-	go stats.report()
-	wg.Wait()
+	log.Printf("no ordering anomalies found by %d readers", len(checkers))
 }
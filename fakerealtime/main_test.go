@@ -0,0 +1,48 @@
+// Copyright 2016 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMessageTime(t *testing.T) {
+	written := time.Unix(1466000000, 123456789)
+	parsed, err := messageTime(newMessage(written))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !parsed.Equal(written) {
+		t.Errorf("expected %s, got %s", written, parsed)
+	}
+	if _, err := messageTime("hello"); err == nil {
+		t.Error("expected an error for a message without a time")
+	}
+}
+
+func TestRecordDelivery(t *testing.T) {
+	var s statistics
+	s.recordDelivery("room-1", nil)
+	s.recordDelivery("room-1", []time.Duration{time.Millisecond, 2 * time.Millisecond})
+	s.recordDelivery("room-2", []time.Duration{3 * time.Millisecond})
+	if len(s.delivery) != 3 {
+		t.Errorf("expected 3 delivery latencies, got %d", len(s.delivery))
+	}
+	if len(s.channelDelivery) != 2 {
+		t.Errorf("expected the latencies of 2 channels, got %d", len(s.channelDelivery))
+	}
+}
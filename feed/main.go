@@ -0,0 +1,374 @@
+// Copyright 2016 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+// The feed example models a social network with users, follow
+// relationships and posts. Follow targets are chosen with a zipfian
+// distribution over user IDs, so low user IDs become "celebrities" with
+// a very large number of followers.
+//
+// Clients read feeds (a join fanning out over the posts of everyone the
+// user follows), write posts, and follow or unfollow other users. Every
+// follow or unfollow maintains a denormalized follower count on the
+// followee, which turns celebrities into contended rows.
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/url"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/cockroachdb/examples-go/dbdriver"
+	"github.com/cockroachdb/examples-go/opstats"
+	// Import postgres driver.
+	_ "github.com/cockroachdb/pq"
+)
+
+var numUsers = flag.Int("users", 10000, "Number of users.")
+var followsPerUser = flag.Int("follows-per-user", 50, "Number of users each user initially follows.")
+var zipfS = flag.Float64("zipf-s", 1.2, "Zipf exponent for the popularity of follow targets. Must be > 1.")
+var concurrency = flag.Int("concurrency", 16, "Number of concurrent clients.")
+var feedPercent = flag.Int("feed-percent", 80, "Percentage of operations that read a feed.")
+var postPercent = flag.Int("post-percent", 15, "Percentage of operations that create a post. "+
+	"The remaining operations follow or unfollow users.")
+var feedLimit = flag.Int("feed-limit", 50, "Number of posts returned by a feed read.")
+var outputInterval = flag.Duration("output-interval", 1*time.Second, "Interval of output.")
+var driver = flag.String("driver", "postgres", dbdriver.Usage)
+
+const schema = `
+CREATE TABLE IF NOT EXISTS users (
+  id             INT PRIMARY KEY,
+  name           STRING NOT NULL,
+  follower_count INT NOT NULL DEFAULT 0
+);
+
+CREATE TABLE IF NOT EXISTS follows (
+  follower_id INT NOT NULL,
+  followee_id INT NOT NULL,
+  PRIMARY KEY (follower_id, followee_id),
+  INDEX (followee_id)
+);
+
+CREATE TABLE IF NOT EXISTS posts (
+  author_id INT NOT NULL,
+  id        INT NOT NULL DEFAULT unique_rowid(),
+  created   TIMESTAMP NOT NULL DEFAULT NOW(),
+  body      STRING NOT NULL,
+  PRIMARY KEY (author_id, created DESC, id)
+);
+`
+
+const (
+	feedOp = iota
+	postOp
+	followOp
+	unfollowOp
+	numOps
+)
+
+var opNames = [numOps]string{"feed", "post", "follow", "unfollow"}
+
+// popularUser returns a user ID chosen with a zipfian distribution, so
+// that low IDs are picked far more often.
+func popularUser(z *rand.Zipf) int {
+	return int(z.Uint64())
+}
+
+func readFeed(db *sql.DB, userID int) error {
+	rows, err := db.Query(`
+SELECT p.author_id, u.name, p.id, p.created, p.body
+  FROM follows AS f
+  JOIN posts AS p ON p.author_id = f.followee_id
+  JOIN users AS u ON u.id = p.author_id
+ WHERE f.follower_id = $1
+ ORDER BY p.created DESC
+ LIMIT $2`, userID, *feedLimit)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = rows.Close() }()
+	for rows.Next() {
+		var authorID, postID int64
+		var name, body string
+		var created time.Time
+		if err := rows.Scan(&authorID, &name, &postID, &created, &body); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func createPost(db *sql.DB, r *rand.Rand, userID int) error {
+	_, err := db.Exec(`INSERT INTO posts (author_id, body) VALUES ($1, $2)`,
+		userID, fmt.Sprintf("post %d by user %d", r.Int63(), userID))
+	return err
+}
+
+// follow makes followerID follow followeeID and bumps the followee's
+// follower count. Following someone twice is a no-op.
+func follow(db *sql.DB, followerID, followeeID int) error {
+	return dbdriver.ExecuteTx(db, func(tx *sql.Tx) error {
+		res, err := tx.Exec(`INSERT INTO follows (follower_id, followee_id) VALUES ($1, $2) `+
+			`ON CONFLICT (follower_id, followee_id) DO NOTHING`, followerID, followeeID)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil || n == 0 {
+			return err
+		}
+		_, err = tx.Exec(`UPDATE users SET follower_count = follower_count + 1 WHERE id = $1`, followeeID)
+		return err
+	})
+}
+
+// unfollow removes a follow relationship, if any, and decrements the
+// followee's follower count.
+func unfollow(db *sql.DB, followerID, followeeID int) error {
+	return dbdriver.ExecuteTx(db, func(tx *sql.Tx) error {
+		res, err := tx.Exec(`DELETE FROM follows WHERE follower_id = $1 AND followee_id = $2`,
+			followerID, followeeID)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil || n == 0 {
+			return err
+		}
+		_, err = tx.Exec(`UPDATE users SET follower_count = follower_count - 1 WHERE id = $1`, followeeID)
+		return err
+	})
+}
+
+var stats [numOps]*opstats.Stats
+
+func init() {
+	for i := range stats {
+		stats[i] = opstats.New(time.Minute)
+	}
+}
+
+func client(db *sql.DB) {
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	z := rand.NewZipf(r, *zipfS, 1, uint64(*numUsers-1))
+	for {
+		userID := r.Intn(*numUsers)
+		op := unfollowOp
+		switch p := r.Intn(100); {
+		case p < *feedPercent:
+			op = feedOp
+		case p < *feedPercent+*postPercent:
+			op = postOp
+		case r.Intn(2) == 0:
+			op = followOp
+		}
+
+		start := time.Now()
+		var err error
+		switch op {
+		case feedOp:
+			err = readFeed(db, userID)
+		case postOp:
+			err = createPost(db, r, userID)
+		case followOp:
+			if target := popularUser(z); target != userID {
+				err = follow(db, userID, target)
+			}
+		case unfollowOp:
+			if target := popularUser(z); target != userID {
+				err = unfollow(db, userID, target)
+			}
+		}
+		if err != nil {
+			log.Printf("%s failed for user %d: %s", opNames[op], userID, err)
+		}
+		stats[op].Record(start, err)
+	}
+}
+
+// insertRows inserts rows in batches using a multi-row VALUES clause.
+func insertRows(db *sql.DB, stmt string, rows [][]interface{}) error {
+	const batchSize = 500
+	for len(rows) > 0 {
+		n := len(rows)
+		if n > batchSize {
+			n = batchSize
+		}
+		var buf bytes.Buffer
+		buf.WriteString(stmt)
+		var args []interface{}
+		for i, row := range rows[:n] {
+			if i > 0 {
+				buf.WriteString(", ")
+			}
+			buf.WriteString("(")
+			for j, v := range row {
+				if j > 0 {
+					buf.WriteString(", ")
+				}
+				args = append(args, v)
+				fmt.Fprintf(&buf, "$%d", len(args))
+			}
+			buf.WriteString(")")
+		}
+		if _, err := db.Exec(buf.String(), args...); err != nil {
+			return err
+		}
+		rows = rows[n:]
+	}
+	return nil
+}
+
+// setupDatabase creates the schema and, unless the existing users table
+// already has the requested size, populates users and their initial
+// (skewed) follow graph.
+func setupDatabase(db *sql.DB) error {
+	if _, err := db.Exec("CREATE DATABASE IF NOT EXISTS feed"); err != nil {
+		return err
+	}
+	if _, err := db.Exec(schema); err != nil {
+		return err
+	}
+
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM users").Scan(&count); err != nil {
+		return err
+	}
+	if count == *numUsers {
+		return nil
+	}
+
+	log.Printf("populating %d users following %d users each", *numUsers, *followsPerUser)
+	for _, table := range []string{"users", "follows", "posts"} {
+		if _, err := db.Exec("TRUNCATE TABLE " + table); err != nil {
+			return err
+		}
+	}
+
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	z := rand.NewZipf(r, *zipfS, 1, uint64(*numUsers-1))
+	followerCounts := make([]int, *numUsers)
+	var users, follows [][]interface{}
+	// Give up on users that can't find enough distinct followees; with a
+	// very skewed distribution the same few celebrities keep coming up.
+	maxAttempts := 10 * *followsPerUser
+	for id := 0; id < *numUsers; id++ {
+		followees := map[int]struct{}{}
+		for attempts := 0; len(followees) < *followsPerUser && attempts < maxAttempts; attempts++ {
+			if target := popularUser(z); target != id {
+				followees[target] = struct{}{}
+			}
+		}
+		var sorted []int
+		for target := range followees {
+			sorted = append(sorted, target)
+		}
+		sort.Ints(sorted)
+		for _, target := range sorted {
+			follows = append(follows, []interface{}{id, target})
+			followerCounts[target]++
+		}
+	}
+	for id, c := range followerCounts {
+		users = append(users, []interface{}{id, fmt.Sprintf("user%d", id), c})
+	}
+
+	if err := insertRows(db, `INSERT INTO users (id, name, follower_count) VALUES `, users); err != nil {
+		return err
+	}
+	return insertRows(db, `INSERT INTO follows (follower_id, followee_id) VALUES `, follows)
+}
+
+var usage = func() {
+	fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s [<db URL>]\n\n", os.Args[0])
+	flag.PrintDefaults()
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() > 1 {
+		usage()
+		os.Exit(2)
+	}
+
+	if *numUsers < 2 {
+		log.Fatalf("Value of 'users' flag (%d) must be greater than or equal to 2", *numUsers)
+	}
+	if *zipfS <= 1 {
+		log.Fatalf("Value of 'zipf-s' flag (%f) must be greater than 1", *zipfS)
+	}
+	if *feedPercent < 0 || *postPercent < 0 || *feedPercent+*postPercent > 100 {
+		log.Fatal("'feed-percent' and 'post-percent' must be non-negative and add up to at most 100")
+	}
+
+	dbURL, err := dbdriver.URL(flag.Arg(0), "")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	parsedURL, err := url.Parse(dbURL)
+	if err != nil {
+		log.Fatal(err)
+	}
+	parsedURL.Path = "feed"
+
+	db, err := dbdriver.Open(*driver, parsedURL.String())
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer func() { _ = db.Close() }()
+
+	db.SetMaxOpenConns(*concurrency + 1)
+
+	if err := setupDatabase(db); err != nil {
+		log.Fatal(err)
+	}
+
+	for i := 0; i < *concurrency; i++ {
+		go client(db)
+	}
+
+	lastNow := time.Now()
+	for range time.Tick(*outputInterval) {
+		now := time.Now()
+		elapsed := now.Sub(lastNow)
+		lastNow = now
+
+		for op, s := range stats {
+			hist, errors := s.Snapshot()
+			log.Printf("%-8s: %7.1f/sec, p50=%s p95=%s p99=%s (%d errors)",
+				opNames[op], float64(hist.TotalCount())/elapsed.Seconds(),
+				time.Duration(hist.ValueAtQuantile(50)),
+				time.Duration(hist.ValueAtQuantile(95)),
+				time.Duration(hist.ValueAtQuantile(99)),
+				errors)
+		}
+
+		var celebrity, followers int
+		if err := db.QueryRow(`SELECT id, follower_count FROM users ORDER BY follower_count DESC LIMIT 1`).
+			Scan(&celebrity, &followers); err != nil {
+			log.Print(err)
+		} else {
+			log.Printf("most followed: user %d with %d followers", celebrity, followers)
+		}
+	}
+}
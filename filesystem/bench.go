@@ -0,0 +1,314 @@
+// Copyright 2016 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+// The bench subcommand measures the throughput of a mounted filesystem,
+// going through the kernel like any other client: sequential and random
+// reads and writes of a file, then the creation, stat and removal of many
+// files. Its report is meant to be compared across changes to the SQL
+// backend, so it has a JSON form.
+
+// A benchConfig holds the sizes of the phases of the benchmark.
+type benchConfig struct {
+	fileSize int
+	ioSize   int
+	randOps  int
+	numFiles int
+}
+
+// A phaseResult is the outcome of a phase of the benchmark.
+type phaseResult struct {
+	Phase     string  `json:"phase"`
+	Ops       int     `json:"ops"`
+	Bytes     int64   `json:"bytes"`
+	Seconds   float64 `json:"seconds"`
+	MBPerSec  float64 `json:"mbPerSec"`
+	OpsPerSec float64 `json:"opsPerSec"`
+	P50Ms     float64 `json:"p50Ms"`
+	P95Ms     float64 `json:"p95Ms"`
+	P99Ms     float64 `json:"p99Ms"`
+	MaxMs     float64 `json:"maxMs"`
+}
+
+// A benchReport is the report of the benchmark.
+type benchReport struct {
+	FileSize int           `json:"fileSize"`
+	IOSize   int           `json:"ioSize"`
+	RandOps  int           `json:"randOps"`
+	Files    int           `json:"files"`
+	Phases   []phaseResult `json:"phases"`
+}
+
+type durations []time.Duration
+
+func (d durations) Len() int           { return len(d) }
+func (d durations) Less(i, j int) bool { return d[i] < d[j] }
+func (d durations) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+
+// A phaseTimer times the operations of a phase.
+type phaseTimer struct {
+	name      string
+	start     time.Time
+	bytes     int64
+	latencies []time.Duration
+}
+
+func newPhaseTimer(name string) *phaseTimer {
+	return &phaseTimer{name: name, start: time.Now()}
+}
+
+// op runs and times an operation, which returns the number of bytes it
+// read or wrote.
+func (t *phaseTimer) op(fn func() (int, error)) error {
+	start := time.Now()
+	n, err := fn()
+	t.latencies = append(t.latencies, time.Since(start))
+	t.bytes += int64(n)
+	return err
+}
+
+func (t *phaseTimer) result() phaseResult {
+	elapsed := time.Since(t.start)
+	r := phaseResult{Phase: t.name, Ops: len(t.latencies), Bytes: t.bytes, Seconds: elapsed.Seconds()}
+	if elapsed > 0 {
+		r.MBPerSec = float64(t.bytes) / (1 << 20) / elapsed.Seconds()
+		r.OpsPerSec = float64(len(t.latencies)) / elapsed.Seconds()
+	}
+	if len(t.latencies) == 0 {
+		return r
+	}
+	sort.Sort(durations(t.latencies))
+	ms := func(p int) float64 {
+		return t.latencies[(len(t.latencies)*p-1)/100].Seconds() * 1000
+	}
+	r.P50Ms, r.P95Ms, r.P99Ms, r.MaxMs = ms(50), ms(95), ms(99), ms(100)
+	return r
+}
+
+func runBench(args []string) {
+	flags := flag.NewFlagSet("bench", flag.ExitOnError)
+	fileSize := flags.Int("file-size", 16<<20, "Size of the file read and written by the sequential and random phases.")
+	ioSize := flags.Int("io-size", 64<<10, "Size of each read and write.")
+	randOps := flags.Int("rand-ops", 256, "Number of reads and writes of each random phase.")
+	numFiles := flags.Int("files", 200, "Number of files created, stat'ed and removed by the metadata phases.")
+	format := flags.String("format", "text", "Format of the report: text or json.")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage of %s bench:\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s bench [flags] <mountpoint>\n\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	if *ioSize < 1 || *fileSize < *ioSize {
+		log.Fatal("--io-size must be at least 1, and --file-size at least --io-size")
+	}
+	if *randOps < 1 || *numFiles < 1 {
+		log.Fatal("--rand-ops and --files must be at least 1")
+	}
+	if *format != "text" && *format != "json" {
+		log.Fatalf("unknown format %q", *format)
+	}
+
+	// Run in a directory of our own.
+	dir := filepath.Join(flags.Arg(0), fmt.Sprintf("bench-%d", time.Now().UnixNano()))
+	if err := os.Mkdir(dir, 0755); err != nil {
+		log.Fatal(err)
+	}
+	cfg := benchConfig{fileSize: *fileSize, ioSize: *ioSize, randOps: *randOps, numFiles: *numFiles}
+	report, err := runBenchPhases(dir, cfg, func(r phaseResult) {
+		log.Printf("%s: %.1f MB/s, %.1f ops/s", r.Phase, r.MBPerSec, r.OpsPerSec)
+	})
+	if rmErr := os.RemoveAll(dir); rmErr != nil {
+		log.Print(rmErr)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := writeBenchReport(os.Stdout, *format, report); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// runBenchPhases runs the phases of the benchmark in dir, calling done
+// after each one.
+func runBenchPhases(dir string, cfg benchConfig, done func(phaseResult)) (benchReport, error) {
+	report := benchReport{FileSize: cfg.fileSize, IOSize: cfg.ioSize, RandOps: cfg.randOps, Files: cfg.numFiles}
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	buf := make([]byte, cfg.ioSize)
+	for i := range buf {
+		buf[i] = byte(rng.Int())
+	}
+	path := filepath.Join(dir, "data")
+	// The random phases read and write whole I/Os within the file.
+	randOffset := func() int64 {
+		return int64(rng.Intn(cfg.fileSize/cfg.ioSize)) * int64(cfg.ioSize)
+	}
+
+	phases := []struct {
+		name string
+		fn   func(t *phaseTimer) error
+	}{
+		{"seq-write", func(t *phaseTimer) error {
+			f, err := os.Create(path)
+			if err != nil {
+				return err
+			}
+			for off := 0; off < cfg.fileSize; off += cfg.ioSize {
+				n := cfg.ioSize
+				if off+n > cfg.fileSize {
+					n = cfg.fileSize - off
+				}
+				if err := t.op(func() (int, error) { return f.Write(buf[:n]) }); err != nil {
+					_ = f.Close()
+					return err
+				}
+			}
+			// Buffered writes only reach the database on fsync or close.
+			if err := t.op(func() (int, error) { return 0, f.Sync() }); err != nil {
+				_ = f.Close()
+				return err
+			}
+			return f.Close()
+		}},
+		{"seq-read", func(t *phaseTimer) error {
+			f, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer func() { _ = f.Close() }()
+			for {
+				err := t.op(func() (int, error) { return f.Read(buf) })
+				if err == io.EOF {
+					return nil
+				} else if err != nil {
+					return err
+				}
+			}
+		}},
+		{"rand-write", func(t *phaseTimer) error {
+			f, err := os.OpenFile(path, os.O_WRONLY, 0)
+			if err != nil {
+				return err
+			}
+			for i := 0; i < cfg.randOps; i++ {
+				off := randOffset()
+				if err := t.op(func() (int, error) { return f.WriteAt(buf, off) }); err != nil {
+					_ = f.Close()
+					return err
+				}
+			}
+			if err := t.op(func() (int, error) { return 0, f.Sync() }); err != nil {
+				_ = f.Close()
+				return err
+			}
+			return f.Close()
+		}},
+		{"rand-read", func(t *phaseTimer) error {
+			f, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer func() { _ = f.Close() }()
+			for i := 0; i < cfg.randOps; i++ {
+				off := randOffset()
+				if err := t.op(func() (int, error) { return f.ReadAt(buf, off) }); err != nil {
+					return err
+				}
+			}
+			return nil
+		}},
+		{"create", func(t *phaseTimer) error {
+			for i := 0; i < cfg.numFiles; i++ {
+				name := filepath.Join(dir, fmt.Sprintf("f%d", i))
+				if err := t.op(func() (int, error) {
+					f, err := os.Create(name)
+					if err != nil {
+						return 0, err
+					}
+					return 0, f.Close()
+				}); err != nil {
+					return err
+				}
+			}
+			return nil
+		}},
+		{"stat", func(t *phaseTimer) error {
+			for i := 0; i < cfg.numFiles; i++ {
+				name := filepath.Join(dir, fmt.Sprintf("f%d", i))
+				if err := t.op(func() (int, error) {
+					_, err := os.Stat(name)
+					return 0, err
+				}); err != nil {
+					return err
+				}
+			}
+			return nil
+		}},
+		{"unlink", func(t *phaseTimer) error {
+			for i := 0; i < cfg.numFiles; i++ {
+				name := filepath.Join(dir, fmt.Sprintf("f%d", i))
+				if err := t.op(func() (int, error) { return 0, os.Remove(name) }); err != nil {
+					return err
+				}
+			}
+			return nil
+		}},
+	}
+	for _, p := range phases {
+		t := newPhaseTimer(p.name)
+		if err := p.fn(t); err != nil {
+			return report, fmt.Errorf("%s: %s", p.name, err)
+		}
+		r := t.result()
+		report.Phases = append(report.Phases, r)
+		done(r)
+	}
+	return report, nil
+}
+
+// writeBenchReport writes the report as a table, or as JSON.
+func writeBenchReport(w io.Writer, format string, report benchReport) error {
+	if format == "json" {
+		return json.NewEncoder(w).Encode(report)
+	}
+	fmt.Fprintf(w, "file size %d, I/O size %d, %d random I/Os, %d files\n",
+		report.FileSize, report.IOSize, report.RandOps, report.Files)
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(tw, "phase\tops\tMB/s\tops/s\tp50(ms)\tp95(ms)\tp99(ms)\tmax(ms)\t\n")
+	for _, r := range report.Phases {
+		fmt.Fprintf(tw, "%s\t%d\t%.2f\t%.1f\t%.2f\t%.2f\t%.2f\t%.2f\t\n",
+			r.Phase, r.Ops, r.MBPerSec, r.OpsPerSec, r.P50Ms, r.P95Ms, r.P99Ms, r.MaxMs)
+	}
+	return tw.Flush()
+}
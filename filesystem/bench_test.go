@@ -0,0 +1,118 @@
+// Copyright 2016 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestBenchPhases runs the benchmark against a local directory, which
+// behaves like a mounted filesystem.
+func TestBenchPhases(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bench")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	cfg := benchConfig{fileSize: 10 * BlockSize, ioSize: 3 * BlockSize, randOps: 5, numFiles: 7}
+	var done []string
+	report, err := runBenchPhases(dir, cfg, func(r phaseResult) { done = append(done, r.Phase) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]struct {
+		ops   int
+		bytes int64
+	}{
+		// 4 writes, the last one partial, and the fsync.
+		"seq-write": {5, 10 * BlockSize},
+		// 4 reads and the one returning EOF.
+		"seq-read":   {5, 10 * BlockSize},
+		"rand-write": {6, 5 * 3 * BlockSize},
+		"rand-read":  {5, 5 * 3 * BlockSize},
+		"create":     {7, 0},
+		"stat":       {7, 0},
+		"unlink":     {7, 0},
+	}
+	if len(report.Phases) != len(expected) || len(done) != len(expected) {
+		t.Fatalf("expected %d phases, got %d reported and %d done", len(expected), len(report.Phases), len(done))
+	}
+	for _, r := range report.Phases {
+		e, ok := expected[r.Phase]
+		if !ok {
+			t.Errorf("unexpected phase %s", r.Phase)
+			continue
+		}
+		if r.Ops != e.ops || r.Bytes != e.bytes {
+			t.Errorf("%s: expected %d ops and %d bytes, got %d ops and %d bytes", r.Phase, e.ops, e.bytes, r.Ops, r.Bytes)
+		}
+		if r.P50Ms > r.P99Ms || r.P99Ms > r.MaxMs {
+			t.Errorf("%s: percentiles out of order: %+v", r.Phase, r)
+		}
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "data" {
+		t.Errorf("expected only the data file to be left, got %d entries", len(entries))
+	}
+}
+
+func TestPhaseTimer(t *testing.T) {
+	timer := newPhaseTimer("test")
+	for i := 1; i <= 100; i++ {
+		_ = timer.op(func() (int, error) { return 10, nil })
+		timer.latencies[len(timer.latencies)-1] = time.Duration(i) * time.Millisecond
+	}
+	r := timer.result()
+	if r.Ops != 100 || r.Bytes != 1000 {
+		t.Fatalf("expected 100 ops and 1000 bytes, got %+v", r)
+	}
+	if r.P50Ms != 50 || r.P95Ms != 95 || r.P99Ms != 99 || r.MaxMs != 100 {
+		t.Errorf("expected percentiles of 50, 95, 99 and 100ms, got %+v", r)
+	}
+}
+
+func TestWriteBenchReport(t *testing.T) {
+	report := benchReport{FileSize: 1, IOSize: 1, RandOps: 1, Files: 1,
+		Phases: []phaseResult{{Phase: "seq-write", Ops: 3, MBPerSec: 1.5}}}
+	var buf bytes.Buffer
+	if err := writeBenchReport(&buf, "text", report); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "seq-write") || !strings.Contains(buf.String(), "1.50") {
+		t.Errorf("unexpected text report:\n%s", buf.String())
+	}
+	buf.Reset()
+	if err := writeBenchReport(&buf, "json", report); err != nil {
+		t.Fatal(err)
+	}
+	var decoded benchReport
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded.Phases) != 1 || decoded.Phases[0].Ops != 3 {
+		t.Errorf("unexpected JSON report: %s", buf.String())
+	}
+}
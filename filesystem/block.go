@@ -188,6 +188,11 @@ func read(e sqlExecutor, inodeID, from, to uint64) ([]byte, error) {
 			readRange.start, end, len(blockInfos))
 	}
 
+	return joinBlocks(readRange, blockInfos), nil
+}
+
+// joinBlocks returns the data of 'readRange' given all of its blocks.
+func joinBlocks(readRange blockRange, blockInfos []blockInfo) []byte {
 	if readRange.lastLength != 0 {
 		// We have a last partial block, truncate it.
 		last := len(blockInfos) - 1
@@ -199,8 +204,7 @@ func read(e sqlExecutor, inodeID, from, to uint64) ([]byte, error) {
 	for _, b := range blockInfos {
 		data = append(data, b.data...)
 	}
-
-	return data, nil
+	return data
 }
 
 // write commits data to the blocks starting at 'offset'
@@ -254,20 +258,22 @@ func write(e sqlExecutor, inodeID, originalSize, offset uint64, data []byte) err
 		return nil
 	}
 
-	// Figure out last existing block. Needed to tell the difference
-	// between insert and update.
+	// Figure out last existing block. Needed to tell whether a partial last
+	// block must be merged with existing data.
 	lastBlock := int(originalSize / BlockSize)
 	if originalSize%BlockSize == 0 {
 		// Empty blocks do not exist (size=0 -> lastblock=-1).
 		lastBlock--
 	}
 
-	// Process updates first.
+	// Overwrite the existing blocks and append the new ones in a single
+	// statement, so that the cost of a write depends only on the number of
+	// blocks it touches, not on the size of the file.
+	paramStrings := []string{}
+	params := []interface{}{}
+	count := 1 // placeholder count starts at 1.
+
 	for i := writeFrom; i <= writeTo; i++ {
-		if i > lastBlock {
-			// We've reached the end of existing blocks, no more UPDATE.
-			break
-		}
 		if len(data) == 0 {
 			panic(fmt.Sprintf("reached end of data, but still have %d blocks to write",
 				writeTo-i))
@@ -275,9 +281,9 @@ func write(e sqlExecutor, inodeID, originalSize, offset uint64, data []byte) err
 		toWrite := min(BlockSize, uint64(len(data)))
 		blockData := data[:toWrite]
 		data = data[toWrite:]
-		if toWrite != BlockSize {
-			// This is the last block, and it's partial, fetch the original
-			// data from this block and append.
+		if toWrite != BlockSize && i <= lastBlock {
+			// This is the last block, it's partial, and it already exists:
+			// fetch the original data from this block and append.
 			// TODO(marc): we could fetch this at the same time as the first
 			// partial block, if any. This would make overwriting in the middle
 			// of the file on non-block boundaries a bit more efficient.
@@ -288,28 +294,6 @@ func write(e sqlExecutor, inodeID, originalSize, offset uint64, data []byte) err
 			toWrite = min(toWrite, uint64(len(origData)))
 			blockData = append(blockData, origData[toWrite:]...)
 		}
-		// TODO(marc): is there a way to do batch updates?
-		if err := updateBlockData(e, inodeID, i, blockData); err != nil {
-			return err
-		}
-	}
-
-	if len(data) == 0 {
-		return nil
-	}
-
-	paramStrings := []string{}
-	params := []interface{}{}
-	count := 1 // placeholder count starts at 1.
-
-	for i := lastBlock + 1; i <= writeTo; i++ {
-		if len(data) == 0 {
-			panic(fmt.Sprintf("reached end of data, but still have %d blocks to write",
-				writeTo-i))
-		}
-		toWrite := min(BlockSize, uint64(len(data)))
-		blockData := data[:toWrite]
-		data = data[toWrite:]
 		paramStrings = append(paramStrings, fmt.Sprintf("(%d, %d, $%d)",
 			inodeID, i, count))
 		params = append(params, blockData)
@@ -320,8 +304,8 @@ func write(e sqlExecutor, inodeID, originalSize, offset uint64, data []byte) err
 		panic(fmt.Sprintf("processed all blocks, but still have %d of data to write", len(data)))
 	}
 
-	insStmt := fmt.Sprintf(`INSERT INTO fs.block VALUES %s`, strings.Join(paramStrings, ","))
-	if _, err := e.Exec(insStmt, params...); err != nil {
+	upsStmt := fmt.Sprintf(`UPSERT INTO fs.block VALUES %s`, strings.Join(paramStrings, ","))
+	if _, err := e.Exec(upsStmt, params...); err != nil {
 		return err
 	}
 
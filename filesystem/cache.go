@@ -0,0 +1,173 @@
+// Copyright 2016 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package main
+
+import (
+	"container/list"
+	"log"
+	"sync"
+)
+
+// A cache keeps recently read data blocks in memory, and tracks the nodes
+// holding writes that haven't been flushed to the database yet.
+//
+// Cached blocks are tagged with the generation of their inode. The
+// generation is bumped in the database on every change to an inode, so
+// blocks read at an older generation than the one a node last saw are
+// stale (another mount modified the file) and get dropped.
+type cache struct {
+	// maxBytes bounds both the cached blocks and the unflushed writes of
+	// a single node.
+	maxBytes int
+
+	mu    sync.Mutex
+	files map[uint64]*cachedFile
+	// lru holds *cachedBlock, the most recently used at the front.
+	lru   *list.List
+	size  int
+	dirty map[*Node]struct{}
+}
+
+// cachedFile holds the cached blocks of an inode.
+type cachedFile struct {
+	gen    int64
+	blocks map[int]*list.Element
+}
+
+type cachedBlock struct {
+	inodeID uint64
+	block   int
+	data    []byte
+}
+
+func newCache(maxBytes int) *cache {
+	return &cache{
+		maxBytes: maxBytes,
+		files:    make(map[uint64]*cachedFile),
+		lru:      list.New(),
+		dirty:    make(map[*Node]struct{}),
+	}
+}
+
+// file returns the cached blocks of an inode at generation 'gen', dropping
+// any blocks cached at another generation.
+// Requires: c.mu is held.
+func (c *cache) file(inodeID uint64, gen int64) *cachedFile {
+	f, ok := c.files[inodeID]
+	if ok && f.gen == gen {
+		return f
+	}
+	if ok {
+		c.invalidateLocked(inodeID)
+	}
+	f = &cachedFile{gen: gen, blocks: make(map[int]*list.Element)}
+	c.files[inodeID] = f
+	return f
+}
+
+// get returns the data of a block if it is cached at generation 'gen'.
+func (c *cache) get(inodeID uint64, gen int64, block int) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.file(inodeID, gen).blocks[block]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(e)
+	return e.Value.(*cachedBlock).data, true
+}
+
+// put caches the data of a block read at generation 'gen', evicting the
+// least recently used blocks if the cache is full.
+func (c *cache) put(inodeID uint64, gen int64, block int, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	f := c.file(inodeID, gen)
+	if e, ok := f.blocks[block]; ok {
+		c.removeLocked(e)
+	}
+	f.blocks[block] = c.lru.PushFront(&cachedBlock{inodeID: inodeID, block: block, data: data})
+	c.size += len(data)
+	for c.size > c.maxBytes {
+		c.removeLocked(c.lru.Back())
+	}
+}
+
+// advance moves the blocks cached at generation 'from' to generation 'to',
+// after a change to the inode that didn't touch its data.
+func (c *cache) advance(inodeID uint64, from, to int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if f, ok := c.files[inodeID]; ok && f.gen == from {
+		f.gen = to
+	}
+}
+
+// invalidate drops the cached blocks of an inode.
+func (c *cache) invalidate(inodeID uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.invalidateLocked(inodeID)
+}
+
+func (c *cache) invalidateLocked(inodeID uint64) {
+	f, ok := c.files[inodeID]
+	if !ok {
+		return
+	}
+	for _, e := range f.blocks {
+		c.removeLocked(e)
+	}
+	delete(c.files, inodeID)
+}
+
+func (c *cache) removeLocked(e *list.Element) {
+	b := c.lru.Remove(e).(*cachedBlock)
+	c.size -= len(b.data)
+	if f, ok := c.files[b.inodeID]; ok {
+		delete(f.blocks, b.block)
+	}
+}
+
+// markDirty records that 'n' holds unflushed writes.
+func (c *cache) markDirty(n *Node) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.dirty[n] = struct{}{}
+}
+
+// markClean records that 'n' no longer holds unflushed writes.
+func (c *cache) markClean(n *Node) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.dirty, n)
+}
+
+// flushAll flushes the unflushed writes of all nodes, logging failures.
+func (c *cache) flushAll() {
+	c.mu.Lock()
+	nodes := make([]*Node, 0, len(c.dirty))
+	for n := range c.dirty {
+		nodes = append(nodes, n)
+	}
+	c.mu.Unlock()
+
+	for _, n := range nodes {
+		if err := n.flush(); err != nil {
+			log.Printf("flushing inode %d: %s", n.ID, err)
+		}
+	}
+}
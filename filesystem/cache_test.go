@@ -0,0 +1,53 @@
+// Copyright 2016 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package main
+
+import "testing"
+
+func TestCache(t *testing.T) {
+	c := newCache(2 * BlockSize)
+	block := make([]byte, BlockSize)
+
+	expect := func(inodeID uint64, gen int64, i int, cached bool) {
+		if _, ok := c.get(inodeID, gen, i); ok != cached {
+			t.Fatalf("inode %d gen %d block %d: expected cached=%t", inodeID, gen, i, cached)
+		}
+	}
+
+	c.put(1, 0, 0, block)
+	c.put(1, 0, 1, block)
+	expect(1, 0, 0, true)
+
+	// Block 1 is the least recently used, it gets evicted.
+	c.put(2, 0, 0, block)
+	expect(1, 0, 1, false)
+	expect(1, 0, 0, true)
+	expect(2, 0, 0, true)
+
+	// Advancing the generation keeps the blocks.
+	c.advance(1, 0, 1)
+	expect(1, 1, 0, true)
+
+	// Reading at another generation drops them.
+	expect(1, 2, 0, false)
+	expect(1, 1, 0, false)
+
+	c.invalidate(2)
+	expect(2, 0, 0, false)
+	if c.size != 0 {
+		t.Fatalf("expected an empty cache, got %d bytes", c.size)
+	}
+}
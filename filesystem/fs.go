@@ -21,10 +21,11 @@ import (
 	"database/sql"
 	"os"
 	"syscall"
+	"time"
 
 	"bazil.org/fuse"
 	"bazil.org/fuse/fs"
-	"github.com/cockroachdb/cockroach-go/crdb"
+	"github.com/cockroachdb/examples-go/dbdriver"
 )
 
 const rootNodeID = 1
@@ -42,7 +43,16 @@ CREATE TABLE IF NOT EXISTS fs.namespace (
 
 CREATE TABLE IF NOT EXISTS fs.inode (
   id    INT PRIMARY KEY,
-  inode STRING
+  inode STRING,
+  nlink INT NOT NULL DEFAULT 1,
+  mode  INT,
+  uid   INT NOT NULL DEFAULT 0,
+  gid   INT NOT NULL DEFAULT 0,
+  atime TIMESTAMP NOT NULL DEFAULT NOW(),
+  mtime TIMESTAMP NOT NULL DEFAULT NOW(),
+  ctime TIMESTAMP NOT NULL DEFAULT NOW(),
+  gen   INT NOT NULL DEFAULT 0,
+  target STRING
 );
 
 CREATE TABLE IF NOT EXISTS fs.block (
@@ -60,6 +70,8 @@ var _ fs.FSInodeGenerator = &CFS{} // GenerateInode
 // CFS implements a filesystem on top of cockroach.
 type CFS struct {
 	db *sql.DB
+	// cache is nil if caching is disabled.
+	cache *cache
 }
 
 func initSchema(db *sql.DB) error {
@@ -73,11 +85,15 @@ func initSchema(db *sql.DB) error {
 // node: new node
 func (cfs CFS) create(parentID uint64, name string, node *Node) error {
 	inode := node.toJSON()
-	const insertNode = `INSERT INTO fs.inode VALUES ($1, $2)`
+	const insertNode = `INSERT INTO fs.inode (id, inode, mode, uid, gid, atime, mtime, ctime, target)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`
 	const insertNamespace = `INSERT INTO fs.namespace VALUES ($1, $2, $3)`
 
-	err := crdb.ExecuteTx(cfs.db, func(tx *sql.Tx) error {
-		if _, err := tx.Exec(insertNode, node.ID, inode); err != nil {
+	err := dbdriver.ExecuteTx(cfs.db, func(tx *sql.Tx) error {
+		a := node.attrs
+		target := sql.NullString{String: node.SymlinkTarget, Valid: node.isSymlink()}
+		if _, err := tx.Exec(insertNode, node.ID, inode, int64(a.Perm), a.UID, a.GID,
+			a.Atime, a.Mtime, a.Ctime, target); err != nil {
 			return err
 		}
 		if _, err := tx.Exec(insertNamespace, parentID, name, node.ID); err != nil {
@@ -90,13 +106,12 @@ func (cfs CFS) create(parentID uint64, name string, node *Node) error {
 
 // remove removes a node give its name and its parent ID.
 // If 'checkChildren' is true, fails if the node has children.
+// The inode and its blocks are deleted once no name links to it.
 func (cfs CFS) remove(parentID uint64, name string, checkChildren bool) error {
 	const lookupSQL = `SELECT id FROM fs.namespace WHERE (parentID, name) = ($1, $2)`
 	const deleteNamespace = `DELETE FROM fs.namespace WHERE (parentID, name) = ($1, $2)`
-	const deleteInode = `DELETE FROM fs.inode WHERE id = $1`
-	const deleteBlock = `DELETE FROM fs.block WHERE id = $1`
 
-	err := crdb.ExecuteTx(cfs.db, func(tx *sql.Tx) error {
+	err := dbdriver.ExecuteTx(cfs.db, func(tx *sql.Tx) error {
 		// Start by looking up the node ID.
 		var id uint64
 		if err := tx.QueryRow(lookupSQL, parentID, name).Scan(&id); err != nil {
@@ -114,15 +129,29 @@ func (cfs CFS) remove(parentID uint64, name string, checkChildren bool) error {
 		if _, err := tx.Exec(deleteNamespace, parentID, name); err != nil {
 			return err
 		}
-		if _, err := tx.Exec(deleteInode, id); err != nil {
-			return err
-		}
-		if _, err := tx.Exec(deleteBlock, id); err != nil {
+		return unlinkInode(tx, id)
+	})
+	return err
+}
+
+// link adds a new name 'parentID/name' for an existing node, which
+// must not be a directory.
+func (cfs CFS) link(parentID uint64, name string, node *Node) (uint32, error) {
+	if node.isDir() {
+		return 0, fuse.Errno(syscall.EPERM)
+	}
+	const insertNamespace = `INSERT INTO fs.namespace VALUES ($1, $2, $3)`
+	const updateLinks = `UPDATE fs.inode SET nlink = nlink + 1 WHERE id = $1 RETURNING nlink`
+
+	var nlink uint32
+	err := dbdriver.ExecuteTx(cfs.db, func(tx *sql.Tx) error {
+		if err := tx.QueryRow(updateLinks, node.ID).Scan(&nlink); err != nil {
 			return err
 		}
-		return nil
+		_, err := tx.Exec(insertNamespace, parentID, name, node.ID)
+		return err
 	})
-	return err
+	return nlink, err
 }
 
 func (cfs CFS) lookup(parentID uint64, name string) (*Node, error) {
@@ -193,8 +222,7 @@ func (cfs CFS) rename(oldParentID, newParentID uint64, oldName, newName string)
 	const deleteNamespace = `DELETE FROM fs.namespace WHERE (parentID, name) = ($1, $2)`
 	const insertNamespace = `INSERT INTO fs.namespace VALUES ($1, $2, $3)`
 	const updateNamespace = `UPDATE fs.namespace SET id = $1 WHERE (parentID, name) = ($2, $3)`
-	const deleteInode = `DELETE FROM fs.inode WHERE id = $1`
-	err := crdb.ExecuteTx(cfs.db, func(tx *sql.Tx) error {
+	err := dbdriver.ExecuteTx(cfs.db, func(tx *sql.Tx) error {
 		// Lookup source inode.
 		srcObject, err := getInode(tx, oldParentID, oldName)
 		if err != nil {
@@ -207,6 +235,11 @@ func (cfs CFS) rename(oldParentID, newParentID uint64, oldName, newName string)
 			return err
 		}
 
+		if destObject != nil && destObject.ID == srcObject.ID {
+			// Both names link to the same inode: nothing to do.
+			return nil
+		}
+
 		// Check that the rename is allowed.
 		if err := validateRename(tx, srcObject, destObject); err != nil {
 			return err
@@ -214,7 +247,7 @@ func (cfs CFS) rename(oldParentID, newParentID uint64, oldName, newName string)
 
 		// At this point we know the following:
 		// - srcObject is not nil
-		// - destObject may be nil. If not, its inode can be deleted.
+		// - destObject may be nil. If not, it loses a link.
 		if destObject == nil {
 			// No new object: use INSERT.
 			if _, err := tx.Exec(deleteNamespace, oldParentID, oldName); err != nil {
@@ -234,7 +267,7 @@ func (cfs CFS) rename(oldParentID, newParentID uint64, oldName, newName string)
 				return err
 			}
 
-			if _, err := tx.Exec(deleteInode, destObject.ID); err != nil {
+			if err := unlinkInode(tx, destObject.ID); err != nil {
 				return err
 			}
 		}
@@ -246,7 +279,13 @@ func (cfs CFS) rename(oldParentID, newParentID uint64, oldName, newName string)
 // Root returns the filesystem's root node.
 // This node is special: it has a fixed ID and is not persisted.
 func (cfs CFS) Root() (fs.Node, error) {
-	return &Node{cfs: cfs, ID: rootNodeID, Mode: os.ModeDir | defaultPerms}, nil
+	return &Node{
+		cfs:   cfs,
+		ID:    rootNodeID,
+		Mode:  os.ModeDir | defaultPerms,
+		NLink: 1,
+		attrs: nodeAttrs{Perm: defaultPerms},
+	}, nil
 }
 
 // GenerateInode returns a new inode ID.
@@ -261,30 +300,30 @@ func (cfs CFS) newUniqueID() (id uint64) {
 	return
 }
 
-// newFileNode returns a new node struct corresponding to a file.
-func (cfs CFS) newFileNode() *Node {
+// newNode returns a new node struct with the given mode, created now.
+func (cfs CFS) newNode(mode os.FileMode) *Node {
+	now := time.Now()
 	return &Node{
-		cfs:  cfs,
-		ID:   cfs.newUniqueID(),
-		Mode: defaultPerms,
+		cfs:   cfs,
+		ID:    cfs.newUniqueID(),
+		Mode:  mode,
+		NLink: 1,
+		attrs: nodeAttrs{Perm: mode.Perm(), Atime: now, Mtime: now, Ctime: now},
 	}
 }
 
+// newFileNode returns a new node struct corresponding to a file.
+func (cfs CFS) newFileNode() *Node {
+	return cfs.newNode(defaultPerms)
+}
+
 // newDirNode returns a new node struct corresponding to a directory.
 func (cfs CFS) newDirNode() *Node {
-	return &Node{
-		cfs:  cfs,
-		ID:   cfs.newUniqueID(),
-		Mode: os.ModeDir | defaultPerms,
-	}
+	return cfs.newNode(os.ModeDir | defaultPerms)
 }
 
 // newSymlinkNode returns a new node struct corresponding to a symlink.
 func (cfs CFS) newSymlinkNode() *Node {
-	return &Node{
-		cfs: cfs,
-		ID:  cfs.newUniqueID(),
-		// Symlinks don't have permissions, allow all.
-		Mode: os.ModeSymlink | allPerms,
-	}
+	// Symlinks don't have permissions, allow all.
+	return cfs.newNode(os.ModeSymlink | allPerms)
 }
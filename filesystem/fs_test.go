@@ -0,0 +1,361 @@
+// Copyright 2016 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"bazil.org/fuse"
+	"github.com/cockroachdb/examples-go/dbdriver"
+	"golang.org/x/net/context"
+)
+
+// mustCreate creates a node named 'name' in directory 'parentID'.
+func mustCreate(t *testing.T, cfs CFS, parentID uint64, name string, node *Node) *Node {
+	if err := cfs.create(parentID, name, node); err != nil {
+		t.Fatal(err)
+	}
+	return node
+}
+
+// expectLookup checks that 'parentID/name' links to inode 'id', or that
+// it doesn't exist if id is 0.
+func expectLookup(t *testing.T, cfs CFS, parentID uint64, name string, id uint64) *Node {
+	node, err := cfs.lookup(parentID, name)
+	if id == 0 {
+		if err != sql.ErrNoRows {
+			t.Fatalf("%d/%s: expected no node, got %v (err=%v)", parentID, name, node, err)
+		}
+		return nil
+	}
+	if err != nil {
+		t.Fatalf("%d/%s: %s", parentID, name, err)
+	}
+	if node.ID != id {
+		t.Fatalf("%d/%s: expected inode %d, got %d", parentID, name, id, node.ID)
+	}
+	return node
+}
+
+func TestRename(t *testing.T) {
+	db, stop := initTestDB(t)
+	defer stop()
+	cfs := CFS{db: db}
+
+	a := mustCreate(t, cfs, rootNodeID, "a", cfs.newDirNode())
+	b := mustCreate(t, cfs, rootNodeID, "b", cfs.newDirNode())
+	f := mustCreate(t, cfs, a.ID, "f", cfs.newFileNode())
+	g := mustCreate(t, cfs, b.ID, "g", cfs.newFileNode())
+
+	// Move a file to another directory.
+	if err := cfs.rename(a.ID, b.ID, "f", "f2"); err != nil {
+		t.Fatal(err)
+	}
+	expectLookup(t, cfs, a.ID, "f", 0)
+	expectLookup(t, cfs, b.ID, "f2", f.ID)
+
+	// Move it back over an existing file, which gets deleted.
+	mustCreate(t, cfs, a.ID, "h", cfs.newFileNode())
+	if err := cfs.rename(b.ID, a.ID, "g", "h"); err != nil {
+		t.Fatal(err)
+	}
+	expectLookup(t, cfs, b.ID, "g", 0)
+	expectLookup(t, cfs, a.ID, "h", g.ID)
+
+	// Move a directory into another one, taking its children along.
+	if err := cfs.rename(rootNodeID, b.ID, "a", "a"); err != nil {
+		t.Fatal(err)
+	}
+	expectLookup(t, cfs, rootNodeID, "a", 0)
+	expectLookup(t, cfs, b.ID, "a", a.ID)
+	expectLookup(t, cfs, a.ID, "h", g.ID)
+
+	// A directory can't replace a file, nor a non-empty directory.
+	c := mustCreate(t, cfs, rootNodeID, "c", cfs.newDirNode())
+	if err := cfs.rename(rootNodeID, b.ID, "c", "f2"); err == nil {
+		t.Fatal("expected renaming a directory over a file to fail")
+	}
+	expectLookup(t, cfs, b.ID, "f2", f.ID)
+	if err := cfs.rename(rootNodeID, b.ID, "c", "a"); err == nil {
+		t.Fatal("expected renaming a directory over a non-empty directory to fail")
+	}
+	expectLookup(t, cfs, rootNodeID, "c", c.ID)
+}
+
+func TestLink(t *testing.T) {
+	db, stop := initTestDB(t)
+	defer stop()
+	cfs := CFS{db: db}
+
+	a := mustCreate(t, cfs, rootNodeID, "a", cfs.newDirNode())
+	b := mustCreate(t, cfs, rootNodeID, "b", cfs.newDirNode())
+	f := mustCreate(t, cfs, a.ID, "f", cfs.newFileNode())
+	data := []byte("hello")
+	if err := write(db, f.ID, 0, 0, data); err != nil {
+		t.Fatal(err)
+	}
+	f.Size = uint64(len(data))
+	if err := updateNode(db, f); err != nil {
+		t.Fatal(err)
+	}
+
+	if nlink, err := cfs.link(b.ID, "g", f); err != nil {
+		t.Fatal(err)
+	} else if nlink != 2 {
+		t.Fatalf("expected 2 links, got %d", nlink)
+	}
+	if node := expectLookup(t, cfs, b.ID, "g", f.ID); node.NLink != 2 || node.Size != f.Size {
+		t.Fatalf("unexpected node %+v", node)
+	}
+
+	// Directories can't be linked.
+	if _, err := cfs.link(b.ID, "a", a); err == nil {
+		t.Fatal("expected linking a directory to fail")
+	}
+
+	// Renaming a link over another link to the same inode is a no-op.
+	if err := cfs.rename(a.ID, b.ID, "f", "g"); err != nil {
+		t.Fatal(err)
+	}
+	expectLookup(t, cfs, a.ID, "f", f.ID)
+
+	// Removing one name keeps the inode and its data.
+	if err := cfs.remove(a.ID, "f", false); err != nil {
+		t.Fatal(err)
+	}
+	expectLookup(t, cfs, a.ID, "f", 0)
+	if node := expectLookup(t, cfs, b.ID, "g", f.ID); node.NLink != 1 {
+		t.Fatalf("expected 1 link, got %d", node.NLink)
+	}
+	if got, err := read(db, f.ID, 0, f.Size); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(got, data) {
+		t.Fatalf("expected %q, got %q", data, got)
+	}
+
+	// Removing the last name deletes the inode and its data.
+	if err := cfs.remove(b.ID, "g", false); err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM fs.inode WHERE id = $1`, f.ID).Scan(&n); err != nil {
+		t.Fatal(err)
+	} else if n != 0 {
+		t.Fatal("expected the inode to be deleted")
+	}
+	if blocks, err := getBlocks(db, f.ID); err != nil {
+		t.Fatal(err)
+	} else if len(blocks) != 0 {
+		t.Fatalf("expected the blocks to be deleted, found %d", len(blocks))
+	}
+}
+
+func TestSetattr(t *testing.T) {
+	db, stop := initTestDB(t)
+	defer stop()
+	cfs := CFS{db: db}
+
+	f := mustCreate(t, cfs, rootNodeID, "f", cfs.newFileNode())
+	f.cfs = cfs
+	mtime := time.Date(2016, 1, 2, 3, 4, 5, 0, time.UTC)
+	req := &fuse.SetattrRequest{
+		Valid: fuse.SetattrMode | fuse.SetattrUid | fuse.SetattrGid | fuse.SetattrMtime,
+		Mode:  0600,
+		Uid:   1000,
+		Gid:   100,
+		Mtime: mtime,
+	}
+	if err := f.Setattr(context.Background(), req, &fuse.SetattrResponse{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The attributes survive a lookup.
+	node := expectLookup(t, cfs, rootNodeID, "f", f.ID)
+	var a fuse.Attr
+	if err := node.Attr(context.Background(), &a); err != nil {
+		t.Fatal(err)
+	}
+	if a.Mode != 0600 || a.Uid != 1000 || a.Gid != 100 || !a.Mtime.Equal(mtime) {
+		t.Fatalf("unexpected attributes %+v", a)
+	}
+	if !a.Ctime.After(mtime) {
+		t.Fatalf("expected the ctime to be updated, got %s", a.Ctime)
+	}
+}
+
+// TestSetattrAfterConcurrentWrite checks that changing the attributes of a
+// file doesn't keep serving the blocks cached before another mount wrote to
+// it.
+func TestSetattrAfterConcurrentWrite(t *testing.T) {
+	db, stop := initTestDB(t)
+	defer stop()
+	cached := CFS{db: db, cache: newCache(4 * BlockSize)}
+	direct := CFS{db: db}
+	ctx := context.Background()
+
+	f := mustCreate(t, cached, rootNodeID, "f", cached.newFileNode())
+	f.cfs = cached
+	if err := f.Write(ctx, &fuse.WriteRequest{Data: []byte("hello")}, &fuse.WriteResponse{}); err != nil {
+		t.Fatal(err)
+	}
+	read := func() string {
+		resp := &fuse.ReadResponse{}
+		if err := f.Read(ctx, &fuse.ReadRequest{Size: 100}, resp); err != nil {
+			t.Fatal(err)
+		}
+		return string(resp.Data)
+	}
+	if data := read(); data != "hello" {
+		t.Fatalf("expected %q, got %q", "hello", data)
+	}
+
+	// Another mount overwrites the file, then this one changes its mode.
+	other := expectLookup(t, direct, rootNodeID, "f", f.ID)
+	other.cfs = direct
+	if err := other.Write(ctx, &fuse.WriteRequest{Data: []byte("world!")}, &fuse.WriteResponse{}); err != nil {
+		t.Fatal(err)
+	}
+	req := &fuse.SetattrRequest{Valid: fuse.SetattrMode, Mode: 0600}
+	if err := f.Setattr(ctx, req, &fuse.SetattrResponse{}); err != nil {
+		t.Fatal(err)
+	}
+	if data := read(); data != "world!" {
+		t.Fatalf("expected %q, got %q", "world!", data)
+	}
+}
+
+func TestSymlink(t *testing.T) {
+	db, stop := initTestDB(t)
+	defer stop()
+	cfs := CFS{db: db}
+
+	root := &Node{cfs: cfs, ID: rootNodeID, Mode: os.ModeDir | defaultPerms}
+	req := &fuse.SymlinkRequest{NewName: "l", Target: "../some/target"}
+	l, err := root.Symlink(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	node := expectLookup(t, cfs, rootNodeID, "l", l.(*Node).ID)
+	if target, err := node.Readlink(context.Background(), &fuse.ReadlinkRequest{}); err != nil {
+		t.Fatal(err)
+	} else if target != req.Target {
+		t.Fatalf("expected target %q, got %q", req.Target, target)
+	}
+
+	var stored string
+	if err := db.QueryRow(`SELECT target FROM fs.inode WHERE id = $1`, node.ID).Scan(&stored); err != nil {
+		t.Fatal(err)
+	} else if stored != req.Target {
+		t.Fatalf("expected stored target %q, got %q", req.Target, stored)
+	}
+}
+
+func TestFsck(t *testing.T) {
+	db, stop := initTestDB(t)
+	defer stop()
+	cfs := CFS{db: db}
+
+	d := mustCreate(t, cfs, rootNodeID, "d", cfs.newDirNode())
+	f := mustCreate(t, cfs, d.ID, "f", cfs.newFileNode())
+	if err := write(db, f.ID, 0, 0, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	f.Size = 5
+	if err := updateNode(db, f); err != nil {
+		t.Fatal(err)
+	}
+	if problems, err := fsck(db); err != nil {
+		t.Fatal(err)
+	} else if len(problems) != 0 {
+		t.Fatalf("expected no problems, got %d: %v", len(problems), problems)
+	}
+
+	for _, stmt := range []string{
+		// A dangling entry.
+		`INSERT INTO fs.namespace VALUES (1, 'dangling', 12345)`,
+		// Orphaned blocks.
+		`INSERT INTO fs.block VALUES (12346, 0, 'x')`,
+		// A wrong link count.
+		`UPDATE fs.inode SET nlink = 3 WHERE id = ` + fmt.Sprint(f.ID),
+		// A block past the end of a file.
+		`INSERT INTO fs.block VALUES (` + fmt.Sprint(f.ID) + `, 1, 'x')`,
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	problems, err := fsck(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 4 {
+		t.Fatalf("expected 4 problems, got %d: %v", len(problems), problems)
+	}
+	for _, p := range problems {
+		if err := dbdriver.ExecuteTx(db, p.repair); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if problems, err := fsck(db); err != nil {
+		t.Fatal(err)
+	} else if len(problems) != 0 {
+		t.Fatalf("expected no problems after repair, got %d: %v", len(problems), problems)
+	}
+}
+
+func TestFsckUnlinkedDirectory(t *testing.T) {
+	db, stop := initTestDB(t)
+	defer stop()
+	cfs := CFS{db: db}
+
+	// A directory linked from nowhere, holding a file and a subdirectory
+	// with another file.
+	d := mustCreate(t, cfs, rootNodeID, "d", cfs.newDirNode())
+	mustCreate(t, cfs, d.ID, "f", cfs.newFileNode())
+	sub := mustCreate(t, cfs, d.ID, "sub", cfs.newDirNode())
+	mustCreate(t, cfs, sub.ID, "g", cfs.newFileNode())
+	if _, err := db.Exec(`DELETE FROM fs.namespace WHERE (parentID, name) = ($1, 'd')`, rootNodeID); err != nil {
+		t.Fatal(err)
+	}
+
+	repaired, remaining, err := fsckRepair(db, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The directory, then its two entries, then the file and the
+	// subdirectory, then the entry of the subdirectory, then its file.
+	if repaired != 7 || remaining != 0 {
+		t.Fatalf("expected 7 problems repaired and none remaining, got %d and %d", repaired, remaining)
+	}
+	if problems, err := fsck(db); err != nil {
+		t.Fatal(err)
+	} else if len(problems) != 0 {
+		t.Fatalf("expected no problems after repair, got %d: %v", len(problems), problems)
+	}
+	var entries int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM fs.namespace`).Scan(&entries); err != nil {
+		t.Fatal(err)
+	} else if entries != 0 {
+		t.Fatalf("expected no entries left, got %d", entries)
+	}
+}
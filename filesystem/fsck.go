@@ -0,0 +1,327 @@
+// Copyright 2016 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/cockroachdb/examples-go/dbdriver"
+)
+
+// The fsck subcommand scans the namespace, inode and block tables for
+// inconsistencies, and optionally repairs them. The filesystem must not be
+// mounted while it runs.
+
+// An fsckProblem is an inconsistency found by fsck. repair is nil if the
+// problem can't be repaired automatically.
+type fsckProblem struct {
+	desc   string
+	repair func(tx *sql.Tx) error
+}
+
+type fsckEntry struct {
+	parentID uint64
+	name     string
+	id       uint64
+}
+
+// fsckBlock describes a stored block, without its data.
+type fsckBlock struct {
+	block  int
+	length uint64
+}
+
+func runFsck(args []string) {
+	flags := flag.NewFlagSet("fsck", flag.ExitOnError)
+	repair := flags.Bool("repair", false, "Repair the problems found, where possible.")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage of %s fsck:\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s fsck [flags] [<db URL>]\n\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(args)
+
+	if flags.NArg() > 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	dbURL, err := dbdriver.URL(flags.Arg(0), "")
+	if err != nil {
+		log.Fatal(err)
+	}
+	db, err := dbdriver.Open(*driver, dbURL)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer func() { _ = db.Close() }()
+
+	repaired, remaining, err := fsckRepair(db, *repair)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("found %d problems, repaired %d", repaired+remaining, repaired)
+	if remaining > 0 {
+		os.Exit(1)
+	}
+}
+
+// fsckRepair logs the problems found by fsck and, if repair is set,
+// repairs them. A repair can uncover more problems, e.g. deleting a
+// directory linked from nowhere leaves its entries in a missing directory,
+// so fsck runs again until a pass repairs nothing. It returns the number of
+// problems repaired and of those remaining.
+func fsckRepair(db *sql.DB, repair bool) (repaired, remaining int, err error) {
+	for {
+		problems, err := fsck(db)
+		if err != nil {
+			return repaired, remaining, err
+		}
+		remaining = 0
+		var pass int
+		for _, p := range problems {
+			switch {
+			case !repair:
+				log.Print(p.desc)
+				remaining++
+			case p.repair == nil:
+				log.Printf("%s (can't be repaired)", p.desc)
+				remaining++
+			default:
+				if err := dbdriver.ExecuteTx(db, p.repair); err != nil {
+					log.Printf("%s (repair failed: %s)", p.desc, err)
+					remaining++
+					continue
+				}
+				log.Printf("%s (repaired)", p.desc)
+				pass++
+			}
+		}
+		repaired += pass
+		if pass == 0 {
+			return repaired, remaining, nil
+		}
+	}
+}
+
+// fsck returns the inconsistencies found in the filesystem tables.
+func fsck(db *sql.DB) ([]fsckProblem, error) {
+	entries, err := fsckEntries(db)
+	if err != nil {
+		return nil, err
+	}
+	nodes, err := fsckNodes(db)
+	if err != nil {
+		return nil, err
+	}
+	blocks, err := fsckBlocks(db)
+	if err != nil {
+		return nil, err
+	}
+
+	var problems []fsckProblem
+
+	// Directory entries must link a node to an existing directory.
+	refs := make(map[uint64]uint32)
+	for _, e := range entries {
+		e := e
+		deleteEntry := func(tx *sql.Tx) error {
+			const sql = `DELETE FROM fs.namespace WHERE (parentID, name) = ($1, $2)`
+			_, err := tx.Exec(sql, e.parentID, e.name)
+			return err
+		}
+		parent, ok := nodes[e.parentID]
+		switch {
+		case e.parentID != rootNodeID && !ok:
+			problems = append(problems, fsckProblem{
+				desc:   fmt.Sprintf("entry %d/%s is in missing directory %d", e.parentID, e.name, e.parentID),
+				repair: deleteEntry,
+			})
+		case e.parentID != rootNodeID && !parent.isDir():
+			problems = append(problems, fsckProblem{
+				desc:   fmt.Sprintf("entry %d/%s is in non-directory %d", e.parentID, e.name, e.parentID),
+				repair: deleteEntry,
+			})
+		case nodes[e.id] == nil:
+			problems = append(problems, fsckProblem{
+				desc:   fmt.Sprintf("entry %d/%s links to missing inode %d", e.parentID, e.name, e.id),
+				repair: deleteEntry,
+			})
+		default:
+			refs[e.id]++
+		}
+	}
+
+	// Link counts must match the entries linking to each inode.
+	for id, node := range nodes {
+		if id == rootNodeID {
+			continue
+		}
+		id, node := id, node
+		switch n := refs[id]; {
+		case n == 0:
+			problems = append(problems, fsckProblem{
+				desc: fmt.Sprintf("inode %d is not linked from any directory", id),
+				repair: func(tx *sql.Tx) error {
+					return deleteInode(tx, id)
+				},
+			})
+		case n > 1 && node.isDir():
+			problems = append(problems, fsckProblem{
+				desc: fmt.Sprintf("directory %d is linked from %d entries", id, n),
+			})
+		case n != node.NLink:
+			problems = append(problems, fsckProblem{
+				desc: fmt.Sprintf("inode %d has a link count of %d, but %d entries link to it",
+					id, node.NLink, n),
+				repair: func(tx *sql.Tx) error {
+					_, err := tx.Exec(`UPDATE fs.inode SET nlink = $1 WHERE id = $2`, n, id)
+					return err
+				},
+			})
+		}
+	}
+
+	// Blocks must belong to a file, and cover exactly its size.
+	for id, fileBlocks := range blocks {
+		id := id
+		node, ok := nodes[id]
+		if !ok || !node.isRegular() {
+			problems = append(problems, fsckProblem{
+				desc: fmt.Sprintf("%d blocks belong to missing or non-file inode %d", len(fileBlocks), id),
+				repair: func(tx *sql.Tx) error {
+					_, err := tx.Exec(`DELETE FROM fs.block WHERE id = $1`, id)
+					return err
+				},
+			})
+			continue
+		}
+		problems = append(problems, fsckFileBlocks(node, fileBlocks)...)
+	}
+	for id, node := range nodes {
+		if node.isRegular() && node.Size > 0 && len(blocks[id]) == 0 {
+			problems = append(problems, fsckProblem{
+				desc: fmt.Sprintf("file %d has a size of %d, but no blocks", id, node.Size),
+			})
+		}
+	}
+
+	return problems, nil
+}
+
+// fsckFileBlocks checks that the blocks of a file match its size.
+func fsckFileBlocks(node *Node, blocks []fsckBlock) []fsckProblem {
+	var problems []fsckProblem
+	numBlocks := int((node.Size + BlockSize - 1) / BlockSize)
+	extra := 0
+	seen := make(map[int]bool)
+	for _, b := range blocks {
+		if b.block >= numBlocks {
+			extra++
+			continue
+		}
+		seen[b.block] = true
+		expected := uint64(BlockSize)
+		if b.block == numBlocks-1 && node.Size%BlockSize != 0 {
+			expected = node.Size % BlockSize
+		}
+		if b.length != expected {
+			problems = append(problems, fsckProblem{
+				desc: fmt.Sprintf("block %d of file %d holds %d bytes, expected %d",
+					b.block, node.ID, b.length, expected),
+			})
+		}
+	}
+	if extra > 0 {
+		id := node.ID
+		problems = append(problems, fsckProblem{
+			desc: fmt.Sprintf("file %d of size %d has %d blocks past its end", id, node.Size, extra),
+			repair: func(tx *sql.Tx) error {
+				_, err := tx.Exec(`DELETE FROM fs.block WHERE id = $1 AND block >= $2`, id, numBlocks)
+				return err
+			},
+		})
+	}
+	if missing := numBlocks - len(seen); missing > 0 {
+		problems = append(problems, fsckProblem{
+			desc: fmt.Sprintf("file %d of size %d is missing %d blocks", node.ID, node.Size, missing),
+		})
+	}
+	return problems
+}
+
+func fsckEntries(db *sql.DB) ([]fsckEntry, error) {
+	rows, err := db.Query(`SELECT parentID, name, id FROM fs.namespace`)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+	var entries []fsckEntry
+	for rows.Next() {
+		var e fsckEntry
+		if err := rows.Scan(&e.parentID, &e.name, &e.id); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+func fsckNodes(db *sql.DB) (map[uint64]*Node, error) {
+	rows, err := db.Query(`SELECT id, inode, nlink FROM fs.inode`)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+	nodes := make(map[uint64]*Node)
+	for rows.Next() {
+		var id uint64
+		var raw string
+		var nlink uint32
+		if err := rows.Scan(&id, &raw, &nlink); err != nil {
+			return nil, err
+		}
+		node := &Node{NLink: nlink}
+		if err := json.Unmarshal([]byte(raw), node); err != nil {
+			return nil, fmt.Errorf("inode %d: %s", id, err)
+		}
+		nodes[id] = node
+	}
+	return nodes, rows.Err()
+}
+
+func fsckBlocks(db *sql.DB) (map[uint64][]fsckBlock, error) {
+	rows, err := db.Query(`SELECT id, block, LENGTH(data) FROM fs.block`)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+	blocks := make(map[uint64][]fsckBlock)
+	for rows.Next() {
+		var id uint64
+		var b fsckBlock
+		if err := rows.Scan(&id, &b.block, &b.length); err != nil {
+			return nil, err
+		}
+		blocks[id] = append(blocks[id], b)
+	}
+	return blocks, rows.Err()
+}
@@ -19,7 +19,9 @@
 // in cockroach.
 //
 // Inode relationships are stored in the `namespace` table, and inodes
-// themselves in the `inode` table.
+// themselves in the `inode` table. An inode may have several names (hard
+// links); its `nlink` column counts them, and it is deleted along with its
+// data once the last one is removed.
 //
 // Data blocks are stored in the `block` table, indexed by inode ID
 // and block number.
@@ -30,43 +32,68 @@
 // - read/write files
 // - rename
 // - symlinks
+// - hard links
+// - permissions, ownership and timestamps (chmod, chown, touch)
+//
+// With --cache-size, data blocks are cached in memory and writes are
+// buffered until the file is closed or fsynced, or the flush interval
+// elapses. Every change to an inode bumps its `gen` column: opening a file
+// checks it, dropping the blocks cached at an older generation, and
+// buffered writes to a file that another mount changed in the meantime are
+// discarded (ESTALE). Changes made by another mount while a file is open
+// aren't seen until it's opened again.
 //
 // WARNING: concurrent access on a single mount is fine. However,
 // behavior is undefined (read broken) when mounted more than once at the
 // same time. Specifically, read/writes will not be seen right away and
 // may work on out of date information.
 //
+// The stress subcommand runs concurrent create/write/read/remove traffic
+// from several simulated mounts against the same database, and verifies
+// the resulting namespace and file contents afterwards. The fsck
+// subcommand looks for orphaned blocks and inodes, dangling directory
+// entries and wrong link counts, and repairs them with --repair. It must
+// not run while the filesystem is mounted. The bench subcommand measures
+// the throughput and latencies of a mounted filesystem.
+//
 // One caveat of the implemented features is that handles are not
 // reference counted so if an inode is deleted, all open file descriptors
 // pointing to it become invalid.
 //
 // Some TODOs (definitely not a comprehensive list):
-// - support basic attributes (mode, timestamps)
-// - support other types: hard links
-// - add ref counting (and handle open/release)
+// - add ref counting of open handles (and handle open/release)
 // - sparse files: don't store empty blocks
 // - sparse files 2: keep track of holes
 
 package main
 
 import (
-	"database/sql"
 	"flag"
 	"fmt"
 	"log"
 	"os"
 	"os/signal"
+	"time"
 
 	"bazil.org/fuse"
 	"bazil.org/fuse/fs"
 	_ "bazil.org/fuse/fs/fstestutil"
+	"github.com/cockroachdb/examples-go/dbdriver"
 	// Import postgres driver.
 	_ "github.com/cockroachdb/pq"
 )
 
+var cacheSize = flag.Int("cache-size", 0, "Size in MB of the block cache and write-back buffers. 0 disables caching. "+
+	"Other mounts' changes to a file are picked up when it's opened.")
+var flushInterval = flag.Duration("flush-interval", time.Second, "Maximum time writes are buffered before being flushed, if caching is enabled.")
+var driver = flag.String("driver", "postgres", dbdriver.Usage)
+
 var usage = func() {
 	fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
-	fmt.Fprintf(os.Stderr, "  %s <db URL> <mountpoint>\n\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s [<db URL>] <mountpoint>\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s stress [flags] [<db URL>]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s fsck [flags] [<db URL>]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s bench [flags] <mountpoint>\n\n", os.Args[0])
 	flag.PrintDefaults()
 }
 
@@ -74,15 +101,35 @@ func main() {
 	flag.Usage = usage
 	flag.Parse()
 
-	if flag.NArg() != 2 {
+	switch flag.Arg(0) {
+	case "stress":
+		runStress(flag.Args()[1:])
+		return
+	case "fsck":
+		runFsck(flag.Args()[1:])
+		return
+	case "bench":
+		runBench(flag.Args()[1:])
+		return
+	}
+
+	var dbArg, mountPoint string
+	switch flag.NArg() {
+	case 1:
+		mountPoint = flag.Arg(0)
+	case 2:
+		dbArg, mountPoint = flag.Arg(0), flag.Arg(1)
+	default:
 		usage()
 		os.Exit(2)
 	}
-
-	dbURL, mountPoint := flag.Arg(0), flag.Arg(1)
+	dbURL, err := dbdriver.URL(dbArg, "")
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	// Open DB connection first.
-	db, err := sql.Open("postgres", dbURL)
+	db, err := dbdriver.Open(*driver, dbURL)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -92,7 +139,15 @@ func main() {
 		log.Fatal(err)
 	}
 
-	cfs := CFS{db}
+	cfs := CFS{db: db}
+	if *cacheSize > 0 {
+		cfs.cache = newCache(*cacheSize << 20)
+		go func() {
+			for range time.Tick(*flushInterval) {
+				cfs.cache.flushAll()
+			}
+		}()
+	}
 	// Mount filesystem.
 	c, err := fuse.Mount(
 		mountPoint,
@@ -122,6 +177,9 @@ func main() {
 
 	// Serve root.
 	err = fs.Serve(c, cfs)
+	if cfs.cache != nil {
+		cfs.cache.flushAll()
+	}
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -26,11 +26,11 @@ import (
 	"os"
 	"sync"
 	"syscall"
-
-	"github.com/cockroachdb/cockroach-go/crdb"
+	"time"
 
 	"bazil.org/fuse"
 	"bazil.org/fuse/fs"
+	"github.com/cockroachdb/examples-go/dbdriver"
 	"golang.org/x/net/context"
 )
 
@@ -43,10 +43,13 @@ var _ fs.NodeCreater = &Node{}        // Create
 var _ fs.NodeRemover = &Node{}        // Remove
 var _ fs.HandleWriter = &Node{}       // Write
 var _ fs.HandleReader = &Node{}       // Read
+var _ fs.NodeOpener = &Node{}         // Open
 var _ fs.NodeFsyncer = &Node{}        // Fsync
+var _ fs.HandleFlusher = &Node{}      // Flush
 var _ fs.NodeRenamer = &Node{}        // Rename
 var _ fs.NodeSymlinker = &Node{}      // Symlink
 var _ fs.NodeReadlinker = &Node{}     // Readlink
+var _ fs.NodeLinker = &Node{}         // Link
 
 // Default permissions: we don't have any right now.
 const defaultPerms = 0755
@@ -60,35 +63,75 @@ const maxSize = math.MaxUint64
 // Maximum length of a symlink target.
 const maxSymlinkTargetLength = 4096
 
+// nodeAttrs holds the attributes of a node that are stored in their own
+// columns of the inode table.
+type nodeAttrs struct {
+	// Perm holds the permission bits of the node.
+	Perm                os.FileMode
+	UID, GID            uint32
+	Atime, Mtime, Ctime time.Time
+}
+
 // Node implements the Node interface.
 // ID, Mode, and SymlinkTarget are currently immutable after node creation.
-// Size (for files only) is protected by mu.
+// Size (for files only), NLink and attrs are protected by mu.
 type Node struct {
 	cfs CFS
 	// ID is a unique ID allocated at node creation time.
 	ID uint64
-	// Used for type only, permissions are ignored.
+	// Used for type only, permissions are in attrs.
 	Mode os.FileMode
-	// SymlinkTarget is the path a symlink points to.
-	SymlinkTarget string
+	// SymlinkTarget is the path a symlink points to. It is stored in the
+	// target column of the inode table.
+	SymlinkTarget string `json:"-"`
+
+	// NLink is the number of names linking to the node. It is stored in
+	// its own column so that updating the node doesn't overwrite it.
+	NLink uint32 `json:"-"`
+	// attrs holds the permissions, ownership and timestamps of the node.
+	attrs nodeAttrs
 
 	// Other fields to add:
-	// nLinks: number of hard links
 	// openFDs: number of open file descriptors
-	// timestamps (probably just ctime and mtime)
 
 	// Implicit fields:
 	// numBlocks: number of 512b blocks
 	// blocksize: preferred block size
-	// mode bits: permissions
 
 	// For regular files only.
 	// Data blocks are addressed by inode number and offset.
 	// Any op accessing Size and blocks must lock 'mu'.
 	mu   sync.RWMutex
 	Size uint64
+
+	// gen is the generation of the inode as of the last time the node read
+	// or changed it. Protected by mu.
+	gen int64
+	// pending holds the writes buffered when caching is enabled, nil if
+	// there are none. Protected by mu.
+	pending *pendingWrites
+}
+
+// pendingWrites holds the writes to a file that haven't been flushed to
+// the database yet.
+type pendingWrites struct {
+	// size is the size of the file in the database.
+	size uint64
+	// extents holds the writes in the order they were made, sequential
+	// writes being merged.
+	extents []extent
+	bytes   int
+}
+
+type extent struct {
+	offset uint64
+	data   []byte
 }
 
+// errStale is returned when buffered writes can't be flushed because the
+// file was changed by another mount in the meantime.
+var errStale = fuse.Errno(syscall.ESTALE)
+
 // convenience functions to query the mode.
 func (n *Node) isDir() bool {
 	return n.Mode.IsDir()
@@ -114,7 +157,12 @@ func (n *Node) toJSON() string {
 // Attr fills attr with the standard metadata for the node.
 func (n *Node) Attr(_ context.Context, a *fuse.Attr) error {
 	a.Inode = n.ID
-	a.Mode = n.Mode
+	n.mu.RLock()
+	a.Mode = n.Mode&^os.ModePerm | n.attrs.Perm
+	a.Nlink = n.NLink
+	a.Uid, a.Gid = n.attrs.UID, n.attrs.GID
+	a.Atime, a.Mtime, a.Ctime = n.attrs.Atime, n.attrs.Mtime, n.attrs.Ctime
+	n.mu.RUnlock()
 	// Does preferred block size make sense on things other
 	// than regular files?
 	a.BlockSize = BlockSize
@@ -134,19 +182,28 @@ func (n *Node) Attr(_ context.Context, a *fuse.Attr) error {
 	return nil
 }
 
-// Setattr modifies node metadata. This includes changing the size.
-func (n *Node) Setattr(_ context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) error {
-	if !req.Valid.Size() {
-		// We can exit early since only setting the size is implemented.
-		return nil
+// Setattr modifies node metadata: its size, permissions, ownership and
+// timestamps.
+func (n *Node) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) error {
+	if req.Valid.Size() {
+		if err := n.setSize(req.Size); err != nil {
+			return err
+		}
 	}
+	if err := n.setAttrs(req); err != nil {
+		return err
+	}
+	return n.Attr(ctx, &resp.Attr)
+}
 
+// setSize truncates or extends the file to 'size' bytes.
+func (n *Node) setSize(size uint64) error {
 	if !n.isRegular() {
 		// Setting the size is only available on regular files.
 		return fuse.Errno(syscall.EINVAL)
 	}
 
-	if req.Size > maxSize {
+	if size > maxSize {
 		// Too big.
 		return fuse.Errno(syscall.EFBIG)
 	}
@@ -154,31 +211,110 @@ func (n *Node) Setattr(_ context.Context, req *fuse.SetattrRequest, resp *fuse.S
 	n.mu.Lock()
 	defer n.mu.Unlock()
 
-	if req.Size == n.Size {
+	// Resize from what's in the database.
+	if err := n.flushLocked(); err != nil {
+		return err
+	}
+
+	if size == n.Size {
 		// Nothing to do.
 		return nil
 	}
 
-	// Store the current size in case we need to rollback.
-	originalSize := n.Size
+	// Store the current size and attributes in case we need to rollback.
+	originalSize, originalAttrs := n.Size, n.attrs
 
 	// Wrap everything inside a transaction.
-	err := crdb.ExecuteTx(n.cfs.db, func(tx *sql.Tx) error {
+	var gen int64
+	err := dbdriver.ExecuteTx(n.cfs.db, func(tx *sql.Tx) error {
 		// Resize blocks as needed.
-		if err := resizeBlocks(tx, n.ID, n.Size, req.Size); err != nil {
+		if err := resizeBlocks(tx, n.ID, n.Size, size); err != nil {
 			return err
 		}
 
-		n.Size = req.Size
-		return updateNode(tx, n)
+		n.Size = size
+		if err := updateNode(tx, n); err != nil {
+			return err
+		}
+		n.attrs.Mtime = time.Now()
+		n.attrs.Ctime = n.attrs.Mtime
+		var err error
+		gen, err = updateAttrs(tx, n.ID, n.attrs)
+		return err
 	})
 
 	if err != nil {
 		// Reset our size.
 		log.Print(err)
-		n.Size = originalSize
+		n.Size, n.attrs = originalSize, originalAttrs
 		return err
 	}
+	n.gen = gen
+	if n.cfs.cache != nil {
+		n.cfs.cache.invalidate(n.ID)
+	}
+	return nil
+}
+
+// setAttrs applies the permission, ownership and timestamp changes of req.
+func (n *Node) setAttrs(req *fuse.SetattrRequest) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	attrs := n.attrs
+	now := time.Now()
+	if req.Valid.Mode() {
+		attrs.Perm = req.Mode.Perm()
+	}
+	if req.Valid.Uid() {
+		attrs.UID = req.Uid
+	}
+	if req.Valid.Gid() {
+		attrs.GID = req.Gid
+	}
+	if req.Valid.AtimeNow() {
+		attrs.Atime = now
+	} else if req.Valid.Atime() {
+		attrs.Atime = req.Atime
+	}
+	if req.Valid.MtimeNow() {
+		attrs.Mtime = now
+	} else if req.Valid.Mtime() {
+		attrs.Mtime = req.Mtime
+	}
+	if attrs == n.attrs {
+		// Nothing to do.
+		return nil
+	}
+	attrs.Ctime = now
+
+	gen, err := updateAttrs(n.cfs.db, n.ID, attrs)
+	if err != nil {
+		log.Print(err)
+		return err
+	}
+	if n.cfs.cache != nil {
+		if gen == n.gen+1 {
+			// The data didn't change, the cached blocks are still good.
+			n.cfs.cache.advance(n.ID, n.gen, gen)
+		} else {
+			// Another mount changed the inode since we last did: drop
+			// the cached blocks and reload its size. Buffered writes
+			// are left for flushing to detect the conflict.
+			n.cfs.cache.invalidate(n.ID)
+			if n.pending != nil {
+				n.attrs = attrs
+				return nil
+			}
+			fresh, err := getInodeByID(n.cfs.db, n.ID)
+			if err != nil {
+				log.Print(err)
+				return err
+			}
+			n.Size, n.NLink = fresh.Size, fresh.NLink
+		}
+	}
+	n.attrs, n.gen = attrs, gen
 	return nil
 }
 
@@ -223,6 +359,8 @@ func (n *Node) Mkdir(_ context.Context, req *fuse.MkdirRequest) (fs.Node, error)
 	}
 
 	node := n.cfs.newDirNode()
+	node.attrs.Perm = req.Mode.Perm()
+	node.attrs.UID, node.attrs.GID = req.Uid, req.Gid
 	err := n.cfs.create(n.ID, req.Name, node)
 	if err != nil {
 		return nil, err
@@ -243,6 +381,8 @@ func (n *Node) Create(_ context.Context, req *fuse.CreateRequest, resp *fuse.Cre
 	}
 
 	node := n.cfs.newFileNode()
+	node.attrs.Perm = req.Mode.Perm()
+	node.attrs.UID, node.attrs.GID = req.Uid, req.Gid
 	err := n.cfs.create(n.ID, req.Name, node)
 	if err != nil {
 		return nil, nil, err
@@ -284,11 +424,20 @@ func (n *Node) Write(_ context.Context, req *fuse.WriteRequest, resp *fuse.Write
 		return fuse.Errno(syscall.EFBIG)
 	}
 
-	// Store the current size in case we need to rollback.
-	originalSize := n.Size
+	if n.cfs.cache != nil {
+		if err := n.bufferWrite(uint64(req.Offset), req.Data); err != nil {
+			return err
+		}
+		resp.Size = len(req.Data)
+		return nil
+	}
+
+	// Store the current size and attributes in case we need to rollback.
+	originalSize, originalAttrs := n.Size, n.attrs
 
 	// Wrap everything inside a transaction.
-	err := crdb.ExecuteTx(n.cfs.db, func(tx *sql.Tx) error {
+	var gen int64
+	err := dbdriver.ExecuteTx(n.cfs.db, func(tx *sql.Tx) error {
 
 		// Update blocks. They will be added as needed.
 		if err := write(tx, n.ID, n.Size, uint64(req.Offset), req.Data); err != nil {
@@ -302,21 +451,118 @@ func (n *Node) Write(_ context.Context, req *fuse.WriteRequest, resp *fuse.Write
 				return err
 			}
 		}
-		return nil
+		n.attrs.Mtime = time.Now()
+		n.attrs.Ctime = n.attrs.Mtime
+		var err error
+		gen, err = updateAttrs(tx, n.ID, n.attrs)
+		return err
 	})
 
 	if err != nil {
 		// Reset our size.
 		log.Print(err)
-		n.Size = originalSize
+		n.Size, n.attrs = originalSize, originalAttrs
 		return err
 	}
+	n.gen = gen
 
 	// We always write everything.
 	resp.Size = len(req.Data)
 	return nil
 }
 
+// bufferWrite records a write to be flushed later, flushing right away if
+// too much data is buffered.
+// Requires: n.mu is held.
+func (n *Node) bufferWrite(offset uint64, data []byte) error {
+	if n.pending == nil {
+		n.pending = &pendingWrites{size: n.Size}
+		n.cfs.cache.markDirty(n)
+	}
+	p := n.pending
+	if last := len(p.extents) - 1; last >= 0 &&
+		p.extents[last].offset+uint64(len(p.extents[last].data)) == offset {
+		p.extents[last].data = append(p.extents[last].data, data...)
+	} else {
+		p.extents = append(p.extents, extent{offset: offset, data: append([]byte(nil), data...)})
+	}
+	p.bytes += len(data)
+
+	if end := offset + uint64(len(data)); end > n.Size {
+		n.Size = end
+	}
+	n.attrs.Mtime = time.Now()
+	n.attrs.Ctime = n.attrs.Mtime
+
+	if p.bytes >= n.cfs.cache.maxBytes {
+		return n.flushLocked()
+	}
+	return nil
+}
+
+// flush writes the buffered writes of 'n' to the database.
+func (n *Node) flush() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.flushLocked()
+}
+
+// flushLocked writes the buffered writes of 'n' to the database in a
+// single transaction. If the inode changed since the node last saw it, the
+// writes are dropped and errStale is returned.
+// Requires: n.mu is held.
+func (n *Node) flushLocked() error {
+	p := n.pending
+	if p == nil {
+		return nil
+	}
+
+	var gen int64
+	err := dbdriver.ExecuteTx(n.cfs.db, func(tx *sql.Tx) error {
+		current, err := getGen(tx, n.ID)
+		if err != nil {
+			return err
+		}
+		if current != n.gen {
+			return errStale
+		}
+		size := p.size
+		for _, e := range p.extents {
+			if err := write(tx, n.ID, size, e.offset, e.data); err != nil {
+				return err
+			}
+			if end := e.offset + uint64(len(e.data)); end > size {
+				size = end
+			}
+		}
+		if err := updateNode(tx, n); err != nil {
+			return err
+		}
+		gen, err = updateAttrs(tx, n.ID, n.attrs)
+		return err
+	})
+
+	switch err {
+	case nil:
+		n.gen = gen
+	case sql.ErrNoRows:
+		// The file was deleted, there's nothing to write to.
+		err = nil
+	case errStale:
+		log.Printf("inode %d was changed by another mount, dropping %d buffered bytes",
+			n.ID, p.bytes)
+		n.Size = p.size
+	default:
+		// Keep the writes around, we'll try again.
+		log.Print(err)
+		return err
+	}
+	n.pending = nil
+	n.cfs.cache.markClean(n)
+	n.cfs.cache.invalidate(n.ID)
+	return err
+}
+
 // Read reads data from 'n'.
 func (n *Node) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
 	if !n.isRegular() {
@@ -332,6 +578,15 @@ func (n *Node) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadR
 	}
 	offset := uint64(req.Offset)
 
+	if n.cfs.cache != nil {
+		data, err := n.readCached(offset, uint64(req.Size))
+		if err != nil {
+			return err
+		}
+		resp.Data = data
+		return nil
+	}
+
 	n.mu.RLock()
 	defer n.mu.RUnlock()
 	if offset >= n.Size {
@@ -352,9 +607,97 @@ func (n *Node) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadR
 	return nil
 }
 
-// Fsync is a noop for us, we always push writes to the DB. We do need to implement it though.
+// Open revalidates a file against the database when caching is enabled:
+// if another mount changed it since this node last read or changed it,
+// its cached blocks are dropped and its size and attributes reloaded.
+// Buffered writes are left for flushing to detect the conflict.
+func (n *Node) Open(_ context.Context, _ *fuse.OpenRequest, _ *fuse.OpenResponse) (fs.Handle, error) {
+	if n.cfs.cache == nil || !n.isRegular() {
+		return n, nil
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.pending != nil {
+		return n, nil
+	}
+	fresh, err := getInodeByID(n.cfs.db, n.ID)
+	if err != nil {
+		return nil, err
+	}
+	if fresh.gen != n.gen {
+		n.cfs.cache.invalidate(n.ID)
+		n.Size, n.NLink, n.attrs, n.gen = fresh.Size, fresh.NLink, fresh.attrs, fresh.gen
+	}
+	return n, nil
+}
+
+// readCached reads up to 'size' bytes from 'offset', using the blocks
+// cached for the inode and caching the ones it fetches.
+func (n *Node) readCached(offset, size uint64) ([]byte, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	// Our own writes must be visible.
+	if err := n.flushLocked(); err != nil {
+		return nil, err
+	}
+	if offset >= n.Size {
+		// Beyond end of file.
+		return nil, nil
+	}
+
+	readRange := newBlockRange(offset, min(n.Size, offset+size)-offset)
+	end := readRange.last
+	if readRange.lastLength == 0 {
+		end--
+	}
+
+	// Look up the cached blocks, and fetch the range of the missing ones.
+	c := n.cfs.cache
+	blocks := make(map[int][]byte)
+	firstMissing, lastMissing := -1, -1
+	for i := readRange.start; i <= end; i++ {
+		if data, ok := c.get(n.ID, n.gen, i); ok {
+			blocks[i] = data
+			continue
+		}
+		if firstMissing < 0 {
+			firstMissing = i
+		}
+		lastMissing = i
+	}
+	if firstMissing >= 0 {
+		fetched, err := getBlocksBetween(n.cfs.db, n.ID, firstMissing, lastMissing)
+		if err != nil {
+			return nil, err
+		}
+		for _, b := range fetched {
+			blocks[b.block] = b.data
+			c.put(n.ID, n.gen, b.block, b.data)
+		}
+	}
+
+	blockInfos := make([]blockInfo, 0, end-readRange.start+1)
+	for i := readRange.start; i <= end; i++ {
+		data, ok := blocks[i]
+		if !ok {
+			return nil, fmt.Errorf("missing block %d of inode %d", i, n.ID)
+		}
+		blockInfos = append(blockInfos, blockInfo{block: i, data: data})
+	}
+	return joinBlocks(readRange, blockInfos), nil
+}
+
+// Fsync flushes the buffered writes, if any. Without caching, writes are
+// always pushed to the DB right away.
 func (n *Node) Fsync(_ context.Context, _ *fuse.FsyncRequest) error {
-	return nil
+	return n.flush()
+}
+
+// Flush is called when a file descriptor is closed. It flushes the buffered
+// writes, if any, so that they are visible to other mounts after a close.
+func (n *Node) Flush(_ context.Context, _ *fuse.FlushRequest) error {
+	return n.flush()
 }
 
 // Rename renames 'req.OldName' to 'req.NewName', optionally moving it to 'newDir'.
@@ -386,6 +729,7 @@ func (n *Node) Symlink(_ context.Context, req *fuse.SymlinkRequest) (fs.Node, er
 	}
 	node := n.cfs.newSymlinkNode()
 	node.SymlinkTarget = req.Target
+	node.attrs.UID, node.attrs.GID = req.Uid, req.Gid
 	err := n.cfs.create(n.ID, req.NewName, node)
 	if err != nil {
 		return nil, err
@@ -400,3 +744,23 @@ func (n *Node) Readlink(_ context.Context, req *fuse.ReadlinkRequest) (string, e
 	}
 	return n.SymlinkTarget, nil
 }
+
+// Link creates a new name 'req.NewName' in the receiver directory for the
+// existing node 'old'. Directories can't be linked.
+func (n *Node) Link(_ context.Context, req *fuse.LinkRequest, old fs.Node) (fs.Node, error) {
+	if !n.isDir() {
+		return nil, fuse.Errno(syscall.ENOTDIR)
+	}
+	oldNode, ok := old.(*Node)
+	if !ok {
+		return nil, fmt.Errorf("old is not a Node: %v", old)
+	}
+	nlink, err := n.cfs.link(n.ID, req.NewName, oldNode)
+	if err != nil {
+		return nil, err
+	}
+	oldNode.mu.Lock()
+	oldNode.NLink = nlink
+	oldNode.mu.Unlock()
+	return oldNode, nil
+}
@@ -20,6 +20,7 @@ package main
 import (
 	"database/sql"
 	"encoding/json"
+	"os"
 	"syscall"
 
 	"bazil.org/fuse"
@@ -33,19 +34,94 @@ type sqlExecutor interface {
 	QueryRow(query string, args ...interface{}) *sql.Row
 }
 
+// inodeColumns are the columns of an inode read by scanInode.
+const inodeColumns = `inode, nlink, mode, uid, gid, atime, mtime, ctime, gen, target`
+
 // getInode looks up an inode given its name and its parent ID.
 // If not found, error will be sql.ErrNoRows.
 func getInode(e sqlExecutor, parentID uint64, name string) (*Node, error) {
-	var raw string
-	const sql = `SELECT inode FROM fs.inode WHERE id = 
+	const sql = `SELECT ` + inodeColumns + ` FROM fs.inode WHERE id = 
 (SELECT id FROM fs.namespace WHERE (parentID, name) = ($1, $2))`
-	if err := e.QueryRow(sql, parentID, name).Scan(&raw); err != nil {
+	return scanInode(e.QueryRow(sql, parentID, name))
+}
+
+// getInodeByID looks up an inode given its ID.
+// If not found, error will be sql.ErrNoRows.
+func getInodeByID(e sqlExecutor, id uint64) (*Node, error) {
+	const sql = `SELECT ` + inodeColumns + ` FROM fs.inode WHERE id = $1`
+	return scanInode(e.QueryRow(sql, id))
+}
+
+// scanInode returns the node of an inode read as inodeColumns.
+func scanInode(row *sql.Row) (*Node, error) {
+	var raw string
+	var nlink uint32
+	var perm sql.NullInt64
+	var a nodeAttrs
+	var gen int64
+	var target sql.NullString
+	if err := row.Scan(&raw, &nlink, &perm, &a.UID, &a.GID,
+		&a.Atime, &a.Mtime, &a.Ctime, &gen, &target); err != nil {
+		return nil, err
+	}
+
+	node := &Node{NLink: nlink, gen: gen, SymlinkTarget: target.String}
+	if err := json.Unmarshal([]byte(raw), node); err != nil {
 		return nil, err
 	}
+	// Inodes created before permissions were stored keep those of their
+	// descriptor.
+	a.Perm = node.Mode.Perm()
+	if perm.Valid {
+		a.Perm = os.FileMode(perm.Int64).Perm()
+	}
+	node.attrs = a
+	return node, nil
+}
+
+// updateAttrs updates the permissions, ownership and timestamps of an
+// inode. Every change to an inode goes through here, so it also bumps the
+// inode's generation, which it returns: unless another mount changed the
+// inode concurrently, that is the generation the caller knew plus one.
+func updateAttrs(e sqlExecutor, id uint64, a nodeAttrs) (int64, error) {
+	const sql = `
+UPDATE fs.inode SET (mode, uid, gid, atime, mtime, ctime, gen) = ($1, $2, $3, $4, $5, $6, gen + 1)
+WHERE id = $7 RETURNING gen;
+`
+	var gen int64
+	err := e.QueryRow(sql, int64(a.Perm), a.UID, a.GID, a.Atime, a.Mtime, a.Ctime, id).Scan(&gen)
+	return gen, err
+}
+
+// getGen returns the generation of an inode.
+func getGen(e sqlExecutor, id uint64) (int64, error) {
+	var gen int64
+	const sql = `SELECT gen FROM fs.inode WHERE id = $1`
+	err := e.QueryRow(sql, id).Scan(&gen)
+	return gen, err
+}
+
+// unlinkInode removes a link to an inode. Once no link is left, the
+// inode and its blocks are deleted.
+func unlinkInode(e sqlExecutor, id uint64) error {
+	const updateLinks = `UPDATE fs.inode SET nlink = nlink - 1 WHERE id = $1 RETURNING nlink`
+	var nlink int
+	if err := e.QueryRow(updateLinks, id).Scan(&nlink); err != nil {
+		return err
+	}
+	if nlink > 0 {
+		return nil
+	}
+	return deleteInode(e, id)
+}
 
-	node := &Node{}
-	err := json.Unmarshal([]byte(raw), node)
-	return node, err
+// deleteInode deletes an inode and its blocks.
+func deleteInode(e sqlExecutor, id uint64) error {
+	if _, err := e.Exec(`DELETE FROM fs.inode WHERE id = $1`, id); err != nil {
+		return err
+	}
+	_, err := e.Exec(`DELETE FROM fs.block WHERE id = $1`, id)
+	return err
 }
 
 // checkIsEmpty returns nil if 'id' has no children.
@@ -0,0 +1,303 @@
+// Copyright 2016 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package main
+
+import (
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"hash/crc32"
+	"log"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/cockroachdb/examples-go/dbdriver"
+	"golang.org/x/net/context"
+)
+
+// The stress subcommand simulates several clients, each with its own
+// connection pool and cache as if it were a separate mount, competing to
+// create, write, read and remove the same files of a shared directory.
+//
+// Every file is written in full by a single Write, with a checksum of its
+// contents in its first bytes. Reads must therefore return either an empty
+// file (created but not written yet) or valid contents.
+
+var stressOps = []string{"create", "write", "read", "remove"}
+
+// maxLoggedErrors is the maximum number of errors logged per client.
+const maxLoggedErrors = 5
+
+type stressStats struct {
+	ops     map[string]int
+	errors  map[string]int
+	corrupt int
+}
+
+type stressClient struct {
+	id       int
+	dir      *Node
+	fileSize int
+	numFiles int
+	rng      *rand.Rand
+	stats    stressStats
+	logged   int
+}
+
+func runStress(args []string) {
+	flags := flag.NewFlagSet("stress", flag.ExitOnError)
+	clients := flags.Int("clients", 4, "Number of simulated mounts.")
+	duration := flags.Duration("duration", 30*time.Second, "Duration of the test.")
+	numFiles := flags.Int("files", 16, "Number of file names the clients compete for.")
+	fileSize := flags.Int("file-size", 3*BlockSize+100, "Size of the files written.")
+	cacheSize := flags.Int("cache-size", 0, "Size in MB of the block cache of each client. 0 disables caching.")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage of %s stress:\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s stress [flags] [<db URL>]\n\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(args)
+
+	if flags.NArg() > 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	if *fileSize < 4 {
+		log.Fatal("--file-size must be at least 4")
+	}
+	dbURL, err := dbdriver.URL(flags.Arg(0), "")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	db, err := dbdriver.Open(*driver, dbURL)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer func() { _ = db.Close() }()
+
+	if err := initSchema(db); err != nil {
+		log.Fatal(err)
+	}
+
+	// Run in a directory of our own.
+	setup := CFS{db: db}
+	dir := setup.newDirNode()
+	dirName := fmt.Sprintf("stress-%d", time.Now().UnixNano())
+	if err := setup.create(rootNodeID, dirName, dir); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("running %d clients in /%s for %s", *clients, dirName, *duration)
+
+	var wg sync.WaitGroup
+	stressClients := make([]*stressClient, *clients)
+	deadline := time.Now().Add(*duration)
+	for i := range stressClients {
+		cdb, err := dbdriver.Open(*driver, dbURL)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer func() { _ = cdb.Close() }()
+
+		cfs := CFS{db: cdb}
+		if *cacheSize > 0 {
+			cfs.cache = newCache(*cacheSize << 20)
+		}
+		c := &stressClient{
+			id:       i,
+			dir:      &Node{cfs: cfs, ID: dir.ID, Mode: dir.Mode},
+			fileSize: *fileSize,
+			numFiles: *numFiles,
+			rng:      rand.New(rand.NewSource(time.Now().UnixNano() + int64(i))),
+			stats:    stressStats{ops: make(map[string]int), errors: make(map[string]int)},
+		}
+		stressClients[i] = c
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for time.Now().Before(deadline) {
+				c.runOp()
+			}
+		}()
+	}
+	wg.Wait()
+
+	var total stressStats
+	total.ops, total.errors = make(map[string]int), make(map[string]int)
+	for _, c := range stressClients {
+		for _, op := range stressOps {
+			total.ops[op] += c.stats.ops[op]
+			total.errors[op] += c.stats.errors[op]
+		}
+		total.corrupt += c.stats.corrupt
+	}
+	for _, op := range stressOps {
+		log.Printf("%-6s: %6d ops, %6d errors", op, total.ops[op], total.errors[op])
+	}
+
+	problems := verifyStressDir(setup, dir.ID, *numFiles, *fileSize)
+	if total.corrupt > 0 {
+		problems = append(problems, fmt.Sprintf("%d reads returned corrupt data", total.corrupt))
+	}
+	for _, p := range problems {
+		log.Print(p)
+	}
+	if len(problems) > 0 {
+		log.Fatalf("stress test failed with %d problems", len(problems))
+	}
+	log.Printf("stress test passed")
+}
+
+// runOp runs a random operation on a random file.
+func (c *stressClient) runOp() {
+	op := stressOps[c.rng.Intn(len(stressOps))]
+	name := fmt.Sprintf("f%d", c.rng.Intn(c.numFiles))
+	ctx := context.Background()
+
+	var err error
+	switch op {
+	case "create":
+		var node fs.Node
+		req := &fuse.CreateRequest{Name: name, Mode: 0644}
+		if node, _, err = c.dir.Create(ctx, req, &fuse.CreateResponse{}); err == nil {
+			err = c.write(node.(*Node))
+		}
+	case "write":
+		var node *Node
+		if node, err = c.lookup(name); err == nil {
+			err = c.write(node)
+		}
+	case "read":
+		var node *Node
+		if node, err = c.lookup(name); err == nil {
+			resp := &fuse.ReadResponse{}
+			req := &fuse.ReadRequest{Size: c.fileSize}
+			if err = node.Read(ctx, req, resp); err == nil && !validStressData(resp.Data, c.fileSize) {
+				c.stats.corrupt++
+				log.Printf("client %d: corrupt read of %s (%d bytes)", c.id, name, len(resp.Data))
+			}
+		}
+	case "remove":
+		err = c.dir.Remove(ctx, &fuse.RemoveRequest{Name: name})
+	}
+
+	c.stats.ops[op]++
+	if err != nil {
+		// Most errors are expected: clients race to create and remove the
+		// same names.
+		c.stats.errors[op]++
+		if c.logged < maxLoggedErrors {
+			c.logged++
+			log.Printf("client %d: %s %s: %s", c.id, op, name, err)
+		}
+	}
+}
+
+func (c *stressClient) lookup(name string) (*Node, error) {
+	n, err := c.dir.Lookup(context.Background(), name)
+	if err != nil {
+		return nil, err
+	}
+	return n.(*Node), nil
+}
+
+// write overwrites the contents of 'node' and flushes them.
+func (c *stressClient) write(node *Node) error {
+	req := &fuse.WriteRequest{Data: stressData(c.rng, c.fileSize)}
+	if err := node.Write(context.Background(), req, &fuse.WriteResponse{}); err != nil {
+		return err
+	}
+	return node.flush()
+}
+
+// stressData returns 'size' random bytes, the first four of which hold the
+// checksum of the others.
+func stressData(rng *rand.Rand, size int) []byte {
+	data := make([]byte, size)
+	for i := 4; i < size; i++ {
+		data[i] = byte(rng.Int())
+	}
+	binary.BigEndian.PutUint32(data, crc32.ChecksumIEEE(data[4:]))
+	return data
+}
+
+// validStressData returns whether 'data' was written by stressData, or
+// is empty.
+func validStressData(data []byte, size int) bool {
+	if len(data) == 0 {
+		return true
+	}
+	return len(data) == size && binary.BigEndian.Uint32(data) == crc32.ChecksumIEEE(data[4:])
+}
+
+// verifyStressDir checks the contents of the stress directory once all
+// clients are done, and returns the problems found.
+func verifyStressDir(cfs CFS, dirID uint64, numFiles, fileSize int) []string {
+	entries, err := cfs.list(dirID)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var problems []string
+	names := make(map[string]bool)
+	for i := 0; i < numFiles; i++ {
+		names[fmt.Sprintf("f%d", i)] = true
+	}
+	for _, e := range entries {
+		if !names[e.Name] {
+			problems = append(problems, fmt.Sprintf("unexpected entry %q", e.Name))
+			continue
+		}
+		node, err := cfs.lookup(dirID, e.Name)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: dangling entry: %s", e.Name, err))
+			continue
+		}
+		if node.NLink != 1 {
+			problems = append(problems, fmt.Sprintf("%s: %d links, expected 1", e.Name, node.NLink))
+		}
+		if node.Size != 0 && node.Size != uint64(fileSize) {
+			problems = append(problems, fmt.Sprintf("%s: size %d, expected 0 or %d",
+				e.Name, node.Size, fileSize))
+			continue
+		}
+		blocks, err := getBlocks(cfs.db, node.ID)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if expected := int((node.Size + BlockSize - 1) / BlockSize); len(blocks) != expected {
+			problems = append(problems, fmt.Sprintf("%s: %d blocks, expected %d",
+				e.Name, len(blocks), expected))
+			continue
+		}
+		if node.Size == 0 {
+			continue
+		}
+		data, err := read(cfs.db, node.ID, 0, node.Size)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if !validStressData(data, fileSize) {
+			problems = append(problems, fmt.Sprintf("%s: corrupt contents", e.Name))
+		}
+	}
+	log.Printf("verified %d files", len(entries))
+	return problems
+}
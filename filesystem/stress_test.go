@@ -0,0 +1,40 @@
+// Copyright 2016 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package main
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestStressData(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	const size = BlockSize + 10
+	data := stressData(rng, size)
+	if !validStressData(data, size) {
+		t.Fatal("expected generated data to be valid")
+	}
+	if !validStressData(nil, size) {
+		t.Fatal("expected an empty file to be valid")
+	}
+	if validStressData(data[:BlockSize], size) {
+		t.Fatal("expected truncated data to be invalid")
+	}
+	data[size-1]++
+	if validStressData(data, size) {
+		t.Fatal("expected modified data to be invalid")
+	}
+}
@@ -0,0 +1,270 @@
+// Copyright 2016 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+// The geo example demonstrates geo-partitioning. It creates a table
+// partitioned by a region column, optionally pins each partition to
+// nodes in the matching locality, and then issues reads and writes from
+// a set of "client regions". Most traffic targets rows in the client's
+// own region; a configurable fraction crosses regions. Latencies are
+// reported separately for local and remote traffic so the benefit of
+// locality can be measured.
+//
+// Each client region connects through its own URL, which should point
+// at a gateway node in that region:
+//
+//	geo --regions=us-east,us-west,eu-west --client-regions=us-east,eu-west \
+//	  <us-east URL> <eu-west URL>
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/examples-go/dbdriver"
+	"github.com/cockroachdb/examples-go/opstats"
+	// Import postgres driver.
+	_ "github.com/cockroachdb/pq"
+)
+
+var regions = flag.String("regions", "us-east,us-west,eu-west", "Comma-separated list of regions the table is partitioned into.")
+var clientRegions = flag.String("client-regions", "", "Comma-separated list of regions clients run in. "+
+	"Defaults to all regions. Each client region uses the URL at the same position, or the first URL.")
+var crossRegionPercent = flag.Int("cross-region-percent", 10, "Percentage of operations targeting a region other than the client's.")
+var readPercent = flag.Int("read-percent", 50, "Percentage of operations that are reads.")
+var rowsPerRegion = flag.Int("rows-per-region", 10000, "Number of rows per region.")
+var concurrency = flag.Int("concurrency", 4, "Number of concurrent clients per client region.")
+var configureZones = flag.Bool("configure-zones", false, "Constrain each partition's replicas to nodes started with --locality=region=<region>.")
+var outputInterval = flag.Duration("output-interval", 1*time.Second, "Interval of output.")
+var driver = flag.String("driver", "postgres", dbdriver.Usage)
+
+// partitionName returns the partition name used for a region.
+func partitionName(region string) string {
+	return strings.Replace(region, "-", "_", -1)
+}
+
+// setupDatabase creates the partitioned table and populates every region.
+func setupDatabase(db *sql.DB, regionList []string) error {
+	if _, err := db.Exec("CREATE DATABASE IF NOT EXISTS geo"); err != nil {
+		return err
+	}
+	if _, err := db.Exec("DROP TABLE IF EXISTS geo.kv"); err != nil {
+		return err
+	}
+
+	var partitions []string
+	for _, region := range regionList {
+		partitions = append(partitions, fmt.Sprintf("PARTITION %s VALUES IN ('%s')",
+			partitionName(region), region))
+	}
+	if _, err := db.Exec(fmt.Sprintf(`
+CREATE TABLE geo.kv (
+  region STRING NOT NULL,
+  id     INT NOT NULL,
+  value  STRING NOT NULL,
+  PRIMARY KEY (region, id)
+) PARTITION BY LIST (region) (
+  %s
+)`, strings.Join(partitions, ",\n  "))); err != nil {
+		return err
+	}
+
+	if *configureZones {
+		for _, region := range regionList {
+			if _, err := db.Exec(fmt.Sprintf(
+				`ALTER PARTITION %s OF TABLE geo.kv CONFIGURE ZONE USING constraints = '[+region=%s]'`,
+				partitionName(region), region)); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, region := range regionList {
+		if _, err := db.Exec(`INSERT INTO geo.kv (region, id, value) `+
+			`SELECT $1, i, 'initial' FROM GENERATE_SERIES(0, $2) AS g(i)`,
+			region, *rowsPerRegion-1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stats holds the latencies keyed by operation, locality and target
+// region, e.g. "read local us-east".
+var stats struct {
+	sync.Mutex
+	ops map[string]*opstats.Stats
+}
+
+func record(key string, start time.Time, err error) {
+	stats.Lock()
+	defer stats.Unlock()
+	s, ok := stats.ops[key]
+	if !ok {
+		s = opstats.New(time.Minute)
+		stats.ops[key] = s
+	}
+	s.Record(start, err)
+}
+
+// client issues traffic from homeRegion until the process exits.
+func client(db *sql.DB, homeRegion string, regionList []string) {
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	for {
+		target, locality := homeRegion, "local"
+		if len(regionList) > 1 && r.Intn(100) < *crossRegionPercent {
+			for target == homeRegion {
+				target = regionList[r.Intn(len(regionList))]
+			}
+			locality = "remote"
+		}
+		id := r.Intn(*rowsPerRegion)
+
+		op := "write"
+		start := time.Now()
+		var err error
+		if r.Intn(100) < *readPercent {
+			op = "read"
+			var value string
+			err = db.QueryRow(`SELECT value FROM geo.kv WHERE region = $1 AND id = $2`, target, id).Scan(&value)
+		} else {
+			_, err = db.Exec(`UPSERT INTO geo.kv (region, id, value) VALUES ($1, $2, $3)`,
+				target, id, fmt.Sprintf("written from %s", homeRegion))
+		}
+		if err != nil {
+			log.Printf("%s from %s to %s failed: %s", op, homeRegion, target, err)
+		}
+		record(fmt.Sprintf("%s %s %s", op, locality, target), start, err)
+	}
+}
+
+func splitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+var usage = func() {
+	fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s [<db URL>...]\n\n", os.Args[0])
+	flag.PrintDefaults()
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+
+	regionList := splitList(*regions)
+	if len(regionList) == 0 {
+		log.Fatal("at least one region is required")
+	}
+	clientRegionList := regionList
+	if *clientRegions != "" {
+		clientRegionList = splitList(*clientRegions)
+	}
+	for _, cr := range clientRegionList {
+		found := false
+		for _, region := range regionList {
+			found = found || region == cr
+		}
+		if !found {
+			log.Fatalf("client region %q is not one of the table regions %v", cr, regionList)
+		}
+	}
+	dbURLs := flag.Args()
+	if len(dbURLs) == 0 {
+		dbURL, err := dbdriver.URL("", "")
+		if err != nil {
+			log.Fatal(err)
+		}
+		dbURLs = []string{dbURL}
+	}
+	dbURLs, err := dbdriver.SplitHosts(dbURLs...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(dbURLs) > len(clientRegionList) {
+		log.Fatalf("got %d URLs for %d client regions", len(dbURLs), len(clientRegionList))
+	}
+
+	dbs := make([]*sql.DB, len(dbURLs))
+	for i, dbURL := range dbURLs {
+		parsedURL, err := url.Parse(dbURL)
+		if err != nil {
+			log.Fatal(err)
+		}
+		db, err := dbdriver.Open(*driver, parsedURL.String())
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer func() { _ = db.Close() }()
+		db.SetMaxOpenConns(*concurrency * len(clientRegionList))
+		dbs[i] = db
+	}
+
+	if err := setupDatabase(dbs[0], regionList); err != nil {
+		log.Fatal(err)
+	}
+
+	stats.ops = map[string]*opstats.Stats{}
+	for i, cr := range clientRegionList {
+		db := dbs[0]
+		if i < len(dbs) {
+			db = dbs[i]
+		}
+		for j := 0; j < *concurrency; j++ {
+			go client(db, cr, regionList)
+		}
+	}
+
+	lastNow := time.Now()
+	for range time.Tick(*outputInterval) {
+		now := time.Now()
+		elapsed := now.Sub(lastNow)
+		lastNow = now
+
+		stats.Lock()
+		ops := stats.ops
+		stats.ops = map[string]*opstats.Stats{}
+		stats.Unlock()
+
+		var keys []string
+		for key := range ops {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			hist, errors := ops[key].Snapshot()
+			log.Printf("%-24s: %7.1f/sec, p50=%s p95=%s p99=%s (%d errors)",
+				key, float64(hist.TotalCount())/elapsed.Seconds(),
+				time.Duration(hist.ValueAtQuantile(50)),
+				time.Duration(hist.ValueAtQuantile(95)),
+				time.Duration(hist.ValueAtQuantile(99)),
+				errors)
+		}
+	}
+}
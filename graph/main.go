@@ -0,0 +1,275 @@
+// Copyright 2016 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+// The graph example builds a random directed graph in an edges table and
+// traverses it with recursive common table expressions. Clients run
+// reachability queries (how many nodes can be reached from a node within
+// --max-depth hops) and shortest path queries between two nodes, while
+// other clients add and remove edges.
+//
+// Query latency depends heavily on the size of the graph and its fan-out;
+// run with different --nodes and --fan-out values to see how it grows.
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/cockroachdb/examples-go/dbdriver"
+	"github.com/cockroachdb/examples-go/opstats"
+	// Import postgres driver.
+	_ "github.com/cockroachdb/pq"
+)
+
+var numNodes = flag.Int("nodes", 10000, "Number of nodes in the graph.")
+var fanOut = flag.Int("fan-out", 5, "Average number of outgoing edges per node.")
+var maxDepth = flag.Int("max-depth", 4, "Maximum number of hops followed by a traversal.")
+var concurrency = flag.Int("concurrency", 8, "Number of concurrent clients.")
+var reachPercent = flag.Int("reach-percent", 45, "Percentage of operations that are reachability queries.")
+var pathPercent = flag.Int("path-percent", 45, "Percentage of operations that are shortest path queries. "+
+	"The remaining operations add or remove edges.")
+var outputInterval = flag.Duration("output-interval", 1*time.Second, "Interval of output.")
+var driver = flag.String("driver", "postgres", dbdriver.Usage)
+
+const schema = `
+CREATE TABLE IF NOT EXISTS edges (
+  src INT NOT NULL,
+  dst INT NOT NULL,
+  PRIMARY KEY (src, dst)
+)`
+
+const (
+	reachOp = iota
+	pathOp
+	mutateOp
+	numOps
+)
+
+var opNames = [numOps]string{"reach", "shortest-path", "mutate"}
+
+// reachable returns the number of nodes reachable from src within
+// --max-depth hops, including src itself.
+func reachable(db *sql.DB, src int) (int, error) {
+	var n int
+	err := db.QueryRow(`
+WITH RECURSIVE reach (node, depth) AS (
+    SELECT $1::INT, 0
+  UNION
+    SELECT e.dst, r.depth + 1 FROM reach AS r JOIN edges AS e ON e.src = r.node WHERE r.depth < $2
+)
+SELECT COUNT(DISTINCT node) FROM reach`, src, *maxDepth).Scan(&n)
+	return n, err
+}
+
+// shortestPath returns the number of hops on the shortest path from src
+// to dst, or -1 if dst can't be reached within --max-depth hops.
+func shortestPath(db *sql.DB, src, dst int) (int, error) {
+	var hops sql.NullInt64
+	err := db.QueryRow(`
+WITH RECURSIVE paths (node, depth) AS (
+    SELECT $1::INT, 0
+  UNION
+    SELECT e.dst, p.depth + 1 FROM paths AS p JOIN edges AS e ON e.src = p.node
+     WHERE p.depth < $3 AND p.node != $2
+)
+SELECT MIN(depth) FROM paths WHERE node = $2`, src, dst, *maxDepth).Scan(&hops)
+	if err != nil || !hops.Valid {
+		return -1, err
+	}
+	return int(hops.Int64), nil
+}
+
+// mutate adds a random edge or removes a random outgoing edge of a node.
+func mutate(db *sql.DB, r *rand.Rand, src int) error {
+	if r.Intn(2) == 0 {
+		_, err := db.Exec(`UPSERT INTO edges (src, dst) VALUES ($1, $2)`, src, r.Intn(*numNodes))
+		return err
+	}
+	_, err := db.Exec(`DELETE FROM edges WHERE src = $1 LIMIT 1`, src)
+	return err
+}
+
+var stats [numOps]*opstats.Stats
+
+func init() {
+	for i := range stats {
+		stats[i] = opstats.New(time.Minute)
+	}
+}
+
+func client(db *sql.DB) {
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	for {
+		op := mutateOp
+		switch p := r.Intn(100); {
+		case p < *reachPercent:
+			op = reachOp
+		case p < *reachPercent+*pathPercent:
+			op = pathOp
+		}
+
+		src := r.Intn(*numNodes)
+		start := time.Now()
+		var result int
+		var err error
+		switch op {
+		case reachOp:
+			result, err = reachable(db, src)
+		case pathOp:
+			result, err = shortestPath(db, src, r.Intn(*numNodes))
+			if result < 0 {
+				result = 0
+			} else {
+				// Count the paths that were found.
+				result = 1
+			}
+		case mutateOp:
+			err = mutate(db, r, src)
+		}
+		if err != nil {
+			log.Printf("%s failed: %s", opNames[op], err)
+		}
+		stats[op].RecordResult(start, result, err)
+	}
+}
+
+func setupDatabase(db *sql.DB) error {
+	if _, err := db.Exec("CREATE DATABASE IF NOT EXISTS graph"); err != nil {
+		return err
+	}
+	if _, err := db.Exec(schema); err != nil {
+		return err
+	}
+	if _, err := db.Exec("TRUNCATE TABLE edges"); err != nil {
+		return err
+	}
+
+	// Give every node between 0 and 2*fan-out random outgoing edges.
+	const batchSize = 500
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	var buf bytes.Buffer
+	var n int
+	flush := func() error {
+		if n == 0 {
+			return nil
+		}
+		buf.WriteString(` ON CONFLICT (src, dst) DO NOTHING`)
+		_, err := db.Exec(buf.String())
+		buf.Reset()
+		n = 0
+		return err
+	}
+	maxEdges := 2 * *fanOut
+	for src := 0; src < *numNodes; src++ {
+		for i := r.Intn(maxEdges + 1); i > 0; i-- {
+			if n == 0 {
+				buf.WriteString(`INSERT INTO edges (src, dst) VALUES `)
+			} else {
+				buf.WriteString(", ")
+			}
+			fmt.Fprintf(&buf, "(%d, %d)", src, r.Intn(*numNodes))
+			if n++; n == batchSize {
+				if err := flush(); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return flush()
+}
+
+var usage = func() {
+	fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s [<db URL>]\n\n", os.Args[0])
+	flag.PrintDefaults()
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() > 1 {
+		usage()
+		os.Exit(2)
+	}
+
+	if *numNodes < 1 || *fanOut < 0 || *maxDepth < 1 {
+		log.Fatal("'nodes' and 'max-depth' must be at least 1 and 'fan-out' must be non-negative")
+	}
+	if *reachPercent < 0 || *pathPercent < 0 || *reachPercent+*pathPercent > 100 {
+		log.Fatal("'reach-percent' and 'path-percent' must be non-negative and add up to at most 100")
+	}
+
+	dbURL, err := dbdriver.URL(flag.Arg(0), "")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	parsedURL, err := url.Parse(dbURL)
+	if err != nil {
+		log.Fatal(err)
+	}
+	parsedURL.Path = "graph"
+
+	db, err := dbdriver.Open(*driver, parsedURL.String())
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer func() { _ = db.Close() }()
+
+	db.SetMaxOpenConns(*concurrency + 1)
+
+	log.Printf("building a graph with %d nodes and fan-out %d", *numNodes, *fanOut)
+	if err := setupDatabase(db); err != nil {
+		log.Fatal(err)
+	}
+
+	for i := 0; i < *concurrency; i++ {
+		go client(db)
+	}
+
+	lastNow := time.Now()
+	for range time.Tick(*outputInterval) {
+		now := time.Now()
+		elapsed := now.Sub(lastNow)
+		lastNow = now
+
+		for op, s := range stats {
+			hist, sum, errors := s.SnapshotSum()
+			var extra string
+			if count := hist.TotalCount(); count > 0 {
+				switch op {
+				case reachOp:
+					extra = fmt.Sprintf(", %.1f nodes reached on average", float64(sum)/float64(count))
+				case pathOp:
+					extra = fmt.Sprintf(", %.0f%% of paths found", 100*float64(sum)/float64(count))
+				}
+			}
+			log.Printf("%-13s: %7.1f/sec, p50=%s p95=%s p99=%s (%d errors)%s",
+				opNames[op], float64(hist.TotalCount())/elapsed.Seconds(),
+				time.Duration(hist.ValueAtQuantile(50)),
+				time.Duration(hist.ValueAtQuantile(95)),
+				time.Duration(hist.ValueAtQuantile(99)),
+				errors, extra)
+		}
+	}
+}
@@ -0,0 +1,289 @@
+// Copyright 2016 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+// The ingest example simulates at-least-once event ingestion. Producers
+// send batches of events, and a configurable fraction of the events are
+// redeliveries of events that were already sent. Duplicates are absorbed
+// by the database with INSERT ... ON CONFLICT, either ignoring them (DO
+// NOTHING) or counting the redeliveries (DO UPDATE).
+//
+// The example reports event throughput, batch latency and the number of
+// conflicts, and checks at the end that every distinct event was stored
+// exactly once.
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/url"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cockroachdb/examples-go/dbdriver"
+	"github.com/cockroachdb/examples-go/opstats"
+	// Import postgres driver.
+	_ "github.com/cockroachdb/pq"
+)
+
+var concurrency = flag.Int("concurrency", 8, "Number of concurrent producers.")
+var batchSize = flag.Int("batch-size", 100, "Number of events per insert.")
+var duplicateRatio = flag.Float64("duplicate-ratio", 0.3, "Fraction of events that are redeliveries.")
+var duplicateWindow = flag.Int("duplicate-window", 10000, "Number of recent events per producer that may be redelivered.")
+var onConflict = flag.String("on-conflict", "nothing", "Conflict handling: nothing (DO NOTHING) or update (DO UPDATE).")
+var payloadBytes = flag.Int("payload-bytes", 100, "Size of each event payload.")
+var duration = flag.Duration("duration", 0, "The duration to run. If 0, run forever.")
+var outputInterval = flag.Duration("output-interval", 1*time.Second, "Interval of output.")
+var driver = flag.String("driver", "postgres", dbdriver.Usage)
+
+const schema = `
+CREATE TABLE IF NOT EXISTS events (
+  id         INT PRIMARY KEY,
+  payload    BYTES NOT NULL,
+  deliveries INT NOT NULL DEFAULT 1,
+  first_seen TIMESTAMP NOT NULL DEFAULT NOW(),
+  last_seen  TIMESTAMP NOT NULL DEFAULT NOW()
+)`
+
+var numEvents, numDistinct, numInserted, numBatchErrors uint64
+
+// batches tracks the latencies of the inserted batches.
+var batches = opstats.New(time.Minute)
+
+// producer generates events. Event IDs combine the producer ID and a
+// sequence number, so they are unique across producers.
+type producer struct {
+	id     int64
+	seq    int64
+	r      *rand.Rand
+	recent []int64
+}
+
+// nextBatch returns the IDs of the next batch of events. The IDs within a
+// batch are distinct, since a single INSERT ... ON CONFLICT DO UPDATE
+// can't affect the same row twice.
+func (p *producer) nextBatch() []int64 {
+	ids := make([]int64, 0, *batchSize)
+	inBatch := make(map[int64]bool, *batchSize)
+	for len(ids) < *batchSize {
+		if len(p.recent) > 0 && p.r.Float64() < *duplicateRatio {
+			id := p.recent[p.r.Intn(len(p.recent))]
+			if !inBatch[id] {
+				inBatch[id] = true
+				ids = append(ids, id)
+			}
+			continue
+		}
+		p.seq++
+		id := p.id<<40 | p.seq
+		inBatch[id] = true
+		ids = append(ids, id)
+		if len(p.recent) < *duplicateWindow {
+			p.recent = append(p.recent, id)
+		} else {
+			p.recent[p.seq%int64(*duplicateWindow)] = id
+		}
+	}
+	return ids
+}
+
+// payload returns the payload of an event. It is derived from the event
+// ID, so redeliveries carry the same payload.
+func payload(id int64) []byte {
+	b := make([]byte, *payloadBytes)
+	_, _ = rand.New(rand.NewSource(id)).Read(b)
+	return b
+}
+
+func insertBatch(db *sql.DB, ids []int64) (int64, error) {
+	var buf bytes.Buffer
+	buf.WriteString(`INSERT INTO events (id, payload) VALUES `)
+	args := make([]interface{}, 0, 2*len(ids))
+	for i, id := range ids {
+		if i > 0 {
+			buf.WriteString(", ")
+		}
+		fmt.Fprintf(&buf, "($%d, $%d)", 2*i+1, 2*i+2)
+		args = append(args, id, payload(id))
+	}
+	if *onConflict == "nothing" {
+		buf.WriteString(` ON CONFLICT (id) DO NOTHING`)
+		res, err := db.Exec(buf.String(), args...)
+		if err != nil {
+			return 0, err
+		}
+		return res.RowsAffected()
+	}
+
+	// Updated rows count as affected too, so tell new events apart by
+	// their delivery count.
+	buf.WriteString(` ON CONFLICT (id) DO UPDATE SET deliveries = events.deliveries + 1, last_seen = NOW()` +
+		` RETURNING deliveries`)
+	rows, err := db.Query(buf.String(), args...)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = rows.Close() }()
+	var inserted int64
+	for rows.Next() {
+		var deliveries int
+		if err := rows.Scan(&deliveries); err != nil {
+			return 0, err
+		}
+		if deliveries == 1 {
+			inserted++
+		}
+	}
+	return inserted, rows.Err()
+}
+
+func produce(db *sql.DB, p *producer, stop <-chan struct{}, wg *sync.WaitGroup) {
+	defer wg.Done()
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		before := p.seq
+		ids := p.nextBatch()
+		start := time.Now()
+		n, err := insertBatch(db, ids)
+		batches.Record(start, err)
+		if err != nil {
+			// The batch may or may not have been applied, but its new
+			// events are counted as distinct either way. The final check
+			// accounts for this.
+			log.Print(err)
+			atomic.AddUint64(&numBatchErrors, 1)
+		} else {
+			atomic.AddUint64(&numInserted, uint64(n))
+			atomic.AddUint64(&numEvents, uint64(len(ids)))
+		}
+		atomic.AddUint64(&numDistinct, uint64(p.seq-before))
+	}
+}
+
+var usage = func() {
+	fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s [<db URL>]\n\n", os.Args[0])
+	flag.PrintDefaults()
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() > 1 {
+		usage()
+		os.Exit(2)
+	}
+
+	if *onConflict != "nothing" && *onConflict != "update" {
+		log.Fatalf("unknown 'on-conflict' value %q", *onConflict)
+	}
+	if *duplicateRatio < 0 || *duplicateRatio >= 1 {
+		log.Fatalf("Value of 'duplicate-ratio' flag (%f) must be in [0, 1)", *duplicateRatio)
+	}
+	if *batchSize < 1 || *duplicateWindow < 1 {
+		log.Fatal("'batch-size' and 'duplicate-window' must be at least 1")
+	}
+
+	dbURL, err := dbdriver.URL(flag.Arg(0), "")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	parsedURL, err := url.Parse(dbURL)
+	if err != nil {
+		log.Fatal(err)
+	}
+	parsedURL.Path = "ingest"
+
+	db, err := dbdriver.Open(*driver, parsedURL.String())
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer func() { _ = db.Close() }()
+
+	db.SetMaxOpenConns(*concurrency + 1)
+
+	if _, err := db.Exec("CREATE DATABASE IF NOT EXISTS ingest"); err != nil {
+		log.Fatal(err)
+	}
+	if _, err := db.Exec(schema); err != nil {
+		log.Fatal(err)
+	}
+	if _, err := db.Exec("TRUNCATE TABLE events"); err != nil {
+		log.Fatal(err)
+	}
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < *concurrency; i++ {
+		wg.Add(1)
+		p := &producer{id: int64(i), r: rand.New(rand.NewSource(time.Now().UnixNano()))}
+		go produce(db, p, stop, &wg)
+	}
+
+	var done <-chan time.Time
+	if *duration > 0 {
+		done = time.After(*duration)
+	}
+	ticker := time.NewTicker(*outputInterval)
+	lastNow := time.Now()
+	var lastEvents, lastInserted uint64
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+			continue
+		case <-ticker.C:
+		}
+		now := time.Now()
+		elapsed := now.Sub(lastNow).Seconds()
+		lastNow = now
+		events, inserted := atomic.LoadUint64(&numEvents), atomic.LoadUint64(&numInserted)
+		// Failed batches are counted by numBatchErrors, which the final
+		// check needs in full.
+		hist, _ := batches.Snapshot()
+		log.Printf("%.1f events/sec, %.1f inserted/sec, %.1f conflicts/sec, batch p50=%s p99=%s, %d batch errors",
+			float64(events-lastEvents)/elapsed, float64(inserted-lastInserted)/elapsed,
+			float64((events-lastEvents)-(inserted-lastInserted))/elapsed,
+			time.Duration(hist.ValueAtQuantile(50)), time.Duration(hist.ValueAtQuantile(99)),
+			atomic.LoadUint64(&numBatchErrors))
+		lastEvents, lastInserted = events, inserted
+	}
+	ticker.Stop()
+	close(stop)
+	wg.Wait()
+
+	var stored uint64
+	if err := db.QueryRow(`SELECT COUNT(*) FROM events`).Scan(&stored); err != nil {
+		log.Fatal(err)
+	}
+	events, distinct := atomic.LoadUint64(&numEvents), atomic.LoadUint64(&numDistinct)
+	log.Printf("sent %d events (%d distinct), stored %d", events, distinct, stored)
+	// Events of failed batches may be missing if they were never
+	// redelivered, so only a surplus is a definite problem.
+	if stored > distinct || (atomic.LoadUint64(&numBatchErrors) == 0 && stored != distinct) {
+		log.Fatalf("expected %d distinct events to be stored, found %d", distinct, stored)
+	}
+}
@@ -0,0 +1,442 @@
+// Copyright 2016 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+// The inventory example models a reservation saga over inventory rows.
+// A shopper first reserves a quantity of a SKU, which moves stock from
+// `available` to `reserved` and records a reservation with an expiry.
+// The shopper then confirms the reservation (moving the stock to `sold`),
+// cancels it, or abandons it. A reaper releases reservations that were
+// neither confirmed nor cancelled before they expired, and a restocker adds
+// stock back to `available`, so that popular SKUs don't stay sold out.
+//
+// SKUs are chosen with a zipfian distribution, so a few popular SKUs are
+// heavily contended. A checker periodically asserts that no SKU has been
+// oversold and that the stock columns agree with the reservations; there
+// should never be any violations.
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/examples-go/dbdriver"
+	"github.com/cockroachdb/examples-go/opstats"
+	// Import postgres driver.
+	_ "github.com/cockroachdb/pq"
+)
+
+var numSKUs = flag.Int("skus", 1000, "Number of SKUs.")
+var initialStock = flag.Int("initial-stock", 1000, "Initial stock of every SKU.")
+var maxQuantity = flag.Int("max-quantity", 5, "Maximum quantity per reservation.")
+var zipfS = flag.Float64("zipf-s", 1.1, "Zipf exponent for SKU popularity. Must be > 1.")
+var concurrency = flag.Int("concurrency", 16, "Number of concurrent shoppers.")
+var confirmPercent = flag.Int("confirm-percent", 60, "Percentage of reservations that are confirmed.")
+var cancelPercent = flag.Int("cancel-percent", 20, "Percentage of reservations that are cancelled. The rest are abandoned.")
+var reservationTimeout = flag.Duration("reservation-timeout", 5*time.Second, "Time after which unconfirmed reservations expire.")
+var maxThink = flag.Duration("max-think", 2*time.Second, "Maximum time between reserving and confirming or cancelling.")
+var reapInterval = flag.Duration("reap-interval", 1*time.Second, "Interval at which expired reservations are released.")
+var restockRate = flag.Int("restock-rate", 50, "Units of stock added back per second, to SKUs picked like those of "+
+	"the shoppers. 0 disables restocking.")
+var checkInterval = flag.Duration("check-interval", 10*time.Second, "Interval of the oversell check.")
+var outputInterval = flag.Duration("output-interval", 1*time.Second, "Interval of output.")
+var driver = flag.String("driver", "postgres", dbdriver.Usage)
+
+const schema = `
+CREATE TABLE IF NOT EXISTS skus (
+  id        INT PRIMARY KEY,
+  available INT NOT NULL,
+  reserved  INT NOT NULL,
+  sold      INT NOT NULL,
+  restocked INT NOT NULL DEFAULT 0
+);
+
+CREATE TABLE IF NOT EXISTS reservations (
+  id       INT NOT NULL DEFAULT unique_rowid() PRIMARY KEY,
+  sku_id   INT NOT NULL,
+  quantity INT NOT NULL,
+  state    STRING NOT NULL,
+  expires  TIMESTAMP NOT NULL,
+  INDEX (state, expires)
+);
+`
+
+var errOutOfStock = fmt.Errorf("out of stock")
+
+// reserve reserves quantity units of a SKU and returns the reservation ID.
+func reserve(db *sql.DB, skuID, quantity int) (int64, error) {
+	var id int64
+	err := dbdriver.ExecuteTx(db, func(tx *sql.Tx) error {
+		var available int
+		if err := tx.QueryRow(`SELECT available FROM skus WHERE id = $1`, skuID).Scan(&available); err != nil {
+			return err
+		}
+		if available < quantity {
+			return errOutOfStock
+		}
+		if _, err := tx.Exec(`UPDATE skus SET available = available - $1, reserved = reserved + $1 WHERE id = $2`,
+			quantity, skuID); err != nil {
+			return err
+		}
+		return tx.QueryRow(`
+INSERT INTO reservations (sku_id, quantity, state, expires)
+  VALUES ($1, $2, 'reserved', NOW() + $3::INTERVAL)
+  RETURNING id`, skuID, quantity, fmt.Sprintf("%d milliseconds", *reservationTimeout/time.Millisecond)).Scan(&id)
+	})
+	return id, err
+}
+
+// finish moves a pending reservation to the given final state and
+// adjusts the stock of its SKU. It returns false if the reservation was
+// no longer pending, e.g. because it expired and was reaped first.
+func finish(db *sql.DB, id int64, state string) (bool, error) {
+	var finished bool
+	err := dbdriver.ExecuteTx(db, func(tx *sql.Tx) error {
+		finished = false
+		cond := ""
+		if state == "confirmed" {
+			// Expired reservations can't be confirmed, even if the reaper
+			// hasn't released them yet.
+			cond = " AND expires > NOW()"
+		}
+		var skuID, quantity int
+		err := tx.QueryRow(`UPDATE reservations SET state = $1 WHERE id = $2 AND state = 'reserved'`+cond+
+			` RETURNING sku_id, quantity`, state, id).Scan(&skuID, &quantity)
+		if err == sql.ErrNoRows {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		update := `UPDATE skus SET reserved = reserved - $1, available = available + $1 WHERE id = $2`
+		if state == "confirmed" {
+			update = `UPDATE skus SET reserved = reserved - $1, sold = sold + $1 WHERE id = $2`
+		}
+		if _, err := tx.Exec(update, quantity, skuID); err != nil {
+			return err
+		}
+		finished = true
+		return nil
+	})
+	return finished, err
+}
+
+// reap releases expired reservations. It returns the number of
+// reservations released.
+func reap(db *sql.DB) (int, error) {
+	rows, err := db.Query(`SELECT id FROM reservations WHERE state = 'reserved' AND expires < NOW() LIMIT 1000`)
+	if err != nil {
+		return 0, err
+	}
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			_ = rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	var reaped int
+	for _, id := range ids {
+		ok, err := finish(db, id, "expired")
+		if err != nil {
+			return reaped, err
+		}
+		if ok {
+			reaped++
+		}
+	}
+	return reaped, nil
+}
+
+// restock adds quantity units back to the available stock of a SKU.
+func restock(db *sql.DB, skuID, quantity int) error {
+	_, err := db.Exec(`UPDATE skus SET available = available + $1, restocked = restocked + $1 WHERE id = $2`,
+		quantity, skuID)
+	return err
+}
+
+// check verifies that no SKU is oversold and that the stock columns
+// match the reservations. It returns the violations found.
+func check(db *sql.DB) ([]string, error) {
+	rows, err := db.Query(`
+SELECT s.id, s.available, s.reserved, s.sold, s.restocked,
+       COALESCE(SUM(CASE WHEN r.state = 'reserved' THEN r.quantity END), 0),
+       COALESCE(SUM(CASE WHEN r.state = 'confirmed' THEN r.quantity END), 0)
+  FROM skus AS s LEFT JOIN reservations AS r ON r.sku_id = s.id
+  GROUP BY s.id, s.available, s.reserved, s.sold, s.restocked`)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+	var violations []string
+	for rows.Next() {
+		var id, available, reserved, sold, restocked, pending, confirmed int
+		if err := rows.Scan(&id, &available, &reserved, &sold, &restocked, &pending, &confirmed); err != nil {
+			return nil, err
+		}
+		stock := *initialStock + restocked
+		if available < 0 || sold > stock {
+			violations = append(violations, fmt.Sprintf("sku %d oversold: available=%d sold=%d", id, available, sold))
+		}
+		if available+reserved+sold != stock {
+			violations = append(violations, fmt.Sprintf("sku %d: available+reserved+sold=%d, expected %d",
+				id, available+reserved+sold, stock))
+		}
+		if reserved != pending || sold != confirmed {
+			violations = append(violations, fmt.Sprintf("sku %d: reserved=%d sold=%d but reservations say %d and %d",
+				id, reserved, sold, pending, confirmed))
+		}
+	}
+	return violations, rows.Err()
+}
+
+// reserves tracks the reservations, outOfStock those rejected because the
+// SKU was out of stock, and finishes the confirmations and cancellations.
+var reserves = opstats.New(time.Minute)
+var outOfStock = opstats.New(time.Minute)
+var finishes = opstats.New(time.Minute)
+
+var stats struct {
+	sync.Mutex
+	confirmed  int
+	cancelled  int
+	abandoned  int
+	tooLate    int
+	reaped     int
+	restocked  int
+	errors     int
+	violations int
+}
+
+func countError(err error) {
+	log.Print(err)
+	stats.Lock()
+	stats.errors++
+	stats.Unlock()
+}
+
+func shop(db *sql.DB) {
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	z := rand.NewZipf(r, *zipfS, 1, uint64(*numSKUs-1))
+	for {
+		skuID := int(z.Uint64())
+		quantity := 1 + r.Intn(*maxQuantity)
+		start := time.Now()
+		id, err := reserve(db, skuID, quantity)
+		if err == errOutOfStock {
+			outOfStock.Record(start, nil)
+			continue
+		}
+		reserves.Record(start, err)
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+
+		time.Sleep(time.Duration(r.Int63n(int64(*maxThink) + 1)))
+
+		p := r.Intn(100)
+		if p >= *confirmPercent+*cancelPercent {
+			stats.Lock()
+			stats.abandoned++
+			stats.Unlock()
+			continue
+		}
+		state := "cancelled"
+		if p < *confirmPercent {
+			state = "confirmed"
+		}
+		start = time.Now()
+		ok, err := finish(db, id, state)
+		finishes.Record(start, err)
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+		stats.Lock()
+		switch {
+		case !ok:
+			stats.tooLate++
+		case state == "confirmed":
+			stats.confirmed++
+		default:
+			stats.cancelled++
+		}
+		stats.Unlock()
+	}
+}
+
+func runReaper(db *sql.DB) {
+	for range time.Tick(*reapInterval) {
+		n, err := reap(db)
+		if err != nil {
+			countError(err)
+		}
+		stats.Lock()
+		stats.reaped += n
+		stats.Unlock()
+	}
+}
+
+// runRestocker adds --restock-rate units of stock back every second, one
+// at a time to SKUs picked like those of the shoppers, so that the popular
+// SKUs get most of it.
+func runRestocker(db *sql.DB) {
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	z := rand.NewZipf(r, *zipfS, 1, uint64(*numSKUs-1))
+	for range time.Tick(time.Second) {
+		quantities := make(map[int]int)
+		for i := 0; i < *restockRate; i++ {
+			quantities[int(z.Uint64())]++
+		}
+		for skuID, quantity := range quantities {
+			if err := restock(db, skuID, quantity); err != nil {
+				countError(err)
+				continue
+			}
+			stats.Lock()
+			stats.restocked += quantity
+			stats.Unlock()
+		}
+	}
+}
+
+func runChecker(db *sql.DB) {
+	for range time.Tick(*checkInterval) {
+		violations, err := check(db)
+		if err != nil {
+			countError(err)
+			continue
+		}
+		for _, v := range violations {
+			log.Print(v)
+		}
+		stats.Lock()
+		stats.violations += len(violations)
+		stats.Unlock()
+	}
+}
+
+func setupDatabase(db *sql.DB) error {
+	if _, err := db.Exec("CREATE DATABASE IF NOT EXISTS inventory"); err != nil {
+		return err
+	}
+	if _, err := db.Exec(schema); err != nil {
+		return err
+	}
+	for _, table := range []string{"skus", "reservations"} {
+		if _, err := db.Exec("TRUNCATE TABLE " + table); err != nil {
+			return err
+		}
+	}
+	_, err := db.Exec(`INSERT INTO skus (id, available, reserved, sold, restocked) `+
+		`SELECT i, $1, 0, 0, 0 FROM GENERATE_SERIES(0, $2) AS g(i)`, *initialStock, *numSKUs-1)
+	return err
+}
+
+var usage = func() {
+	fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s [<db URL>]\n\n", os.Args[0])
+	flag.PrintDefaults()
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() > 1 {
+		usage()
+		os.Exit(2)
+	}
+
+	if *numSKUs < 2 {
+		log.Fatalf("Value of 'skus' flag (%d) must be greater than or equal to 2", *numSKUs)
+	}
+	if *zipfS <= 1 {
+		log.Fatalf("Value of 'zipf-s' flag (%f) must be greater than 1", *zipfS)
+	}
+	if *maxQuantity < 1 {
+		log.Fatalf("Value of 'max-quantity' flag (%d) must be greater than or equal to 1", *maxQuantity)
+	}
+	if *restockRate < 0 {
+		log.Fatalf("Value of 'restock-rate' flag (%d) must be greater than or equal to 0", *restockRate)
+	}
+	if *confirmPercent+*cancelPercent > 100 {
+		log.Fatal("'confirm-percent' and 'cancel-percent' must add up to at most 100")
+	}
+
+	dbURL, err := dbdriver.URL(flag.Arg(0), "")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	parsedURL, err := url.Parse(dbURL)
+	if err != nil {
+		log.Fatal(err)
+	}
+	parsedURL.Path = "inventory"
+
+	db, err := dbdriver.Open(*driver, parsedURL.String())
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer func() { _ = db.Close() }()
+
+	db.SetMaxOpenConns(*concurrency + 3)
+
+	if err := setupDatabase(db); err != nil {
+		log.Fatal(err)
+	}
+
+	for i := 0; i < *concurrency; i++ {
+		go shop(db)
+	}
+	go runReaper(db)
+	if *restockRate > 0 {
+		go runRestocker(db)
+	}
+	go runChecker(db)
+
+	for range time.Tick(*outputInterval) {
+		reserveHist, reserveErrors := reserves.Snapshot()
+		outOfStockHist, _ := outOfStock.Snapshot()
+		finishHist, finishErrors := finishes.Snapshot()
+		stats.Lock()
+		stats.errors += reserveErrors + finishErrors
+		log.Printf("reserve: %d ok, p50=%s p99=%s; out of stock: %d, p50=%s p99=%s; confirm/cancel: p50=%s p99=%s",
+			reserveHist.TotalCount(),
+			time.Duration(reserveHist.ValueAtQuantile(50)),
+			time.Duration(reserveHist.ValueAtQuantile(99)),
+			outOfStockHist.TotalCount(),
+			time.Duration(outOfStockHist.ValueAtQuantile(50)),
+			time.Duration(outOfStockHist.ValueAtQuantile(99)),
+			time.Duration(finishHist.ValueAtQuantile(50)),
+			time.Duration(finishHist.ValueAtQuantile(99)))
+		log.Printf("%d confirmed, %d cancelled, %d abandoned, %d too late, %d reaped, %d restocked, %d errors, "+
+			"%d oversell violations", stats.confirmed, stats.cancelled, stats.abandoned, stats.tooLate, stats.reaped,
+			stats.restocked, stats.errors, stats.violations)
+		stats.Unlock()
+	}
+}
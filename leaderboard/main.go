@@ -0,0 +1,305 @@
+// Copyright 2016 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+// The leaderboard example maintains scores for a population of players
+// and serves concurrent top-N queries over them. Two designs are offered:
+//
+//   - "indexed": top-N queries are answered directly from a secondary
+//     index on the score column (ORDER BY score DESC LIMIT N).
+//   - "materialized": every score update also maintains a small `top`
+//     table holding the current top N players, which readers scan in its
+//     entirety. Reads become trivial, but every update that enters the
+//     top N contends on the same handful of rows.
+//
+// Running the example once in each mode with the same flags allows the
+// two designs to be compared under load.
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/cockroachdb/examples-go/dbdriver"
+	"github.com/cockroachdb/examples-go/opstats"
+	"github.com/codahale/hdrhistogram"
+	// Import postgres driver.
+	_ "github.com/cockroachdb/pq"
+)
+
+var numPlayers = flag.Int("num-players", 100000, "Number of players.")
+var topN = flag.Int("top-n", 10, "Number of players returned by each top-N query.")
+var writers = flag.Int("writers", 8, "Number of concurrent actors updating scores.")
+var readers = flag.Int("readers", 8, "Number of concurrent actors querying the top N.")
+var maxDelta = flag.Int("max-delta", 100, "Maximum score increase applied by a single update.")
+var mode = flag.String("mode", "indexed", "Top-N design. One of indexed or materialized.")
+var outputInterval = flag.Duration("output-interval", 1*time.Second, "Interval of output.")
+var driver = flag.String("driver", "postgres", dbdriver.Usage)
+
+const schema = `
+CREATE TABLE IF NOT EXISTS scores (
+  player_id INT PRIMARY KEY,
+  score     INT NOT NULL,
+  INDEX (score DESC, player_id)
+);
+
+CREATE TABLE IF NOT EXISTS top (
+  player_id INT PRIMARY KEY,
+  score     INT NOT NULL
+);
+`
+
+// A leaderboard implements one of the top-N designs.
+type leaderboard interface {
+	// addScore increases the score of the given player by delta.
+	addScore(tx *sql.Tx, playerID, delta int) error
+	// topPlayers returns the current top N player IDs, highest score first.
+	topPlayers(db *sql.DB) ([]int, error)
+}
+
+// indexedLeaderboard answers top-N queries from the index on scores.
+type indexedLeaderboard struct{}
+
+func (indexedLeaderboard) addScore(tx *sql.Tx, playerID, delta int) error {
+	_, err := tx.Exec(`UPDATE scores SET score = score + $1 WHERE player_id = $2`, delta, playerID)
+	return err
+}
+
+func (indexedLeaderboard) topPlayers(db *sql.DB) ([]int, error) {
+	return queryPlayers(db, `SELECT player_id FROM scores ORDER BY score DESC, player_id LIMIT $1`, *topN)
+}
+
+// materializedLeaderboard maintains the top N players in the `top` table
+// transactionally with every score update. Since scores only ever
+// increase, a player that isn't in the top N can only enter it by
+// beating the current minimum, and the lowest entry is evicted when the
+// table grows beyond N rows.
+type materializedLeaderboard struct{}
+
+func (materializedLeaderboard) addScore(tx *sql.Tx, playerID, delta int) error {
+	var score int
+	if err := tx.QueryRow(`UPDATE scores SET score = score + $1 WHERE player_id = $2 RETURNING score`,
+		delta, playerID).Scan(&score); err != nil {
+		return err
+	}
+
+	var count int
+	var minScore sql.NullInt64
+	if err := tx.QueryRow(`SELECT COUNT(*), MIN(score) FROM top`).Scan(&count, &minScore); err != nil {
+		return err
+	}
+	var inTop bool
+	if err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM top WHERE player_id = $1)`,
+		playerID).Scan(&inTop); err != nil {
+		return err
+	}
+	full := count >= *topN
+	if !inTop && full && minScore.Valid && int64(score) <= minScore.Int64 {
+		// Not good enough to enter the top N.
+		return nil
+	}
+
+	if _, err := tx.Exec(`UPSERT INTO top (player_id, score) VALUES ($1, $2)`, playerID, score); err != nil {
+		return err
+	}
+	if inTop || !full {
+		return nil
+	}
+	// The player displaced the lowest entry.
+	_, err := tx.Exec(`DELETE FROM top WHERE player_id = ` +
+		`(SELECT player_id FROM top ORDER BY score, player_id DESC LIMIT 1)`)
+	return err
+}
+
+func (materializedLeaderboard) topPlayers(db *sql.DB) ([]int, error) {
+	return queryPlayers(db, `SELECT player_id FROM top ORDER BY score DESC, player_id LIMIT $1`, *topN)
+}
+
+func queryPlayers(db *sql.DB, query string, args ...interface{}) ([]int, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+var leaderboards = map[string]leaderboard{
+	"indexed":      indexedLeaderboard{},
+	"materialized": materializedLeaderboard{},
+}
+
+var writeStats, readStats = opstats.New(time.Minute), opstats.New(time.Minute)
+
+func updateScores(db *sql.DB, lb leaderboard) {
+	for {
+		playerID := rand.Intn(*numPlayers)
+		delta := 1 + rand.Intn(*maxDelta)
+		start := time.Now()
+		err := dbdriver.ExecuteTx(db, func(tx *sql.Tx) error {
+			return lb.addScore(tx, playerID, delta)
+		})
+		if err != nil {
+			log.Print(err)
+		}
+		writeStats.Record(start, err)
+	}
+}
+
+func queryTop(db *sql.DB, lb leaderboard) {
+	for {
+		start := time.Now()
+		ids, err := lb.topPlayers(db)
+		if err != nil {
+			log.Print(err)
+		} else if len(ids) > *topN {
+			log.Fatalf("top-%d query returned %d players", *topN, len(ids))
+		}
+		readStats.Record(start, err)
+	}
+}
+
+// setupDatabase creates the schema and populates the scores table. The
+// materialized top N is rebuilt from scratch to match.
+func setupDatabase(db *sql.DB) error {
+	if _, err := db.Exec("CREATE DATABASE IF NOT EXISTS leaderboard"); err != nil {
+		return err
+	}
+	if _, err := db.Exec(schema); err != nil {
+		return err
+	}
+
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM scores").Scan(&count); err != nil {
+		return err
+	}
+	if count != *numPlayers {
+		if _, err := db.Exec("TRUNCATE TABLE scores"); err != nil {
+			return err
+		}
+		const batchSize = 1000
+		for i := 0; i < *numPlayers; i += batchSize {
+			end := i + batchSize
+			if end > *numPlayers {
+				end = *numPlayers
+			}
+			if _, err := db.Exec(`INSERT INTO scores (player_id, score) `+
+				`SELECT i, 0 FROM GENERATE_SERIES($1, $2) AS g(i)`,
+				i, end-1); err != nil {
+				return err
+			}
+		}
+	}
+
+	return dbdriver.ExecuteTx(db, func(tx *sql.Tx) error {
+		if _, err := tx.Exec("DELETE FROM top"); err != nil {
+			return err
+		}
+		_, err := tx.Exec(`INSERT INTO top (player_id, score) `+
+			`SELECT player_id, score FROM scores ORDER BY score DESC, player_id LIMIT $1`, *topN)
+		return err
+	})
+}
+
+func logStats(name string, elapsed time.Duration, hist *hdrhistogram.Histogram, errors int) {
+	log.Printf("%s: %.1f/sec, p50=%s p95=%s p99=%s (%d errors)",
+		name, float64(hist.TotalCount())/elapsed.Seconds(),
+		time.Duration(hist.ValueAtQuantile(50)),
+		time.Duration(hist.ValueAtQuantile(95)),
+		time.Duration(hist.ValueAtQuantile(99)),
+		errors)
+}
+
+var usage = func() {
+	fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s [<db URL>]\n\n", os.Args[0])
+	flag.PrintDefaults()
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() > 1 {
+		usage()
+		os.Exit(2)
+	}
+
+	lb, ok := leaderboards[*mode]
+	if !ok {
+		usage()
+		os.Exit(2)
+	}
+	if *numPlayers < 1 || *topN < 1 || *maxDelta < 1 {
+		log.Fatal("num-players, top-n and max-delta must all be positive")
+	}
+
+	dbURL, err := dbdriver.URL(flag.Arg(0), "")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	parsedURL, err := url.Parse(dbURL)
+	if err != nil {
+		log.Fatal(err)
+	}
+	parsedURL.Path = "leaderboard"
+
+	db, err := dbdriver.Open(*driver, parsedURL.String())
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer func() { _ = db.Close() }()
+
+	db.SetMaxOpenConns(*writers + *readers + 1)
+
+	if err := setupDatabase(db); err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("running %s leaderboard with %d players, %d writers and %d readers",
+		*mode, *numPlayers, *writers, *readers)
+	for i := 0; i < *writers; i++ {
+		go updateScores(db, lb)
+	}
+	for i := 0; i < *readers; i++ {
+		go queryTop(db, lb)
+	}
+
+	lastNow := time.Now()
+	for range time.Tick(*outputInterval) {
+		now := time.Now()
+		elapsed := now.Sub(lastNow)
+		lastNow = now
+
+		hist, errors := writeStats.Snapshot()
+		logStats("updates", elapsed, hist, errors)
+		hist, errors = readStats.Snapshot()
+		logStats("top-n queries", elapsed, hist, errors)
+	}
+}
@@ -0,0 +1,343 @@
+// Copyright 2016 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+// The lease example implements distributed locks as lease rows in SQL.
+// Each lock is a row holding the current holder, an epoch and an expiry
+// timestamp. Leases are acquired and renewed with compare-and-swap
+// UPDATEs:
+//
+// - acquire: succeeds only if the lease has expired, bumping the epoch.
+// - renew: succeeds only if the caller still holds the same epoch.
+//
+// Many contenders compete for each lock. After holding a lock for a
+// while, a holder either releases it or "dies", i.e. silently stops
+// renewing it. The example measures the failover time (from the death of
+// a holder until another contender acquires the lock) and checks that no
+// two contenders ever believe they hold the same lock at the same time.
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/examples-go/dbdriver"
+	"github.com/cockroachdb/examples-go/opstats"
+	"github.com/codahale/hdrhistogram"
+	// Import postgres driver.
+	_ "github.com/cockroachdb/pq"
+)
+
+var numLocks = flag.Int("locks", 10, "Number of locks.")
+var contenders = flag.Int("contenders", 10, "Number of contenders per lock.")
+var leaseDuration = flag.Duration("lease-duration", 2*time.Second, "Duration of a lease.")
+var renewInterval = flag.Duration("renew-interval", 500*time.Millisecond, "Interval at which holders renew their lease.")
+var pollInterval = flag.Duration("poll-interval", 100*time.Millisecond, "Interval at which contenders try to acquire a lock.")
+var meanHold = flag.Duration("mean-hold", 10*time.Second, "Mean time a holder keeps a lock (exponentially distributed).")
+var releasePercent = flag.Int("release-percent", 50, "Percentage of holders that release the lock instead of dying.")
+var outputInterval = flag.Duration("output-interval", 5*time.Second, "Interval of output.")
+var driver = flag.String("driver", "postgres", dbdriver.Usage)
+
+const schema = `
+CREATE TABLE IF NOT EXISTS leases (
+  name    STRING PRIMARY KEY,
+  holder  STRING NOT NULL,
+  epoch   INT NOT NULL,
+  expires TIMESTAMP NOT NULL
+)`
+
+// interval returns d in a form accepted as an INTERVAL literal.
+func interval(d time.Duration) string {
+	return fmt.Sprintf("%d milliseconds", d/time.Millisecond)
+}
+
+// acquire tries to take over an expired lease. It returns the new epoch,
+// or 0 if the lease is still held by someone else.
+func acquire(db *sql.DB, lock, holder string) (int64, error) {
+	var epoch int64
+	err := db.QueryRow(`
+UPDATE leases SET holder = $2, epoch = epoch + 1, expires = NOW() + $3::INTERVAL
+  WHERE name = $1 AND expires < NOW()
+  RETURNING epoch`, lock, holder, interval(*leaseDuration)).Scan(&epoch)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return epoch, err
+}
+
+// renew extends a lease still held at the given epoch. It returns false
+// if the lease was lost.
+func renew(db *sql.DB, lock, holder string, epoch int64) (bool, error) {
+	res, err := db.Exec(`
+UPDATE leases SET expires = NOW() + $4::INTERVAL
+  WHERE name = $1 AND holder = $2 AND epoch = $3`, lock, holder, epoch, interval(*leaseDuration))
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// release expires a lease immediately so another contender can take it.
+func release(db *sql.DB, lock, holder string, epoch int64) error {
+	_, err := db.Exec(`UPDATE leases SET expires = NOW() WHERE name = $1 AND holder = $2 AND epoch = $3`,
+		lock, holder, epoch)
+	return err
+}
+
+// lockState is the client-side view of a lock, used to check mutual
+// exclusion and to measure failover times.
+type lockState struct {
+	owner    string
+	until    time.Time // end of the owner's lease, as conservatively assumed by the owner
+	vacated  time.Time // time the last owner died or released the lock
+	released bool      // whether the last owner released the lock rather than died
+}
+
+var stats struct {
+	sync.Mutex
+	locks         map[string]*lockState
+	acquisitions  int
+	renewals      int
+	lostLeases    int
+	deaths        int
+	releases      int
+	violations    int
+	errors        int
+	maxFailover   time.Duration
+	lastViolation string
+}
+
+// failovers tracks the times from the deaths of owners to the next
+// acquisitions of their locks, and handoffs the times from the releases.
+var failovers = opstats.New(time.Hour)
+var handoffs = opstats.New(time.Hour)
+
+// acquired records that holder believes it owns lock until the given
+// time, checking that nobody else does.
+func acquired(lock, holder string, until time.Time) {
+	stats.Lock()
+	defer stats.Unlock()
+	now := time.Now()
+	s := stats.locks[lock]
+	if s.owner != "" && s.owner != holder && s.until.After(now) {
+		stats.violations++
+		stats.lastViolation = fmt.Sprintf("%s acquired %s while %s still held it until %s",
+			holder, lock, s.owner, s.until)
+		log.Print(stats.lastViolation)
+	}
+	if !s.vacated.IsZero() {
+		d := now.Sub(s.vacated)
+		if s.released {
+			handoffs.Record(s.vacated, nil)
+		} else {
+			failovers.Record(s.vacated, nil)
+			if d > stats.maxFailover {
+				stats.maxFailover = d
+			}
+		}
+		s.vacated = time.Time{}
+	}
+	s.owner, s.until = holder, until
+	stats.acquisitions++
+}
+
+// vacate records that holder stopped holding lock, either by releasing
+// it or by dying.
+func vacate(lock, holder string, released bool) {
+	stats.Lock()
+	defer stats.Unlock()
+	s := stats.locks[lock]
+	if s.owner == holder {
+		s.owner = ""
+		s.vacated = time.Now()
+		s.released = released
+	}
+	if released {
+		stats.releases++
+	} else {
+		stats.deaths++
+	}
+}
+
+func countError(err error) {
+	log.Print(err)
+	stats.Lock()
+	stats.errors++
+	stats.Unlock()
+}
+
+// contend repeatedly competes for a lock. Once it holds the lock, it
+// renews the lease until its hold time is over and then releases the
+// lock or dies.
+func contend(db *sql.DB, lock, holder string) {
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	for {
+		start := time.Now()
+		epoch, err := acquire(db, lock, holder)
+		if err != nil {
+			countError(err)
+		}
+		if epoch == 0 {
+			time.Sleep(*pollInterval)
+			continue
+		}
+		// The lease may have been granted as early as the statement was
+		// sent, so that's where its validity must be measured from.
+		until := start.Add(*leaseDuration)
+		acquired(lock, holder, until)
+
+		holdUntil := time.Now().Add(time.Duration(r.ExpFloat64() * float64(*meanHold)))
+		lost := false
+		for !lost && time.Now().Before(holdUntil) {
+			time.Sleep(*renewInterval)
+			start := time.Now()
+			ok, err := renew(db, lock, holder, epoch)
+			if err != nil {
+				countError(err)
+				continue
+			}
+			if !ok {
+				// Someone else took over after our lease expired.
+				stats.Lock()
+				stats.lostLeases++
+				stats.Unlock()
+				lost = true
+				break
+			}
+			stats.Lock()
+			stats.locks[lock].until = start.Add(*leaseDuration)
+			stats.renewals++
+			stats.Unlock()
+		}
+
+		if lost {
+			continue
+		}
+		if r.Intn(100) < *releasePercent {
+			if err := release(db, lock, holder, epoch); err != nil {
+				countError(err)
+			}
+			vacate(lock, holder, true)
+		} else {
+			// Die: stop renewing and stay away for a while, like a
+			// crashed process being restarted.
+			vacate(lock, holder, false)
+			time.Sleep(2 * *leaseDuration)
+		}
+	}
+}
+
+// setupDatabase creates a fresh, expired lease row for every lock.
+func setupDatabase(db *sql.DB) error {
+	if _, err := db.Exec("CREATE DATABASE IF NOT EXISTS lease"); err != nil {
+		return err
+	}
+	if _, err := db.Exec(schema); err != nil {
+		return err
+	}
+	if _, err := db.Exec("TRUNCATE TABLE leases"); err != nil {
+		return err
+	}
+	for i := 0; i < *numLocks; i++ {
+		if _, err := db.Exec(`INSERT INTO leases (name, holder, epoch, expires) VALUES ($1, '', 0, NOW())`,
+			fmt.Sprintf("lock%d", i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var usage = func() {
+	fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s [<db URL>]\n\n", os.Args[0])
+	flag.PrintDefaults()
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() > 1 {
+		usage()
+		os.Exit(2)
+	}
+
+	if *renewInterval >= *leaseDuration {
+		log.Fatalf("Value of 'renew-interval' (%s) must be smaller than 'lease-duration' (%s)",
+			*renewInterval, *leaseDuration)
+	}
+
+	dbURL, err := dbdriver.URL(flag.Arg(0), "")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	parsedURL, err := url.Parse(dbURL)
+	if err != nil {
+		log.Fatal(err)
+	}
+	parsedURL.Path = "lease"
+
+	db, err := dbdriver.Open(*driver, parsedURL.String())
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer func() { _ = db.Close() }()
+
+	db.SetMaxOpenConns(*numLocks * *contenders)
+
+	if err := setupDatabase(db); err != nil {
+		log.Fatal(err)
+	}
+
+	stats.locks = map[string]*lockState{}
+	for i := 0; i < *numLocks; i++ {
+		lock := fmt.Sprintf("lock%d", i)
+		stats.locks[lock] = &lockState{}
+		for j := 0; j < *contenders; j++ {
+			go contend(db, lock, fmt.Sprintf("%s-contender%d", lock, j))
+		}
+	}
+
+	// The failover and handoff times are reported over the whole run.
+	failover := hdrhistogram.New(0, int64(time.Hour), 1)
+	handoff := hdrhistogram.New(0, int64(time.Hour), 1)
+	for range time.Tick(*outputInterval) {
+		hist, _ := failovers.Snapshot()
+		failover.Merge(hist)
+		hist, _ = handoffs.Snapshot()
+		handoff.Merge(hist)
+		stats.Lock()
+		log.Printf("%d acquisitions, %d renewals, %d lost leases, %d releases, %d deaths, %d errors",
+			stats.acquisitions, stats.renewals, stats.lostLeases, stats.releases, stats.deaths, stats.errors)
+		log.Printf("failover after death: p50=%s p99=%s max=%s; handoff after release: p50=%s p99=%s",
+			time.Duration(failover.ValueAtQuantile(50)),
+			time.Duration(failover.ValueAtQuantile(99)),
+			stats.maxFailover,
+			time.Duration(handoff.ValueAtQuantile(50)),
+			time.Duration(handoff.ValueAtQuantile(99)))
+		if stats.violations > 0 {
+			log.Printf("%d mutual exclusion violations, last: %s", stats.violations, stats.lastViolation)
+		}
+		stats.Unlock()
+	}
+}
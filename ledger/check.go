@@ -0,0 +1,271 @@
+// Copyright 2016 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+
+	"github.com/cockroachdb/examples-go/dialect"
+)
+
+// The postings of the accounts table are the history of the run: each
+// posting of an account records the causality ID and balance it read last
+// for the account, and each posting group moves money between two
+// accounts. --check looks for anomalies in this history.
+
+// A posting is a row of the accounts table.
+type posting struct {
+	account string
+	cid     int64
+	group   int64
+	amount  int64
+	balance int64
+}
+
+// An anomaly is a violation of the invariants of the history, along with
+// the posting groups involved.
+type anomaly struct {
+	kind   string
+	detail string
+	groups []int64
+}
+
+func (a anomaly) String() string {
+	return fmt.Sprintf("%s: %s (posting groups %v)", a.kind, a.detail, a.groups)
+}
+
+// checkAccount checks the single-key linearizability of the postings of an
+// account, ordered by causality ID: every posting must build on the one
+// before it, which it must have read as the last one. The causality IDs
+// then go 1, 2, 3, etc., and each balance is the previous one plus the
+// amount of the posting. A gap shows a posting lost after it was
+// acknowledged, and a wrong balance a posting that read a stale balance.
+func checkAccount(postings []posting) []anomaly {
+	var anomalies []anomaly
+	var prev posting
+	for i, p := range postings {
+		if i == 0 {
+			prev = posting{account: p.account}
+		}
+		switch {
+		case p.cid != prev.cid+1 && i == 0:
+			anomalies = append(anomalies, anomaly{
+				kind:   "lost postings",
+				detail: fmt.Sprintf("the first posting of %s has causality ID %d", p.account, p.cid),
+				groups: []int64{p.group},
+			})
+		case p.cid != prev.cid+1:
+			anomalies = append(anomalies, anomaly{
+				kind: "lost postings",
+				detail: fmt.Sprintf("the causality IDs of %s jump from %d to %d",
+					p.account, prev.cid, p.cid),
+				groups: []int64{prev.group, p.group},
+			})
+		case p.balance != prev.balance+p.amount:
+			groups := []int64{p.group}
+			if i > 0 {
+				groups = []int64{prev.group, p.group}
+			}
+			anomalies = append(anomalies, anomaly{
+				kind: "stale read",
+				detail: fmt.Sprintf("posting %d of %s has balance %d, but the balance was %d before its amount of %d",
+					p.cid, p.account, p.balance, prev.balance, p.amount),
+				groups: groups,
+			})
+		}
+		prev = p
+	}
+	return anomalies
+}
+
+// A groupSum is the sum of the amounts of the postings of a posting group.
+type groupSum struct {
+	group    int64
+	postings int
+	sum      int64
+}
+
+// checkGroups checks that every posting group moves money without creating
+// or destroying any: its postings sum up to zero. A group usually has two
+// postings, but the few-few generator reuses group 1 across accounts.
+func checkGroups(sums []groupSum) []anomaly {
+	var anomalies []anomaly
+	for _, s := range sums {
+		if s.sum != 0 {
+			anomalies = append(anomalies, anomaly{
+				kind:   "non-zero sum",
+				detail: fmt.Sprintf("the %d postings of the group sum up to %d", s.postings, s.sum),
+				groups: []int64{s.group},
+			})
+		}
+	}
+	return anomalies
+}
+
+// nonZeroGroups returns the posting groups whose postings don't sum up to
+// zero.
+func nonZeroGroups(db *sql.DB, d dialect.Dialect) ([]anomaly, error) {
+	rows, err := db.Query(`SELECT posting_group_id, COUNT(*), ` + d.CastInt("SUM(amount)") + ` FROM ` +
+		accounts() + ` GROUP BY posting_group_id HAVING ` + d.CastInt("SUM(amount)") + ` != 0`)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+	var sums []groupSum
+	for rows.Next() {
+		var s groupSum
+		if err := rows.Scan(&s.group, &s.postings, &s.sum); err != nil {
+			return nil, err
+		}
+		sums = append(sums, s)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return checkGroups(sums), nil
+}
+
+// duplicateCausalityIDs returns the causality IDs used by several postings
+// of an account, which the UNIQUE constraint of the table should prevent.
+func duplicateCausalityIDs(db *sql.DB, d dialect.Dialect) ([]anomaly, error) {
+	rows, err := db.Query(`SELECT account_id, causality_id, COUNT(*) FROM ` + accounts() +
+		` GROUP BY account_id, causality_id HAVING COUNT(*) > 1`)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+	type duplicate struct {
+		account string
+		cid     int64
+		count   int
+	}
+	var duplicates []duplicate
+	for rows.Next() {
+		var dup duplicate
+		if err := rows.Scan(&dup.account, &dup.cid, &dup.count); err != nil {
+			return nil, err
+		}
+		duplicates = append(duplicates, dup)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var anomalies []anomaly
+	for _, dup := range duplicates {
+		query, args := d.Bind(`SELECT posting_group_id FROM `+accounts()+
+			` WHERE account_id = $1 AND causality_id = $2 ORDER BY posting_group_id`, dup.account, dup.cid)
+		groups, err := queryInts(db, query, args...)
+		if err != nil {
+			return nil, err
+		}
+		anomalies = append(anomalies, anomaly{
+			kind:   "duplicate causality ID",
+			detail: fmt.Sprintf("%d postings of %s have causality ID %d", dup.count, dup.account, dup.cid),
+			groups: groups,
+		})
+	}
+	return anomalies, nil
+}
+
+// queryInts returns the integers of the single column returned by query.
+func queryInts(db *sql.DB, query string, args ...interface{}) ([]int64, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+	var ints []int64
+	for rows.Next() {
+		var i int64
+		if err := rows.Scan(&i); err != nil {
+			return nil, err
+		}
+		ints = append(ints, i)
+	}
+	return ints, rows.Err()
+}
+
+// check checks the history recorded in the accounts table, logging the
+// anomalies found, and returns their number. Without running balances, only
+// the posting groups are checked.
+func check(db *sql.DB, d dialect.Dialect) (int, error) {
+	var numAnomalies, numPostings, numAccounts int
+	report := func(anomalies []anomaly) {
+		for _, a := range anomalies {
+			log.Print(a)
+		}
+		numAnomalies += len(anomalies)
+	}
+
+	if !*noRunningBalance {
+		rows, err := db.Query(`SELECT account_id, causality_id, posting_group_id, amount, balance FROM ` +
+			accounts() + ` ORDER BY account_id, causality_id`)
+		if err != nil {
+			return 0, err
+		}
+		var postings []posting
+		for rows.Next() {
+			var p posting
+			if err := rows.Scan(&p.account, &p.cid, &p.group, &p.amount, &p.balance); err != nil {
+				_ = rows.Close()
+				return 0, err
+			}
+			numPostings++
+			if len(postings) > 0 && postings[0].account != p.account {
+				report(checkAccount(postings))
+				postings = postings[:0]
+			}
+			if len(postings) == 0 {
+				numAccounts++
+			}
+			postings = append(postings, p)
+		}
+		if err := rows.Err(); err != nil {
+			return 0, err
+		}
+		report(checkAccount(postings))
+	}
+
+	anomalies, err := duplicateCausalityIDs(db, d)
+	if err != nil {
+		return 0, err
+	}
+	report(anomalies)
+	if anomalies, err = nonZeroGroups(db, d); err != nil {
+		return 0, err
+	}
+	report(anomalies)
+
+	var total int64
+	if err := db.QueryRow(`SELECT ` + d.CastInt("COALESCE(SUM(amount), 0)") + ` FROM ` +
+		accounts()).Scan(&total); err != nil {
+		return 0, err
+	}
+	if total != 0 {
+		log.Printf("non-zero sum: the postings of all the accounts sum up to %d", total)
+		numAnomalies++
+	}
+
+	if *noRunningBalance {
+		log.Print("checked the causality IDs and posting groups, without running balances")
+	} else {
+		log.Printf("checked %d postings of %d accounts", numPostings, numAccounts)
+	}
+	return numAnomalies, nil
+}
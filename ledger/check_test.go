@@ -0,0 +1,83 @@
+// Copyright 2016 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCheckAccount(t *testing.T) {
+	testCases := []struct {
+		postings []posting
+		expected []anomaly
+	}{
+		// A consistent history.
+		{[]posting{
+			{"acc1", 1, 10, 5, 5},
+			{"acc1", 2, 11, -3, 2},
+			{"acc1", 3, 12, 5, 7},
+		}, nil},
+		// Posting 2 is lost.
+		{[]posting{
+			{"acc1", 1, 10, 5, 5},
+			{"acc1", 3, 12, 5, 15},
+		}, []anomaly{{"lost postings", "the causality IDs of acc1 jump from 1 to 3", []int64{10, 12}}}},
+		// The first posting is lost.
+		{[]posting{
+			{"acc1", 2, 11, 5, 10},
+		}, []anomaly{{"lost postings", "the first posting of acc1 has causality ID 2", []int64{11}}}},
+		// Posting 2 read a balance of 0 instead of 5.
+		{[]posting{
+			{"acc1", 1, 10, 5, 5},
+			{"acc1", 2, 11, 5, 5},
+		}, []anomaly{{"stale read",
+			"posting 2 of acc1 has balance 5, but the balance was 5 before its amount of 5", []int64{10, 11}}}},
+	}
+	for i, c := range testCases {
+		if anomalies := checkAccount(c.postings); !reflect.DeepEqual(anomalies, c.expected) {
+			t.Errorf("%d: expected %v, got %v", i, c.expected, anomalies)
+		}
+	}
+}
+
+func TestCheckGroups(t *testing.T) {
+	anomalies := checkGroups([]groupSum{{1, 4, 0}, {2, 2, 0}, {3, 1, -5}})
+	expected := []anomaly{{"non-zero sum", "the 1 postings of the group sum up to -5", []int64{3}}}
+	if !reflect.DeepEqual(anomalies, expected) {
+		t.Errorf("expected %v, got %v", expected, anomalies)
+	}
+}
+
+func TestWorkerHistory(t *testing.T) {
+	h := newWorkerHistory(3)
+	for i := int64(1); i <= 5; i++ {
+		h.add(postingRequest{Group: i}, nil)
+	}
+	var groups []int64
+	for _, e := range h.window() {
+		groups = append(groups, e.req.Group)
+	}
+	if expected := []int64{3, 4, 5}; !reflect.DeepEqual(groups, expected) {
+		t.Errorf("expected %v, got %v", expected, groups)
+	}
+
+	h = newWorkerHistory(0)
+	h.add(postingRequest{Group: 1}, nil)
+	if len(h.window()) != 0 {
+		t.Errorf("expected no history, got %v", h.window())
+	}
+}
@@ -0,0 +1,127 @@
+// Copyright 2016 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/examples-go/control"
+)
+
+var latencyWindow = flag.Duration("latency-window", 10*time.Second, "Window of the p50 and p99 latencies "+
+	"of the postings reported every second, rolling by one second.")
+var csvFile = flag.String("csv", "", "If set, CSV file to write the rate and the windowed latencies of the "+
+	"postings to every second.")
+
+type durations []time.Duration
+
+func (d durations) Len() int           { return len(d) }
+func (d durations) Less(i, j int) bool { return d[i] < d[j] }
+func (d durations) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+
+// A rollingLatencies holds the latencies of the postings of the last
+// seconds, one bucket per second, so that percentiles over a window are
+// reported while running rather than only over the whole run. It is safe
+// for concurrent use.
+type rollingLatencies struct {
+	mu      sync.Mutex
+	buckets [][]time.Duration
+	// cur is the bucket of the current second.
+	cur int
+	// sorted is reused by percentiles to merge the buckets.
+	sorted []time.Duration
+}
+
+func newRollingLatencies(window time.Duration) *rollingLatencies {
+	n := int(window / time.Second)
+	if n < 1 {
+		n = 1
+	}
+	return &rollingLatencies{buckets: make([][]time.Duration, n)}
+}
+
+func (r *rollingLatencies) record(d time.Duration) {
+	r.mu.Lock()
+	r.buckets[r.cur] = append(r.buckets[r.cur], d)
+	r.mu.Unlock()
+}
+
+// rotate starts a new second, dropping the oldest one out of the window.
+func (r *rollingLatencies) rotate() {
+	r.mu.Lock()
+	r.cur = (r.cur + 1) % len(r.buckets)
+	r.buckets[r.cur] = r.buckets[r.cur][:0]
+	r.mu.Unlock()
+}
+
+// percentiles returns the p50 and p99 latencies of the window, and the
+// number of latencies in it.
+func (r *rollingLatencies) percentiles() (p50, p99 time.Duration, n int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sorted = r.sorted[:0]
+	for _, b := range r.buckets {
+		r.sorted = append(r.sorted, b...)
+	}
+	if len(r.sorted) == 0 {
+		return 0, 0, 0
+	}
+	sort.Sort(durations(r.sorted))
+	at := func(p int) time.Duration {
+		return r.sorted[(len(r.sorted)*p-1)/100]
+	}
+	return at(50), at(99), len(r.sorted)
+}
+
+// latencies holds the latencies of the successful postings.
+var latencies *rollingLatencies
+
+// report logs the rate of postings and the latencies of the window every
+// second and, with --csv, writes them to the CSV file. The changes of the
+// concurrency of ctl are logged as they happen.
+func report(csv *os.File, ctl *control.Controller) {
+	var w *bufio.Writer
+	if csv != nil {
+		w = bufio.NewWriter(csv)
+		fmt.Fprintln(w, "elapsed,postings_per_sec,p50_ms,p99_ms")
+	}
+	start := time.Now()
+	for now := range time.Tick(time.Second) {
+		rate := counter.Rate()
+		p50, p99, _ := latencies.percentiles()
+		latencies.rotate()
+		for _, ch := range ctl.Changes() {
+			log.Printf("%s: ----- %s -----", time.Duration(ch.Elapsed.Seconds()+0.5)*time.Second, ch)
+		}
+		log.Printf("%d postings/seq, p50 %s, p99 %s over the last %s", rate, p50, p99, *latencyWindow)
+		if w == nil {
+			continue
+		}
+		fmt.Fprintf(w, "%.0f,%d,%.2f,%.2f\n", now.Sub(start).Seconds(), rate,
+			p50.Seconds()*1000, p99.Seconds()*1000)
+		// Flushing every second keeps the file readable while running.
+		if err := w.Flush(); err != nil {
+			log.Print(err)
+		}
+	}
+}
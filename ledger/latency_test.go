@@ -0,0 +1,50 @@
+// Copyright 2016 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRollingLatencies(t *testing.T) {
+	r := newRollingLatencies(2 * time.Second)
+	if p50, p99, n := r.percentiles(); p50 != 0 || p99 != 0 || n != 0 {
+		t.Fatalf("expected no latencies, got p50 %s, p99 %s over %d", p50, p99, n)
+	}
+
+	for i := 1; i <= 100; i++ {
+		r.record(time.Duration(i) * time.Millisecond)
+	}
+	if p50, p99, n := r.percentiles(); p50 != 50*time.Millisecond || p99 != 99*time.Millisecond || n != 100 {
+		t.Fatalf("expected p50 50ms, p99 99ms over 100, got p50 %s, p99 %s over %d", p50, p99, n)
+	}
+
+	// The next second is merged with the previous one...
+	r.rotate()
+	for i := 0; i < 100; i++ {
+		r.record(time.Second)
+	}
+	if p50, p99, n := r.percentiles(); p50 != 100*time.Millisecond || p99 != time.Second || n != 200 {
+		t.Fatalf("expected p50 100ms, p99 1s over 200, got p50 %s, p99 %s over %d", p50, p99, n)
+	}
+
+	// ...until it rolls out of the window.
+	r.rotate()
+	if p50, p99, n := r.percentiles(); p50 != time.Second || p99 != time.Second || n != 100 {
+		t.Fatalf("expected p50 1s, p99 1s over 100, got p50 %s, p99 %s over %d", p50, p99, n)
+	}
+}
@@ -28,47 +28,89 @@ import (
 	"math/rand"
 	"net/url"
 	"os"
+	"os/signal"
+	"regexp"
 	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
-	// Import postgres driver.
-	"github.com/cockroachdb/cockroach-go/crdb"
-	"github.com/cockroachdb/pq"
+	"github.com/cockroachdb/examples-go/capture"
+	"github.com/cockroachdb/examples-go/chaos"
+	"github.com/cockroachdb/examples-go/control"
+	"github.com/cockroachdb/examples-go/dbdriver"
+	"github.com/cockroachdb/examples-go/dialect"
 	"github.com/paulbellamy/ratecounter"
 )
 
-const stmtCreate = `
-CREATE TABLE accounts (
+var concurrency = flag.Int("concurrency", 5, "Number of concurrent actors moving money.")
+var generator = flag.String("generator", "few-few", "Type of action. One of few-few, many-many or few-one.")
+var noRunningBalance = flag.Bool("no-running-balance", false, "Do not keep a running balance per account. Avoids contention.")
+var verbose = flag.Bool("verbose", false, "Print information about each transfer.")
+var driver = flag.String("driver", "postgres", "Database driver. One of postgres, pgx or mysql.")
+var dbName = flag.String("db", "ledger", "Database to run in.")
+var tablePrefix = flag.String("table-prefix", "", "Prefix of the names of the tables and indexes, "+
+	"to run several independent instances in one database.")
+
+var readURL = flag.String("read-url", "", "If set, db URL of the read replicas or load balancer pool "+
+	"to read the last balances from, while writes use the main db URL.")
+
+var checkOnly = flag.Bool("check", false, "Check the history recorded by earlier runs for lost postings, "+
+	"stale reads and money created or destroyed, and exit. Pass --no-running-balance if the runs did.")
+
+var checkInterval = flag.Duration("check-interval", 0, "If non-zero, interval at which to check for duplicate "+
+	"causality IDs and posting groups not summing up to zero while running. A broken invariant stops the "+
+	"workers, dumps the postings involved and the last postings of each worker, and exits with code 3.")
+var historyWindow = flag.Int("history-window", 100, "Number of last postings of each worker to dump "+
+	"when --check-interval finds a broken invariant.")
+
+var identRE = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// schema creates the accounts table. %[1]s is the type of string columns,
+// %[2]s the name of the table.
+const schema = `
+CREATE TABLE %[2]s (
   causality_id BIGINT NOT NULL,
   posting_group_id BIGINT NOT NULL,
 
   amount BIGINT,
   balance BIGINT,
-  currency VARCHAR,
+  currency %[1]s,
 
   created TIMESTAMP,
   value_date TIMESTAMP,
 
-  account_id VARCHAR,
-  transaction_id VARCHAR,
+  account_id %[1]s,
+  transaction_id %[1]s,
 
-  scheme VARCHAR,
+  scheme %[1]s,
 
   PRIMARY KEY (account_id, posting_group_id),
   UNIQUE (account_id, causality_id)
-);
--- Could create this inline on Cockroach, but not on Postgres.
-CREATE INDEX ON accounts(transaction_id);
-CREATE INDEX ON accounts (posting_group_id);
-`
+)`
 
-var concurrency = flag.Int("concurrency", 5, "Number of concurrent actors moving money.")
-var generator = flag.String("generator", "few-few", "Type of action. One of few-few, many-many or few-one.")
-var noRunningBalance = flag.Bool("no-running-balance", false, "Do not keep a running balance per account. Avoids contention.")
-var verbose = flag.Bool("verbose", false, "Print information about each transfer.")
+// indexes are created separately, as neither Postgres nor MySQL accept them
+// inline. %[1]s is the name of the table.
+var indexes = []string{
+	`CREATE INDEX %[1]s_transaction_id ON %[1]s (transaction_id)`,
+	`CREATE INDEX %[1]s_posting_group_id ON %[1]s (posting_group_id)`,
+}
+
+// accounts returns the name of the accounts table.
+func accounts() string {
+	return *tablePrefix + "accounts"
+}
 
 var counter *ratecounter.RateCounter
 
+// numOps and numErrors count the postings run by the workers, and those
+// that failed.
+var numOps, numErrors uint64
+
+// faults are the faults injected with --chaos.
+var faults *chaos.Injector
+
 func init() {
 	counter = ratecounter.NewRateCounter(1 * time.Second)
 	rand.Seed(time.Now().UnixNano())
@@ -76,7 +118,9 @@ func init() {
 
 var usage = func() {
 	fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
-	fmt.Fprintf(os.Stderr, "  %s <db URL>\n\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s [<db URL>]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s --coordinate=<addr>,... <command>\n\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "%s\n", control.Usage)
 	flag.PrintDefaults()
 }
 
@@ -99,20 +143,30 @@ var goldenReq = postingRequest{
 
 type genFn func() postingRequest
 
+// fewAccounts are the names of the accounts of the few-* generators,
+// computed once rather than for each request.
+var fewAccounts = func() []string {
+	names := make([]string, 10)
+	for i := range names {
+		names[i] = "acc" + strconv.Itoa(i)
+	}
+	return names
+}()
+
 var generators = map[string]genFn{
 	// Uncontended.
 	"many-many": func() postingRequest {
 		req := goldenReq
-		req.AccountA = fmt.Sprintf("acc%d", rand.Int63())
-		req.AccountB = fmt.Sprintf("acc%d", rand.Int63())
+		req.AccountA = "acc" + strconv.FormatInt(rand.Int63(), 10)
+		req.AccountB = "acc" + strconv.FormatInt(rand.Int63(), 10)
 		req.Group = rand.Int63()
 		return req
 	},
 	// Mildly contended: 10 users shuffling money around among each other.
 	"few-few": func() postingRequest {
 		req := goldenReq
-		req.AccountA = fmt.Sprintf("acc%d", rand.Intn(10))
-		req.AccountB = fmt.Sprintf("acc%d", rand.Intn(10))
+		req.AccountA = fewAccounts[rand.Intn(len(fewAccounts))]
+		req.AccountB = fewAccounts[rand.Intn(len(fewAccounts))]
 		req.Group = rand.Int63()
 		if req.Group%100 == 0 {
 			// Create some fake contention in ~1% of the requests.
@@ -123,17 +177,18 @@ var generators = map[string]genFn{
 	// Highly contended: 10 users all involving one peer account.
 	"few-one": func() postingRequest {
 		req := goldenReq
-		req.AccountA = fmt.Sprintf("acc%d", rand.Intn(10))
+		req.AccountA = fewAccounts[rand.Intn(len(fewAccounts))]
 		req.AccountB = "outbound_wash"
 		req.Group = rand.Int63()
 		return req
 	},
 }
 
-func getLast(tx *sql.Tx, accountID string) (lastCID int64, lastBalance int64, err error) {
-	err = tx.QueryRow(`SELECT causality_id, balance FROM accounts `+
-		`WHERE account_id = $1 ORDER BY causality_id DESC LIMIT 1`, accountID).
-		Scan(&lastCID, &lastBalance)
+func getLast(s *postingStmts, tx *sql.Tx, accountID string) (lastCID int64, lastBalance int64, err error) {
+	if s.getLastOutside {
+		tx = nil
+	}
+	err = s.getLast.queryRow(tx, accountID).Scan(&lastCID, &lastBalance)
 
 	if err == sql.ErrNoRows {
 		err = nil
@@ -144,15 +199,19 @@ func getLast(tx *sql.Tx, accountID string) (lastCID int64, lastBalance int64, er
 	return
 }
 
-func doPosting(tx *sql.Tx, req postingRequest) error {
+// doPosting inserts a posting in tx. The last balances are read from the
+// read replicas if --read-url is set, outside of the transaction: a stale
+// read then causes an integrity violation of the causality IDs instead of a
+// wrong balance.
+func doPosting(s *postingStmts, tx *sql.Tx, req postingRequest) error {
 	var cidA, balA, cidB, balB int64
 	if !*noRunningBalance {
 		var err error
-		cidA, balA, err = getLast(tx, req.AccountA)
+		cidA, balA, err = getLast(s, tx, req.AccountA)
 		if err != nil {
 			return err
 		}
-		cidB, balB, err = getLast(tx, req.AccountB)
+		cidB, balB, err = getLast(s, tx, req.AccountB)
 		if err != nil {
 			return err
 		}
@@ -164,69 +223,148 @@ func doPosting(tx *sql.Tx, req postingRequest) error {
 		balA = -req.Amount
 		balB = req.Amount
 	}
-	_, err := tx.Exec(`
-INSERT INTO accounts (
-  posting_group_id,
-  amount,
-  account_id,
-  causality_id, -- strictly increasing in absolute time. Only used for running balance.
-  balance
-)
-VALUES (
-  $1,	-- posting_group_id
-  $2, 	-- amount
-  $3, 	-- account_id (A)
-  $4, 	-- causality_id
-  $5+CAST($2 AS BIGINT) -- (new) balance (Postgres needs the cast)
-), (
-  $1,   -- posting_group_id
- -$2,   -- amount
-  $6,   -- account_id (B)
-  $7,   -- causality_id
-  $8-$2 -- (new) balance
-)`, req.Group, req.Amount,
+	_, err := s.insert.exec(tx, req.Group, req.Amount,
 		req.AccountA, cidA+1, balA,
 		req.AccountB, cidB+1, balB)
 	return err
 }
 
-func worker(db *sql.DB, l func(string, ...interface{}), gen func() postingRequest) {
-	for {
-		req := gen()
-		l("running %v", req)
-		if err := crdb.ExecuteTx(db, func(tx *sql.Tx) error {
-			return doPosting(tx, req)
-		}); err != nil {
-			pqErr, ok := err.(*pq.Error)
-			if ok {
-				if pqErr.Code.Class() == pq.ErrorClass("23") {
-					// Integrity violations. Note that (especially with Postgres)
-					// the primary key will often be violated under congestion.
-					l("%s", pqErr)
-					continue
-				}
-				if pqErr.Code.Class() == pq.ErrorClass("40") {
-					// Transaction rollback errors (e.g. Postgres
-					// serializability restarts)
-					l("%s", pqErr)
-					continue
-				}
+// A logger logs the events of a worker, prefixed with its number. Debug
+// events are only logged with --verbose; callers check debug before
+// logging them, so that their arguments aren't even boxed otherwise.
+type logger struct {
+	prefix string
+	debug  bool
+}
+
+func (l *logger) printf(format string, args ...interface{}) {
+	log.Printf(l.prefix+format, args...)
+}
+
+// A worker runs the posting requests it receives. It allocates as little as
+// possible per request, so that the client doesn't become the bottleneck
+// before the database does.
+type worker struct {
+	num int
+	// node is the host:port of db, which --chaos may cut the worker off
+	// from.
+	node  string
+	db    *sql.DB
+	stmts *postingStmts
+	d     dialect.Dialect
+	l     *logger
+	hist  *workerHistory
+	// req is the request being run by post, which is passed to ExecuteTx
+	// as a method value created once rather than a closure per request.
+	req  postingRequest
+	post func(*sql.Tx) error
+}
+
+func newWorker(db *sql.DB, node string, stmts *postingStmts, d dialect.Dialect, num int,
+	hist *workerHistory) *worker {
+	w := &worker{
+		num:   num,
+		node:  node,
+		db:    db,
+		stmts: stmts,
+		d:     d,
+		l:     &logger{prefix: strconv.Itoa(num) + ": ", debug: *verbose},
+		hist:  hist,
+	}
+	w.post = w.doPosting
+	return w
+}
+
+func (w *worker) doPosting(tx *sql.Tx) error {
+	if err := doPosting(w.stmts, tx, w.req); err != nil {
+		return err
+	}
+	faults.BeforeCommit()
+	return nil
+}
+
+// run runs the requests received on reqs, each once ctl lets the worker
+// through, until reqs is closed or stop is.
+func (w *worker) run(ctl *control.Controller, reqs <-chan postingRequest, stop <-chan struct{}, wg *sync.WaitGroup) {
+	defer wg.Done()
+	for ctl.Wait(w.num, stop) {
+		var ok bool
+		select {
+		case w.req, ok = <-reqs:
+		case <-stop:
+		}
+		if !ok {
+			return
+		}
+		if err := faults.Reach(w.node); err != nil {
+			atomic.AddUint64(&numOps, 1)
+			atomic.AddUint64(&numErrors, 1)
+			w.l.printf("%s", err)
+			continue
+		}
+		if w.l.debug {
+			w.l.printf("running %v", w.req)
+		}
+		world.RLock()
+		start := time.Now()
+		err := w.d.ExecuteTx(w.db, w.post)
+		latency := time.Since(start)
+		w.hist.add(w.req, err)
+		world.RUnlock()
+		atomic.AddUint64(&numOps, 1)
+		if err != nil {
+			atomic.AddUint64(&numErrors, 1)
+			switch w.d.Classify(err) {
+			case dialect.IntegrityError, dialect.RetryError:
+				// Integrity violations and transaction rollbacks are
+				// expected under contention.
+				w.l.printf("%s", err)
+				continue
 			}
 			log.Fatal(err)
 		} else {
-			if *verbose {
-				l("success")
+			if w.l.debug {
+				w.l.printf("success")
 			}
 			counter.Incr(1)
+			latencies.record(latency)
+			ctl.Record(latency)
 		}
 	}
 }
 
+// openDB opens a handle to the database of the example at dbURL.
+func openDB(dbURL string) (*sql.DB, error) {
+	parsedURL, err := url.Parse(dbURL)
+	if err != nil {
+		return nil, err
+	}
+	parsedURL.Path = "/" + *dbName
+
+	if *driver == "mysql" {
+		dataSource, err := dialect.MySQLDataSource(parsedURL)
+		if err != nil {
+			return nil, err
+		}
+		db, err := sql.Open("mysql", dataSource)
+		if err != nil {
+			return nil, err
+		}
+		if err := dbdriver.Wait(db); err != nil {
+			_ = db.Close()
+			return nil, err
+		}
+		return db, nil
+	}
+	return dbdriver.Open(*driver, parsedURL.String())
+}
+
 func main() {
 	flag.Usage = usage
 	flag.Parse()
+	control.Coordinate(flag.Args())
 
-	if flag.NArg() != 1 {
+	if flag.NArg() > 1 {
 		usage()
 		os.Exit(2)
 	}
@@ -237,44 +375,168 @@ func main() {
 		os.Exit(2)
 	}
 
-	dbURL := flag.Arg(0)
+	if err := capture.Check(); err != nil {
+		log.Fatal(err)
+	}
+	if *historyWindow < 0 {
+		log.Fatalf("Value of 'history-window' flag (%d) must be greater than or equal to 0", *historyWindow)
+	}
+	if *latencyWindow < time.Second {
+		log.Fatalf("Value of 'latency-window' flag (%s) must be at least 1s", *latencyWindow)
+	}
+	latencies = newRollingLatencies(*latencyWindow)
+	var err error
+	var csv *os.File
+	if *csvFile != "" {
+		if csv, err = os.Create(*csvFile); err != nil {
+			log.Fatal(err)
+		}
+	}
 
-	parsedURL, err := url.Parse(dbURL)
+	if !identRE.MatchString(*dbName) {
+		log.Fatalf("invalid --db %q", *dbName)
+	}
+	if !identRE.MatchString(accounts()) {
+		log.Fatalf("invalid --table-prefix %q", *tablePrefix)
+	}
+
+	dbURL, err := dbdriver.URL(flag.Arg(0), "")
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	db, err := sql.Open("postgres", parsedURL.String())
+	db, err := openDB(dbURL)
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer func() { _ = db.Close() }()
 
+	var readDB *sql.DB
+	if *readURL != "" {
+		if readDB, err = openDB(*readURL); err != nil {
+			log.Fatal(err)
+		}
+		defer func() { _ = readDB.Close() }()
+		log.Print("reading balances from --read-url")
+	}
+
+	d, err := dialect.Detect(db)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("running against %s", d.Name())
+
+	if *checkOnly {
+		n, err := check(db, d)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if n > 0 {
+			log.Fatalf("found %d anomalies", n)
+		}
+		log.Print("found no anomalies")
+		return
+	}
+
 	// Ignoring the error is the easiest way to be reasonably sure the db+table
 	// exist without bloating the example.
-	_, _ = db.Exec(`CREATE DATABASE ledger`)
-	if _, err := db.Exec(stmtCreate); err != nil {
-		log.Print(err)
+	_, _ = db.Exec(`CREATE DATABASE ` + *dbName)
+	stmts := []string{fmt.Sprintf(schema, d.StringType(), accounts())}
+	for _, index := range indexes {
+		stmts = append(stmts, fmt.Sprintf(index, accounts()))
+	}
+	for _, stmt := range stmts {
+		if _, err := db.Exec(stmt); err != nil {
+			log.Print(err)
+		}
 	}
 
 	//db.SetMaxOpenConns(*concurrency)
 
+	prepared := *prepare
+	if prepared && dbdriver.Pooler() {
+		log.Print("not preparing statements behind a pooler")
+		prepared = false
+	}
+	statements, err := newPostingStmts(db, readDB, d, prepared)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	reqs := make(chan postingRequest)
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	var histories workerHistories
+	parsedURL, err := url.Parse(dbURL)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var ctl *control.Controller
+	spawn := func(i int) {
+		wg.Add(1)
+		w := newWorker(db, parsedURL.Host, statements, d, i, histories.add(*historyWindow))
+		go w.run(ctl, reqs, stop, &wg)
+	}
+	if faults, err = chaos.New(func() (uint64, uint64) {
+		return atomic.LoadUint64(&numOps), atomic.LoadUint64(&numErrors)
+	}); err != nil {
+		log.Fatal(err)
+	}
+	ctl = control.New(*concurrency, spawn, func() (uint64, uint64) {
+		return atomic.LoadUint64(&numOps), atomic.LoadUint64(&numErrors)
+	})
 	for i := 0; i < *concurrency; i++ {
-		num := i
-		go worker(db, func(s string, args ...interface{}) {
-			log.Printf(strconv.Itoa(num)+": "+s, args...)
-		}, gen)
+		spawn(i)
+	}
+	if err := control.Serve(ctl); err != nil {
+		log.Fatal(err)
 	}
+	if err := control.ServeREST(ctl); err != nil {
+		log.Fatal(err)
+	}
+	control.Adapt(ctl)
+	control.HandleSignals(ctl)
+	if *checkInterval > 0 {
+		go checkOnline(db, d, &histories, *checkInterval)
+	}
+
+	go report(csv, ctl)
 
+	if capture.Replaying() {
+		start := time.Now()
+		n, err := replay(reqs)
+		if err != nil {
+			log.Fatal(err)
+		}
+		// Every request was taken: release the workers waiting for the
+		// controller too.
+		ctl.Close()
+		close(stop)
+		wg.Wait()
+		log.Printf("replayed %d requests in %s", n, time.Since(start))
+		return
+	}
+
+	rec, err := capture.NewRecorder()
+	if err != nil {
+		log.Fatal(err)
+	}
+	done := make(chan struct{})
 	go func() {
-		t := time.NewTicker(time.Second)
-		for {
-			select {
-			case <-t.C:
-				log.Printf("%d postings/seq", counter.Rate())
-			}
+		if err := generate(gen, reqs, rec, stop, done); err != nil {
+			log.Fatal(err)
 		}
 	}()
-
-	select {} // block until killed
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	<-signals
+	// Flush the recorded requests before exiting.
+	close(stop)
+	<-done
+	if rec != nil {
+		log.Printf("recorded the requests to %s", capture.Path())
+	}
+	if n := ctl.Stats().Sustainable; n > 0 {
+		log.Printf("sustainable concurrency under --target-p99: %d workers", n)
+	}
 }
@@ -0,0 +1,180 @@
+// Copyright 2016 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/examples-go/dialect"
+)
+
+// exitInvariantViolation is the exit code of the example when the online
+// checker finds a broken invariant.
+const exitInvariantViolation = 3
+
+// world is held for reading by the workers while they run a posting, and
+// for writing by the online checker to stop them once it finds a broken
+// invariant.
+var world sync.RWMutex
+
+// A historyEntry is a posting request run by a worker, and its outcome.
+type historyEntry struct {
+	at  time.Time
+	req postingRequest
+	err error
+}
+
+// A workerHistory holds the last postings run by a worker. It is only
+// written by its worker, with world held for reading.
+type workerHistory struct {
+	entries []historyEntry
+	next    int
+}
+
+func newWorkerHistory(size int) *workerHistory {
+	return &workerHistory{entries: make([]historyEntry, 0, size)}
+}
+
+func (h *workerHistory) add(req postingRequest, err error) {
+	if cap(h.entries) == 0 {
+		return
+	}
+	e := historyEntry{at: time.Now(), req: req, err: err}
+	if len(h.entries) < cap(h.entries) {
+		h.entries = append(h.entries, e)
+		return
+	}
+	h.entries[h.next] = e
+	h.next = (h.next + 1) % len(h.entries)
+}
+
+// workerHistories are the histories of the workers, numbered from 0. Workers
+// are added while running when the concurrency is raised.
+type workerHistories struct {
+	mu   sync.Mutex
+	list []*workerHistory
+}
+
+// add returns the history of the next worker, holding its last size
+// postings.
+func (hs *workerHistories) add(size int) *workerHistory {
+	h := newWorkerHistory(size)
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	hs.list = append(hs.list, h)
+	return h
+}
+
+// all returns the histories of the workers started so far.
+func (hs *workerHistories) all() []*workerHistory {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	return append([]*workerHistory(nil), hs.list...)
+}
+
+// window returns the entries of the history, oldest first.
+func (h *workerHistory) window() []historyEntry {
+	return append(append([]historyEntry(nil), h.entries[h.next:]...), h.entries[:h.next]...)
+}
+
+// checkOnline checks the invariants of the accounts table every interval
+// while the workers run: causality IDs are unique per account, and the
+// postings of every posting group sum up to zero. Once one is broken, it
+// stops the workers, dumps the involved postings, the histories of the
+// workers and the timestamp of the database to stderr, and exits.
+func checkOnline(db *sql.DB, d dialect.Dialect, histories *workerHistories, interval time.Duration) {
+	for range time.Tick(interval) {
+		anomalies, err := duplicateCausalityIDs(db, d)
+		if err == nil {
+			var more []anomaly
+			more, err = nonZeroGroups(db, d)
+			anomalies = append(anomalies, more...)
+		}
+		if err != nil {
+			log.Printf("online check: %s", err)
+			continue
+		}
+		if len(anomalies) == 0 {
+			continue
+		}
+		// Never released: the example exits once the dump is done.
+		world.Lock()
+		if err := dump(os.Stderr, db, d, anomalies, histories.all()); err != nil {
+			log.Print(err)
+		}
+		os.Exit(exitInvariantViolation)
+	}
+}
+
+// dump writes the anomalies found, the postings of the posting groups
+// involved, the histories of the workers and the timestamp of the database.
+func dump(w io.Writer, db *sql.DB, d dialect.Dialect, anomalies []anomaly, histories []*workerHistory) error {
+	fmt.Fprintf(w, "=== broken invariants, workers stopped\n")
+	var ts string
+	if err := db.QueryRow(`SELECT ` + d.Timestamp()).Scan(&ts); err != nil {
+		fmt.Fprintf(w, "database timestamp: %s\n", err)
+	} else {
+		fmt.Fprintf(w, "database timestamp: %s\n", ts)
+	}
+
+	groups := make(map[int64]bool)
+	for _, a := range anomalies {
+		fmt.Fprintf(w, "%s\n", a)
+		for _, g := range a.groups {
+			groups[g] = true
+		}
+	}
+
+	fmt.Fprintf(w, "=== postings of the posting groups involved\n")
+	for g := range groups {
+		query, args := d.Bind(`SELECT account_id, causality_id, posting_group_id, amount, balance FROM `+
+			accounts()+` WHERE posting_group_id = $1 ORDER BY account_id, causality_id`, g)
+		rows, err := db.Query(query, args...)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var p posting
+			if err := rows.Scan(&p.account, &p.cid, &p.group, &p.amount, &p.balance); err != nil {
+				_ = rows.Close()
+				return err
+			}
+			fmt.Fprintf(w, "group %d: account %s, causality ID %d, amount %d, balance %d\n",
+				p.group, p.account, p.cid, p.amount, p.balance)
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+	}
+
+	for i, h := range histories {
+		fmt.Fprintf(w, "=== last postings of worker %d\n", i)
+		for _, e := range h.window() {
+			outcome := "ok"
+			if e.err != nil {
+				outcome = e.err.Error()
+			}
+			fmt.Fprintf(w, "%s %+v: %s\n", e.at.Format(time.RFC3339Nano), e.req, outcome)
+		}
+	}
+	return nil
+}
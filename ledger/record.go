@@ -0,0 +1,53 @@
+// Copyright 2016 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/cockroachdb/examples-go/capture"
+)
+
+// generate sends the requests of gen to the workers until stop is closed.
+// The requests are also recorded with rec, which is closed before done is.
+func generate(gen genFn, reqs chan<- postingRequest, rec *capture.Recorder, stop <-chan struct{}, done chan<- struct{}) error {
+	defer close(done)
+	for {
+		req := gen()
+		select {
+		case reqs <- req:
+		case <-stop:
+			return rec.Close()
+		}
+		if err := rec.Record(req); err != nil {
+			return err
+		}
+	}
+}
+
+// replay sends the requests recorded with --replay to the workers. It
+// closes reqs once done, and returns the number of requests sent.
+func replay(reqs chan<- postingRequest) (int, error) {
+	defer close(reqs)
+	return capture.Replay(func(op json.RawMessage) error {
+		var req postingRequest
+		if err := json.Unmarshal(op, &req); err != nil {
+			return err
+		}
+		reqs <- req
+		return nil
+	})
+}
@@ -0,0 +1,85 @@
+// Copyright 2016 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/cockroachdb/examples-go/capture"
+)
+
+func TestRecordReplay(t *testing.T) {
+	f, err := ioutil.TempFile("", "record")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.Remove(f.Name()) }()
+	_ = f.Close()
+	rec, err := capture.Create(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var group int64
+	gen := func() postingRequest {
+		group++
+		req := goldenReq
+		req.Group = group
+		return req
+	}
+	reqs := make(chan postingRequest)
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	errCh := make(chan error, 1)
+	go func() { errCh <- generate(gen, reqs, rec, stop, done) }()
+	var recorded []postingRequest
+	for i := 0; i < 3; i++ {
+		recorded = append(recorded, <-reqs)
+	}
+	close(stop)
+	<-done
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+
+	if err := flag.Set("replay", f.Name()); err != nil {
+		t.Fatal(err)
+	}
+	if err := flag.Set("replay-speed", "0"); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = flag.Set("replay", "")
+		_ = flag.Set("replay-speed", "1")
+	}()
+	reqs = make(chan postingRequest)
+	go func() {
+		if _, err := replay(reqs); err != nil {
+			t.Error(err)
+		}
+	}()
+	var replayed []postingRequest
+	for req := range reqs {
+		replayed = append(replayed, req)
+	}
+	if !reflect.DeepEqual(replayed, recorded) {
+		t.Errorf("expected %v, got %v", recorded, replayed)
+	}
+}
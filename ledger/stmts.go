@@ -0,0 +1,156 @@
+// Copyright 2016 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+
+	"github.com/cockroachdb/examples-go/dialect"
+)
+
+// At tens of thousands of postings per second, parsing the statements of
+// every posting is a significant part of the work of the database.
+var prepare = flag.Bool("prepare", true, "Prepare the statements of the postings once per connection "+
+	"instead of sending their text with every posting. Disabled with --pooler.")
+
+// getLastQuery reads the last posting of account $1.
+const getLastQuery = `SELECT causality_id, balance FROM %s WHERE account_id = $1 ORDER BY causality_id DESC LIMIT 1`
+
+// insertQuery inserts the two postings of a posting group.
+const insertQuery = `
+INSERT INTO %[1]s (
+  posting_group_id,
+  amount,
+  account_id,
+  causality_id, -- strictly increasing in absolute time. Only used for running balance.
+  balance
+)
+VALUES (
+  $1,	-- posting_group_id
+  $2, 	-- amount
+  $3, 	-- account_id (A)
+  $4, 	-- causality_id
+  $5+%[2]s -- (new) balance (Postgres needs the cast)
+), (
+  $1,   -- posting_group_id
+ -$2,   -- amount
+  $6,   -- account_id (B)
+  $7,   -- causality_id
+  $8-$2 -- (new) balance
+)`
+
+// A statement is a statement of the postings bound for the dialect and, with
+// --prepare, prepared on db, where database/sql prepares it once per
+// connection.
+type statement struct {
+	db    *sql.DB
+	query string
+	// order holds the indexes of the arguments in the order the dialect
+	// binds them, unless it binds them as they are.
+	order []int
+	stmt  *sql.Stmt
+}
+
+func newStatement(db *sql.DB, d dialect.Dialect, query string, numArgs int, prepared bool) (*statement, error) {
+	// Binding the indexes of the arguments gives the order in which the
+	// dialect binds them, so that it's only done once.
+	indexes := make([]interface{}, numArgs)
+	for i := range indexes {
+		indexes[i] = i
+	}
+	query, order := d.Bind(query, indexes...)
+	s := &statement{db: db, query: query, order: make([]int, len(order))}
+	identity := len(order) == numArgs
+	for i, index := range order {
+		s.order[i] = index.(int)
+		identity = identity && s.order[i] == i
+	}
+	if identity {
+		s.order = nil
+	}
+	if prepared {
+		var err error
+		if s.stmt, err = db.Prepare(query); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// bind returns the arguments in the order the dialect binds them.
+func (s *statement) bind(args []interface{}) []interface{} {
+	if s.order == nil {
+		return args
+	}
+	bound := make([]interface{}, len(s.order))
+	for i, index := range s.order {
+		bound[i] = args[index]
+	}
+	return bound
+}
+
+// queryRow runs the statement in tx or, if tx is nil, on the db of the
+// statement.
+func (s *statement) queryRow(tx *sql.Tx, args ...interface{}) *sql.Row {
+	args = s.bind(args)
+	switch {
+	case tx != nil && s.stmt != nil:
+		return tx.Stmt(s.stmt).QueryRow(args...)
+	case tx != nil:
+		return tx.QueryRow(s.query, args...)
+	case s.stmt != nil:
+		return s.stmt.QueryRow(args...)
+	}
+	return s.db.QueryRow(s.query, args...)
+}
+
+// exec runs the statement in tx.
+func (s *statement) exec(tx *sql.Tx, args ...interface{}) (sql.Result, error) {
+	args = s.bind(args)
+	if s.stmt != nil {
+		return tx.Stmt(s.stmt).Exec(args...)
+	}
+	return tx.Exec(s.query, args...)
+}
+
+// postingStmts are the statements of the postings.
+type postingStmts struct {
+	// getLast reads the last posting of an account, in the transaction of
+	// the posting or, with --read-url, from the read replicas outside of
+	// it.
+	getLast        *statement
+	getLastOutside bool
+	insert         *statement
+}
+
+func newPostingStmts(db, readDB *sql.DB, d dialect.Dialect, prepared bool) (*postingStmts, error) {
+	s := &postingStmts{getLastOutside: readDB != nil}
+	getLastDB := db
+	if readDB != nil {
+		getLastDB = readDB
+	}
+	var err error
+	if s.getLast, err = newStatement(getLastDB, d, fmt.Sprintf(getLastQuery, accounts()), 1, prepared); err != nil {
+		return nil, err
+	}
+	if s.insert, err = newStatement(db, d, fmt.Sprintf(insertQuery, accounts(), d.CastInt("$2")), 8,
+		prepared); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
@@ -0,0 +1,67 @@
+// Copyright 2016 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/cockroachdb/examples-go/dialect"
+)
+
+func TestStatementBind(t *testing.T) {
+	s, err := newStatement(nil, dialect.MySQL, `SELECT $2, $1 + $2`, 2, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := `SELECT ?, ? + ?`; s.query != expected {
+		t.Errorf("expected %q, got %q", expected, s.query)
+	}
+	if args := s.bind([]interface{}{"a", "b"}); !reflect.DeepEqual(args, []interface{}{"b", "a", "b"}) {
+		t.Errorf("unexpected arguments %v", args)
+	}
+
+	s, err = newStatement(nil, dialect.Cockroach, `SELECT $2, $1 + $2`, 2, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if args := s.bind([]interface{}{"a", "b"}); !reflect.DeepEqual(args, []interface{}{"a", "b"}) {
+		t.Errorf("unexpected arguments %v", args)
+	}
+}
+
+func TestGeneratorAllocs(t *testing.T) {
+	for _, name := range []string{"few-few", "few-one"} {
+		gen := generators[name]
+		if allocs := testing.AllocsPerRun(100, func() { _ = gen() }); allocs != 0 {
+			t.Errorf("%s: expected no allocation per request, got %.1f", name, allocs)
+		}
+	}
+}
+
+func benchmarkGenerator(b *testing.B, name string) {
+	gen := generators[name]
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_ = gen()
+	}
+}
+
+func BenchmarkManyMany(b *testing.B) { benchmarkGenerator(b, "many-many") }
+
+func BenchmarkFewFew(b *testing.B) { benchmarkGenerator(b, "few-few") }
+
+func BenchmarkFewOne(b *testing.B) { benchmarkGenerator(b, "few-one") }
@@ -0,0 +1,78 @@
+// Copyright 2016 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+// Package opstats accumulates the latencies and errors of the operations of
+// the examples between two reports of their progress.
+package opstats
+
+import (
+	"sync"
+	"time"
+
+	"github.com/codahale/hdrhistogram"
+)
+
+// A Stats tracks the latencies of one type of operation, the number of
+// them that failed and the sum of their results. It is safe for concurrent
+// use.
+type Stats struct {
+	mu     sync.Mutex
+	max    time.Duration
+	hist   *hdrhistogram.Histogram
+	sum    int64
+	errors int
+}
+
+// New returns stats recording latencies of up to max.
+func New(max time.Duration) *Stats {
+	return &Stats{max: max, hist: hdrhistogram.New(0, int64(max), 1)}
+}
+
+// Record records an operation started at start, which failed if err is
+// not nil.
+func (s *Stats) Record(start time.Time, err error) {
+	s.RecordResult(start, 0, err)
+}
+
+// RecordResult records an operation like Record, adding the result of a
+// successful one to the sum returned by SnapshotSum.
+func (s *Stats) RecordResult(start time.Time, result int, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		s.errors++
+		return
+	}
+	_ = s.hist.RecordValue(int64(time.Since(start)))
+	s.sum += int64(result)
+}
+
+// Snapshot returns the latencies and the number of errors accumulated since
+// the last snapshot, and resets them.
+func (s *Stats) Snapshot() (*hdrhistogram.Histogram, int) {
+	hist, _, errors := s.SnapshotSum()
+	return hist, errors
+}
+
+// SnapshotSum returns the latencies, the sum of the results and the number
+// of errors accumulated since the last snapshot, and resets them.
+func (s *Stats) SnapshotSum() (*hdrhistogram.Histogram, int64, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	hist, sum, errors := s.hist, s.sum, s.errors
+	s.hist = hdrhistogram.New(0, int64(s.max), 1)
+	s.sum, s.errors = 0, 0
+	return hist, sum, errors
+}
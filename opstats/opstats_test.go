@@ -0,0 +1,38 @@
+// Copyright 2016 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package opstats
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestStats(t *testing.T) {
+	s := New(time.Minute)
+	start := time.Now()
+	s.RecordResult(start, 3, nil)
+	s.RecordResult(start, 4, nil)
+	s.RecordResult(start, 5, errors.New("boom"))
+	s.Record(start, errors.New("boom"))
+
+	if _, sum, errs := s.SnapshotSum(); sum != 7 || errs != 2 {
+		t.Errorf("expected a sum of 7 and 2 errors, got %d and %d", sum, errs)
+	}
+	if _, errs := s.Snapshot(); errs != 0 {
+		t.Errorf("expected the errors to be reset, got %d", errs)
+	}
+}
@@ -0,0 +1,359 @@
+// Copyright 2016 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+// The outbox example implements the transactional outbox pattern.
+// Writers update an aggregate (an order) and append an event describing
+// the change to the `outbox` table in the same transaction. Relays poll
+// the outbox for unpublished events, hand them to a sink and mark them
+// as published.
+//
+// Each relay owns a disjoint subset of the aggregates and publishes
+// their events in sequence order, so delivery is expected to be
+// exactly-once and in order per aggregate. A verifier observes every
+// published event; when the run ends (after --duration or on interrupt)
+// the writers are stopped, the outbox is drained and the deliveries are
+// checked against the final version of every aggregate.
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/cockroachdb/examples-go/dbdriver"
+	// Import postgres driver.
+	_ "github.com/cockroachdb/pq"
+)
+
+var numAggregates = flag.Int("aggregates", 1000, "Number of aggregates (orders).")
+var writers = flag.Int("writers", 8, "Number of concurrent writers.")
+var relays = flag.Int("relays", 2, "Number of concurrent relays.")
+var batchSize = flag.Int("batch-size", 100, "Maximum number of events published per relay batch.")
+var pollInterval = flag.Duration("poll-interval", 50*time.Millisecond, "Interval at which idle relays poll the outbox.")
+var sinkType = flag.String("sink", "log", "Event sink. One of log, file or kafka.")
+var sinkFile = flag.String("sink-file", "outbox.events", "Output file of the file sink.")
+var kafkaTopic = flag.String("kafka-topic", "outbox", "Topic of the kafka sink.")
+var kafkaPartitions = flag.Int("kafka-partitions", 8, "Number of partitions of the kafka sink.")
+var duration = flag.Duration("duration", 0, "Duration of the run before verifying deliveries. 0 runs until interrupted.")
+var outputInterval = flag.Duration("output-interval", 1*time.Second, "Interval of output.")
+var driver = flag.String("driver", "postgres", dbdriver.Usage)
+
+const schema = `
+CREATE TABLE IF NOT EXISTS orders (
+  id      INT PRIMARY KEY,
+  version INT NOT NULL,
+  state   STRING NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS outbox (
+  id           INT NOT NULL DEFAULT unique_rowid() PRIMARY KEY,
+  aggregate_id INT NOT NULL,
+  seq          INT NOT NULL,
+  payload      STRING NOT NULL,
+  published    BOOL NOT NULL DEFAULT false,
+  UNIQUE (aggregate_id, seq),
+  INDEX (published, aggregate_id, seq)
+);
+`
+
+var states = []string{"created", "paid", "packed", "shipped", "delivered"}
+
+var numWritten, numPublished uint64
+
+// updateOrder advances an order and records the change in the outbox.
+func updateOrder(db *sql.DB, r *rand.Rand) error {
+	id := r.Intn(*numAggregates)
+	state := states[r.Intn(len(states))]
+	return dbdriver.ExecuteTx(db, func(tx *sql.Tx) error {
+		var version int64
+		err := tx.QueryRow(`SELECT version FROM orders WHERE id = $1`, id).Scan(&version)
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+		version++
+		if _, err := tx.Exec(`UPSERT INTO orders (id, version, state) VALUES ($1, $2, $3)`,
+			id, version, state); err != nil {
+			return err
+		}
+		_, err = tx.Exec(`INSERT INTO outbox (aggregate_id, seq, payload) VALUES ($1, $2, $3)`,
+			id, version, fmt.Sprintf("order %d is %s", id, state))
+		return err
+	})
+}
+
+func write(db *sql.DB, stop <-chan struct{}, wg *sync.WaitGroup) {
+	defer wg.Done()
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		if err := updateOrder(db, r); err != nil {
+			log.Print(err)
+			continue
+		}
+		atomic.AddUint64(&numWritten, 1)
+	}
+}
+
+// relayBatch publishes the next batch of unpublished events of the
+// aggregates owned by the given relay. It returns the number of events
+// published.
+func relayBatch(db *sql.DB, s sink, relay int) (int, error) {
+	rows, err := db.Query(`
+SELECT id, aggregate_id, seq, payload FROM outbox
+  WHERE published = false AND aggregate_id % $1 = $2
+  ORDER BY aggregate_id, seq
+  LIMIT $3`, *relays, relay, *batchSize)
+	if err != nil {
+		return 0, err
+	}
+	var events []event
+	for rows.Next() {
+		var e event
+		if err := rows.Scan(&e.id, &e.aggregateID, &e.seq, &e.payload); err != nil {
+			_ = rows.Close()
+			return 0, err
+		}
+		events = append(events, e)
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	if len(events) == 0 {
+		return 0, nil
+	}
+
+	if err := s.publish(events); err != nil {
+		return 0, err
+	}
+	// If marking the events fails, they will be published again and the
+	// verifier will report duplicates.
+	ids := make([]string, len(events))
+	for i, e := range events {
+		ids[i] = strconv.FormatInt(e.id, 10)
+	}
+	if _, err := db.Exec(`UPDATE outbox SET published = true WHERE id IN (` +
+		strings.Join(ids, ", ") + `)`); err != nil {
+		return 0, err
+	}
+	return len(events), nil
+}
+
+// runRelay publishes events until drain is closed and no events are
+// left to publish.
+func runRelay(db *sql.DB, s sink, relay int, drain <-chan struct{}, wg *sync.WaitGroup) {
+	defer wg.Done()
+	for {
+		n, err := relayBatch(db, s, relay)
+		if err != nil {
+			log.Printf("relay %d: %s", relay, err)
+		}
+		atomic.AddUint64(&numPublished, uint64(n))
+		if n > 0 || err != nil {
+			continue
+		}
+		select {
+		case <-drain:
+			return
+		case <-time.After(*pollInterval):
+		}
+	}
+}
+
+// verify checks the deliveries against the final order versions and the
+// outbox contents.
+func verify(db *sql.DB, v *verifier) error {
+	rows, err := db.Query(`SELECT id, version FROM orders`)
+	if err != nil {
+		return err
+	}
+	expected := map[int64]int64{}
+	for rows.Next() {
+		var id, version int64
+		if err := rows.Scan(&id, &version); err != nil {
+			_ = rows.Close()
+			return err
+		}
+		expected[id] = version
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	var unpublished int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM outbox WHERE published = false`).Scan(&unpublished); err != nil {
+		return err
+	}
+
+	problems := v.check(expected)
+	if unpublished > 0 {
+		problems = append(problems, fmt.Sprintf("%d events were never published", unpublished))
+	}
+	for _, p := range problems {
+		log.Print(p)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%d delivery anomalies among %d published events", len(problems), v.total)
+	}
+	log.Printf("all %d events of %d aggregates were delivered exactly once and in order", v.total, len(expected))
+	return nil
+}
+
+func setupDatabase(db *sql.DB) error {
+	if _, err := db.Exec("CREATE DATABASE IF NOT EXISTS outbox"); err != nil {
+		return err
+	}
+	if _, err := db.Exec(schema); err != nil {
+		return err
+	}
+	// Verification only makes sense for events written during this run.
+	for _, table := range []string{"orders", "outbox"} {
+		if _, err := db.Exec("TRUNCATE TABLE " + table); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func newSink() (sink, error) {
+	switch *sinkType {
+	case "log":
+		return logSink{}, nil
+	case "file":
+		return newFileSink(*sinkFile)
+	case "kafka":
+		return newKafkaSink(*kafkaTopic, *kafkaPartitions), nil
+	default:
+		return nil, fmt.Errorf("unknown sink %q", *sinkType)
+	}
+}
+
+var usage = func() {
+	fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s [<db URL>]\n\n", os.Args[0])
+	flag.PrintDefaults()
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() > 1 {
+		usage()
+		os.Exit(2)
+	}
+
+	if *relays < 1 {
+		log.Fatalf("Value of 'relays' flag (%d) must be greater than or equal to 1", *relays)
+	}
+
+	dbURL, err := dbdriver.URL(flag.Arg(0), "")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	parsedURL, err := url.Parse(dbURL)
+	if err != nil {
+		log.Fatal(err)
+	}
+	parsedURL.Path = "outbox"
+
+	db, err := dbdriver.Open(*driver, parsedURL.String())
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer func() { _ = db.Close() }()
+
+	db.SetMaxOpenConns(*writers + *relays + 1)
+
+	if err := setupDatabase(db); err != nil {
+		log.Fatal(err)
+	}
+
+	s, err := newSink()
+	if err != nil {
+		log.Fatal(err)
+	}
+	v := newVerifier()
+	vs := verifyingSink{sink: s, v: v}
+
+	stopWriters, drain := make(chan struct{}), make(chan struct{})
+	var writerWG, relayWG sync.WaitGroup
+	for i := 0; i < *writers; i++ {
+		writerWG.Add(1)
+		go write(db, stopWriters, &writerWG)
+	}
+	for i := 0; i < *relays; i++ {
+		relayWG.Add(1)
+		go runRelay(db, vs, i, drain, &relayWG)
+	}
+
+	signalCh := make(chan os.Signal, 1)
+	signal.Notify(signalCh, os.Interrupt, syscall.SIGTERM)
+	var done <-chan time.Time
+	if *duration > 0 {
+		done = time.After(*duration)
+	}
+
+	ticker := time.NewTicker(*outputInterval)
+	lastNow := time.Now()
+	var lastWritten, lastPublished uint64
+loop:
+	for {
+		select {
+		case <-ticker.C:
+			now := time.Now()
+			elapsed := now.Sub(lastNow).Seconds()
+			lastNow = now
+			written, published := atomic.LoadUint64(&numWritten), atomic.LoadUint64(&numPublished)
+			log.Printf("%.1f events written/sec, %.1f published/sec, %d behind",
+				float64(written-lastWritten)/elapsed, float64(published-lastPublished)/elapsed,
+				int64(written)-int64(published))
+			lastWritten, lastPublished = written, published
+		case <-signalCh:
+			break loop
+		case <-done:
+			break loop
+		}
+	}
+	ticker.Stop()
+
+	log.Print("stopping writers and draining the outbox")
+	close(stopWriters)
+	writerWG.Wait()
+	close(drain)
+	relayWG.Wait()
+	if err := s.close(); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := verify(db, v); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright 2016 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// verifier checks that events are delivered exactly once and, per
+// aggregate, in sequence order. Sequence numbers of an aggregate start at
+// 1 and have no gaps.
+type verifier struct {
+	mu         sync.Mutex
+	seen       map[int64]map[int64]struct{} // aggregate ID -> delivered seqs
+	last       map[int64]int64              // aggregate ID -> last delivered seq
+	total      int
+	duplicates []event
+	reordered  []event
+}
+
+func newVerifier() *verifier {
+	return &verifier{
+		seen: map[int64]map[int64]struct{}{},
+		last: map[int64]int64{},
+	}
+}
+
+// deliver records the delivery of an event.
+func (v *verifier) deliver(e event) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.total++
+	seqs, ok := v.seen[e.aggregateID]
+	if !ok {
+		seqs = map[int64]struct{}{}
+		v.seen[e.aggregateID] = seqs
+	}
+	if _, ok := seqs[e.seq]; ok {
+		v.duplicates = append(v.duplicates, e)
+		return
+	}
+	seqs[e.seq] = struct{}{}
+	if e.seq != v.last[e.aggregateID]+1 {
+		v.reordered = append(v.reordered, e)
+	}
+	v.last[e.aggregateID] = e.seq
+}
+
+// check compares the delivered events against the final sequence number
+// of every aggregate and returns a description of every anomaly found.
+func (v *verifier) check(expected map[int64]int64) []string {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	var problems []string
+	for _, e := range v.duplicates {
+		problems = append(problems, fmt.Sprintf("aggregate %d: seq %d delivered more than once", e.aggregateID, e.seq))
+	}
+	for _, e := range v.reordered {
+		problems = append(problems, fmt.Sprintf("aggregate %d: seq %d delivered out of order", e.aggregateID, e.seq))
+	}
+
+	var ids []int64
+	for id := range expected {
+		ids = append(ids, id)
+	}
+	for id := range v.seen {
+		if _, ok := expected[id]; !ok {
+			ids = append(ids, id)
+		}
+	}
+	sort.Sort(int64Slice(ids))
+	for _, id := range ids {
+		if got, want := len(v.seen[id]), expected[id]; int64(got) != want {
+			problems = append(problems, fmt.Sprintf("aggregate %d: delivered %d events, expected %d", id, got, want))
+		}
+	}
+	return problems
+}
+
+type int64Slice []int64
+
+func (s int64Slice) Len() int           { return len(s) }
+func (s int64Slice) Less(i, j int) bool { return s[i] < s[j] }
+func (s int64Slice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
@@ -0,0 +1,65 @@
+// Copyright 2016 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestVerifier(t *testing.T) {
+	testCases := []struct {
+		delivered []event
+		expected  map[int64]int64
+		problems  []string
+	}{
+		{
+			delivered: []event{{aggregateID: 1, seq: 1}, {aggregateID: 2, seq: 1}, {aggregateID: 1, seq: 2}},
+			expected:  map[int64]int64{1: 2, 2: 1},
+		},
+		{
+			delivered: []event{{aggregateID: 1, seq: 1}, {aggregateID: 1, seq: 1}},
+			expected:  map[int64]int64{1: 1},
+			problems:  []string{"aggregate 1: seq 1 delivered more than once"},
+		},
+		{
+			delivered: []event{{aggregateID: 1, seq: 2}, {aggregateID: 1, seq: 1}},
+			expected:  map[int64]int64{1: 2},
+			problems: []string{
+				"aggregate 1: seq 2 delivered out of order",
+				"aggregate 1: seq 1 delivered out of order",
+			},
+		},
+		{
+			delivered: []event{{aggregateID: 1, seq: 1}},
+			expected:  map[int64]int64{1: 3, 2: 1},
+			problems: []string{
+				"aggregate 1: delivered 1 events, expected 3",
+				"aggregate 2: delivered 0 events, expected 1",
+			},
+		},
+	}
+
+	for i, tc := range testCases {
+		v := newVerifier()
+		for _, e := range tc.delivered {
+			v.deliver(e)
+		}
+		if problems := v.check(tc.expected); !reflect.DeepEqual(problems, tc.problems) {
+			t.Errorf("%d: expected %q, got %q", i, tc.problems, problems)
+		}
+	}
+}
@@ -0,0 +1,322 @@
+// Copyright 2016 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+// The pagination example compares two ways of paging through a large
+// table while it is being modified:
+//
+// - "offset": SELECT ... ORDER BY id LIMIT n OFFSET m
+// - "keyset": SELECT ... WHERE id > last ORDER BY id LIMIT n
+//
+// The table is populated with even IDs only, which are never modified
+// afterwards. Concurrent writers keep inserting and deleting odd IDs.
+// Every complete pass over the table must therefore see each even ID
+// exactly once; any even ID that is missing is reported as skipped, and
+// any ID returned twice is reported as duplicated. Latencies are
+// reported per strategy and page depth.
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/examples-go/dbdriver"
+	"github.com/cockroachdb/examples-go/opstats"
+	"github.com/codahale/hdrhistogram"
+	// Import postgres driver.
+	_ "github.com/cockroachdb/pq"
+)
+
+var numRows = flag.Int("rows", 100000, "Number of stable rows in the table.")
+var pageSize = flag.Int("page-size", 100, "Number of rows per page.")
+var strategy = flag.String("strategy", "both", "Pagination strategy. One of offset, keyset or both.")
+var readers = flag.Int("readers", 4, "Number of concurrent paginators per strategy.")
+var writers = flag.Int("writers", 4, "Number of concurrent writers inserting and deleting rows.")
+var outputInterval = flag.Duration("output-interval", 5*time.Second, "Interval of output.")
+var driver = flag.String("driver", "postgres", dbdriver.Usage)
+
+// A pager fetches the page following the given one. lastID is the
+// largest ID returned so far and offset the number of rows returned so
+// far; each strategy uses only one of them.
+type pager func(db *sql.DB, lastID int64, offset int) ([]int64, error)
+
+var pagers = map[string]pager{
+	"offset": func(db *sql.DB, _ int64, offset int) ([]int64, error) {
+		return queryIDs(db, `SELECT id FROM items ORDER BY id LIMIT $1 OFFSET $2`, *pageSize, offset)
+	},
+	"keyset": func(db *sql.DB, lastID int64, _ int) ([]int64, error) {
+		return queryIDs(db, `SELECT id FROM items WHERE id > $1 ORDER BY id LIMIT $2`, lastID, *pageSize)
+	},
+}
+
+func queryIDs(db *sql.DB, query string, args ...interface{}) ([]int64, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// depthBuckets are the upper bounds (exclusive) of the page number
+// buckets latencies are reported in.
+var depthBuckets = []int{10, 100, 1000, 10000, 100000}
+
+func depthBucket(page int) int {
+	for i, bound := range depthBuckets {
+		if page < bound {
+			return i
+		}
+	}
+	return len(depthBuckets)
+}
+
+func depthBucketName(i int) string {
+	lower := 0
+	if i > 0 {
+		lower = depthBuckets[i-1]
+	}
+	if i == len(depthBuckets) {
+		return fmt.Sprintf("pages %d+", lower)
+	}
+	return fmt.Sprintf("pages %d-%d", lower, depthBuckets[i]-1)
+}
+
+// strategyStats accumulates the results of one pagination strategy.
+type strategyStats struct {
+	sync.Mutex
+	depths     []*opstats.Stats
+	errors     int
+	passes     int
+	skipped    int
+	duplicated int
+}
+
+func newStrategyStats() *strategyStats {
+	s := &strategyStats{depths: make([]*opstats.Stats, len(depthBuckets)+1)}
+	for i := range s.depths {
+		s.depths[i] = opstats.New(time.Minute)
+	}
+	return s
+}
+
+var stats = map[string]*strategyStats{}
+
+// paginate repeatedly pages through the whole table, checking each pass
+// for skipped and duplicated rows.
+func paginate(db *sql.DB, name string, p pager, s *strategyStats) {
+	for {
+		seen := make(map[int64]int, *numRows)
+		var lastID int64 = -1
+		offset := 0
+		failed := false
+		for page := 0; ; page++ {
+			start := time.Now()
+			ids, err := p(db, lastID, offset)
+			s.depths[depthBucket(page)].Record(start, err)
+			if err != nil {
+				log.Printf("%s: page %d failed: %s", name, page, err)
+				failed = true
+				break
+			}
+			for _, id := range ids {
+				seen[id]++
+			}
+			if len(ids) < *pageSize {
+				break
+			}
+			lastID = ids[len(ids)-1]
+			offset += len(ids)
+		}
+		if failed {
+			continue
+		}
+
+		var skipped, duplicated int
+		for i := 0; i < *numRows; i++ {
+			if seen[int64(2*i)] == 0 {
+				skipped++
+			}
+		}
+		for _, count := range seen {
+			if count > 1 {
+				duplicated++
+			}
+		}
+		if skipped > 0 || duplicated > 0 {
+			log.Printf("%s: pass saw %d skipped and %d duplicated rows", name, skipped, duplicated)
+		}
+		s.Lock()
+		s.passes++
+		s.skipped += skipped
+		s.duplicated += duplicated
+		s.Unlock()
+	}
+}
+
+// write inserts or deletes random odd IDs, shifting the positions of the
+// stable even rows.
+func write(db *sql.DB) {
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	for {
+		id := 2*r.Int63n(int64(*numRows)) + 1
+		var err error
+		if r.Intn(2) == 0 {
+			_, err = db.Exec(`INSERT INTO items (id, value) VALUES ($1, 'churn') ON CONFLICT (id) DO NOTHING`, id)
+		} else {
+			_, err = db.Exec(`DELETE FROM items WHERE id = $1`, id)
+		}
+		if err != nil {
+			log.Print(err)
+		}
+	}
+}
+
+// setupDatabase creates a fresh items table holding the stable rows.
+func setupDatabase(db *sql.DB) error {
+	if _, err := db.Exec("CREATE DATABASE IF NOT EXISTS pagination"); err != nil {
+		return err
+	}
+	if _, err := db.Exec("DROP TABLE IF EXISTS items"); err != nil {
+		return err
+	}
+	if _, err := db.Exec("CREATE TABLE items (id INT PRIMARY KEY, value STRING NOT NULL)"); err != nil {
+		return err
+	}
+	const batchSize = 10000
+	for i := 0; i < *numRows; i += batchSize {
+		end := i + batchSize
+		if end > *numRows {
+			end = *numRows
+		}
+		if _, err := db.Exec(`INSERT INTO items (id, value) `+
+			`SELECT 2*i, 'stable' FROM GENERATE_SERIES($1, $2) AS g(i)`, i, end-1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var usage = func() {
+	fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s [<db URL>]\n\n", os.Args[0])
+	flag.PrintDefaults()
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() > 1 {
+		usage()
+		os.Exit(2)
+	}
+
+	var strategies []string
+	switch *strategy {
+	case "both":
+		strategies = []string{"offset", "keyset"}
+	case "offset", "keyset":
+		strategies = []string{*strategy}
+	default:
+		usage()
+		os.Exit(2)
+	}
+	if *pageSize < 1 {
+		log.Fatalf("Value of 'page-size' flag (%d) must be greater than or equal to 1", *pageSize)
+	}
+	if *numRows < 1 {
+		log.Fatalf("Value of 'rows' flag (%d) must be greater than or equal to 1", *numRows)
+	}
+
+	dbURL, err := dbdriver.URL(flag.Arg(0), "")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	parsedURL, err := url.Parse(dbURL)
+	if err != nil {
+		log.Fatal(err)
+	}
+	parsedURL.Path = "pagination"
+
+	db, err := dbdriver.Open(*driver, parsedURL.String())
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer func() { _ = db.Close() }()
+
+	db.SetMaxOpenConns(*readers*len(strategies) + *writers + 1)
+
+	log.Printf("populating %d rows", *numRows)
+	if err := setupDatabase(db); err != nil {
+		log.Fatal(err)
+	}
+
+	for _, name := range strategies {
+		stats[name] = newStrategyStats()
+		for i := 0; i < *readers; i++ {
+			go paginate(db, name, pagers[name], stats[name])
+		}
+	}
+	for i := 0; i < *writers; i++ {
+		go write(db)
+	}
+
+	lastNow := time.Now()
+	for range time.Tick(*outputInterval) {
+		now := time.Now()
+		elapsed := now.Sub(lastNow)
+		lastNow = now
+
+		for _, name := range strategies {
+			s := stats[name]
+			hists := make([]*hdrhistogram.Histogram, len(s.depths))
+			s.Lock()
+			for i, depth := range s.depths {
+				var errors int
+				hists[i], errors = depth.Snapshot()
+				s.errors += errors
+			}
+			log.Printf("%s: %d passes, %d skipped, %d duplicated, %d errors",
+				name, s.passes, s.skipped, s.duplicated, s.errors)
+			s.Unlock()
+			for i, hist := range hists {
+				if hist.TotalCount() == 0 {
+					continue
+				}
+				log.Printf("  %-16s: %7.1f pages/sec, p50=%s p95=%s p99=%s",
+					depthBucketName(i), float64(hist.TotalCount())/elapsed.Seconds(),
+					time.Duration(hist.ValueAtQuantile(50)),
+					time.Duration(hist.ValueAtQuantile(95)),
+					time.Duration(hist.ValueAtQuantile(99)))
+			}
+		}
+	}
+}
@@ -24,6 +24,7 @@ import (
 	"time"
 
 	"github.com/cockroachdb/cockroach/util"
+	"github.com/cockroachdb/examples-go/dbdriver"
 	// Import postgres driver.
 	_ "github.com/cockroachdb/pq"
 )
@@ -53,6 +54,8 @@ CREATE TABLE IF NOT EXISTS photos (
   latitude     FLOAT,
   longitude    FLOAT,
   timestamp    TIMESTAMP,
+  likeCount    INT,
+  data         BYTES,
 
   PRIMARY KEY (id),
   UNIQUE INDEX byUserID (userID, timestamp)
@@ -66,12 +69,33 @@ CREATE TABLE IF NOT EXISTS comments (
   timestamp TIMESTAMP,
 
   PRIMARY KEY (photoID, timestamp, commentID)
+);
+
+CREATE TABLE IF NOT EXISTS photoChunks (
+  photoID BYTES,
+  chunk   INT,
+  data    BYTES,
+
+  PRIMARY KEY (photoID, chunk)
+);
+
+CREATE TABLE IF NOT EXISTS likes (
+  photoID   BYTES,
+  likeID    BYTES DEFAULT uuid_v4(),
+  userID    INT,
+  timestamp TIMESTAMP,
+
+  PRIMARY KEY (photoID, likeID)
 );`
 )
 
 // openDB opens the database connection according to the context.
 func openDB(ctx Context) (*sql.DB, error) {
-	return sql.Open("postgres", ctx.DBUrl)
+	dbURL, err := dbdriver.URL(ctx.DBUrl, defaultDBUrl)
+	if err != nil {
+		return nil, err
+	}
+	return dbdriver.Open(ctx.Driver, dbURL)
 }
 
 // initSchema creates the database schema if it doesn't exist.
@@ -86,6 +110,18 @@ func dropDatabase(db *sql.DB) error {
 	return err
 }
 
+// randPhotoData returns the image data of a new photo: random bytes of a
+// size picked uniformly between --photo-min-bytes and --photo-max-bytes,
+// or nil if photos have no data.
+func randPhotoData() []byte {
+	if ctx.PhotoMaxBytes == 0 {
+		return nil
+	}
+	data := make([]byte, ctx.PhotoMinBytes+rand.Intn(ctx.PhotoMaxBytes-ctx.PhotoMinBytes+1))
+	_, _ = rand.Read(data)
+	return data
+}
+
 const letterBytes = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
 
 func randString(n int) string {
@@ -158,16 +194,37 @@ func createPhoto(tx *sql.Tx, userID int) error {
 	}
 
 	const insertSQL = `
-INSERT INTO photos VALUES (DEFAULT, $1, 0, $2, $3, $4, NOW());
+INSERT INTO photos VALUES (DEFAULT, $1, 0, $2, $3, $4, NOW(), 0, $5) RETURNING id;
 `
 	const minCaptionLen = 10
 	const maxCaptionLen = 200
 	caption := randString(minCaptionLen + rand.Intn(maxCaptionLen-minCaptionLen))
 	latitude := rand.Float32() * 90
 	longitude := rand.Float32() * 180
-	if _, err := tx.Exec(insertSQL, userID, caption, latitude, longitude); err != nil {
+	data := randPhotoData()
+	var inline []byte
+	if ctx.PhotoStorage == "inline" {
+		inline = data
+	}
+	var photoID []byte
+	if err := tx.QueryRow(insertSQL, userID, caption, latitude, longitude, inline).Scan(&photoID); err != nil {
 		return err
 	}
+	if ctx.PhotoStorage == "chunked" {
+		const insertChunkSQL = `
+INSERT INTO photoChunks VALUES ($1, $2, $3);
+`
+		for i := 0; i*ctx.PhotoChunkBytes < len(data); i++ {
+			end := (i + 1) * ctx.PhotoChunkBytes
+			if end > len(data) {
+				end = len(data)
+			}
+			if _, err := tx.Exec(insertChunkSQL, photoID, i, data[i*ctx.PhotoChunkBytes:end]); err != nil {
+				return err
+			}
+		}
+	}
+	popular.add(photoID)
 
 	const updateSQL = `
 UPDATE users SET photoCount = photoCount + 1 WHERE id = $1;
@@ -186,7 +243,39 @@ func createComment(tx *sql.Tx, userID int) error {
 	if err != nil {
 		return err
 	}
-	authorID := rand.Intn(userID) + 1
+	return addComment(tx, photoID, rand.Intn(userID)+1)
+}
+
+// commentPopularPhoto has the user author a comment on a photo picked
+// by popularity.
+func commentPopularPhoto(tx *sql.Tx, userID int) error {
+	photoID, ok := popular.pick()
+	if !ok {
+		return nil
+	}
+	return addComment(tx, photoID, userID)
+}
+
+// addComment adds a comment authored by authorID to a photo, and updates
+// the counts on the photo and author user. No comment is added if the
+// author doesn't exist (yet), as a user created later would start with a
+// comment count of 0 and drift from the comments authored.
+func addComment(tx *sql.Tx, photoID []byte, authorID int) error {
+	if exists, err := userExists(tx, authorID); err != nil || !exists {
+		return err
+	}
+	// Update the photo first so that no comment is added to a photo that
+	// doesn't exist (anymore).
+	const updatePhotoSQL = `
+UPDATE photos SET commentCount = commentCount + 1 WHERE id = $1;
+`
+	res, err := tx.Exec(updatePhotoSQL, photoID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return err
+	}
 
 	const insertSQL = `
 INSERT INTO comments VALUES ($1, DEFAULT, $2, $3, NOW());
@@ -199,13 +288,6 @@ INSERT INTO comments VALUES ($1, DEFAULT, $2, $3, NOW());
 		return err
 	}
 
-	const updatePhotoSQL = `
-UPDATE photos SET commentCount = commentCount + 1 WHERE id = $1;
-`
-	if _, err := tx.Exec(updatePhotoSQL, photoID); err != nil {
-		return err
-	}
-
 	const updateUserSQL = `
 UPDATE users SET commentCount = commentCount + 1 WHERE id = $1;
 `
@@ -215,6 +297,35 @@ UPDATE users SET commentCount = commentCount + 1 WHERE id = $1;
 	return nil
 }
 
+// likePhoto has the user like a photo picked by popularity. Popular
+// photos receive most likes, so their like counts are heavily contended.
+func likePhoto(tx *sql.Tx, userID int) error {
+	photoID, ok := popular.pick()
+	if !ok {
+		return nil
+	}
+	if exists, err := userExists(tx, userID); err != nil || !exists {
+		return err
+	}
+	const updatePhotoSQL = `
+UPDATE photos SET likeCount = likeCount + 1 WHERE id = $1;
+`
+	res, err := tx.Exec(updatePhotoSQL, photoID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		// The photo was deleted.
+		return err
+	}
+
+	const insertSQL = `
+INSERT INTO likes VALUES ($1, DEFAULT, $2, NOW());
+`
+	_, err = tx.Exec(insertSQL, photoID, userID)
+	return err
+}
+
 // listPhotos queries up to 100 photos, sorted by timestamp in
 // descending order, for the first user with ID >= userID. If photoIDs
 // is not nil, stores the queried photo IDs in photoIDs.
@@ -366,36 +477,92 @@ UPDATE comments SET message = $1 WHERE photoID = $2 AND commentID = $3;
 	return nil
 }
 
+// deletePhoto deletes a random photo of the user or of the existing user
+// with the closest user ID, along with its comments, likes and data.
 func deletePhoto(tx *sql.Tx, userID int) error {
 	photoID, err := chooseRandomPhoto(tx, userID)
 	if err != nil {
 		return err
 	}
 	const deletePhotoSQL = `
-DELETE FROM photos WHERE id = $1;
+DELETE FROM photos WHERE id = $1 RETURNING userID;
+`
+	var ownerID int
+	switch err := tx.QueryRow(deletePhotoSQL, photoID).Scan(&ownerID); err {
+	case sql.ErrNoRows:
+		return nil
+	case nil:
+	default:
+		return err
+	}
+
+	const deleteChunksSQL = `
+DELETE FROM photoChunks WHERE photoID = $1;
+`
+	if _, err := tx.Exec(deleteChunksSQL, photoID); err != nil {
+		return err
+	}
+
+	const deleteLikesSQL = `
+DELETE FROM likes WHERE photoID = $1;
 `
-	if _, err := tx.Exec(deletePhotoSQL, photoID); err != nil {
+	if _, err := tx.Exec(deleteLikesSQL, photoID); err != nil {
 		return err
 	}
 
+	const deleteCommentsSQL = `
+DELETE FROM comments WHERE photoID = $1 RETURNING userID;
+`
+	rows, err := tx.Query(deleteCommentsSQL, photoID)
+	if err != nil {
+		return err
+	}
+	authors := map[int]int{}
+	for rows.Next() {
+		var authorID int
+		if err := rows.Scan(&authorID); err != nil {
+			_ = rows.Close()
+			return err
+		}
+		authors[authorID]++
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	const updateAuthorSQL = `
+UPDATE users SET commentCount = commentCount - $1 WHERE id = $2;
+`
+	for authorID, n := range authors {
+		if _, err := tx.Exec(updateAuthorSQL, n, authorID); err != nil {
+			return err
+		}
+	}
+
 	const updateSQL = `
 UPDATE users SET photoCount = photoCount - 1 WHERE id = $1;
 `
-	if _, err := tx.Exec(updateSQL, userID); err != nil {
+	if _, err := tx.Exec(updateSQL, ownerID); err != nil {
 		return err
 	}
 	return nil
 }
 
+// deleteComment deletes a random comment of a photo of the user or of the
+// existing user with the closest user ID.
 func deleteComment(tx *sql.Tx, userID int) error {
 	photoID, commentID, err := chooseRandomComment(tx, userID)
 	if err != nil {
 		return err
 	}
 	const deleteCommentSQL = `
-DELETE FROM comments WHERE photoID = $1 AND commentID = $2;
+DELETE FROM comments WHERE photoID = $1 AND commentID = $2 RETURNING userID;
 `
-	if _, err := tx.Exec(deleteCommentSQL, photoID, commentID); err != nil {
+	var authorID int
+	switch err := tx.QueryRow(deleteCommentSQL, photoID, commentID).Scan(&authorID); err {
+	case sql.ErrNoRows:
+		return nil
+	case nil:
+	default:
 		return err
 	}
 
@@ -409,7 +576,7 @@ UPDATE photos SET commentCount = commentCount - 1 WHERE id = $1;
 	const updateUserSQL = `
 UPDATE users SET commentCount = commentCount - 1 WHERE id = $1;
 `
-	if _, err := tx.Exec(updateUserSQL, userID); err != nil {
+	if _, err := tx.Exec(updateUserSQL, authorID); err != nil {
 		return err
 	}
 	return nil
@@ -26,6 +26,7 @@ import (
 	"os/signal"
 	"reflect"
 	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -54,23 +55,74 @@ func normalizeStdFlagName(s string) string {
 }
 
 var usage = map[string]string{
-	"db":    "URL to the CockroachDB cluster",
-	"users": "number of concurrent simulated users",
+	"db": "URL to the CockroachDB cluster; if not set, read from --url-file or $DATABASE_URL, " +
+		"defaulting to " + defaultDBUrl,
+	"driver": "database driver: postgres (lib/pq) or pgx",
+	"users":  "number of concurrent simulated users",
+	"op-weights": "comma-separated list of name=weight pairs overriding the relative frequencies " +
+		"of operations, e.g. \"create-photo=20,delete-photo=0\"",
+	"user-zipf-s": "if non-zero, exponent (> 1) of a zipfian distribution of user activity, used " +
+		"instead of the default exponential distribution",
+	"photo-min-bytes": "minimum size of the image data stored with each photo",
+	"photo-max-bytes": "maximum size of the image data stored with each photo; if 0, photos have no data",
+	"photo-storage": "how image data is stored: \"inline\" in the photos table, or \"chunked\" in " +
+		"the photoChunks table",
+	"photo-chunk-bytes": "size of the chunks of chunked image data",
+	"duration":          "if non-zero, how long to generate load before stopping",
+	"max-ops":           "if non-zero, the number of operations to run before stopping",
+	"verify": "once load generation stops, check that denormalized counts match the actual rows " +
+		"and that no row references a missing parent",
+	"verify-interval": "if non-zero, interval at which to recompute the denormalized counts with aggregate " +
+		"queries while load generation runs, logging the counts that drifted and failing the run if any did",
+	"photo-zipf-s": "exponent (> 1) of the zipfian distribution of photo popularity used by likes " +
+		"and comments on popular photos",
 }
 
+const defaultDBUrl = "postgresql://root@localhost:26257/photos?sslmode=disable"
+
 // A Context holds configuration data.
 type Context struct {
 	// DBUrl is the URL to the database server.
 	DBUrl string
+	// Driver is the database driver, "postgres" or "pgx".
+	Driver string
 	// NumUsers is the number of concurrent users generating load.
 	NumUsers int
+	// OpWeights overrides the relative frequencies of operations.
+	OpWeights string
+	// UserZipfS, if non-zero, is the exponent of the distribution of user
+	// activity.
+	UserZipfS float64
+	// PhotoMinBytes and PhotoMaxBytes bound the size of the image data of
+	// each photo. If PhotoMaxBytes is 0, photos have no data.
+	PhotoMinBytes int
+	PhotoMaxBytes int
+	// PhotoStorage is "inline" to store image data in the photos table,
+	// or "chunked" to split it into PhotoChunkBytes chunks.
+	PhotoStorage    string
+	PhotoChunkBytes int
+	// Duration and MaxOps, if non-zero, bound the load generation.
+	Duration time.Duration
+	MaxOps   int
+	// Verify enables the verification pass after load generation.
+	Verify bool
+	// VerifyInterval, if non-zero, is the interval of the reconciliation
+	// of the counts during load generation.
+	VerifyInterval time.Duration
+	// PhotoZipfS is the exponent of the distribution of photo popularity.
+	PhotoZipfS float64
 	//
 	DB *sql.DB
 }
 
 var ctx = Context{
-	DBUrl:    "postgresql://root@localhost:26257/photos?sslmode=disable",
-	NumUsers: 1,
+	Driver:     "postgres",
+	NumUsers:   1,
+	PhotoZipfS: 1.1,
+
+	PhotoMinBytes:   16 << 10,
+	PhotoStorage:    "inline",
+	PhotoChunkBytes: 64 << 10,
 }
 
 var loadCmd = &cobra.Command{
@@ -78,17 +130,62 @@ var loadCmd = &cobra.Command{
 	Short: "generate artifical load using a simple three-table schema with indexes",
 	Long: `
 Create artificial load using a simple database schema containing
-users, photos and comments. Users have photos, photos have comments.
-Users can author comments on any photos. User actions are simulated
+users, photos, comments and likes. Users have photos, photos have
+comments and likes. Users can author comments on any photos. Likes
+and some comments go to popular photos, picked with a zipfian
+distribution (--photo-zipf-s), so the like and comment counts of a
+few photos are heavily contended. User actions are simulated
 using an exponential distribution on user IDs, so lower IDs see
-more activity than high ones.
+more activity than high ones. With --user-zipf-s, a zipfian
+distribution is used instead, so that a few users are very active.
+The distribution of activity per user is reported on exit. The mix
+of operations can be tuned with --op-weights to simulate different
+usage profiles.
+
+By default, photos only store metadata. With --photo-max-bytes, each
+photo also stores random image data of a size picked uniformly between
+--photo-min-bytes and --photo-max-bytes, either inline in the photos
+table or split into chunks of --photo-chunk-bytes (--photo-storage).
+
+Load generation runs until interrupted, for --duration or for
+--max-ops operations, then a summary of the operations of each type
+is reported, with their latencies and errors.
+
+With --verify, once load generation stops, the photo counts of users
+and the comment and like counts of photos are checked against the
+actual rows, and rows referencing missing photos or users are
+reported. Run it after a chaos test to find anomalies. With
+--verify-interval, the counts are also recomputed periodically while
+load generation runs, so that drift is flagged when it happens.
 `,
 	Example: `  photos --db=postgresql://root@localhost:26257/photos?sslmode=disable`,
 	RunE:    runLoad,
 }
 
 func runLoad(c *cobra.Command, args []string) error {
+	if err := setOpWeights(ctx.OpWeights); err != nil {
+		return err
+	}
+	if err := initPopularity(ctx.PhotoZipfS); err != nil {
+		return err
+	}
+	if ctx.PhotoMaxBytes != 0 && (ctx.PhotoMinBytes < 0 || ctx.PhotoMaxBytes < ctx.PhotoMinBytes) {
+		return fmt.Errorf("photo-max-bytes (%d) must be 0 or at least photo-min-bytes (%d), "+
+			"which must be non-negative", ctx.PhotoMaxBytes, ctx.PhotoMinBytes)
+	}
+	if ctx.PhotoStorage != "inline" && ctx.PhotoStorage != "chunked" {
+		return fmt.Errorf("unknown photo storage %q", ctx.PhotoStorage)
+	}
+	if ctx.PhotoChunkBytes < 1 {
+		return fmt.Errorf("photo-chunk-bytes (%d) must be at least 1", ctx.PhotoChunkBytes)
+	}
+	if ctx.UserZipfS != 0 && ctx.UserZipfS <= 1 {
+		return fmt.Errorf("user-zipf-s (%g) must be greater than 1", ctx.UserZipfS)
+	}
 	log.Printf("generating load for %d concurrent users...", ctx.NumUsers)
+	for _, op := range ops {
+		log.Printf("%s: weight %g", op.name, op.relFreq)
+	}
 	db, err := openDB(ctx)
 	if err != nil {
 		log.Fatal(err)
@@ -108,18 +205,34 @@ func runLoad(c *cobra.Command, args []string) error {
 			startUser(ctx, stopper)
 		})
 	}
+	if ctx.VerifyInterval > 0 {
+		stopper.RunWorker(func() {
+			reconcile(db, ctx.VerifyInterval, stopper)
+		})
+	}
 
 	signalCh := make(chan os.Signal, 1)
 	signal.Notify(signalCh, os.Interrupt, os.Kill)
 	signal.Notify(signalCh, syscall.SIGTERM)
 
-	// Block until one of the signals above is received or the stopper
-	// is stopped externally.
+	var done <-chan time.Time
+	if ctx.Duration > 0 {
+		done = time.After(ctx.Duration)
+	}
+
+	// Block until one of the signals above is received, the duration or
+	// the maximum number of ops is reached, or the stopper is stopped
+	// externally.
+	start := time.Now()
 	select {
 	case <-stopper.ShouldStop():
 	case <-signalCh:
-		stopper.Stop()
+	case <-done:
+	case <-maxOpsReached:
 	}
+	// Stop in the background so that a second signal can still cause a
+	// hard shutdown.
+	go stopper.Stop()
 
 	select {
 	case <-signalCh:
@@ -129,6 +242,15 @@ func runLoad(c *cobra.Command, args []string) error {
 	case <-stopper.IsStopped():
 		log.Printf("load generation complete")
 	}
+	showSummary(time.Since(start))
+	if ctx.Verify {
+		if err := runVerify(db); err != nil {
+			return err
+		}
+	}
+	if n := atomic.LoadInt64(&driftedPasses); n > 0 {
+		return fmt.Errorf("reconciliation found drifted counts in %d passes", n)
+	}
 	return nil
 }
 
@@ -169,6 +291,18 @@ func init() {
 	// Add persistent flags to the top-level command.
 	loadCmd.PersistentFlags().IntVarP(&ctx.NumUsers, "users", "", ctx.NumUsers, usage["users"])
 	loadCmd.PersistentFlags().StringVarP(&ctx.DBUrl, "db", "", ctx.DBUrl, usage["db"])
+	loadCmd.PersistentFlags().StringVarP(&ctx.Driver, "driver", "", ctx.Driver, usage["driver"])
+	loadCmd.PersistentFlags().StringVarP(&ctx.OpWeights, "op-weights", "", ctx.OpWeights, usage["op-weights"])
+	loadCmd.PersistentFlags().Float64VarP(&ctx.UserZipfS, "user-zipf-s", "", ctx.UserZipfS, usage["user-zipf-s"])
+	loadCmd.PersistentFlags().IntVarP(&ctx.PhotoMinBytes, "photo-min-bytes", "", ctx.PhotoMinBytes, usage["photo-min-bytes"])
+	loadCmd.PersistentFlags().IntVarP(&ctx.PhotoMaxBytes, "photo-max-bytes", "", ctx.PhotoMaxBytes, usage["photo-max-bytes"])
+	loadCmd.PersistentFlags().StringVarP(&ctx.PhotoStorage, "photo-storage", "", ctx.PhotoStorage, usage["photo-storage"])
+	loadCmd.PersistentFlags().IntVarP(&ctx.PhotoChunkBytes, "photo-chunk-bytes", "", ctx.PhotoChunkBytes, usage["photo-chunk-bytes"])
+	loadCmd.PersistentFlags().DurationVarP(&ctx.Duration, "duration", "", ctx.Duration, usage["duration"])
+	loadCmd.PersistentFlags().IntVarP(&ctx.MaxOps, "max-ops", "", ctx.MaxOps, usage["max-ops"])
+	loadCmd.PersistentFlags().BoolVarP(&ctx.Verify, "verify", "", ctx.Verify, usage["verify"])
+	loadCmd.PersistentFlags().DurationVarP(&ctx.VerifyInterval, "verify-interval", "", ctx.VerifyInterval, usage["verify-interval"])
+	loadCmd.PersistentFlags().Float64VarP(&ctx.PhotoZipfS, "photo-zipf-s", "", ctx.PhotoZipfS, usage["photo-zipf-s"])
 }
 
 // Run ...
@@ -20,18 +20,22 @@ import (
 	"database/sql"
 	"log"
 	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
-	"github.com/cockroachdb/cockroach-go/crdb"
 	"github.com/cockroachdb/cockroach/util"
 	"github.com/cockroachdb/cockroach/util/stop"
+	"github.com/cockroachdb/examples-go/dbdriver"
 	"github.com/codahale/hdrhistogram"
 )
 
 const (
 	meanUserID    = 1 << 15
 	rate          = 1.0 / (meanUserID * 2)
+	maxZipfUserID = 1 << 20
 	statsInterval = 10 * time.Second
 )
 
@@ -45,6 +49,8 @@ const (
 	updateCommentOp
 	deletePhotoOp
 	deleteCommentOp
+	likePhotoOp
+	commentPopularPhotoOp
 )
 
 type opDesc struct {
@@ -64,6 +70,57 @@ var ops = []*opDesc{
 	{updateCommentOp, "update comment", 5, 0},
 	{deletePhotoOp, "delete photo", 1.25, 0},
 	{deleteCommentOp, "delete comment", 2.5, 0},
+	{likePhotoOp, "like photo", 30, 0},
+	{commentPopularPhotoOp, "comment popular photo", 10, 0},
+}
+
+// maxPopularPhotos is the number of photos tracked for popularity. Photos
+// are ranked by creation order, so the first photos created are the most
+// popular.
+const maxPopularPhotos = 100000
+
+// popularPhotos tracks the IDs of the photos created by this process, and
+// picks photos with a zipfian distribution on their rank.
+type popularPhotos struct {
+	sync.Mutex
+	ids  [][]byte
+	zipf *rand.Zipf
+}
+
+var popular popularPhotos
+
+// initPopularity sets the exponent of the zipfian distribution used to
+// pick popular photos. It must be greater than 1.
+func initPopularity(s float64) error {
+	if s <= 1 {
+		return util.Errorf("photo-zipf-s (%g) must be greater than 1", s)
+	}
+	popular.Lock()
+	defer popular.Unlock()
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	popular.zipf = rand.NewZipf(r, s, 1, maxPopularPhotos-1)
+	return nil
+}
+
+// add records a newly created photo. The photo may not exist if its
+// transaction doesn't commit, in which case operations on it do nothing.
+func (p *popularPhotos) add(id []byte) {
+	p.Lock()
+	defer p.Unlock()
+	if len(p.ids) < maxPopularPhotos {
+		p.ids = append(p.ids, id)
+	}
+}
+
+// pick returns a photo picked by popularity, or false if no photo has
+// been created yet.
+func (p *popularPhotos) pick() ([]byte, bool) {
+	p.Lock()
+	defer p.Unlock()
+	if len(p.ids) == 0 {
+		return nil, false
+	}
+	return p.ids[p.zipf.Uint64()%uint64(len(p.ids))], true
 }
 
 var stats struct {
@@ -74,12 +131,29 @@ var stats struct {
 	failedOps int
 	hist      *hdrhistogram.Histogram
 	opCounts  map[int]int
+	userOps   map[int]int
+	opErrors  map[int]int
+	latencies map[int]*hdrhistogram.Histogram
 }
 
+// maxOpsReached is closed once --max-ops operations have run.
+var maxOpsReached = make(chan struct{})
+
 func init() {
 	stats.hist = hdrhistogram.New(0, 0x7fffffff, 1)
 	stats.opCounts = map[int]int{}
+	stats.userOps = map[int]int{}
+	stats.opErrors = map[int]int{}
+	stats.latencies = map[int]*hdrhistogram.Histogram{}
+	for _, op := range ops {
+		stats.latencies[op.typ] = hdrhistogram.New(0, int64(time.Minute), 1)
+	}
+	normalizeOps()
+}
 
+// normalizeOps computes the normalized frequencies of the ops from their
+// relative frequencies.
+func normalizeOps() {
 	// Compute the total of all op relative frequencies.
 	var relFreqTotal float64
 	for _, op := range ops {
@@ -94,6 +168,56 @@ func init() {
 	}
 }
 
+// opFlagName returns the name of an op as used in the --op-weights flag,
+// e.g. "create-photo".
+func opFlagName(op *opDesc) string {
+	return strings.Replace(op.name, " ", "-", -1)
+}
+
+// setOpWeights overrides the relative frequencies of the ops with the
+// weights in s, a comma-separated list of name=weight pairs such as
+// "create-photo=20,delete-photo=0". Ops not listed keep their default
+// weight.
+func setOpWeights(s string) error {
+	if s == "" {
+		return nil
+	}
+	for _, pair := range strings.Split(s, ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return util.Errorf("invalid op weight %q: expected name=weight", pair)
+		}
+		name := strings.TrimSpace(kv[0])
+		weight, err := strconv.ParseFloat(strings.TrimSpace(kv[1]), 64)
+		if err != nil || weight < 0 {
+			return util.Errorf("invalid weight %q for op %s: must be a non-negative number", kv[1], name)
+		}
+		var found bool
+		for _, op := range ops {
+			if opFlagName(op) == name {
+				op.relFreq = weight
+				found = true
+			}
+		}
+		if !found {
+			var names []string
+			for _, op := range ops {
+				names = append(names, opFlagName(op))
+			}
+			return util.Errorf("unknown op %q: must be one of %s", name, strings.Join(names, ", "))
+		}
+	}
+	var total float64
+	for _, op := range ops {
+		total += op.relFreq
+	}
+	if total == 0 {
+		return util.Errorf("op weights must not all be zero")
+	}
+	normalizeOps()
+	return nil
+}
+
 // randomOp chooses a random operation from the ops slice.
 func randomOp() *opDesc {
 	r := rand.Float64()
@@ -131,22 +255,36 @@ func startStats(stopper *stop.Stopper) {
 // startUser simulates a stream of user events until the stopper
 // indicates it's time to exit.
 func startUser(ctx Context, stopper *stop.Stopper) {
+	pickUserID := func() int { return 1 + int(rand.ExpFloat64()/rate) }
+	if ctx.UserZipfS != 0 {
+		r := rand.New(rand.NewSource(rand.Int63()))
+		z := rand.NewZipf(r, ctx.UserZipfS, 1, maxZipfUserID-1)
+		pickUserID = func() int { return 1 + int(z.Uint64()) }
+	}
 	for {
-		userID := 1 + int(rand.ExpFloat64()/rate)
+		userID := pickUserID()
 		op := randomOp()
 
 		if !stopper.RunTask(func() {
+			start := time.Now()
 			err := runUserOp(ctx, userID, op.typ)
 			stats.Lock()
 			_ = stats.hist.RecordValue(int64(userID))
 			stats.totalOps++
 			stats.opCounts[op.typ]++
+			stats.userOps[userID]++
 			switch {
 			case err == errNoUser:
 				stats.noUserOps++
 			case err != nil:
 				stats.failedOps++
+				stats.opErrors[op.typ]++
 				log.Printf("failed to run %s op for %d: %s", op.name, userID, err)
+			default:
+				_ = stats.latencies[op.typ].RecordValue(int64(time.Since(start)))
+			}
+			if stats.totalOps == ctx.MaxOps {
+				close(maxOpsReached)
 			}
 			stats.Unlock()
 		}) {
@@ -158,7 +296,7 @@ func startUser(ctx Context, stopper *stop.Stopper) {
 // runUserOp starts a transaction and creates the user if it doesn't
 // yet exist.
 func runUserOp(ctx Context, userID, opType int) error {
-	return crdb.ExecuteTx(ctx.DB, func(tx *sql.Tx) error {
+	return dbdriver.ExecuteTx(ctx.DB, func(tx *sql.Tx) error {
 		switch opType {
 		case createUserOp:
 			return createUser(tx, userID)
@@ -179,6 +317,10 @@ func runUserOp(ctx Context, userID, opType int) error {
 			return deletePhoto(tx, userID)
 		case deleteCommentOp:
 			return deleteComment(tx, userID)
+		case likePhotoOp:
+			return likePhoto(tx, userID)
+		case commentPopularPhotoOp:
+			return commentPopularPhoto(tx, userID)
 		default:
 			return util.Errorf("unsupported op type: %d", opType)
 		}
@@ -192,3 +334,50 @@ func showHistogram() {
 		log.Printf("** users %d-%d (%d)", b.From, b.To, b.Count)
 	}
 }
+
+// showSummary logs the number of operations of each type, their latency
+// percentiles and error counts, followed by the user activity.
+func showSummary(elapsed time.Duration) {
+	stats.Lock()
+	defer stats.Unlock()
+	log.Printf("**** %d ops in %s (%.2f/s), %d no-user, %d errs",
+		stats.totalOps, elapsed, float64(stats.totalOps)/elapsed.Seconds(), stats.noUserOps, stats.failedOps)
+	log.Printf("%-22s %8s %8s %10s %10s %10s %10s", "op", "count", "errors", "p50", "p95", "p99", "max")
+	for _, op := range ops {
+		h := stats.latencies[op.typ]
+		log.Printf("%-22s %8d %8d %10s %10s %10s %10s", op.name, stats.opCounts[op.typ], stats.opErrors[op.typ],
+			time.Duration(h.ValueAtQuantile(50)), time.Duration(h.ValueAtQuantile(95)),
+			time.Duration(h.ValueAtQuantile(99)), time.Duration(h.Max()))
+	}
+	showUserActivity()
+}
+
+// showUserActivity logs the distribution of the number of operations per
+// user, and the share of operations run by the most active users.
+func showUserActivity() {
+	counts := make([]int, 0, len(stats.userOps))
+	var total int
+	for _, n := range stats.userOps {
+		counts = append(counts, n)
+		total += n
+	}
+	if total == 0 {
+		return
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(counts)))
+	log.Printf("**** user activity: %d ops by %d users", total, len(counts))
+	// counts is sorted in decreasing order, so the p-th percentile of
+	// activity is found 100-p percent of the way in.
+	for _, p := range []int{50, 90, 99, 100} {
+		i := len(counts) * (100 - p) / 100
+		log.Printf("** p%d: %d ops per user", p, counts[i])
+	}
+	for _, top := range []int{1, 10} {
+		n := (len(counts)*top + 99) / 100
+		var ops int
+		for _, c := range counts[:n] {
+			ops += c
+		}
+		log.Printf("** top %d%% of users (%d): %.1f%% of ops", top, n, 100*float64(ops)/float64(total))
+	}
+}
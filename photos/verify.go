@@ -0,0 +1,178 @@
+// Copyright 2016 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/cockroachdb/cockroach/util/stop"
+)
+
+// maxReported is the maximum number of discrepancies logged per check.
+const maxReported = 10
+
+// A countCheck compares a denormalized count with the number of rows it
+// counts.
+type countCheck struct {
+	desc  string
+	query string
+}
+
+var countChecks = []countCheck{
+	{"photo count of user", `
+SELECT u.id::STRING, u.photoCount, COUNT(p.id) FROM users AS u LEFT JOIN photos AS p ON p.userID = u.id
+ GROUP BY u.id, u.photoCount HAVING u.photoCount != COUNT(p.id)`},
+	{"comment count of user", `
+SELECT u.id::STRING, u.commentCount, COUNT(c.commentID) FROM users AS u LEFT JOIN comments AS c ON c.userID = u.id
+ GROUP BY u.id, u.commentCount HAVING u.commentCount != COUNT(c.commentID)`},
+	{"comment count of photo", `
+SELECT to_hex(p.id), p.commentCount, COUNT(c.commentID) FROM photos AS p LEFT JOIN comments AS c ON c.photoID = p.id
+ GROUP BY p.id, p.commentCount HAVING p.commentCount != COUNT(c.commentID)`},
+	{"like count of photo", `
+SELECT to_hex(p.id), p.likeCount, COUNT(l.likeID) FROM photos AS p LEFT JOIN likes AS l ON l.photoID = p.id
+ GROUP BY p.id, p.likeCount HAVING p.likeCount != COUNT(l.likeID)`},
+}
+
+// An orphanCheck counts the child rows whose parent doesn't exist.
+type orphanCheck struct {
+	desc  string
+	query string
+}
+
+var orphanChecks = []orphanCheck{
+	{"photos of missing users", `
+SELECT COUNT(*) FROM photos AS p LEFT JOIN users AS u ON p.userID = u.id WHERE u.id IS NULL`},
+	{"comments on missing photos", `
+SELECT COUNT(*) FROM comments AS c LEFT JOIN photos AS p ON c.photoID = p.id WHERE p.id IS NULL`},
+	{"likes on missing photos", `
+SELECT COUNT(*) FROM likes AS l LEFT JOIN photos AS p ON l.photoID = p.id WHERE p.id IS NULL`},
+	{"comments by missing users", `
+SELECT COUNT(*) FROM comments AS c LEFT JOIN users AS u ON c.userID = u.id WHERE u.id IS NULL`},
+	{"likes by missing users", `
+SELECT COUNT(*) FROM likes AS l LEFT JOIN users AS u ON l.userID = u.id WHERE u.id IS NULL`},
+	{"data chunks of missing photos", `
+SELECT COUNT(*) FROM photoChunks AS d LEFT JOIN photos AS p ON d.photoID = p.id WHERE p.id IS NULL`},
+}
+
+// verifyDatabase checks that the denormalized counts match the rows they
+// count and that no row references a missing parent. It logs the
+// discrepancies found and returns their number.
+func verifyDatabase(db *sql.DB) (int, error) {
+	found, err := checkCounts(db)
+	if err != nil {
+		return found, err
+	}
+	for _, c := range orphanChecks {
+		var n int
+		if err := db.QueryRow(c.query).Scan(&n); err != nil {
+			return found, err
+		}
+		if n > 0 {
+			log.Printf("found %d %s", n, c.desc)
+		}
+		found += n
+	}
+	return found, nil
+}
+
+// checkCounts recomputes the denormalized counts with aggregate queries and
+// returns the number of counts that drifted from the rows they count. Each
+// check is a single statement, which sees a consistent snapshot even while
+// load generation runs.
+func checkCounts(db *sql.DB) (int, error) {
+	var found int
+	for _, c := range countChecks {
+		n, err := runCountCheck(db, c)
+		if err != nil {
+			return found, err
+		}
+		found += n
+	}
+	return found, nil
+}
+
+func runCountCheck(db *sql.DB, c countCheck) (int, error) {
+	rows, err := db.Query(c.query)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = rows.Close() }()
+	var n int
+	for rows.Next() {
+		var id string
+		var stored, actual int
+		if err := rows.Scan(&id, &stored, &actual); err != nil {
+			return n, err
+		}
+		if n < maxReported {
+			log.Printf("%s %s is %d, but %d rows exist", c.desc, id, stored, actual)
+		}
+		n++
+	}
+	if n > maxReported {
+		log.Printf("... %s: %d discrepancies in total", c.desc, n)
+	}
+	return n, rows.Err()
+}
+
+// runVerify runs the verification pass and returns an error if it found
+// any discrepancy.
+func runVerify(db *sql.DB) error {
+	log.Printf("verifying referential integrity...")
+	n, err := verifyDatabase(db)
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return fmt.Errorf("verification found %d discrepancies", n)
+	}
+	log.Printf("verification passed")
+	return nil
+}
+
+// driftedPasses counts the reconciliation passes that found drifted counts.
+var driftedPasses int64
+
+// reconcile recomputes the denormalized counts every interval while load
+// generation runs, logging the counts that drifted. Drift under retries,
+// e.g. a count incremented twice for one row, is the bug class this
+// catches as it happens rather than after the run.
+func reconcile(db *sql.DB, interval time.Duration, stopper *stop.Stopper) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-stopper.ShouldStop():
+			return
+		}
+		start := time.Now()
+		n, err := checkCounts(db)
+		if err != nil {
+			log.Printf("reconciliation failed: %s", err)
+			continue
+		}
+		if n > 0 {
+			atomic.AddInt64(&driftedPasses, 1)
+			log.Printf("reconciliation: %d counts drifted from their rows", n)
+		} else {
+			log.Printf("reconciliation: no drift (%s)", time.Since(start))
+		}
+	}
+}
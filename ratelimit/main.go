@@ -0,0 +1,333 @@
+// Copyright 2016 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+// The ratelimit example implements a database-backed rate limiter. Many
+// concurrent clients try to acquire permits for a small number of limiter
+// keys, each of which is stored in one or more rows that are updated
+// transactionally. Two algorithms are supported:
+//
+//   - token-bucket: a row holds a number of tokens which is refilled at
+//     a constant rate up to a burst size.
+//   - sliding-window: a row per window counts the permits granted; the
+//     count of the previous window is weighted by its overlap with the
+//     sliding window.
+//
+// With --shards greater than 1, the limit of each key is split evenly
+// across several rows and clients pick a shard at random, trading
+// accuracy for less contention on the hot limiter rows.
+//
+// The example reports how many permits were granted compared to the
+// configured limit, along with acquisition latency and transaction
+// retries.
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/examples-go/dbdriver"
+	"github.com/cockroachdb/examples-go/opstats"
+	// Import postgres driver.
+	_ "github.com/cockroachdb/pq"
+)
+
+var algorithm = flag.String("algorithm", "token-bucket", "Rate limiting algorithm: token-bucket or sliding-window.")
+var numKeys = flag.Int("keys", 1, "Number of limiter keys.")
+var numShards = flag.Int("shards", 1, "Number of rows each key is sharded across.")
+var rate = flag.Float64("rate", 100, "Permits per second allowed for each key.")
+var burst = flag.Float64("burst", 100, "Maximum burst of a token bucket.")
+var window = flag.Duration("window", 1*time.Second, "Width of the sliding window.")
+var concurrency = flag.Int("concurrency", 16, "Number of concurrent clients.")
+var duration = flag.Duration("duration", 0, "The duration to run. If 0, run forever.")
+var outputInterval = flag.Duration("output-interval", 1*time.Second, "Interval of output.")
+var driver = flag.String("driver", "postgres", dbdriver.Usage)
+
+const schema = `
+CREATE TABLE IF NOT EXISTS buckets (
+  key     INT NOT NULL,
+  shard   INT NOT NULL,
+  tokens  FLOAT NOT NULL,
+  updated TIMESTAMP NOT NULL,
+  PRIMARY KEY (key, shard)
+);
+
+CREATE TABLE IF NOT EXISTS windows (
+  key          INT NOT NULL,
+  shard        INT NOT NULL,
+  window_start TIMESTAMP NOT NULL,
+  permits      INT NOT NULL,
+  PRIMARY KEY (key, shard, window_start)
+);
+`
+
+// A limiter grants permits for a key using rows of the database.
+type limiter interface {
+	// setup creates the initial limiter state.
+	setup(db *sql.DB) error
+	// acquire tries to acquire a permit from the given shard of a key.
+	acquire(tx *sql.Tx, key, shard int) (bool, error)
+	// expected returns the number of permits that should have been
+	// granted across all keys after the given duration.
+	expected(elapsed time.Duration) float64
+}
+
+// refill returns the tokens in a bucket after elapsed time, given its
+// refill rate (per second) and burst size.
+func refill(tokens, rate, burst float64, elapsed time.Duration) float64 {
+	if elapsed < 0 {
+		elapsed = 0
+	}
+	return math.Min(burst, tokens+rate*elapsed.Seconds())
+}
+
+// slidingCount estimates the number of permits granted in the sliding
+// window ending at now, given the counts of the current fixed window
+// (which started at start) and of the previous one.
+func slidingCount(prev, cur int, start, now time.Time, window time.Duration) float64 {
+	overlap := 1 - float64(now.Sub(start))/float64(window)
+	if overlap < 0 {
+		overlap = 0
+	}
+	return float64(prev)*overlap + float64(cur)
+}
+
+type tokenBucket struct{}
+
+func (tokenBucket) setup(db *sql.DB) error {
+	if _, err := db.Exec("TRUNCATE TABLE buckets"); err != nil {
+		return err
+	}
+	for key := 0; key < *numKeys; key++ {
+		for shard := 0; shard < *numShards; shard++ {
+			if _, err := db.Exec(`INSERT INTO buckets (key, shard, tokens, updated) VALUES ($1, $2, $3, NOW())`,
+				key, shard, *burst/float64(*numShards)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (tokenBucket) acquire(tx *sql.Tx, key, shard int) (bool, error) {
+	var tokens float64
+	var updated, now time.Time
+	if err := tx.QueryRow(`SELECT tokens, updated, NOW() FROM buckets WHERE key = $1 AND shard = $2`,
+		key, shard).Scan(&tokens, &updated, &now); err != nil {
+		return false, err
+	}
+	shards := float64(*numShards)
+	tokens = refill(tokens, *rate/shards, *burst/shards, now.Sub(updated))
+	allowed := tokens >= 1
+	if allowed {
+		tokens--
+	}
+	_, err := tx.Exec(`UPDATE buckets SET tokens = $1, updated = $2 WHERE key = $3 AND shard = $4`,
+		tokens, now, key, shard)
+	return allowed, err
+}
+
+func (tokenBucket) expected(elapsed time.Duration) float64 {
+	return float64(*numKeys) * (*burst + *rate*elapsed.Seconds())
+}
+
+type slidingWindow struct{}
+
+func (slidingWindow) setup(db *sql.DB) error {
+	_, err := db.Exec("TRUNCATE TABLE windows")
+	return err
+}
+
+func (slidingWindow) acquire(tx *sql.Tx, key, shard int) (bool, error) {
+	var now time.Time
+	if err := tx.QueryRow(`SELECT NOW()`).Scan(&now); err != nil {
+		return false, err
+	}
+	start := now.Truncate(*window)
+	counts := map[time.Time]int{}
+	rows, err := tx.Query(`SELECT window_start, permits FROM windows WHERE key = $1 AND shard = $2 AND window_start >= $3`,
+		key, shard, start.Add(-*window))
+	if err != nil {
+		return false, err
+	}
+	for rows.Next() {
+		var s time.Time
+		var c int
+		if err := rows.Scan(&s, &c); err != nil {
+			_ = rows.Close()
+			return false, err
+		}
+		counts[s.UTC()] = c
+	}
+	if err := rows.Err(); err != nil {
+		return false, err
+	}
+	cur := counts[start.UTC()]
+	limit := *rate * window.Seconds() / float64(*numShards)
+	if slidingCount(counts[start.Add(-*window).UTC()], cur, start, now, *window)+1 > limit {
+		return false, nil
+	}
+	// The first permit of a window expires the windows before the previous
+	// one, which no longer count, so that the table doesn't keep growing.
+	if cur == 0 {
+		if _, err := tx.Exec(`DELETE FROM windows WHERE key = $1 AND shard = $2 AND window_start < $3`,
+			key, shard, start.Add(-*window)); err != nil {
+			return false, err
+		}
+	}
+	_, err = tx.Exec(`UPSERT INTO windows (key, shard, window_start, permits) VALUES ($1, $2, $3, $4)`,
+		key, shard, start, cur+1)
+	return true, err
+}
+
+func (slidingWindow) expected(elapsed time.Duration) float64 {
+	return float64(*numKeys) * *rate * elapsed.Seconds()
+}
+
+// acquires tracks the latencies of the acquisitions, whether allowed or
+// denied.
+var acquires = opstats.New(time.Minute)
+
+var stats struct {
+	sync.Mutex
+	allowed int
+	denied  int
+	retries int
+	errors  int
+}
+
+func client(db *sql.DB, l limiter) {
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	for {
+		key, shard := r.Intn(*numKeys), r.Intn(*numShards)
+		var allowed bool
+		attempts := 0
+		start := time.Now()
+		err := dbdriver.ExecuteTx(db, func(tx *sql.Tx) error {
+			attempts++
+			var err error
+			allowed, err = l.acquire(tx, key, shard)
+			return err
+		})
+		acquires.Record(start, err)
+
+		stats.Lock()
+		stats.retries += attempts - 1
+		if err != nil {
+			log.Print(err)
+		} else if allowed {
+			stats.allowed++
+		} else {
+			stats.denied++
+		}
+		stats.Unlock()
+	}
+}
+
+var usage = func() {
+	fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s [<db URL>]\n\n", os.Args[0])
+	flag.PrintDefaults()
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() > 1 {
+		usage()
+		os.Exit(2)
+	}
+
+	var l limiter
+	switch *algorithm {
+	case "token-bucket":
+		l = tokenBucket{}
+	case "sliding-window":
+		l = slidingWindow{}
+	default:
+		log.Fatalf("unknown algorithm %q", *algorithm)
+	}
+	if *numKeys < 1 || *numShards < 1 {
+		log.Fatal("'keys' and 'shards' must be at least 1")
+	}
+
+	dbURL, err := dbdriver.URL(flag.Arg(0), "")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	parsedURL, err := url.Parse(dbURL)
+	if err != nil {
+		log.Fatal(err)
+	}
+	parsedURL.Path = "ratelimit"
+
+	db, err := dbdriver.Open(*driver, parsedURL.String())
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer func() { _ = db.Close() }()
+
+	db.SetMaxOpenConns(*concurrency + 1)
+
+	if _, err := db.Exec("CREATE DATABASE IF NOT EXISTS ratelimit"); err != nil {
+		log.Fatal(err)
+	}
+	if _, err := db.Exec(schema); err != nil {
+		log.Fatal(err)
+	}
+	if err := l.setup(db); err != nil {
+		log.Fatal(err)
+	}
+
+	start := time.Now()
+	for i := 0; i < *concurrency; i++ {
+		go client(db, l)
+	}
+
+	var done <-chan time.Time
+	if *duration > 0 {
+		done = time.After(*duration)
+	}
+	tick := time.Tick(*outputInterval)
+	for {
+		select {
+		case <-tick:
+		case <-done:
+		}
+		elapsed := time.Since(start)
+		hist, errors := acquires.Snapshot()
+		stats.Lock()
+		stats.errors += errors
+		expected := l.expected(elapsed)
+		log.Printf("%s: %d allowed (%.1f%% of limit), %d denied, %d retries, %d errors, p50=%s p99=%s",
+			elapsed-elapsed%time.Second, stats.allowed, 100*float64(stats.allowed)/expected,
+			stats.denied, stats.retries, stats.errors,
+			time.Duration(hist.ValueAtQuantile(50)),
+			time.Duration(hist.ValueAtQuantile(99)))
+		stats.Unlock()
+		if *duration > 0 && elapsed >= *duration {
+			return
+		}
+	}
+}
@@ -0,0 +1,276 @@
+// Copyright 2016 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+// The shortener example simulates a URL shortening service. Writers
+// create short codes for new URLs; codes are random and short enough
+// that collisions happen, in which case a new code is drawn. Readers
+// resolve ("redirect") existing codes, choosing them with a zipfian
+// distribution so that a few links receive most of the traffic.
+//
+// With --count-clicks, every redirect also increments a click counter
+// on the link's row. Combined with the skewed popularity, this
+// deliberately creates a few very hot rows.
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"net/url"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cockroachdb/examples-go/dbdriver"
+	"github.com/cockroachdb/examples-go/opstats"
+	"github.com/codahale/hdrhistogram"
+	// Import postgres driver.
+	_ "github.com/cockroachdb/pq"
+)
+
+var concurrency = flag.Int("concurrency", 16, "Number of concurrent clients.")
+var readPercent = flag.Int("read-percent", 90, "Percentage of operations that are redirects.")
+var codeLength = flag.Int("code-length", 4, "Length of generated short codes. Short codes cause more collisions.")
+var initialURLs = flag.Int("initial-urls", 10000, "Number of URLs to shorten before starting the workload.")
+var zipfS = flag.Float64("zipf-s", 1.1, "Zipf exponent for link popularity. Must be > 1.")
+var countClicks = flag.Bool("count-clicks", false, "Increment a per-link click counter on every redirect.")
+var outputInterval = flag.Duration("output-interval", 1*time.Second, "Interval of output.")
+var driver = flag.String("driver", "postgres", dbdriver.Usage)
+
+const schema = `
+CREATE TABLE IF NOT EXISTS urls (
+  code    STRING PRIMARY KEY,
+  url     STRING NOT NULL,
+  created TIMESTAMP NOT NULL DEFAULT NOW(),
+  clicks  INT NOT NULL DEFAULT 0
+)`
+
+const codeChars = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+
+// codeSpaceFactor is how many times more short codes than initial URLs
+// --code-length must allow, so that finding an unused one stays cheap.
+const codeSpaceFactor = 10
+
+// maxShortenAttempts is the number of short codes shorten tries before
+// giving up, once the codes are nearly all taken.
+const maxShortenAttempts = 100
+
+// collisions counts the short codes that were already taken.
+var collisions uint64
+
+// codes holds all short codes created so far, in creation order. The
+// oldest links are the most popular ones.
+var codes struct {
+	sync.RWMutex
+	list []string
+}
+
+func addCode(code string) {
+	codes.Lock()
+	codes.list = append(codes.list, code)
+	codes.Unlock()
+}
+
+// popularCode returns an existing short code, chosen with a zipfian
+// distribution over the codes' creation order.
+func popularCode(r *rand.Rand) string {
+	codes.RLock()
+	defer codes.RUnlock()
+	n := len(codes.list)
+	if n == 1 {
+		return codes.list[0]
+	}
+	z := rand.NewZipf(r, *zipfS, 1, uint64(n-1))
+	return codes.list[z.Uint64()]
+}
+
+func randomCode(r *rand.Rand) string {
+	b := make([]byte, *codeLength)
+	for i := range b {
+		b[i] = codeChars[r.Intn(len(codeChars))]
+	}
+	return string(b)
+}
+
+// shorten stores a new URL under a fresh short code, retrying with a new
+// code until an unused one is found, up to maxShortenAttempts times.
+func shorten(db *sql.DB, r *rand.Rand) error {
+	longURL := fmt.Sprintf("https://example.com/%d/%d", r.Int63(), r.Int63())
+	for i := 0; i < maxShortenAttempts; i++ {
+		code := randomCode(r)
+		res, err := db.Exec(`INSERT INTO urls (code, url) VALUES ($1, $2) ON CONFLICT (code) DO NOTHING`,
+			code, longURL)
+		if err != nil {
+			return err
+		}
+		inserted, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if inserted == 1 {
+			addCode(code)
+			return nil
+		}
+		atomic.AddUint64(&collisions, 1)
+	}
+	return fmt.Errorf("no unused short code found in %d attempts", maxShortenAttempts)
+}
+
+// redirect resolves a popular short code. With --count-clicks, the click
+// counter is incremented in the same statement.
+func redirect(db *sql.DB, r *rand.Rand) error {
+	code := popularCode(r)
+	var longURL string
+	var err error
+	if *countClicks {
+		err = db.QueryRow(`UPDATE urls SET clicks = clicks + 1 WHERE code = $1 RETURNING url`,
+			code).Scan(&longURL)
+	} else {
+		err = db.QueryRow(`SELECT url FROM urls WHERE code = $1`, code).Scan(&longURL)
+	}
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("short code %q not found", code)
+	}
+	return err
+}
+
+var shortenStats, redirectStats = opstats.New(time.Minute), opstats.New(time.Minute)
+
+func client(db *sql.DB) {
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	for {
+		start := time.Now()
+		if r.Intn(100) < *readPercent {
+			err := redirect(db, r)
+			if err != nil {
+				log.Print(err)
+			}
+			redirectStats.Record(start, err)
+		} else {
+			err := shorten(db, r)
+			if err != nil {
+				log.Print(err)
+			}
+			shortenStats.Record(start, err)
+		}
+	}
+}
+
+// setupDatabase creates a fresh urls table and shortens the initial set
+// of URLs.
+func setupDatabase(db *sql.DB) error {
+	if _, err := db.Exec("CREATE DATABASE IF NOT EXISTS shortener"); err != nil {
+		return err
+	}
+	if _, err := db.Exec(schema); err != nil {
+		return err
+	}
+	if _, err := db.Exec("TRUNCATE TABLE urls"); err != nil {
+		return err
+	}
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	for i := 0; i < *initialURLs; i++ {
+		if err := shorten(db, r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func logStats(name string, elapsed time.Duration, hist *hdrhistogram.Histogram, errors int) {
+	log.Printf("%s: %.1f/sec, p50=%s p95=%s p99=%s (%d errors)",
+		name, float64(hist.TotalCount())/elapsed.Seconds(),
+		time.Duration(hist.ValueAtQuantile(50)),
+		time.Duration(hist.ValueAtQuantile(95)),
+		time.Duration(hist.ValueAtQuantile(99)),
+		errors)
+}
+
+var usage = func() {
+	fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s [<db URL>]\n\n", os.Args[0])
+	flag.PrintDefaults()
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() > 1 {
+		usage()
+		os.Exit(2)
+	}
+
+	if *initialURLs < 1 {
+		log.Fatalf("Value of 'initial-urls' flag (%d) must be greater than or equal to 1", *initialURLs)
+	}
+	if *zipfS <= 1 {
+		log.Fatalf("Value of 'zipf-s' flag (%f) must be greater than 1", *zipfS)
+	}
+	if *codeLength < 1 {
+		log.Fatalf("Value of 'code-length' flag (%d) must be greater than or equal to 1", *codeLength)
+	}
+	if math.Pow(float64(len(codeChars)), float64(*codeLength)) < codeSpaceFactor*float64(*initialURLs) {
+		log.Fatalf("Value of 'code-length' flag (%d) allows too few short codes for %d initial URLs",
+			*codeLength, *initialURLs)
+	}
+
+	dbURL, err := dbdriver.URL(flag.Arg(0), "")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	parsedURL, err := url.Parse(dbURL)
+	if err != nil {
+		log.Fatal(err)
+	}
+	parsedURL.Path = "shortener"
+
+	db, err := dbdriver.Open(*driver, parsedURL.String())
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer func() { _ = db.Close() }()
+
+	db.SetMaxOpenConns(*concurrency + 1)
+
+	if err := setupDatabase(db); err != nil {
+		log.Fatal(err)
+	}
+
+	for i := 0; i < *concurrency; i++ {
+		go client(db)
+	}
+
+	lastNow := time.Now()
+	var lastCollisions uint64
+	for range time.Tick(*outputInterval) {
+		now := time.Now()
+		elapsed := now.Sub(lastNow)
+		lastNow = now
+
+		hist, errors := shortenStats.Snapshot()
+		logStats("shorten", elapsed, hist, errors)
+		hist, errors = redirectStats.Snapshot()
+		logStats("redirect", elapsed, hist, errors)
+		c := atomic.LoadUint64(&collisions)
+		log.Printf("%d short code collisions (%d total)", c-lastCollisions, c)
+		lastCollisions = c
+	}
+}
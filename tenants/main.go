@@ -0,0 +1,280 @@
+// Copyright 2016 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+// The tenants example models a multi-tenant SaaS application. Every table
+// is prefixed by tenant_id, and tenant sizes follow a zipfian
+// distribution: a few tenants own most of the rows and receive most of
+// the traffic. Each operation is a transaction touching the rows of a
+// single tenant.
+//
+// With --noisy-tenant, extra workers start hammering one tenant after
+// --noisy-after, so the latencies of the other tenants can be compared
+// before and after the burst. Latencies are reported separately for the
+// noisy tenant and for large, medium and small tenants.
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"net/url"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/cockroachdb/examples-go/dbdriver"
+	"github.com/cockroachdb/examples-go/opstats"
+	// Import postgres driver.
+	_ "github.com/cockroachdb/pq"
+)
+
+var numTenants = flag.Int("tenants", 2000, "Number of tenants.")
+var maxRows = flag.Int("max-rows", 100000, "Number of rows of the largest tenant.")
+var minRows = flag.Int("min-rows", 10, "Minimum number of rows per tenant.")
+var zipfS = flag.Float64("zipf-s", 1.0, "Exponent of the tenant size distribution.")
+var concurrency = flag.Int("concurrency", 16, "Number of concurrent workers serving all tenants.")
+var noisyTenant = flag.Int("noisy-tenant", -1, "Tenant that bursts traffic. If -1, there is no noisy tenant.")
+var noisyWorkers = flag.Int("noisy-workers", 32, "Number of extra workers serving the noisy tenant.")
+var noisyAfter = flag.Duration("noisy-after", 30*time.Second, "Time after which the noisy tenant starts bursting.")
+var outputInterval = flag.Duration("output-interval", 1*time.Second, "Interval of output.")
+var driver = flag.String("driver", "postgres", dbdriver.Usage)
+
+const schema = `
+CREATE TABLE IF NOT EXISTS records (
+  tenant_id INT NOT NULL,
+  id        INT NOT NULL,
+  counter   INT NOT NULL DEFAULT 0,
+  data      STRING NOT NULL,
+  PRIMARY KEY (tenant_id, id)
+);
+
+CREATE TABLE IF NOT EXISTS activity (
+  tenant_id INT NOT NULL,
+  id        INT NOT NULL DEFAULT unique_rowid(),
+  record_id INT NOT NULL,
+  created   TIMESTAMP NOT NULL DEFAULT NOW(),
+  PRIMARY KEY (tenant_id, id)
+);
+`
+
+const (
+	noisyClass = iota
+	largeClass
+	mediumClass
+	smallClass
+	numClasses
+)
+
+var classNames = [numClasses]string{"noisy", "large", "medium", "small"}
+
+// tenantRows returns the number of rows of a tenant. Tenant 0 is the
+// largest.
+func tenantRows(tenant int) int {
+	n := int(float64(*maxRows) / math.Pow(float64(tenant+1), *zipfS))
+	if n < *minRows {
+		return *minRows
+	}
+	return n
+}
+
+// tenantClass returns the class a tenant's latencies are reported under:
+// the largest 1% of tenants are large, the next 10% are medium, and the
+// rest are small.
+func tenantClass(tenant int) int {
+	switch {
+	case tenant == *noisyTenant:
+		return noisyClass
+	case tenant < (*numTenants+99)/100:
+		return largeClass
+	case tenant < (*numTenants+9)/10:
+		return mediumClass
+	default:
+		return smallClass
+	}
+}
+
+// cumRows[i] is the number of rows of tenants 0 through i. Tenants are
+// picked with a probability proportional to their size.
+var cumRows []int
+
+func pickTenant(r *rand.Rand) int {
+	n := r.Intn(cumRows[len(cumRows)-1])
+	return sort.Search(len(cumRows), func(i int) bool { return cumRows[i] > n })
+}
+
+// operate runs a transaction on behalf of a tenant: it reads a few of the
+// tenant's records, updates one of them and logs the activity.
+func operate(db *sql.DB, r *rand.Rand, tenant int) error {
+	rows := tenantRows(tenant)
+	id := r.Intn(rows)
+	return dbdriver.ExecuteTx(db, func(tx *sql.Tx) error {
+		var sum int
+		if err := tx.QueryRow(`SELECT COALESCE(SUM(counter), 0) FROM records `+
+			`WHERE tenant_id = $1 AND id >= $2 AND id < $3`, tenant, id, id+10).Scan(&sum); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`UPDATE records SET counter = counter + 1 WHERE tenant_id = $1 AND id = $2`,
+			tenant, id); err != nil {
+			return err
+		}
+		_, err := tx.Exec(`INSERT INTO activity (tenant_id, record_id) VALUES ($1, $2)`, tenant, id)
+		return err
+	})
+}
+
+var stats [numClasses]*opstats.Stats
+
+func init() {
+	for i := range stats {
+		stats[i] = opstats.New(time.Minute)
+	}
+}
+
+// worker serves requests for the given tenant or, if tenant is -1, for
+// tenants picked in proportion to their size.
+func worker(db *sql.DB, tenant int) {
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	for {
+		t := tenant
+		if t < 0 {
+			t = pickTenant(r)
+		}
+		start := time.Now()
+		err := operate(db, r, t)
+		if err != nil {
+			log.Printf("tenant %d: %s", t, err)
+		}
+		stats[tenantClass(t)].Record(start, err)
+	}
+}
+
+func setupDatabase(db *sql.DB) error {
+	if _, err := db.Exec("CREATE DATABASE IF NOT EXISTS tenants"); err != nil {
+		return err
+	}
+	if _, err := db.Exec(schema); err != nil {
+		return err
+	}
+	for _, table := range []string{"records", "activity"} {
+		if _, err := db.Exec("TRUNCATE TABLE " + table); err != nil {
+			return err
+		}
+	}
+	const batchSize = 1000
+	for tenant := 0; tenant < *numTenants; tenant++ {
+		rows := tenantRows(tenant)
+		for i := 0; i < rows; i += batchSize {
+			end := i + batchSize
+			if end > rows {
+				end = rows
+			}
+			if _, err := db.Exec(`INSERT INTO records (tenant_id, id, data) `+
+				`SELECT $1, i, 'record ' || i::STRING FROM GENERATE_SERIES($2, $3) AS g(i)`,
+				tenant, i, end-1); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+var usage = func() {
+	fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s [<db URL>]\n\n", os.Args[0])
+	flag.PrintDefaults()
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() > 1 {
+		usage()
+		os.Exit(2)
+	}
+
+	if *numTenants < 1 || *minRows < 1 || *maxRows < *minRows {
+		log.Fatal("'tenants' and 'min-rows' must be at least 1, and 'max-rows' at least 'min-rows'")
+	}
+	if *noisyTenant >= *numTenants {
+		log.Fatalf("Value of 'noisy-tenant' flag (%d) must be less than 'tenants' (%d)", *noisyTenant, *numTenants)
+	}
+
+	cumRows = make([]int, *numTenants)
+	var total int
+	for i := range cumRows {
+		total += tenantRows(i)
+		cumRows[i] = total
+	}
+
+	dbURL, err := dbdriver.URL(flag.Arg(0), "")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	parsedURL, err := url.Parse(dbURL)
+	if err != nil {
+		log.Fatal(err)
+	}
+	parsedURL.Path = "tenants"
+
+	db, err := dbdriver.Open(*driver, parsedURL.String())
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer func() { _ = db.Close() }()
+
+	db.SetMaxOpenConns(*concurrency + *noisyWorkers + 1)
+
+	log.Printf("populating %d tenants with %d rows", *numTenants, total)
+	if err := setupDatabase(db); err != nil {
+		log.Fatal(err)
+	}
+
+	for i := 0; i < *concurrency; i++ {
+		go worker(db, -1)
+	}
+	if *noisyTenant >= 0 {
+		time.AfterFunc(*noisyAfter, func() {
+			log.Printf("tenant %d starts bursting with %d workers", *noisyTenant, *noisyWorkers)
+			for i := 0; i < *noisyWorkers; i++ {
+				go worker(db, *noisyTenant)
+			}
+		})
+	}
+
+	lastNow := time.Now()
+	for range time.Tick(*outputInterval) {
+		now := time.Now()
+		elapsed := now.Sub(lastNow)
+		lastNow = now
+
+		for class, s := range stats {
+			hist, errors := s.Snapshot()
+			if class == noisyClass && *noisyTenant < 0 {
+				continue
+			}
+			log.Printf("%-6s: %7.1f txns/sec, p50=%s p95=%s p99=%s (%d errors)",
+				classNames[class], float64(hist.TotalCount())/elapsed.Seconds(),
+				time.Duration(hist.ValueAtQuantile(50)),
+				time.Duration(hist.ValueAtQuantile(95)),
+				time.Duration(hist.ValueAtQuantile(99)),
+				errors)
+		}
+	}
+}